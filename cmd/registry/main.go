@@ -3,6 +3,8 @@ package main
 import (
 	_ "net/http/pprof"
 
+	_ "github.com/docker/distribution/notifications/kafka"
+	_ "github.com/docker/distribution/notifications/nats"
 	"github.com/docker/distribution/registry"
 	_ "github.com/docker/distribution/registry/auth/htpasswd"
 	_ "github.com/docker/distribution/registry/auth/silly"
@@ -13,7 +15,11 @@ import (
 	_ "github.com/docker/distribution/registry/storage/driver/gcs"
 	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
 	_ "github.com/docker/distribution/registry/storage/driver/middleware/cloudfront"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/encryption"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/localcache"
 	_ "github.com/docker/distribution/registry/storage/driver/middleware/redirect"
+	_ "github.com/docker/distribution/registry/storage/driver/middleware/retry"
+	_ "github.com/docker/distribution/registry/storage/driver/mirror"
 	_ "github.com/docker/distribution/registry/storage/driver/oss"
 	_ "github.com/docker/distribution/registry/storage/driver/cos"
 	_ "github.com/docker/distribution/registry/storage/driver/s3-aws"
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"path"
 	"reflect"
 	"strings"
 	"time"
@@ -194,6 +195,9 @@ type Configuration struct {
 
 	Proxy Proxy `yaml:"proxy,omitempty"`
 
+	// Replication configures the copy of pushed content to other registries
+	Replication Replication `yaml:"replication,omitempty"`
+
 	// Compatibility is used for configurations of working with older or deprecated features.
 	Compatibility struct {
 		// Schema1 configures how schema1 manifests will be handled
@@ -238,9 +242,112 @@ type Configuration struct {
 			// the class in authorized resources.
 			Classes []string `yaml:"classes"`
 		} `yaml:"repository,omitempty"`
+
+		// Retention configures the automatic pruning of tags.
+		Retention Retention `yaml:"retention,omitempty"`
+
+		// Immutability configures the tags which may not be moved or
+		// removed once pushed.
+		Immutability Immutability `yaml:"immutability,omitempty"`
+
+		// Quota caps the storage consumed by repositories and namespaces.
+		Quota Quota `yaml:"quota,omitempty"`
 	} `yaml:"policy,omitempty"`
 }
 
+// Retention configures a background job which removes tags according to a
+// list of rules. The job is enabled when at least one rule is configured.
+type Retention struct {
+	// Interval is the duration in between evaluations of the rules.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// DryRun logs the tags that would be removed without removing them.
+	DryRun bool `yaml:"dryrun,omitempty"`
+	// Rules is evaluated in order. Each repository is governed by the first
+	// rule matching its name.
+	Rules []RetentionRule `yaml:"rules,omitempty"`
+}
+
+// RepositoryPatterns lists patterns, in the syntax of path.Match, of
+// repository names. As with paths, * does not match the / separator.
+type RepositoryPatterns []string
+
+// Validate returns an error if one of the patterns is malformed.
+func (p RepositoryPatterns) Validate() error {
+	for _, pattern := range p {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether one of the patterns matches the name.
+func (p RepositoryPatterns) Matches(name string) bool {
+	for _, pattern := range p {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RetentionRule describes the tags to retain in a set of repositories.
+type RetentionRule struct {
+	// Repositories are the repositories the rule applies to.
+	Repositories RepositoryPatterns `yaml:"repositories"`
+	// KeepLast is the number of most recently pushed tags to retain.
+	KeepLast int `yaml:"keeplast,omitempty"`
+	// KeepTags lists regular expressions matching tags that are always
+	// retained.
+	KeepTags []string `yaml:"keeptags,omitempty"`
+	// OlderThan retains tags pushed within this duration.
+	OlderThan time.Duration `yaml:"olderthan,omitempty"`
+}
+
+// Immutability configures the tags which may not be moved to another manifest
+// or removed once they exist.
+type Immutability struct {
+	// Rules lists the immutable tags. A tag is immutable if any rule matches
+	// it.
+	Rules []ImmutabilityRule `yaml:"rules,omitempty"`
+	// Admins lists the names of the authenticated users allowed to move and
+	// remove immutable tags.
+	Admins []string `yaml:"admins,omitempty"`
+}
+
+// ImmutabilityRule describes immutable tags in a set of repositories.
+type ImmutabilityRule struct {
+	// Repositories are the repositories the rule applies to.
+	Repositories RepositoryPatterns `yaml:"repositories"`
+	// Tags lists regular expressions matching the immutable tags. Every tag
+	// is immutable when empty.
+	Tags []string `yaml:"tags,omitempty"`
+}
+
+// Quota caps the storage consumed by repositories and namespaces. Quotas are
+// enforced when at least one rule is configured.
+type Quota struct {
+	// Repositories is evaluated in order. Each repository is limited by the
+	// first rule matching its name.
+	Repositories []QuotaRule `yaml:"repositories,omitempty"`
+	// Namespaces is evaluated in order. The repositories of a namespace,
+	// the first component of their name, are limited together by the first
+	// rule matching the namespace.
+	Namespaces []QuotaRule `yaml:"namespaces,omitempty"`
+}
+
+// QuotaRule limits the storage consumed by a set of repositories or
+// namespaces.
+type QuotaRule struct {
+	// Names are the repositories or namespaces the rule applies to.
+	Names RepositoryPatterns `yaml:"names"`
+	// Size is the maximum number of bytes of the layers and manifests. It is
+	// unlimited when zero.
+	Size int64 `yaml:"size,omitempty"`
+	// Tags is the maximum number of tags. It is unlimited when zero.
+	Tags int64 `yaml:"tags,omitempty"`
+}
+
 // LogHook is composed of hook Level and Type.
 // After hooks configuration, it can execute the next handling automatically,
 // when defined levels of log message emitted.
@@ -419,6 +526,8 @@ func (storage Storage) Type() string {
 			// allow configuration of delete
 		case "redirect":
 			// allow configuration of redirect
+		case "compression":
+			// allow configuration of compression
 		default:
 			storageType = append(storageType, k)
 		}
@@ -460,6 +569,8 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 					// allow configuration of delete
 				case "redirect":
 					// allow configuration of redirect
+				case "compression":
+					// allow configuration of compression
 				default:
 					types = append(types, k)
 				}
@@ -557,9 +668,10 @@ type Notifications struct {
 	// EventConfig is the configuration for the event format that is sent to each Endpoint.
 	EventConfig Events `yaml:"events,omitempty"`
 	// Endpoints is a list of http configurations for endpoints that
-	// respond to webhook notifications. In the future, we may allow other
-	// kinds of endpoints, such as external queues.
+	// respond to webhook notifications.
 	Endpoints []Endpoint `yaml:"endpoints,omitempty"`
+	// Brokers is a list of message brokers to which events are published.
+	Brokers []Broker `yaml:"brokers,omitempty"`
 }
 
 // Endpoint describes the configuration of an http webhook notification
@@ -569,11 +681,54 @@ type Endpoint struct {
 	Disabled          bool          `yaml:"disabled"`          // disables the endpoint
 	URL               string        `yaml:"url"`               // post url for the endpoint.
 	Headers           http.Header   `yaml:"headers"`           // static headers that should be added to all requests
+	Secrets           []string      `yaml:"secrets,omitempty"` // secrets signing the requests, all active during a rotation
 	Timeout           time.Duration `yaml:"timeout"`           // HTTP timeout
 	Threshold         int           `yaml:"threshold"`         // circuit breaker threshold before backing off on failure
 	Backoff           time.Duration `yaml:"backoff"`           // backoff duration
 	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"` // target media types to ignore
 	Ignore            Ignore        `yaml:"ignore"`            // ignore event types
+	Queue             EndpointQueue `yaml:"queue"`             // persists the events pending
+	Filter            Filter        `yaml:"filter"`            // include or exclude events by repository, tag, actor or user agent
+}
+
+// EndpointQueue configures the persistent queue of an endpoint, which keeps
+// the events pending delivery on local disk so that they survive restarts.
+type EndpointQueue struct {
+	Directory  string `yaml:"directory"`  // directory of the queue, the events are kept in memory if empty
+	MaxEvents  int    `yaml:"maxevents"`  // maximum number of events pending
+	DropPolicy string `yaml:"droppolicy"` // events dropped when the queue is full: oldest or newest
+}
+
+// Filter selects the events sent to an endpoint or broker: those matching
+// at least one of the include rules, if any, and none of the exclude rules.
+type Filter struct {
+	Include []FilterRule `yaml:"include,omitempty"`
+	Exclude []FilterRule `yaml:"exclude,omitempty"`
+}
+
+// FilterRule matches the events of which every field set matches its
+// pattern. A pattern is a glob, as matched by path.Match, or a regular
+// expression when enclosed in slashes. Patterns never match events without
+// the field, such as the events without a tag.
+type FilterRule struct {
+	Repository string `yaml:"repository,omitempty"` // name of the repository
+	Tag        string `yaml:"tag,omitempty"`        // tag of the target
+	Actor      string `yaml:"actor,omitempty"`      // name of the user initiating the event
+	UserAgent  string `yaml:"useragent,omitempty"`  // user agent of the request
+}
+
+// Broker describes the configuration of a notification sink publishing
+// events to a message broker.
+type Broker struct {
+	Name      string        `yaml:"name"`      // identifies the broker in the registry instance.
+	Disabled  bool          `yaml:"disabled"`  // disables the broker
+	Type      string        `yaml:"type"`      // type of the sink, such as kafka or nats
+	Options   Parameters    `yaml:"options"`   // options of the sink type
+	Threshold int           `yaml:"threshold"` // circuit breaker threshold before backing off on failure
+	Backoff   time.Duration `yaml:"backoff"`   // backoff duration
+	Ignore    Ignore        `yaml:"ignore"`    // ignore event types
+	Queue     EndpointQueue `yaml:"queue"`     // persists the events pending
+	Filter    Filter        `yaml:"filter"`    // include or exclude events by repository, tag, actor or user agent
 }
 
 // Events configures notification events.
@@ -636,6 +791,78 @@ type Proxy struct {
 
 	// Password of the hub user
 	Password string `yaml:"password"`
+
+	// Upstreams lists remote registries mirrored under a repository
+	// prefix. They may be combined with RemoteURL, which then serves the
+	// repositories matching no prefix.
+	Upstreams []ProxyUpstream `yaml:"upstreams,omitempty"`
+
+	// PushThrough hosts the repositories matching none of the upstream
+	// prefixes in local storage, accepting pushes to them.
+	PushThrough bool `yaml:"pushthrough,omitempty"`
+}
+
+// ProxyUpstream configures a remote registry mirrored under a repository
+// prefix
+type ProxyUpstream struct {
+	// Prefix is the path component under which the repositories of the
+	// remote registry are exposed. It is removed from repository names
+	// before they are requested from the remote registry.
+	Prefix string `yaml:"prefix"`
+
+	// RemoteURL is the URL of the remote registry
+	RemoteURL string `yaml:"remoteurl"`
+
+	// Username of the remote registry user
+	Username string `yaml:"username,omitempty"`
+
+	// Password of the remote registry user
+	Password string `yaml:"password,omitempty"`
+
+	// TTL is the time after which content fetched from the remote registry
+	// is removed from the cache. Defaults to one week.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+// Enabled reports whether the registry is configured as a pull through cache
+func (proxy Proxy) Enabled() bool {
+	return proxy.RemoteURL != "" || len(proxy.Upstreams) > 0
+}
+
+// Replication configures the copy of pushed manifests, and the blobs they
+// reference, to other registries
+type Replication struct {
+	// Targets lists the registries content is replicated to
+	Targets []ReplicationTarget `yaml:"targets,omitempty"`
+
+	// Backoff is the delay before retrying a failed replication. It doubles
+	// with every failed attempt, up to MaxBackoff.
+	Backoff time.Duration `yaml:"backoff,omitempty"`
+
+	// MaxBackoff is the longest delay between two attempts
+	MaxBackoff time.Duration `yaml:"maxbackoff,omitempty"`
+}
+
+// ReplicationTarget configures a registry content is replicated to
+type ReplicationTarget struct {
+	// Name identifies the target in logs and status reports
+	Name string `yaml:"name"`
+
+	// URL is the base URL of the target registry
+	URL string `yaml:"url"`
+
+	// Username used to authenticate to the target registry
+	Username string `yaml:"username,omitempty"`
+
+	// Password used to authenticate to the target registry
+	Password string `yaml:"password,omitempty"`
+
+	// Repositories selects the repositories replicated to the target. All
+	// repositories are replicated if empty.
+	Repositories RepositoryPatterns `yaml:"repositories,omitempty"`
+
+	// Disabled stops replication to the target, leaving its queue intact
+	Disabled bool `yaml:"disabled,omitempty"`
 }
 
 // Parse parses an input configuration yaml document into a Configuration struct
@@ -511,6 +511,18 @@ func checkStructs(c *C, t reflect.Type, structsChecked map[string]struct{}) {
 
 // TestValidateConfigStruct makes sure that the config struct has no members
 // with yaml tags that would be ambiguous to the environment variable parser.
+func (suite *ConfigSuite) TestRepositoryPatterns(c *C) {
+	patterns := RepositoryPatterns{"library/*", "ci/*/cache"}
+	c.Assert(patterns.Validate(), IsNil)
+	c.Assert(patterns.Matches("library/ubuntu"), Equals, true)
+	c.Assert(patterns.Matches("ci/app/cache"), Equals, true)
+	c.Assert(patterns.Matches("library/team/app"), Equals, false)
+	c.Assert(patterns.Matches("ci/app"), Equals, false)
+	c.Assert(RepositoryPatterns{}.Matches("library/ubuntu"), Equals, false)
+
+	c.Assert(RepositoryPatterns{"library/*", "["}.Validate(), NotNil)
+}
+
 func (suite *ConfigSuite) TestValidateConfigStruct(c *C) {
 	structsChecked := make(map[string]struct{})
 	checkStructs(c, reflect.TypeOf(Configuration{}), structsChecked)
@@ -33,6 +33,31 @@ func (err ErrTagUnknown) Error() string {
 	return fmt.Sprintf("unknown tag=%s", err.Tag)
 }
 
+// ErrTagImmutable is returned when an operation would move or remove a tag
+// which the registry does not allow to change.
+type ErrTagImmutable struct {
+	Tag string
+}
+
+func (err ErrTagImmutable) Error() string {
+	return fmt.Sprintf("immutable tag=%s", err.Tag)
+}
+
+// ErrQuotaExceeded is returned when storing content would take a repository
+// or namespace over its storage quota.
+type ErrQuotaExceeded struct {
+	// Scope is either "repository" or "namespace".
+	Scope string
+	Name  string
+	// Resource is either "size" or "tags".
+	Resource string
+	Limit    int64
+}
+
+func (err ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("%s quota of %s %s exceeded: limit=%d", err.Resource, err.Scope, err.Name, err.Limit)
+}
+
 // ErrRepositoryUnknown is returned if the named repository is not known by
 // the registry.
 type ErrRepositoryUnknown struct {
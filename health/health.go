@@ -132,31 +132,48 @@ func NewThresholdStatusUpdater(t int) Updater {
 
 // PeriodicChecker wraps an updater to provide a periodic checker
 func PeriodicChecker(check Checker, period time.Duration) Checker {
-	u := NewStatusUpdater()
-	go func() {
-		t := time.NewTicker(period)
-		for {
-			<-t.C
-			u.Update(check.Check())
-		}
-	}()
-
-	return u
+	return newPeriodicChecker(check, period, NewStatusUpdater())
 }
 
 // PeriodicThresholdChecker wraps an updater to provide a periodic checker that
 // uses a threshold before it changes status
 func PeriodicThresholdChecker(check Checker, period time.Duration, threshold int) Checker {
-	tu := NewThresholdStatusUpdater(threshold)
+	return newPeriodicChecker(check, period, NewThresholdStatusUpdater(threshold))
+}
+
+// periodicChecker runs a check periodically until it is unregistered.
+type periodicChecker struct {
+	Updater
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newPeriodicChecker(check Checker, period time.Duration, u Updater) *periodicChecker {
+	pc := &periodicChecker{
+		Updater: u,
+		stopped: make(chan struct{}),
+	}
 	go func() {
 		t := time.NewTicker(period)
+		defer t.Stop()
 		for {
-			<-t.C
-			tu.Update(check.Check())
+			select {
+			case <-t.C:
+				u.Update(check.Check())
+			case <-pc.stopped:
+				return
+			}
 		}
 	}()
 
-	return tu
+	return pc
+}
+
+// stop stops running the check.
+func (pc *periodicChecker) stop() {
+	pc.once.Do(func() {
+		close(pc.stopped)
+	})
 }
 
 // CheckStatus returns a map with all the current health check errors
@@ -200,6 +217,23 @@ func Register(name string, check Checker) {
 	DefaultRegistry.Register(name, check)
 }
 
+// Unregister removes the checker registered with the provided name, if any.
+// Periodic checkers stop running.
+func (registry *Registry) Unregister(name string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if pc, ok := registry.registeredChecks[name].(*periodicChecker); ok {
+		pc.stop()
+	}
+	delete(registry.registeredChecks, name)
+}
+
+// Unregister removes the checker registered with the provided name from the
+// default registry.
+func Unregister(name string) {
+	DefaultRegistry.Unregister(name)
+}
+
 // RegisterFunc allows the convenience of registering a checker directly from
 // an arbitrary func() error.
 func (registry *Registry) RegisterFunc(name string, check func() error) {
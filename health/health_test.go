@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestReturns200IfThereAreNoChecks ensures that the result code of the health
@@ -105,3 +107,43 @@ func TestHealthHandler(t *testing.T) {
 	updater.Update(nil)
 	checkUp(t, "when server is back up") // now we should be back up.
 }
+
+// TestUnregister ensures that unregistered checks are no longer reported, and
+// that periodic checks stop running.
+func TestUnregister(t *testing.T) {
+	registry := NewRegistry()
+
+	var mu sync.Mutex
+	runs := 0
+	registry.RegisterPeriodicFunc("periodic_check", time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs++
+		return errors.New("failing")
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	if len(registry.CheckStatus()) != 1 {
+		t.Fatal("expected the periodic check to fail")
+	}
+
+	registry.Unregister("periodic_check")
+	if len(registry.CheckStatus()) != 0 {
+		t.Fatal("expected no checks once unregistered")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	mu.Lock()
+	stopped := runs
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if runs != stopped {
+		t.Fatalf("periodic check still running after being unregistered: %d runs, %d expected", runs, stopped)
+	}
+
+	// the name may be registered again
+	registry.RegisterFunc("periodic_check", func() error { return nil })
+	registry.Unregister("missing_check")
+}
@@ -21,6 +21,7 @@ type bridge struct {
 }
 
 var _ Listener = &bridge{}
+var _ TagListener = &bridge{}
 
 // URLBuilder defines a subset of url builder to be used by the event listener.
 type URLBuilder interface {
@@ -118,6 +119,23 @@ func (b *bridge) TagDeleted(repo reference.Named, tag string) error {
 	return b.sink.Write(*event)
 }
 
+func (b *bridge) TagCreated(repo reference.Named, tag string, desc distribution.Descriptor) error {
+	return b.createTagEventAndWrite(EventActionTagCreate, repo, tag, desc, "")
+}
+
+func (b *bridge) TagMoved(repo reference.Named, tag string, desc distribution.Descriptor, previous digest.Digest) error {
+	return b.createTagEventAndWrite(EventActionTagMove, repo, tag, desc, previous)
+}
+
+func (b *bridge) TagRemoved(repo reference.Named, tag string, previous digest.Digest) error {
+	event := b.createEvent(EventActionTagDelete)
+	event.Target.Repository = repo.Name()
+	event.Target.Tag = tag
+	event.Target.PreviousDigest = previous
+
+	return b.sink.Write(*event)
+}
+
 func (b *bridge) RepoDeleted(repo reference.Named) error {
 	event := b.createEvent(EventActionDelete)
 	event.Target.Repository = repo.Name()
@@ -133,6 +151,27 @@ func (b *bridge) createManifestDeleteEventAndWrite(action string, repo reference
 	return b.sink.Write(*event)
 }
 
+func (b *bridge) createTagEventAndWrite(action string, repo reference.Named, tag string, desc distribution.Descriptor, previous digest.Digest) error {
+	event := b.createEvent(action)
+	event.Target.Descriptor = desc
+	event.Target.Length = desc.Size
+	event.Target.Repository = repo.Name()
+	event.Target.Tag = tag
+	event.Target.PreviousDigest = previous
+
+	ref, err := reference.WithDigest(repo, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	event.Target.URL, err = b.ub.BuildManifestURL(ref)
+	if err != nil {
+		return err
+	}
+
+	return b.sink.Write(*event)
+}
+
 func (b *bridge) createManifestEvent(action string, repo reference.Named, sm distribution.Manifest) (*Event, error) {
 	event := b.createEvent(action)
 	event.Target.Repository = repo.Name()
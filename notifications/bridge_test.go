@@ -133,6 +133,47 @@ func TestEventBridgeTagDeleted(t *testing.T) {
 	}
 }
 
+func TestEventBridgeTagMoved(t *testing.T) {
+	previous := digest.FromString("previous")
+	l := createTestEnv(t, testSinkFn(func(events ...Event) error {
+		checkCommon(t, events...)
+		if events[0].Action != EventActionTagMove {
+			t.Fatalf("unexpected event action: %q != %q", events[0].Action, EventActionTagMove)
+		}
+		if events[0].Target.Tag != m.Tag {
+			t.Fatalf("unexpected tag on event target: %q != %q", events[0].Target.Tag, m.Tag)
+		}
+		if events[0].Target.PreviousDigest != previous {
+			t.Fatalf("unexpected previous digest: %q != %q", events[0].Target.PreviousDigest, previous)
+		}
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	desc := distribution.Descriptor{Digest: dgst, Size: int64(len(payload)), MediaType: schema1.MediaTypeSignedManifest}
+	if err := l.(TagListener).TagMoved(repoRef, m.Tag, desc, previous); err != nil {
+		t.Fatalf("unexpected error notifying tag move: %v", err)
+	}
+}
+
+func TestEventBridgeTagRemoved(t *testing.T) {
+	l := createTestEnv(t, testSinkFn(func(events ...Event) error {
+		checkDeleted(t, EventActionTagDelete, events...)
+		if events[0].Target.Tag != m.Tag {
+			t.Fatalf("unexpected tag on event target: %q != %q", events[0].Target.Tag, m.Tag)
+		}
+		if events[0].Target.PreviousDigest != dgst {
+			t.Fatalf("unexpected previous digest: %q != %q", events[0].Target.PreviousDigest, dgst)
+		}
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	if err := l.(TagListener).TagRemoved(repoRef, m.Tag, dgst); err != nil {
+		t.Fatalf("unexpected error notifying tag removal: %v", err)
+	}
+}
+
 func TestEventBridgeRepoDeleted(t *testing.T) {
 	l := createTestEnv(t, testSinkFn(func(events ...Event) error {
 		checkDeleted(t, EventActionDelete, events...)
@@ -0,0 +1,703 @@
+package notifications
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// QueueDropOldest drops the oldest events pending when a persistent
+	// queue is full. It is the default drop policy.
+	QueueDropOldest = "oldest"
+
+	// QueueDropNewest drops the events written to a full persistent queue.
+	QueueDropNewest = "newest"
+
+	// defaultQueueMaxEvents is the number of events pending after which a
+	// persistent queue is full, unless configured.
+	defaultQueueMaxEvents = 100000
+
+	queueLogName    = "events.log"
+	queueOffsetName = "events.offset"
+
+	// queueCompactSize is the size of the records delivered or dropped after
+	// which the log is rewritten, if events are still pending.
+	queueCompactSize = 64 << 20
+
+	// queueReportInterval is the interval at which the prometheus metrics of
+	// the persistent queues are updated.
+	queueReportInterval = 10 * time.Second
+)
+
+// diskQueue accepts all messages into a write-ahead log on local disk for
+// asynchronous consumption by a sink, so that the events pending when the
+// registry stops are delivered once it starts again. The events are removed
+// from the log once the sink accepted them, so they may be delivered twice if
+// the registry crashes. It is bounded: once full, events are dropped according
+// to the drop policy.
+//
+// The log is a file of json lines: the records, one per write, and the
+// offsets of the records dropped while an older one was in flight. Another
+// file holds the offset in the log of the first record pending.
+type diskQueue struct {
+	sink       Sink
+	name       string
+	dir        string
+	maxEvents  int
+	dropNewest bool
+	listeners  []diskQueueListener
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	records  *list.List   // of *queueRecord, in order of writes
+	pending  int          // events of the records not removed
+	inflight *queueRecord // record being written to the sink
+	ready    bool         // the records of the log have been replayed
+	log      *os.File     // nil until the directory is acquired
+	offset   *os.File
+	head     int64 // offset of the first record pending in the log
+	size     int64 // size of the log
+	live     int64 // size of the records pending in the log
+	closed   bool
+	done     chan struct{}
+}
+
+// queueRecord is a write to the queue, as persisted in the log.
+type queueRecord struct {
+	Queued time.Time `json:"queued"`
+	Events []Event   `json:"events"`
+
+	offset  int64 // offset of the record in the log
+	length  int64 // length of the record in the log, zero if not persisted
+	removed bool  // delivered or dropped
+}
+
+// queueLine is a line of the log: either a record or the offsets of the
+// records dropped.
+type queueLine struct {
+	queueRecord
+	Dropped []int64 `json:"dropped,omitempty"`
+}
+
+// diskQueueListener is called when various events happen on a persistent
+// queue.
+type diskQueueListener interface {
+	eventQueueListener
+
+	// dropped is called with the events dropped from a full queue.
+	dropped(events ...Event)
+
+	// backlog is called with the queue time of the oldest event pending
+	// when it changes, zero once the queue is empty.
+	backlog(oldest time.Time)
+}
+
+// newDiskQueue returns a persistent queue to the provided sink, replaying the
+// records left in the configured directory. The queue of an endpoint being
+// replaced may still be closing: the records are then replayed once it is
+// closed and the events written meanwhile kept in memory.
+func newDiskQueue(sink Sink, name string, config configuration.EndpointQueue, listeners ...diskQueueListener) (*diskQueue, error) {
+	dq := &diskQueue{
+		sink:      sink,
+		name:      name,
+		maxEvents: config.MaxEvents,
+		listeners: listeners,
+		records:   list.New(),
+		done:      make(chan struct{}),
+	}
+	dq.cond = sync.NewCond(&dq.mu)
+
+	if dq.maxEvents <= 0 {
+		dq.maxEvents = defaultQueueMaxEvents
+	}
+	switch config.DropPolicy {
+	case "", QueueDropOldest:
+	case QueueDropNewest:
+		dq.dropNewest = true
+	default:
+		return nil, fmt.Errorf("unknown drop policy %q", config.DropPolicy)
+	}
+
+	dir, err := filepath.Abs(config.Directory)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dq.dir = dir
+
+	if acquireQueueDirectory(dir, false) {
+		if err := dq.open(); err != nil {
+			releaseQueueDirectory(dir)
+			return nil, err
+		}
+	} else {
+		go func() {
+			acquireQueueDirectory(dir, true)
+			if err := dq.open(); err != nil {
+				releaseQueueDirectory(dir)
+				logrus.Errorf("diskqueue: error opening %s, events are kept in memory: %v", dir, err)
+
+				dq.mu.Lock()
+				dq.ready = true
+				dq.cond.Broadcast()
+				dq.mu.Unlock()
+			}
+		}()
+	}
+
+	go dq.run()
+	go dq.report()
+	return dq, nil
+}
+
+// open replays the records of the log not removed yet, ahead of those written
+// since the queue was created, which are appended to the log.
+func (dq *diskQueue) open() error {
+	logFile, err := os.OpenFile(filepath.Join(dq.dir, queueLogName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	offsetFile, err := os.OpenFile(filepath.Join(dq.dir, queueOffsetName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logFile.Close()
+		return err
+	}
+
+	var replayed []*queueRecord
+	var size int64
+	head, err := readQueueOffset(offsetFile)
+	if err == nil {
+		replayed, head, size, err = readQueueRecords(logFile, head)
+	}
+	if err == nil {
+		err = dq.replay(logFile, offsetFile, head, size, replayed)
+	}
+	if err != nil {
+		logFile.Close()
+		offsetFile.Close()
+		return err
+	}
+	return nil
+}
+
+// replay makes the queue write to the log from the end of the records
+// replayed.
+func (dq *diskQueue) replay(logFile, offsetFile *os.File, head, size int64, replayed []*queueRecord) error {
+	// a record partially written when the registry stopped is discarded
+	if err := logFile.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := logFile.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+
+	dq.log, dq.offset = logFile, offsetFile
+	dq.head, dq.size = head, size
+
+	written := dq.records
+	dq.records = list.New()
+	for _, record := range replayed {
+		dq.records.PushBack(record)
+		dq.pending += len(record.Events)
+		dq.live += record.length
+		for _, listener := range dq.listeners {
+			listener.ingress(record.Events...)
+		}
+	}
+	for e := written.Front(); e != nil; e = e.Next() {
+		record := e.Value.(*queueRecord)
+		if record.removed {
+			continue
+		}
+		dq.append(record)
+		dq.records.PushBack(record)
+	}
+	if len(replayed) > 0 {
+		logrus.Infof("diskqueue: replaying %d events queued for endpoint %s", dq.pending, dq.name)
+	}
+
+	dq.makeRoom(0)
+	dq.ready = true
+	dq.cond.Broadcast()
+	dq.updateBacklog()
+
+	if dq.closed {
+		// closed before the directory was acquired
+		dq.closeFiles()
+	}
+	return nil
+}
+
+// Write accepts the events into the queue, only failing if the queue has
+// been closed. Events are dropped rather than failing when the queue is full.
+func (dq *diskQueue) Write(events ...Event) error {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+
+	if dq.closed {
+		return ErrSinkClosed
+	}
+
+	for _, listener := range dq.listeners {
+		listener.ingress(events...)
+	}
+	if len(events) > dq.maxEvents || (dq.dropNewest && dq.pending+len(events) > dq.maxEvents) {
+		dq.drop(events...)
+		return nil
+	}
+	dq.makeRoom(len(events))
+
+	record := &queueRecord{Queued: time.Now(), Events: events}
+	if dq.log != nil {
+		dq.append(record)
+	}
+	dq.records.PushBack(record)
+	dq.pending += len(events)
+	if dq.pending == len(events) {
+		dq.updateBacklog()
+	}
+	dq.cond.Signal()
+
+	return nil
+}
+
+// Close shuts down the queue without flushing it: the write in flight is
+// interrupted and the events pending are delivered once the queue is opened
+// again.
+func (dq *diskQueue) Close() error {
+	dq.mu.Lock()
+	if dq.closed {
+		dq.mu.Unlock()
+		return fmt.Errorf("diskqueue: already closed")
+	}
+	dq.closed = true
+	dq.cond.Broadcast()
+	dq.mu.Unlock()
+
+	err := dq.sink.Close()
+	<-dq.done
+
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if dq.log != nil {
+		dq.closeFiles()
+	}
+	return err
+}
+
+// run is the main goroutine to flush events to the target sink.
+func (dq *diskQueue) run() {
+	defer close(dq.done)
+
+	for {
+		record := dq.next()
+		if record == nil {
+			return // nil record means the queue is closed.
+		}
+
+		if err := dq.sink.Write(record.Events...); err != nil {
+			if dq.isClosed() {
+				// delivered once the queue is opened again
+				return
+			}
+			logrus.Warnf("diskqueue: error writing events to %v, these events will be lost: %v", dq.sink, err)
+		}
+
+		dq.remove(record)
+	}
+}
+
+// next returns the oldest record pending once the log has been replayed,
+// blocking until there is one. When closed, nil is returned.
+func (dq *diskQueue) next() *queueRecord {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+
+	for !dq.closed && (!dq.ready || dq.records.Len() < 1) {
+		dq.cond.Wait()
+	}
+	if dq.closed {
+		return nil
+	}
+
+	dq.inflight = dq.records.Front().Value.(*queueRecord)
+	return dq.inflight
+}
+
+func (dq *diskQueue) isClosed() bool {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	return dq.closed
+}
+
+// remove removes the record written to the sink from the queue.
+func (dq *diskQueue) remove(record *queueRecord) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+
+	dq.inflight = nil
+	dq.removeRecord(record)
+	for _, listener := range dq.listeners {
+		listener.egress(record.Events...)
+	}
+	dq.trim()
+	dq.updateBacklog()
+}
+
+// makeRoom drops the oldest records, except the one in flight, until n more
+// events fit in the queue.
+func (dq *diskQueue) makeRoom(n int) {
+	var dropped []int64
+	e := dq.records.Front()
+	for dq.pending+n > dq.maxEvents && e != nil {
+		record := e.Value.(*queueRecord)
+		e = e.Next()
+		if record.removed || record == dq.inflight {
+			continue
+		}
+		dq.removeRecord(record)
+		dq.drop(record.Events...)
+		if record.length > 0 {
+			dropped = append(dropped, record.offset)
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	if dq.log != nil && dq.inflight != nil {
+		// the head of the log cannot move past the record in flight
+		dq.appendLine(&queueLine{Dropped: dropped})
+	}
+	dq.trim()
+	dq.updateBacklog()
+}
+
+func (dq *diskQueue) removeRecord(record *queueRecord) {
+	record.removed = true
+	dq.pending -= len(record.Events)
+	dq.live -= record.length
+}
+
+// drop reports the events dropped from the full queue.
+func (dq *diskQueue) drop(events ...Event) {
+	logrus.Warnf("diskqueue: queue of endpoint %s full, dropping %d events", dq.name, len(events))
+	for _, listener := range dq.listeners {
+		listener.dropped(events...)
+	}
+	queueDropped.WithValues(dq.name).Inc(float64(len(events)))
+}
+
+// trim removes the leading records delivered or dropped from the queue and
+// moves the head of the log past them, truncating it once empty and
+// rewriting it once mostly made of removed records.
+func (dq *diskQueue) trim() {
+	for e := dq.records.Front(); e != nil && e.Value.(*queueRecord).removed; e = dq.records.Front() {
+		dq.records.Remove(e)
+	}
+	if dq.log == nil {
+		return
+	}
+
+	head := dq.size
+	for e := dq.records.Front(); e != nil; e = e.Next() {
+		if record := e.Value.(*queueRecord); record.length > 0 {
+			head = record.offset
+			break
+		}
+	}
+
+	var err error
+	switch {
+	case dq.records.Len() == 0:
+		if dq.size > 0 {
+			err = dq.truncate()
+		}
+	case dq.size-dq.live >= queueCompactSize:
+		err = dq.compact()
+	case head != dq.head:
+		if err = dq.writeOffset(head); err == nil {
+			dq.head = head
+		}
+	}
+	if err != nil {
+		logrus.Errorf("diskqueue: error removing events from %s, these events may be delivered again: %v", dq.dir, err)
+	}
+}
+
+// append persists the record at the end of the log. The record is kept in
+// memory only if it cannot be written.
+func (dq *diskQueue) append(record *queueRecord) {
+	offset := dq.size
+	n, err := dq.appendLine(record)
+	if err != nil {
+		logrus.Errorf("diskqueue: error writing events to %s, these events are kept in memory: %v", dq.dir, err)
+		return
+	}
+
+	record.offset, record.length = offset, n
+	dq.live += n
+}
+
+// appendLine writes a line at the end of the log, returning its length.
+func (dq *diskQueue) appendLine(v interface{}) (int64, error) {
+	p, err := json.Marshal(v)
+	if err == nil {
+		p = append(p, '\n')
+		if _, err = dq.log.Write(p); err == nil {
+			err = dq.log.Sync()
+		}
+	}
+	if err != nil {
+		// the log may end with a partial line
+		if err := dq.log.Truncate(dq.size); err == nil {
+			dq.log.Seek(dq.size, io.SeekStart)
+		}
+		return 0, err
+	}
+
+	dq.size += int64(len(p))
+	return int64(len(p)), nil
+}
+
+// writeOffset persists the offset of the first record not removed.
+func (dq *diskQueue) writeOffset(head int64) error {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], uint64(head))
+	if _, err := dq.offset.WriteAt(p[:], 0); err != nil {
+		return err
+	}
+	return dq.offset.Sync()
+}
+
+// truncate empties the log. The offset is reset last: an offset beyond the
+// end of the log is read as an empty log.
+func (dq *diskQueue) truncate() error {
+	if err := dq.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := dq.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dq.head, dq.size, dq.live = 0, 0, 0
+	return dq.writeOffset(0)
+}
+
+// compact rewrites the log with the records pending only. The offset is
+// reset first: records may be delivered twice but never lost if the registry
+// crashes meanwhile.
+func (dq *diskQueue) compact() error {
+	path := filepath.Join(dq.dir, queueLogName)
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var records []*queueRecord
+	var lengths []int64
+	var size int64
+	w := bufio.NewWriter(f)
+	for e := dq.records.Front(); e != nil && err == nil; e = e.Next() {
+		record := e.Value.(*queueRecord)
+		if record.removed || record.length == 0 {
+			continue
+		}
+		var p []byte
+		if p, err = json.Marshal(record); err == nil {
+			_, err = w.Write(append(p, '\n'))
+			records = append(records, record)
+			lengths = append(lengths, int64(len(p)+1))
+			size += int64(len(p) + 1)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		if err = dq.writeOffset(0); err == nil {
+			dq.head = 0
+		}
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	dq.log.Close()
+	dq.log, dq.size, dq.live = f, size, size
+	var offset int64
+	for i, record := range records {
+		record.offset, record.length = offset, lengths[i]
+		offset += lengths[i]
+	}
+	return nil
+}
+
+func (dq *diskQueue) closeFiles() {
+	dq.log.Close()
+	dq.offset.Close()
+	dq.log, dq.offset = nil, nil
+	releaseQueueDirectory(dq.dir)
+}
+
+// updateBacklog reports the queue time of the oldest event pending.
+func (dq *diskQueue) updateBacklog() {
+	oldest := dq.oldest()
+	for _, listener := range dq.listeners {
+		listener.backlog(oldest)
+	}
+}
+
+func (dq *diskQueue) oldest() time.Time {
+	for e := dq.records.Front(); e != nil; e = e.Next() {
+		if record := e.Value.(*queueRecord); !record.removed {
+			return record.Queued
+		}
+	}
+	return time.Time{}
+}
+
+// report updates the prometheus metrics of the queue until it is closed.
+func (dq *diskQueue) report() {
+	pending := queuePending.WithValues(dq.name)
+	backlogAge := queueBacklogAge.WithValues(dq.name)
+
+	ticker := time.NewTicker(queueReportInterval)
+	defer ticker.Stop()
+	for {
+		dq.mu.Lock()
+		n, oldest := dq.pending, dq.oldest()
+		dq.mu.Unlock()
+
+		pending.Set(float64(n))
+		if oldest.IsZero() {
+			backlogAge.Set(0)
+		} else {
+			backlogAge.Set(time.Since(oldest).Seconds())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-dq.done:
+			return
+		}
+	}
+}
+
+// readQueueOffset returns the offset persisted, zero if none is.
+func readQueueOffset(f *os.File) (int64, error) {
+	var p [8]byte
+	if _, err := io.ReadFull(f, p[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(p[:])), nil
+}
+
+// readQueueRecords returns the records pending in the log from head, with
+// the offsets of the first line and of the end of the last complete line.
+func readQueueRecords(f *os.File, head int64) ([]*queueRecord, int64, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if head > info.Size() {
+		// the log was truncated before the offset was reset
+		return nil, 0, 0, nil
+	}
+
+	var records []*queueRecord
+	dropped := make(map[int64]bool)
+	offset := head
+	r := bufio.NewReader(io.NewSectionReader(f, head, info.Size()-head))
+	for {
+		p, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, 0, err
+		}
+
+		var line queueLine
+		if err := json.Unmarshal(p, &line); err != nil {
+			logrus.Errorf("diskqueue: error reading %s, the events following are lost: %v", f.Name(), err)
+			break
+		}
+		if line.Dropped != nil {
+			for _, offset := range line.Dropped {
+				dropped[offset] = true
+			}
+		} else {
+			record := line.queueRecord
+			record.offset, record.length = offset, int64(len(p))
+			records = append(records, &record)
+		}
+		offset += int64(len(p))
+	}
+
+	pending := records[:0]
+	for _, record := range records {
+		if !dropped[record.offset] {
+			pending = append(pending, record)
+		}
+	}
+	return pending, head, offset, nil
+}
+
+// queueDirectories are the directories of the persistent queues open in the
+// process, closed once released.
+var queueDirectories = struct {
+	sync.Mutex
+	released map[string]chan struct{}
+}{released: make(map[string]chan struct{})}
+
+// acquireQueueDirectory reserves the directory for a queue, waiting until it
+// is released if asked to. It returns whether the directory was acquired.
+func acquireQueueDirectory(dir string, wait bool) bool {
+	for {
+		queueDirectories.Lock()
+		released, ok := queueDirectories.released[dir]
+		if !ok {
+			queueDirectories.released[dir] = make(chan struct{})
+			queueDirectories.Unlock()
+			return true
+		}
+		queueDirectories.Unlock()
+
+		if !wait {
+			return false
+		}
+		<-released
+	}
+}
+
+func releaseQueueDirectory(dir string) {
+	queueDirectories.Lock()
+	defer queueDirectories.Unlock()
+	close(queueDirectories.released[dir])
+	delete(queueDirectories.released, dir)
+}
@@ -0,0 +1,265 @@
+package notifications
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+)
+
+// queueDirectory creates a directory for a queue, removed by the returned
+// function.
+func queueDirectory(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "diskqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestDiskQueueReplay(t *testing.T) {
+	dir, remove := queueDirectory(t)
+	defer remove()
+	config := configuration.EndpointQueue{Directory: dir}
+
+	// the events are pending while the endpoint is down
+	down := newDownSink()
+	metrics := newSafeMetrics()
+	dq, err := newDiskQueue(down, "endpoint", config, metrics.diskQueueListener())
+	if err != nil {
+		t.Fatalf("unexpected error opening queue: %v", err)
+	}
+	var ids []string
+	for i, action := range []string{"push", "pull", "delete"} {
+		event := createTestEvent(action, "library/test", "blob")
+		event.ID = string(rune('a' + i))
+		ids = append(ids, event.ID)
+		if err := dq.Write(event); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+	<-down.writes
+	checkClose(t, dq)
+
+	var em EndpointMetrics
+	metrics.Lock()
+	em = metrics.EndpointMetrics
+	oldest := metrics.oldest
+	metrics.Unlock()
+	if em.Pending != 3 || em.Events != 3 || oldest.IsZero() {
+		t.Fatalf("unexpected metrics: %#v, oldest %v", em, oldest)
+	}
+
+	// they are delivered in order once the queue is opened again
+	var ts testSink
+	dq, err = newDiskQueue(&ts, "endpoint", config)
+	if err != nil {
+		t.Fatalf("unexpected error opening queue: %v", err)
+	}
+	if received := waitForEvents(t, &ts, 3); !reflect.DeepEqual(eventIDs(received), ids) {
+		t.Fatalf("unexpected events replayed: %v != %v", eventIDs(received), ids)
+	}
+	checkClose(t, dq)
+
+	// and only once
+	info, err := os.Stat(filepath.Join(config.Directory, queueLogName))
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("log not truncated once delivered: %d bytes", info.Size())
+	}
+	ts = testSink{}
+	dq, err = newDiskQueue(&ts, "endpoint", config)
+	if err != nil {
+		t.Fatalf("unexpected error opening queue: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	checkClose(t, dq)
+	if len(ts.events) != 0 {
+		t.Fatalf("events delivered twice: %v", eventIDs(ts.events))
+	}
+}
+
+func TestDiskQueueDropPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy    string
+		delivered []string
+	}{
+		{"", []string{"a", "c"}},
+		{QueueDropOldest, []string{"a", "c"}},
+		{QueueDropNewest, []string{"a", "b"}},
+	} {
+		dir, remove := queueDirectory(t)
+		defer remove()
+		config := configuration.EndpointQueue{Directory: dir, MaxEvents: 2, DropPolicy: tc.policy}
+
+		down := newDownSink()
+		metrics := newSafeMetrics()
+		dq, err := newDiskQueue(down, "endpoint", config, metrics.diskQueueListener())
+		if err != nil {
+			t.Fatalf("%q: unexpected error opening queue: %v", tc.policy, err)
+		}
+		for i, id := range []string{"a", "b", "c"} {
+			event := createTestEvent("push", "library/test", "blob")
+			event.ID = id
+			if err := dq.Write(event); err != nil {
+				t.Fatalf("%q: unexpected error writing: %v", tc.policy, err)
+			}
+			if i == 0 {
+				// the event in flight is never dropped
+				<-down.writes
+			}
+		}
+		checkClose(t, dq)
+
+		metrics.Lock()
+		pending, dropped := metrics.Pending, metrics.Dropped
+		metrics.Unlock()
+		if pending != 2 || dropped != 1 {
+			t.Fatalf("%q: unexpected metrics: %d pending, %d dropped", tc.policy, pending, dropped)
+		}
+
+		var ts testSink
+		dq, err = newDiskQueue(&ts, "endpoint", config)
+		if err != nil {
+			t.Fatalf("%q: unexpected error opening queue: %v", tc.policy, err)
+		}
+		if received := waitForEvents(t, &ts, 2); !reflect.DeepEqual(eventIDs(received), tc.delivered) {
+			t.Fatalf("%q: unexpected events delivered: %v != %v", tc.policy, eventIDs(received), tc.delivered)
+		}
+		checkClose(t, dq)
+	}
+
+	dir, remove := queueDirectory(t)
+	defer remove()
+	if _, err := newDiskQueue(&testSink{}, "endpoint", configuration.EndpointQueue{Directory: dir, DropPolicy: "random"}); err == nil {
+		t.Fatal("expected an error opening a queue with an unknown drop policy")
+	}
+}
+
+func TestDiskQueuePartialRecord(t *testing.T) {
+	dir, remove := queueDirectory(t)
+	defer remove()
+	config := configuration.EndpointQueue{Directory: dir}
+
+	dq, err := newDiskQueue(newDownSink(), "endpoint", config)
+	if err != nil {
+		t.Fatalf("unexpected error opening queue: %v", err)
+	}
+	event := createTestEvent("push", "library/test", "blob")
+	event.ID = "a"
+	if err := dq.Write(event); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	checkClose(t, dq)
+
+	// the registry crashed while writing a record
+	f, err := os.OpenFile(filepath.Join(config.Directory, queueLogName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error opening log: %v", err)
+	}
+	if _, err := f.WriteString(`{"queued":"2020-`); err != nil {
+		t.Fatalf("unexpected error writing log: %v", err)
+	}
+	f.Close()
+
+	var ts testSink
+	dq, err = newDiskQueue(&ts, "endpoint", config)
+	if err != nil {
+		t.Fatalf("unexpected error opening queue: %v", err)
+	}
+	event.ID = "b"
+	if err := dq.Write(event); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if received := waitForEvents(t, &ts, 2); !reflect.DeepEqual(eventIDs(received), []string{"a", "b"}) {
+		t.Fatalf("unexpected events delivered: %v", eventIDs(received))
+	}
+	checkClose(t, dq)
+}
+
+func TestDiskQueueReopenWhileClosing(t *testing.T) {
+	dir, remove := queueDirectory(t)
+	defer remove()
+	config := configuration.EndpointQueue{Directory: dir}
+
+	down := newDownSink()
+	previous, err := newDiskQueue(down, "endpoint", config)
+	if err != nil {
+		t.Fatalf("unexpected error opening queue: %v", err)
+	}
+	event := createTestEvent("push", "library/test", "blob")
+	event.ID = "a"
+	if err := previous.Write(event); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	<-down.writes
+
+	// the queue replacing it replays the log once it is closed
+	var ts testSink
+	dq, err := newDiskQueue(&ts, "endpoint", config)
+	if err != nil {
+		t.Fatalf("unexpected error opening queue: %v", err)
+	}
+	event.ID = "b"
+	if err := dq.Write(event); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	checkClose(t, previous)
+
+	if received := waitForEvents(t, &ts, 2); !reflect.DeepEqual(eventIDs(received), []string{"a", "b"}) {
+		t.Fatalf("unexpected events delivered: %v", eventIDs(received))
+	}
+	checkClose(t, dq)
+}
+
+// downSink blocks writes until it is closed, like a retrying sink does while
+// its endpoint is down.
+type downSink struct {
+	writes chan []Event
+	closed chan struct{}
+}
+
+func newDownSink() *downSink {
+	return &downSink{
+		writes: make(chan []Event, 10),
+		closed: make(chan struct{}),
+	}
+}
+
+func (ds *downSink) Write(events ...Event) error {
+	ds.writes <- events
+	<-ds.closed
+	return ErrSinkClosed
+}
+
+func (ds *downSink) Close() error {
+	close(ds.closed)
+	return nil
+}
+
+func waitForEvents(t *testing.T, ts *testSink, n int) []Event {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		ts.mu.Lock()
+		events := append([]Event(nil), ts.events...)
+		ts.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+	}
+	t.Fatalf("%d events not delivered", n)
+	return nil
+}
+
+func eventIDs(events []Event) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
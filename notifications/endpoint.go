@@ -1,6 +1,7 @@
 package notifications
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -11,12 +12,15 @@ import (
 // endpoint.
 type EndpointConfig struct {
 	Headers           http.Header
+	Secrets           []string `json:"-"`
 	Timeout           time.Duration
 	Threshold         int
 	Backoff           time.Duration
 	IgnoredMediaTypes []string
 	Transport         *http.Transport `json:"-"`
 	Ignore            configuration.Ignore
+	Queue             configuration.EndpointQueue
+	Filter            configuration.Filter
 }
 
 // defaults set any zero-valued fields to a reasonable default.
@@ -39,7 +43,7 @@ func (ec *EndpointConfig) defaults() {
 }
 
 // Endpoint is a reliable, queued, thread-safe sink that notify external http
-// services when events are written. Writes are non-blocking and always
+// services or message brokers when events are written. Writes are non-blocking and always
 // succeed for callers but events may be queued internally.
 type Endpoint struct {
 	Sink
@@ -51,26 +55,79 @@ type Endpoint struct {
 	metrics *safeMetrics
 }
 
-// NewEndpoint returns a running endpoint, ready to receive events.
+// NewEndpoint returns a running endpoint, ready to receive events. It panics
+// if the persistent queue of the endpoint cannot be opened.
 func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
+	endpoint, err := OpenEndpoint(name, url, config)
+	if err != nil {
+		panic(err)
+	}
+	return endpoint
+}
+
+// OpenEndpoint returns a running endpoint, ready to receive events. When a
+// queue directory is configured, the events left pending in it when the
+// endpoint was last closed are delivered first.
+func OpenEndpoint(name, url string, config EndpointConfig) (*Endpoint, error) {
+	endpoint := newEndpoint(name, url, config)
+
+	// Configures the inmemory or persistent queue, retry, http pipeline.
+	sink := newHTTPSink(
+		endpoint.url, endpoint.Timeout, endpoint.Headers,
+		endpoint.Transport, endpoint.metrics.httpStatusListener())
+	sink.secrets = endpoint.Secrets
+	return endpoint.open(sink)
+}
+
+// OpenSinkEndpoint returns a running endpoint writing the events to sink,
+// such as a sink returned by GetSink, through the same queue and retries as
+// http endpoints. The url of the endpoint is the string form of the sink.
+func OpenSinkEndpoint(name string, sink Sink, config EndpointConfig) (*Endpoint, error) {
+	endpoint := newEndpoint(name, fmt.Sprint(sink), config)
+	return endpoint.open(&listenedSink{Sink: sink, listener: endpoint.metrics.sinkListener()})
+}
+
+func newEndpoint(name, url string, config EndpointConfig) *Endpoint {
 	var endpoint Endpoint
 	endpoint.name = name
 	endpoint.url = url
 	endpoint.EndpointConfig = config
 	endpoint.defaults()
 	endpoint.metrics = newSafeMetrics()
+	return &endpoint
+}
 
-	// Configures the inmemory queue, retry, http pipeline.
-	endpoint.Sink = newHTTPSink(
-		endpoint.url, endpoint.Timeout, endpoint.Headers,
-		endpoint.Transport, endpoint.metrics.httpStatusListener())
-	endpoint.Sink = newRetryingSink(endpoint.Sink, endpoint.Threshold, endpoint.Backoff)
-	endpoint.Sink = newEventQueue(endpoint.Sink, endpoint.metrics.eventQueueListener())
-	mediaTypes := append(config.Ignore.MediaTypes, config.IgnoredMediaTypes...)
-	endpoint.Sink = newIgnoredSink(endpoint.Sink, mediaTypes, config.Ignore.Actions)
+// open queues and retries the writes to sink.
+func (e *Endpoint) open(sink Sink) (*Endpoint, error) {
+	e.Sink = newRetryingSink(sink, e.Threshold, e.Backoff)
+	if e.Queue.Directory != "" {
+		queue, err := newDiskQueue(e.Sink, e.name, e.Queue, e.metrics.diskQueueListener())
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the queue of endpoint %s: %v", e.name, err)
+		}
+		e.Sink = queue
+	} else {
+		e.Sink = newEventQueue(e.Sink, e.metrics.eventQueueListener())
+	}
+	mediaTypes := append(e.Ignore.MediaTypes, e.IgnoredMediaTypes...)
+	e.Sink = newIgnoredSink(e.Sink, mediaTypes, e.Ignore.Actions)
+	filtered, err := newFilteredSink(e.Sink, e.Filter)
+	if err != nil {
+		e.Sink.Close()
+		return nil, fmt.Errorf("invalid filter of endpoint %s: %v", e.name, err)
+	}
+	e.Sink = filtered
 
-	register(&endpoint)
-	return &endpoint
+	register(e)
+	return e, nil
+}
+
+// Close flushes the events queued in memory and closes the endpoint, which
+// no longer reports its metrics. The events of a persistent queue are not
+// flushed but kept on disk until the endpoint is opened again.
+func (e *Endpoint) Close() error {
+	unregister(e)
+	return e.Sink.Close()
 }
 
 // Name returns the name of the endpoint, generally used for debugging.
@@ -89,6 +146,9 @@ func (e *Endpoint) ReadMetrics(em *EndpointMetrics) {
 	defer e.metrics.Unlock()
 
 	*em = e.metrics.EndpointMetrics
+	if !e.metrics.oldest.IsZero() {
+		em.BacklogAge = time.Since(e.metrics.oldest)
+	}
 	// Map still need to copied in a threadsafe manner.
 	em.Statuses = make(map[string]int)
 	for k, v := range e.metrics.Statuses {
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
 )
 
 // EventAction constants used in action field of Event.
@@ -13,6 +14,13 @@ const (
 	EventActionPush   = "push"
 	EventActionMount  = "mount"
 	EventActionDelete = "delete"
+
+	// The tag actions are sent in addition to the push and delete events of
+	// manifests and tags, once a tag is created, moved to another manifest
+	// or deleted.
+	EventActionTagCreate = "tag_create"
+	EventActionTagMove   = "tag_move"
+	EventActionTagDelete = "tag_delete"
 )
 
 const (
@@ -72,6 +80,10 @@ type Event struct {
 		// Tag provides the tag
 		Tag string `json:"tag,omitempty"`
 
+		// PreviousDigest is the digest of the manifest a tag pointed to
+		// before it was moved or deleted.
+		PreviousDigest digest.Digest `json:"previousDigest,omitempty"`
+
 		// References provides the references descriptors.
 		References []distribution.Descriptor `json:"references,omitempty"`
 	} `json:"target,omitempty"`
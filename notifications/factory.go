@@ -0,0 +1,33 @@
+package notifications
+
+import "fmt"
+
+// SinkInitFunc is the type of a Sink factory function and is used to
+// register the constructor of the sinks publishing events to message
+// brokers.
+type SinkInitFunc func(options map[string]interface{}) (Sink, error)
+
+var sinkFactories = make(map[string]SinkInitFunc)
+
+// RegisterSink is used to register an SinkInitFunc for a sink type with the
+// given name, generally from the init function of the package implementing
+// it.
+func RegisterSink(name string, initFunc SinkInitFunc) error {
+	if _, exists := sinkFactories[name]; exists {
+		return fmt.Errorf("name already registered: %s", name)
+	}
+
+	sinkFactories[name] = initFunc
+
+	return nil
+}
+
+// GetSink constructs a Sink with the given options using the named sink type.
+// Wrap it with OpenSinkEndpoint to queue and retry the events written.
+func GetSink(name string, options map[string]interface{}) (Sink, error) {
+	if initFunc, exists := sinkFactories[name]; exists {
+		return initFunc(options)
+	}
+
+	return nil, fmt.Errorf("no notification sink registered with name: %s", name)
+}
@@ -0,0 +1,141 @@
+package notifications
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/configuration"
+)
+
+// filteredSink only writes the events matching at least one of the include
+// rules, if any, and none of the exclude rules.
+type filteredSink struct {
+	Sink
+	include []eventRule
+	exclude []eventRule
+}
+
+// newFilteredSink returns a sink filtering the events written to sink, or
+// sink itself when filter has no rules. An error is returned if a pattern of
+// the rules is invalid.
+func newFilteredSink(sink Sink, filter configuration.Filter) (Sink, error) {
+	if len(filter.Include) == 0 && len(filter.Exclude) == 0 {
+		return sink, nil
+	}
+
+	include, err := newEventRules(filter.Include)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include rule: %v", err)
+	}
+	exclude, err := newEventRules(filter.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude rule: %v", err)
+	}
+	return &filteredSink{Sink: sink, include: include, exclude: exclude}, nil
+}
+
+func (fs *filteredSink) Write(events ...Event) error {
+	var kept []Event
+	for _, event := range events {
+		if fs.accepts(event) {
+			kept = append(kept, event)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return fs.Sink.Write(kept...)
+}
+
+func (fs *filteredSink) accepts(event Event) bool {
+	for _, rule := range fs.exclude {
+		if rule.matches(event) {
+			return false
+		}
+	}
+	if len(fs.include) == 0 {
+		return true
+	}
+	for _, rule := range fs.include {
+		if rule.matches(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventRule matches the events of which every field configured matches its
+// pattern.
+type eventRule struct {
+	repository, tag, actor, userAgent pattern
+}
+
+func newEventRules(rules []configuration.FilterRule) ([]eventRule, error) {
+	var compiled []eventRule
+	for _, rule := range rules {
+		var r eventRule
+		for _, p := range []struct {
+			pattern *pattern
+			value   string
+		}{
+			{&r.repository, rule.Repository},
+			{&r.tag, rule.Tag},
+			{&r.actor, rule.Actor},
+			{&r.userAgent, rule.UserAgent},
+		} {
+			compiledPattern, err := newPattern(p.value)
+			if err != nil {
+				return nil, err
+			}
+			*p.pattern = compiledPattern
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func (r eventRule) matches(event Event) bool {
+	return r.repository.matches(event.Target.Repository) &&
+		r.tag.matches(event.Target.Tag) &&
+		r.actor.matches(event.Actor.Name) &&
+		r.userAgent.matches(event.Request.UserAgent)
+}
+
+// pattern is a glob pattern, with the syntax of path.Match, or a regular
+// expression when enclosed in slashes, such as /^v[0-9]+$/. The empty pattern
+// matches everything, other patterns never match the empty string: events
+// without a tag only match the rules without a tag pattern.
+type pattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+func newPattern(s string) (pattern, error) {
+	if len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return pattern{}, fmt.Errorf("invalid regular expression %q: %v", s, err)
+		}
+		return pattern{regexp: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return pattern{}, fmt.Errorf("invalid pattern %q: %v", s, err)
+	}
+	return pattern{glob: s}, nil
+}
+
+func (p pattern) matches(s string) bool {
+	switch {
+	case p.regexp == nil && p.glob == "":
+		return true
+	case s == "":
+		return false
+	case p.regexp != nil:
+		return p.regexp.MatchString(s)
+	default:
+		matched, _ := path.Match(p.glob, s)
+		return matched
+	}
+}
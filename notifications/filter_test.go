@@ -0,0 +1,100 @@
+package notifications
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+)
+
+func TestFilteredSink(t *testing.T) {
+	newEvent := func(repository, tag, actor, userAgent string) Event {
+		event := createTestEvent("push", repository, "manifest")
+		event.Target.Tag = tag
+		event.Actor.Name = actor
+		event.Request.UserAgent = userAgent
+		return event
+	}
+	release := newEvent("prod/app", "v1.2.3", "deployer", "docker/20.10.7 go/go1.13.15")
+	ci := newEvent("prod/app", "build-42", "ci", "buildkit/v0.8")
+	staging := newEvent("staging/app", "v1.2.3", "deployer", "docker/20.10.7 go/go1.13.15")
+	nested := newEvent("prod/team/app", "v2.0.0", "deployer", "containerd/1.5.2")
+	blob := newEvent("prod/app", "", "ci", "buildkit/v0.8")
+	events := []Event{release, ci, staging, nested, blob}
+
+	for _, tc := range []struct {
+		name     string
+		filter   configuration.Filter
+		expected []Event
+	}{
+		{
+			name:     "no rules",
+			expected: events,
+		},
+		{
+			name: "repository glob and tag regexp",
+			filter: configuration.Filter{Include: []configuration.FilterRule{
+				{Repository: "prod/*", Tag: `/^v[0-9]+\.[0-9]+\.[0-9]+$/`},
+			}},
+			expected: []Event{release},
+		},
+		{
+			name: "any of the include rules",
+			filter: configuration.Filter{Include: []configuration.FilterRule{
+				{Repository: "/^prod//"},
+				{Actor: "deployer"},
+			}},
+			expected: []Event{release, ci, staging, nested, blob},
+		},
+		{
+			name: "exclude rules",
+			filter: configuration.Filter{Exclude: []configuration.FilterRule{
+				{UserAgent: "buildkit/*"},
+				{Repository: "staging/*"},
+			}},
+			expected: []Event{release, nested},
+		},
+		{
+			name: "exclude rules take precedence",
+			filter: configuration.Filter{
+				Include: []configuration.FilterRule{{Repository: "prod/*"}},
+				Exclude: []configuration.FilterRule{{Actor: "ci"}},
+			},
+			expected: []Event{release},
+		},
+		{
+			name: "events without a tag",
+			filter: configuration.Filter{Include: []configuration.FilterRule{
+				{Tag: "*"},
+			}},
+			expected: []Event{release, ci, staging, nested},
+		},
+	} {
+		ts := &testSink{}
+		s, err := newFilteredSink(ts, tc.filter)
+		if err != nil {
+			t.Fatalf("%s: unexpected error creating sink: %v", tc.name, err)
+		}
+		if err := s.Write(events...); err != nil {
+			t.Fatalf("%s: unexpected error writing: %v", tc.name, err)
+		}
+
+		ts.mu.Lock()
+		if !reflect.DeepEqual(ts.events, tc.expected) {
+			t.Errorf("%s: unexpected events %v, expected %v", tc.name, eventIDs(ts.events), eventIDs(tc.expected))
+		}
+		ts.mu.Unlock()
+	}
+}
+
+func TestFilteredSinkInvalid(t *testing.T) {
+	for _, rule := range []configuration.FilterRule{
+		{Repository: "prod/["},
+		{Tag: "/v[0-9+/"},
+	} {
+		filter := configuration.Filter{Exclude: []configuration.FilterRule{rule}}
+		if _, err := newFilteredSink(&testSink{}, filter); err == nil {
+			t.Errorf("expected an error creating a sink filtering %+v", rule)
+		}
+	}
+}
@@ -15,6 +15,9 @@ import (
 type httpSink struct {
 	url string
 
+	// secrets sign the requests, when set.
+	secrets []string
+
 	mu        sync.Mutex
 	closed    bool
 	client    *http.Client
@@ -78,8 +81,19 @@ func (hs *httpSink) Write(events ...Event) error {
 		return fmt.Errorf("%v: error marshaling event envelope: %v", hs, err)
 	}
 
-	body := bytes.NewReader(p)
-	resp, err := hs.client.Post(hs.url, EventsMediaType, body)
+	req, err := http.NewRequest("POST", hs.url, bytes.NewReader(p))
+	if err != nil {
+		for _, listener := range hs.listeners {
+			listener.err(err, events...)
+		}
+		return fmt.Errorf("%v: error creating request: %v", hs, err)
+	}
+	req.Header.Set("Content-Type", EventsMediaType)
+	if len(hs.secrets) > 0 {
+		signRequest(req.Header, p, hs.secrets, time.Now())
+	}
+
+	resp, err := hs.client.Do(req)
 	if err != nil {
 		for _, listener := range hs.listeners {
 			listener.err(err, events...)
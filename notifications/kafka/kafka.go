@@ -0,0 +1,540 @@
+// Package kafka provides a notification sink producing the events to a topic
+// of a Kafka cluster.
+//
+// Each event is produced as a message holding an envelope of the event, keyed
+// by the repository of the event. The messages of a repository are produced
+// to the same partition, chosen as the Java client does, so that consumers
+// receive the events of a repository in order.
+//
+// The connections to the brokers may use TLS, and authenticate with SASL,
+// with the PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512 mechanisms.
+package kafka
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/notifications"
+)
+
+const (
+	defaultClientID = "registry"
+	defaultTimeout  = 10 * time.Second
+
+	// maxResponseSize bounds the responses read from the brokers, which
+	// are small for the requests of the sink.
+	maxResponseSize = 16 << 20
+)
+
+func init() {
+	notifications.RegisterSink("kafka", New)
+}
+
+// Options are the options of a Kafka sink.
+type Options struct {
+	// Brokers are the addresses of the brokers from which the metadata of
+	// the cluster is bootstrapped.
+	Brokers []string
+
+	// Topic is the topic to which events are produced.
+	Topic string
+
+	// ClientID identifies the registry to the brokers.
+	ClientID string
+
+	// Timeout bounds the connection to the brokers and each request.
+	Timeout time.Duration
+
+	// TLS enables TLS with the configuration, if not nil.
+	TLS *tls.Config
+
+	// SASL authenticates the registry, if not nil.
+	SASL *SASL
+}
+
+// sink produces events to a Kafka topic. The writes are serialized and each
+// one is acknowledged by all the in-sync replicas of the partitions written.
+type sink struct {
+	Options
+
+	mu            sync.Mutex
+	closed        bool
+	correlationID int32
+	brokers       map[int32]string   // addresses of the brokers, by id
+	leaders       []int32            // leader of each partition of the topic
+	conns         map[int32]net.Conn // connections to the leaders
+}
+
+// New returns a sink from the options of the configuration: brokers, topic,
+// clientid, timeout, tls and sasl, a map of the mechanism, username and
+// password.
+func New(options map[string]interface{}) (notifications.Sink, error) {
+	opts := Options{
+		ClientID: defaultClientID,
+		Timeout:  defaultTimeout,
+	}
+
+	switch brokers := options["brokers"].(type) {
+	case string:
+		opts.Brokers = strings.Split(brokers, ",")
+	case []interface{}:
+		for _, broker := range brokers {
+			s, ok := broker.(string)
+			if !ok {
+				return nil, fmt.Errorf("kafka: the brokers must be addresses, %#v invalid", broker)
+			}
+			opts.Brokers = append(opts.Brokers, s)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("kafka: the brokers must be a list of addresses, %#v invalid", brokers)
+	}
+
+	if v, ok := options["topic"]; ok {
+		topic, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("kafka: the topic must be a string, %#v invalid", v)
+		}
+		opts.Topic = topic
+	}
+	if v, ok := options["clientid"]; ok {
+		clientID, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("kafka: the clientid must be a string, %#v invalid", v)
+		}
+		opts.ClientID = clientID
+	}
+	if v, ok := options["timeout"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("kafka: the timeout must be a duration, %#v invalid", v)
+		}
+		timeout, err := time.ParseDuration(s)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("kafka: the timeout must be a positive duration, %q invalid", s)
+		}
+		opts.Timeout = timeout
+	}
+
+	tlsConfig, err := notifications.SinkTLSConfig(options["tls"])
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %v", err)
+	}
+	opts.TLS = tlsConfig
+
+	if v, ok := options["sasl"]; ok {
+		sasl, err := saslOption(v)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: %v", err)
+		}
+		opts.SASL = sasl
+	}
+
+	return NewSink(opts)
+}
+
+// saslOption returns the SASL credentials of the sasl option.
+func saslOption(option interface{}) (*SASL, error) {
+	options := make(map[string]interface{})
+	switch v := option.(type) {
+	case map[string]interface{}:
+		options = v
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			options[fmt.Sprint(key)] = value
+		}
+	default:
+		return nil, fmt.Errorf("the sasl option must be a map, %#v invalid", option)
+	}
+
+	sasl := &SASL{Mechanism: SASLPlain}
+	for name, v := range map[string]*string{"mechanism": &sasl.Mechanism, "username": &sasl.Username, "password": &sasl.Password} {
+		if value, ok := options[name]; ok {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("the sasl %s must be a string, %#v invalid", name, value)
+			}
+			*v = s
+		}
+	}
+	sasl.Mechanism = strings.ToUpper(sasl.Mechanism)
+	return sasl, nil
+}
+
+// NewSink returns a sink producing the events to the topic of the options.
+// The brokers are only contacted once events are written.
+func NewSink(opts Options) (notifications.Sink, error) {
+	if len(opts.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka: no brokers configured")
+	}
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("kafka: no topic configured")
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = defaultClientID
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.SASL != nil {
+		if _, err := newSASLClient(opts.SASL); err != nil {
+			return nil, fmt.Errorf("kafka: %v", err)
+		}
+		if opts.SASL.Username == "" {
+			return nil, fmt.Errorf("kafka: no sasl username configured")
+		}
+	}
+
+	return &sink{
+		Options: opts,
+		conns:   make(map[int32]net.Conn),
+	}, nil
+}
+
+func (s *sink) String() string {
+	return fmt.Sprintf("kafka://%s/%s", strings.Join(s.Brokers, ","), s.Topic)
+}
+
+// Write produces the events, returning once all of them are acknowledged.
+// The metadata of the topic is fetched again after an error, so that the
+// retries reach the new leaders of the partitions.
+func (s *sink) Write(events ...notifications.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return notifications.ErrSinkClosed
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := s.produce(events); err != nil {
+		s.reset()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connections to the brokers.
+func (s *sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("kafka: sink already closed")
+	}
+	s.closed = true
+	s.reset()
+	return nil
+}
+
+// reset closes the connections and forgets the metadata of the cluster.
+func (s *sink) reset() {
+	for id, conn := range s.conns {
+		conn.Close()
+		delete(s.conns, id)
+	}
+	s.brokers, s.leaders = nil, nil
+}
+
+func (s *sink) produce(events []notifications.Event) error {
+	if s.leaders == nil {
+		if err := s.fetchMetadata(); err != nil {
+			return err
+		}
+	}
+
+	// the events of a repository are written to the same partition, in
+	// order
+	batches := make(map[int32][]message)
+	for _, event := range events {
+		value, err := json.Marshal(notifications.Envelope{Events: []notifications.Event{event}})
+		if err != nil {
+			return err
+		}
+		key := []byte(event.Target.Repository)
+		partition := (murmur2(key) & 0x7fffffff) % int32(len(s.leaders))
+		batches[partition] = append(batches[partition], message{
+			key:       key,
+			value:     value,
+			headers:   []header{{key: "content-type", value: []byte(notifications.EventsMediaType)}},
+			timestamp: event.Timestamp,
+		})
+	}
+
+	byLeader := make(map[int32][]int32)
+	for partition := range batches {
+		leader := s.leaders[partition]
+		byLeader[leader] = append(byLeader[leader], partition)
+	}
+	for leader, partitions := range byLeader {
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+		if err := s.produceTo(leader, partitions, batches); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// produceTo writes the batches of the partitions led by the broker.
+func (s *sink) produceTo(leader int32, partitions []int32, batches map[int32][]message) error {
+	var e encoder
+	e.nullableString(nil) // transactional id
+	e.int16(-1)           // acks from all the in-sync replicas
+	e.int32(int32(s.Timeout / time.Millisecond))
+	e.int32(1)
+	e.string(s.Topic)
+	e.int32(int32(len(partitions)))
+	for _, partition := range partitions {
+		e.int32(partition)
+		e.bytes(recordBatch(batches[partition]))
+	}
+
+	conn, err := s.conn(leader)
+	if err != nil {
+		return err
+	}
+	d, err := s.roundTrip(conn, apiKeyProduce, produceVersion, e.b)
+	if err != nil {
+		return err
+	}
+
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		topic := d.string()
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			partition := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if d.err == nil && code != 0 {
+				return fmt.Errorf("kafka: error %d producing to partition %d of %s", code, partition, topic)
+			}
+		}
+	}
+	return d.err
+}
+
+// fetchMetadata fetches the brokers of the cluster and the leaders of the
+// partitions of the topic from the first bootstrap broker answering.
+func (s *sink) fetchMetadata() error {
+	var e encoder
+	e.int32(1)
+	e.string(s.Topic)
+	e.int8(1) // allow the creation of the topic, if the brokers do
+
+	var err error
+	for _, addr := range s.Brokers {
+		var conn net.Conn
+		conn, err = s.dial(addr)
+		if err != nil {
+			continue
+		}
+		var d *decoder
+		d, err = s.roundTrip(conn, apiKeyMetadata, metadataVersion, e.b)
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		if err = s.readMetadata(d); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *sink) readMetadata(d *decoder) error {
+	d.int32() // throttle time
+	brokers := make(map[int32]string)
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	d.string() // cluster id
+	d.int32()  // controller id
+
+	var leaders []int32
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := d.int16()
+		topic := d.string()
+		d.int8() // internal
+		partitions := make(map[int32]int32)
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			d.int16() // error of the partition
+			partition := d.int32()
+			partitions[partition] = d.int32()
+			for k, l := 0, d.arrayLen(); k < l; k++ {
+				d.int32() // replicas
+			}
+			for k, l := 0, d.arrayLen(); k < l; k++ {
+				d.int32() // in-sync replicas
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+		if topic != s.Topic {
+			continue
+		}
+		if code != 0 {
+			return fmt.Errorf("kafka: error %d fetching the metadata of %s", code, topic)
+		}
+
+		leaders = make([]int32, len(partitions))
+		for partition, leader := range partitions {
+			if partition < 0 || int(partition) >= len(leaders) {
+				return fmt.Errorf("kafka: unexpected partition %d of %s", partition, topic)
+			}
+			if _, ok := brokers[leader]; !ok {
+				return fmt.Errorf("kafka: no leader for partition %d of %s", partition, topic)
+			}
+			leaders[partition] = leader
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("kafka: no partitions for %s", s.Topic)
+	}
+
+	s.brokers, s.leaders = brokers, leaders
+	return nil
+}
+
+// conn returns the connection to the broker, dialing it if needed.
+func (s *sink) conn(id int32) (net.Conn, error) {
+	if conn, ok := s.conns[id]; ok {
+		return conn, nil
+	}
+	conn, err := s.dial(s.brokers[id])
+	if err != nil {
+		return nil, err
+	}
+	s.conns[id] = conn
+	return conn, nil
+}
+
+// dial connects to the broker, over TLS if enabled, and authenticates the
+// registry if SASL is enabled.
+func (s *sink) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	var conn net.Conn
+	var err error
+	if s.TLS != nil {
+		config := s.TLS.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.SASL != nil {
+		if err := s.authenticate(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authenticate runs the SASL exchange of the mechanism over the connection.
+func (s *sink) authenticate(conn net.Conn) error {
+	var e encoder
+	e.string(s.SASL.Mechanism)
+	d, err := s.roundTrip(conn, apiKeySaslHandshake, saslHandshakeVersion, e.b)
+	if err != nil {
+		return err
+	}
+	code := d.int16()
+	var mechanisms []string
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		mechanisms = append(mechanisms, d.string())
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if code != 0 {
+		return fmt.Errorf("kafka: SASL mechanism %s not enabled by the broker, only %s", s.SASL.Mechanism, strings.Join(mechanisms, ", "))
+	}
+
+	client, err := newSASLClient(s.SASL)
+	if err != nil {
+		return fmt.Errorf("kafka: %v", err)
+	}
+	var challenge []byte
+	for {
+		response, done, err := client.step(challenge)
+		if err != nil {
+			return fmt.Errorf("kafka: %v", err)
+		}
+		if done {
+			return nil
+		}
+
+		var e encoder
+		e.bytes(response)
+		d, err := s.roundTrip(conn, apiKeySaslAuthenticate, saslAuthenticateVersion, e.b)
+		if err != nil {
+			return err
+		}
+		code := d.int16()
+		message := d.string()
+		challenge = d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+		if code != 0 {
+			return fmt.Errorf("kafka: SASL authentication failed: error %d: %s", code, message)
+		}
+	}
+}
+
+// roundTrip sends the request and returns a decoder of the body of the
+// response.
+func (s *sink) roundTrip(conn net.Conn, apiKey, apiVersion int16, body []byte) (*decoder, error) {
+	s.correlationID++
+	correlationID := s.correlationID
+
+	if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request(apiKey, apiVersion, correlationID, s.ClientID, body)); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	d := &decoder{b: size[:]}
+	n := d.int32()
+	if n < 4 || n > maxResponseSize {
+		return nil, fmt.Errorf("kafka: unexpected response size %d", n)
+	}
+	response := make([]byte, n)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	d = &decoder{b: response}
+	if id := d.int32(); d.err == nil && id != correlationID {
+		return nil, fmt.Errorf("kafka: unexpected correlation id %d, expected %d", id, correlationID)
+	}
+	return d, d.err
+}
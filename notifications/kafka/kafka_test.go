@@ -0,0 +1,526 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/notifications"
+)
+
+func TestMurmur2(t *testing.T) {
+	// the values of the Java client
+	for key, expected := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if hash := murmur2([]byte(key)); hash != expected {
+			t.Errorf("murmur2(%q) = %d, expected %d", key, hash, expected)
+		}
+	}
+}
+
+func TestSink(t *testing.T) {
+	broker := newTestBroker(t, "events", 4)
+	defer broker.Close()
+
+	s, err := notifications.GetSink("kafka", map[string]interface{}{
+		"brokers": []interface{}{broker.Addr()},
+		"topic":   "events",
+		"timeout": "5s",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	defer s.Close()
+
+	repositories := []string{"library/a", "library/b", "team/c", "d"}
+	var events []notifications.Event
+	for i := 0; i < 12; i++ {
+		var event notifications.Event
+		event.ID = strconv.Itoa(i)
+		event.Action = notifications.EventActionPush
+		event.Timestamp = time.Now()
+		event.Target.Repository = repositories[i%len(repositories)]
+		events = append(events, event)
+	}
+	if err := s.Write(events[:5]...); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := s.Write(events[5:]...); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+
+	// the events of a repository are in order in a single partition
+	received := make(map[string][]string)
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for partition, messages := range broker.messages {
+		for _, m := range messages {
+			repository := string(m.key)
+			if expected := (murmur2(m.key) & 0x7fffffff) % 4; partition != expected {
+				t.Fatalf("%s produced to partition %d, expected %d", repository, partition, expected)
+			}
+			if len(m.headers) != 1 || m.headers[0].key != "content-type" || string(m.headers[0].value) != notifications.EventsMediaType {
+				t.Fatalf("unexpected headers: %v", m.headers)
+			}
+			var envelope notifications.Envelope
+			if err := json.Unmarshal(m.value, &envelope); err != nil || len(envelope.Events) != 1 {
+				t.Fatalf("unexpected message %s: %v", m.value, err)
+			}
+			if envelope.Events[0].Target.Repository != repository {
+				t.Fatalf("event of %s keyed by %s", envelope.Events[0].Target.Repository, repository)
+			}
+			received[repository] = append(received[repository], envelope.Events[0].ID)
+		}
+	}
+	for i, repository := range repositories {
+		var expected []string
+		for id := i; id < 12; id += len(repositories) {
+			expected = append(expected, strconv.Itoa(id))
+		}
+		if fmt.Sprint(received[repository]) != fmt.Sprint(expected) {
+			t.Fatalf("unexpected events of %s: %v, expected %v", repository, received[repository], expected)
+		}
+	}
+	if broker.metadataRequests != 1 {
+		t.Fatalf("unexpected metadata requests: %d", broker.metadataRequests)
+	}
+}
+
+func TestSinkError(t *testing.T) {
+	broker := newTestBroker(t, "events", 1)
+	defer broker.Close()
+	broker.produceErrors = 1
+
+	s, err := NewSink(Options{Brokers: []string{broker.Addr()}, Topic: "events"})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	var event notifications.Event
+	event.Target.Repository = "library/a"
+
+	if err := s.Write(event); err == nil {
+		t.Fatal("expected an error writing to a broker no longer leading the partition")
+	}
+	// the metadata is fetched again for the retry
+	if err := s.Write(event); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	broker.mu.Lock()
+	if broker.metadataRequests != 2 || len(broker.messages[0]) != 1 {
+		t.Fatalf("unexpected requests: %d metadata, %d messages", broker.metadataRequests, len(broker.messages[0]))
+	}
+	broker.mu.Unlock()
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+	if err := s.Write(event); err != notifications.ErrSinkClosed {
+		t.Fatalf("unexpected error writing after close: %v", err)
+	}
+
+	// no broker
+	s, _ = NewSink(Options{Brokers: []string{broker.Addr()}, Topic: "missing", Timeout: time.Second})
+	if err := s.Write(event); err == nil {
+		t.Fatal("expected an error writing to a missing topic")
+	}
+}
+
+func TestSinkTLSAndSASL(t *testing.T) {
+	serverTLS, ca, cleanup := newTestTLS(t)
+	defer cleanup()
+	broker := newSecureTestBroker(t, "events", 1, serverTLS, "registry", "secret")
+	defer broker.Close()
+
+	var event notifications.Event
+	event.Target.Repository = "library/a"
+	for _, tc := range []struct {
+		options map[string]interface{}
+		err     string
+	}{
+		{
+			options: map[string]interface{}{
+				"tls":  map[interface{}]interface{}{"ca": ca},
+				"sasl": map[interface{}]interface{}{"username": "registry", "password": "secret"},
+			},
+		},
+		{
+			options: map[string]interface{}{
+				"tls":  map[interface{}]interface{}{"ca": ca},
+				"sasl": map[interface{}]interface{}{"username": "registry", "password": "wrong"},
+			},
+			err: "SASL authentication failed",
+		},
+		{
+			options: map[string]interface{}{
+				"tls":  map[interface{}]interface{}{"ca": ca},
+				"sasl": map[interface{}]interface{}{"mechanism": "scram-sha-512", "username": "registry", "password": "secret"},
+			},
+			err: "SASL mechanism SCRAM-SHA-512 not enabled by the broker, only PLAIN",
+		},
+		{
+			options: map[string]interface{}{
+				"tls":  true,
+				"sasl": map[interface{}]interface{}{"username": "registry", "password": "secret"},
+			},
+			err: "certificate",
+		},
+	} {
+		tc.options["brokers"] = broker.Addr()
+		tc.options["topic"] = "events"
+		tc.options["timeout"] = "1s"
+		s, err := New(tc.options)
+		if err != nil {
+			t.Fatalf("unexpected error creating sink: %v", err)
+		}
+		err = s.Write(event)
+		s.Close()
+		if tc.err == "" && err != nil {
+			t.Fatalf("unexpected error writing with %v: %v", tc.options, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("expected an error %q writing with %v, got %v", tc.err, tc.options, err)
+		}
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.messages[0]) != 1 {
+		t.Fatalf("unexpected messages: %d", len(broker.messages[0]))
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	// the example of RFC 7677
+	c := newSCRAMClient(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO")
+	for _, step := range []struct{ challenge, response string }{
+		{"", "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"},
+		{
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		},
+	} {
+		response, done, err := c.step([]byte(step.challenge))
+		if err != nil || done || string(response) != step.response {
+			t.Fatalf("unexpected response to %q: %q, %t, %v", step.challenge, response, done, err)
+		}
+	}
+	if _, _, err := c.step([]byte("v=AAAA")); err == nil {
+		t.Fatal("expected an error with an invalid server signature")
+	}
+	c.state = 2
+	if _, done, err := c.step([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); !done || err != nil {
+		t.Fatalf("unexpected error verifying the server signature: %t, %v", done, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"topic": "events"},
+		{"brokers": "localhost:9092"},
+		{"brokers": 9092, "topic": "events"},
+		{"brokers": "localhost:9092", "topic": "events", "timeout": "soon"},
+		{"brokers": "localhost:9092", "topic": "events", "tls": "yes"},
+		{"brokers": "localhost:9092", "topic": "events", "tls": map[string]interface{}{"ca": "/missing"}},
+		{"brokers": "localhost:9092", "topic": "events", "sasl": map[string]interface{}{"mechanism": "GSSAPI", "username": "registry"}},
+		{"brokers": "localhost:9092", "topic": "events", "sasl": map[string]interface{}{"password": "secret"}},
+	} {
+		if _, err := New(options); err == nil {
+			t.Errorf("expected an error creating a sink with %v", options)
+		}
+	}
+
+	s, err := New(map[string]interface{}{"brokers": "kafka-1:9092,kafka-2:9092", "topic": "events"})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	if url := fmt.Sprint(s); url != "kafka://kafka-1:9092,kafka-2:9092/events" {
+		t.Fatalf("unexpected url %s", url)
+	}
+}
+
+// newTestTLS returns the TLS configuration of a server for 127.0.0.1 and the
+// path of its certificate authority.
+func newTestTLS(t *testing.T) (config *tls.Config, ca string, cleanup func()) {
+	server := httptest.NewUnstartedServer(nil)
+	server.StartTLS()
+	server.Close()
+
+	dir, err := ioutil.TempDir("", "kafka-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca = filepath.Join(dir, "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, pemBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: server.TLS.Certificates}, ca, func() { os.RemoveAll(dir) }
+}
+
+// testBroker is an in-process stand-in for a Kafka cluster of one broker,
+// serving the requests of the sink.
+type testBroker struct {
+	t          *testing.T
+	listener   net.Listener
+	topic      string
+	partitions int32
+
+	// username and password are required with SASL PLAIN, if set
+	username, password string
+
+	mu               sync.Mutex
+	metadataRequests int
+	produceErrors    int // produce requests failed as not leader
+	messages         map[int32][]message
+}
+
+func newTestBroker(t *testing.T, topic string, partitions int32) *testBroker {
+	return newSecureTestBroker(t, topic, partitions, nil, "", "")
+}
+
+// newSecureTestBroker returns a broker serving TLS with the configuration,
+// if not nil, and requiring SASL PLAIN authentication, if username is set.
+func newSecureTestBroker(t *testing.T, topic string, partitions int32, config *tls.Config, username, password string) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	b := &testBroker{
+		t:          t,
+		listener:   listener,
+		topic:      topic,
+		partitions: partitions,
+		username:   username,
+		password:   password,
+		messages:   make(map[int32][]message),
+	}
+	go b.serve()
+	return b
+}
+
+func (b *testBroker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *testBroker) Close() error {
+	return b.listener.Close()
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			authenticated := b.username == ""
+			for {
+				var size [4]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				d := &decoder{b: size[:]}
+				req := make([]byte, d.int32())
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+
+				d = &decoder{b: req}
+				apiKey, apiVersion, correlationID := d.int16(), d.int16(), d.int32()
+				d.string() // client id
+				var e encoder
+				e.int32(0)
+				e.int32(correlationID)
+				switch {
+				case apiKey == apiKeySaslHandshake && apiVersion == saslHandshakeVersion:
+					if mechanism := d.string(); mechanism == SASLPlain {
+						e.int16(0)
+					} else {
+						e.int16(33) // unsupported mechanism
+					}
+					e.int32(1)
+					e.string(SASLPlain)
+				case apiKey == apiKeySaslAuthenticate && apiVersion == saslAuthenticateVersion:
+					authenticated = string(d.bytes()) == "\x00"+b.username+"\x00"+b.password
+					if authenticated {
+						e.int16(0)
+						e.nullableString(nil)
+					} else {
+						message := "invalid credentials"
+						e.int16(58) // authentication failed
+						e.nullableString(&message)
+					}
+					e.bytes(nil)
+				case !authenticated:
+					b.t.Errorf("unexpected request %d before authentication", apiKey)
+					return
+				case apiKey == apiKeyMetadata && apiVersion == metadataVersion:
+					b.metadata(d, &e)
+				case apiKey == apiKeyProduce && apiVersion == produceVersion:
+					b.produce(d, &e)
+				default:
+					b.t.Errorf("unexpected request %d v%d", apiKey, apiVersion)
+					return
+				}
+				if d.err != nil {
+					b.t.Errorf("error decoding request %d: %v", apiKey, d.err)
+					return
+				}
+				e.b[0], e.b[1], e.b[2], e.b[3] = byte((len(e.b)-4)>>24), byte((len(e.b)-4)>>16), byte((len(e.b)-4)>>8), byte(len(e.b)-4)
+				if _, err := conn.Write(e.b); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (b *testBroker) metadata(d *decoder, e *encoder) {
+	var topics []string
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		topics = append(topics, d.string())
+	}
+	d.int8() // allow auto topic creation
+
+	b.mu.Lock()
+	b.metadataRequests++
+	b.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(b.Addr())
+	p, _ := strconv.Atoi(port)
+	e.int32(0) // throttle time
+	e.int32(1)
+	e.int32(0)
+	e.string(host)
+	e.int32(int32(p))
+	e.nullableString(nil)
+	e.nullableString(nil)
+	e.int32(0)
+	e.int32(int32(len(topics)))
+	for _, topic := range topics {
+		if topic != b.topic {
+			e.int16(3) // unknown topic
+			e.string(topic)
+			e.int8(0)
+			e.int32(0)
+			continue
+		}
+		e.int16(0)
+		e.string(topic)
+		e.int8(0)
+		e.int32(b.partitions)
+		for partition := int32(0); partition < b.partitions; partition++ {
+			e.int16(0)
+			e.int32(partition)
+			e.int32(0) // leader
+			e.int32(1)
+			e.int32(0)
+			e.int32(1)
+			e.int32(0)
+		}
+	}
+}
+
+func (b *testBroker) produce(d *decoder, e *encoder) {
+	d.string() // transactional id
+	if acks := d.int16(); acks != -1 {
+		b.t.Errorf("unexpected acks %d", acks)
+	}
+	d.int32() // timeout
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	code := int16(0)
+	if b.produceErrors > 0 {
+		b.produceErrors--
+		code = 6 // not leader
+	}
+
+	topics := d.arrayLen()
+	e.int32(int32(topics))
+	for i := 0; i < topics; i++ {
+		topic := d.string()
+		e.string(topic)
+		partitions := d.arrayLen()
+		e.int32(int32(partitions))
+		for j := 0; j < partitions; j++ {
+			partition := d.int32()
+			batch := d.bytes()
+			if code == 0 {
+				messages, err := decodeRecordBatch(batch)
+				if err != nil {
+					b.t.Errorf("error decoding record batch: %v", err)
+				}
+				b.messages[partition] = append(b.messages[partition], messages...)
+			}
+			e.int32(partition)
+			e.int16(code)
+			e.int64(0)
+			e.int64(-1)
+		}
+	}
+	e.int32(0) // throttle time
+}
+
+func decodeRecordBatch(batch []byte) ([]message, error) {
+	d := &decoder{b: batch}
+	d.int64() // base offset
+	if length := d.int32(); int(length) != len(d.b) {
+		return nil, fmt.Errorf("unexpected batch length %d, %d bytes left", length, len(d.b))
+	}
+	d.int32() // partition leader epoch
+	if magic := d.int8(); magic != recordBatchMagic {
+		return nil, fmt.Errorf("unexpected magic %d", magic)
+	}
+	crc := uint32(d.int32())
+	if crc32.Checksum(d.b, crc32c) != crc {
+		return nil, fmt.Errorf("invalid checksum")
+	}
+	d.int16() // attributes
+	d.int32() // last offset delta
+	baseTimestamp := d.int64()
+	d.int64() // max timestamp
+	d.int64() // producer id
+	d.int16() // producer epoch
+	d.int32() // base sequence
+
+	var messages []message
+	for i, n := 0, int(d.int32()); i < n; i++ {
+		d.varint() // length
+		d.int8()   // attributes
+		timestamp := baseTimestamp + d.varint()
+		if delta := d.varint(); delta != int64(i) {
+			return nil, fmt.Errorf("unexpected offset delta %d", delta)
+		}
+		m := message{key: d.varbytes(), value: d.varbytes(), timestamp: time.Unix(0, timestamp*int64(time.Millisecond))}
+		for j, h := 0, int(d.varint()); j < h; j++ {
+			m.headers = append(m.headers, header{key: string(d.varbytes()), value: d.varbytes()})
+		}
+		messages = append(messages, m)
+	}
+	return messages, d.err
+}
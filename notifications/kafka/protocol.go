@@ -0,0 +1,304 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// The sink speaks the versions of the Kafka protocol supported by the
+// brokers since Kafka 1.0, including those of Kafka 4.
+const (
+	apiKeyProduce          = 0
+	apiKeyMetadata         = 3
+	apiKeySaslHandshake    = 17
+	apiKeySaslAuthenticate = 36
+
+	produceVersion          = 3
+	metadataVersion         = 4
+	saslHandshakeVersion    = 1
+	saslAuthenticateVersion = 0
+
+	// recordBatchMagic is the version of the record batches produced.
+	recordBatchMagic = 2
+)
+
+var (
+	errShortMessage = errors.New("kafka: short message")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// encoder appends the primitive types of the protocol to a buffer.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	e.b = append(e.b, byte(uint16(v)>>8), byte(v))
+}
+
+func (e *encoder) int32(v int32) {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], uint32(v))
+	e.b = append(e.b, p[:]...)
+}
+
+func (e *encoder) int64(v int64) {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], uint64(v))
+	e.b = append(e.b, p[:]...)
+}
+
+func (e *encoder) varint(v int64) {
+	var p [binary.MaxVarintLen64]byte
+	e.b = append(e.b, p[:binary.PutVarint(p[:], v)]...)
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) nullableString(s *string) {
+	if s == nil {
+		e.int16(-1)
+		return
+	}
+	e.string(*s)
+}
+
+func (e *encoder) bytes(p []byte) {
+	e.int32(int32(len(p)))
+	e.b = append(e.b, p...)
+}
+
+// varbytes appends p prefixed by its varint length, as in records.
+func (e *encoder) varbytes(p []byte) {
+	if p == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(p)))
+	e.b = append(e.b, p...)
+}
+
+// decoder reads the primitive types of the protocol from a message,
+// remembering the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errShortMessage
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) int8() int8 {
+	if p := d.next(1); p != nil {
+		return int8(p[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if p := d.next(2); p != nil {
+		return int16(binary.BigEndian.Uint16(p))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if p := d.next(4); p != nil {
+		return int32(binary.BigEndian.Uint32(p))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if p := d.next(8); p != nil {
+		return int64(binary.BigEndian.Uint64(p))
+	}
+	return 0
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errShortMessage
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *decoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// arrayLen returns the length of an array, zero if null.
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.b) {
+		// each element takes a byte at least
+		d.err = errShortMessage
+		return 0
+	}
+	return int(n)
+}
+
+// request returns a request of the api, framed with its size.
+func request(apiKey, apiVersion int16, correlationID int32, clientID string, body []byte) []byte {
+	var e encoder
+	e.int32(0) // size, set below
+	e.int16(apiKey)
+	e.int16(apiVersion)
+	e.int32(correlationID)
+	e.string(clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	return e.b
+}
+
+// message is a record of a batch.
+type message struct {
+	key       []byte
+	value     []byte
+	headers   []header
+	timestamp time.Time
+}
+
+type header struct {
+	key   string
+	value []byte
+}
+
+// recordBatch returns the messages encoded as a batch of records.
+func recordBatch(messages []message) []byte {
+	base := messages[0].timestamp
+	maxTimestamp := base
+	var records encoder
+	for i, m := range messages {
+		if m.timestamp.After(maxTimestamp) {
+			maxTimestamp = m.timestamp
+		}
+
+		var r encoder
+		r.int8(0) // attributes
+		r.varint(millis(m.timestamp) - millis(base))
+		r.varint(int64(i)) // offset delta
+		r.varbytes(m.key)
+		r.varbytes(m.value)
+		r.varint(int64(len(m.headers)))
+		for _, h := range m.headers {
+			r.varbytes([]byte(h.key))
+			r.varbytes(h.value)
+		}
+
+		records.varint(int64(len(r.b)))
+		records.b = append(records.b, r.b...)
+	}
+
+	// the fields covered by the checksum
+	var c encoder
+	c.int16(0) // attributes: no compression, create time
+	c.int32(int32(len(messages) - 1))
+	c.int64(millis(base))
+	c.int64(millis(maxTimestamp))
+	c.int64(-1) // producer id
+	c.int16(-1) // producer epoch
+	c.int32(-1) // base sequence
+	c.int32(int32(len(messages)))
+	c.b = append(c.b, records.b...)
+
+	var e encoder
+	e.int64(0) // base offset
+	e.int32(int32(4 + 1 + 4 + len(c.b)))
+	e.int32(-1) // partition leader epoch
+	e.int8(recordBatchMagic)
+	e.int32(int32(crc32.Checksum(c.b, crc32c)))
+	e.b = append(e.b, c.b...)
+	return e.b
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// murmur2 is the hash of the default partitioner of the Java client, so that
+// the messages of a key are produced to the same partition by both.
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	h := uint32(seed) ^ uint32(len(data))
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	switch len(data) % 4 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
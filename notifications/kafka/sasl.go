@@ -0,0 +1,162 @@
+package kafka
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SASL mechanisms supported by the sink.
+const (
+	SASLPlain       = "PLAIN"
+	SASLSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// SASL are the credentials authenticating the registry to the brokers.
+type SASL struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512.
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// saslClient is the client side of the exchange of a SASL mechanism.
+type saslClient interface {
+	// step returns the next message sent to the broker, from the challenge
+	// of the broker, nil for the first message. It returns done once the
+	// last message of the broker was verified.
+	step(challenge []byte) (response []byte, done bool, err error)
+}
+
+func newSASLClient(sasl *SASL) (saslClient, error) {
+	switch sasl.Mechanism {
+	case SASLPlain:
+		return &plainClient{username: sasl.Username, password: sasl.Password}, nil
+	case SASLSCRAMSHA256:
+		return newSCRAMClient(sha256.New, sasl.Username, sasl.Password, ""), nil
+	case SASLSCRAMSHA512:
+		return newSCRAMClient(sha512.New, sasl.Username, sasl.Password, ""), nil
+	}
+	return nil, fmt.Errorf("unsupported SASL mechanism %q", sasl.Mechanism)
+}
+
+// plainClient sends the credentials in clear, over TLS if enabled.
+type plainClient struct {
+	username, password string
+	sent               bool
+}
+
+func (c *plainClient) step(challenge []byte) ([]byte, bool, error) {
+	if c.sent {
+		return nil, true, nil
+	}
+	c.sent = true
+	return []byte("\x00" + c.username + "\x00" + c.password), false, nil
+}
+
+// scramClient authenticates with SCRAM, as specified by RFC 5802, without
+// channel binding.
+type scramClient struct {
+	hash     func() hash.Hash
+	username string
+	password string
+	nonce    string
+
+	state       int
+	clientFirst string // without the GS2 header
+	serverKey   []byte
+	authMessage string
+}
+
+// newSCRAMClient returns a SCRAM client, with a random nonce unless given.
+func newSCRAMClient(h func() hash.Hash, username, password, nonce string) *scramClient {
+	if nonce == "" {
+		p := make([]byte, 24)
+		rand.Read(p)
+		nonce = base64.RawStdEncoding.EncodeToString(p)
+	}
+	return &scramClient{hash: h, username: username, password: password, nonce: nonce}
+}
+
+func (c *scramClient) step(challenge []byte) ([]byte, bool, error) {
+	c.state++
+	switch c.state {
+	case 1:
+		username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.username)
+		c.clientFirst = "n=" + username + ",r=" + c.nonce
+		return []byte("n,," + c.clientFirst), false, nil
+	case 2:
+		return c.clientFinal(string(challenge))
+	case 3:
+		attributes := scramAttributes(string(challenge))
+		if e, ok := attributes["e"]; ok {
+			return nil, false, fmt.Errorf("SCRAM authentication failed: %s", e)
+		}
+		signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+		if err != nil || !hmac.Equal(signature, c.hmac(c.serverKey, c.authMessage)) {
+			return nil, false, fmt.Errorf("SCRAM authentication failed: invalid server signature")
+		}
+		return nil, true, nil
+	}
+	return nil, false, fmt.Errorf("unexpected SCRAM message")
+}
+
+// clientFinal returns the proof of the password, from the salt and the
+// iterations of the first message of the server.
+func (c *scramClient) clientFinal(serverFirst string) ([]byte, bool, error) {
+	attributes := scramAttributes(serverFirst)
+	nonce := attributes["r"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, false, fmt.Errorf("SCRAM authentication failed: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return nil, false, fmt.Errorf("SCRAM authentication failed: invalid salt")
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations <= 0 {
+		return nil, false, fmt.Errorf("SCRAM authentication failed: invalid iteration count")
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(c.password), salt, iterations, c.hash().Size(), c.hash)
+	clientKey := c.hmac(saltedPassword, "Client Key")
+	h := c.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	clientFinal := "c=biws,r=" + nonce // biws: the GS2 header n,, base64 encoded
+	c.authMessage = c.clientFirst + "," + serverFirst + "," + clientFinal
+	proof := c.hmac(storedKey, c.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverKey = c.hmac(saltedPassword, "Server Key")
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), false, nil
+}
+
+func (c *scramClient) hmac(key []byte, message string) []byte {
+	mac := hmac.New(c.hash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramAttributes returns the values of the attributes of a SCRAM message by
+// name.
+func scramAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if i := strings.IndexByte(attribute, '='); i > 0 {
+			attributes[attribute[:i]] = attribute[i+1:]
+		}
+	}
+	return attributes
+}
@@ -32,7 +32,16 @@ type RepoListener interface {
 	RepoDeleted(repo reference.Named) error
 }
 
-// Listener combines all repository events into a single interface.
+// TagListener describes a listener that can respond to tag related events.
+// A Listener receives these events only if it also implements TagListener.
+type TagListener interface {
+	TagCreated(repo reference.Named, tag string, desc distribution.Descriptor) error
+	TagMoved(repo reference.Named, tag string, desc distribution.Descriptor, previous digest.Digest) error
+	TagRemoved(repo reference.Named, tag string, previous digest.Digest) error
+}
+
+// Listener combines all repository events into a single interface. The tag
+// events of TagListener are dispatched to the listeners implementing it.
 type Listener interface {
 	ManifestListener
 	BlobListener
@@ -251,13 +260,56 @@ func (rl *repositoryListener) Tags(ctx context.Context) distribution.TagService
 	}
 }
 
+func (tagSL *tagServiceListener) List(ctx context.Context, tags []string, last string) (int, error) {
+	return distribution.ListTags(ctx, tagSL.TagService, tags, last)
+}
+
+func (tagSL *tagServiceListener) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	tagListener, ok := tagSL.parent.listener.(TagListener)
+	if !ok {
+		return tagSL.TagService.Tag(ctx, tag, desc)
+	}
+
+	previous, err := distribution.ReplaceTag(ctx, tagSL.TagService, tag, desc)
+	if err != nil {
+		return err
+	}
+
+	repo := tagSL.parent.Repository.Named()
+	switch previous {
+	case "":
+		err = tagListener.TagCreated(repo, tag, desc)
+	case desc.Digest:
+		return nil
+	default:
+		err = tagListener.TagMoved(repo, tag, desc, previous)
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("error dispatching tag event to listener: %v", err)
+	}
+	return nil
+}
+
 func (tagSL *tagServiceListener) Untag(ctx context.Context, tag string) error {
-	if err := tagSL.TagService.Untag(ctx, tag); err != nil {
+	tagListener, ok := tagSL.parent.listener.(TagListener)
+	var previous digest.Digest
+	var err error
+	if ok {
+		previous, err = distribution.RemoveTag(ctx, tagSL.TagService, tag)
+	} else {
+		err = tagSL.TagService.Untag(ctx, tag)
+	}
+	if err != nil {
 		return err
 	}
 	if err := tagSL.parent.listener.TagDeleted(tagSL.parent.Repository.Named(), tag); err != nil {
 		dcontext.GetLogger(ctx).Errorf("error dispatching tag deleted to listener: %v", err)
 		return err
 	}
+	if previous != "" {
+		if err := tagListener.TagRemoved(tagSL.parent.Repository.Named(), tag, previous); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error dispatching tag removed to listener: %v", err)
+		}
+	}
 	return nil
 }
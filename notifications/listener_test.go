@@ -19,6 +19,56 @@ import (
 )
 
 func TestListener(t *testing.T) {
+	ops := exerciseListener(t, func(tl *testListener) Listener { return tl })
+
+	expectedOps := map[string]int{
+		"manifest:push":   1,
+		"manifest:pull":   1,
+		"manifest:delete": 1,
+		"layer:push":      2,
+		"layer:pull":      2,
+		"layer:delete":    2,
+		"tag:create":      1,
+		"tag:move":        1,
+		"tag:delete":      2,
+		"tag:remove":      1,
+		"repo:delete":     1,
+	}
+
+	if !reflect.DeepEqual(ops, expectedOps) {
+		t.Fatalf("counts do not match:\n%v\n !=\n%v", ops, expectedOps)
+	}
+}
+
+func TestListenerWithoutTagEvents(t *testing.T) {
+	ops := exerciseListener(t, func(tl *testListener) Listener {
+		return struct {
+			ManifestListener
+			BlobListener
+			RepoListener
+		}{tl, tl, tl}
+	})
+
+	expectedOps := map[string]int{
+		"manifest:push":   1,
+		"manifest:pull":   1,
+		"manifest:delete": 1,
+		"layer:push":      2,
+		"layer:pull":      2,
+		"layer:delete":    2,
+		"tag:delete":      2,
+		"repo:delete":     1,
+	}
+
+	if !reflect.DeepEqual(ops, expectedOps) {
+		t.Fatalf("counts do not match:\n%v\n !=\n%v", ops, expectedOps)
+	}
+}
+
+// exerciseListener takes a repository listened to by the listener returned by
+// wrap through a number of operations, returning the events counted by the
+// testListener wrapped.
+func exerciseListener(t *testing.T, wrap func(tl *testListener) Listener) map[string]int {
 	ctx := context.Background()
 	k, err := libtrust.GenerateECP256PrivateKey()
 	if err != nil {
@@ -43,25 +93,12 @@ func TestListener(t *testing.T) {
 	if !ok {
 		t.Fatal("registry does not implement RepositoryRemover")
 	}
-	repository, remover = Listen(repository, remover, tl)
+	repository, remover = Listen(repository, remover, wrap(tl))
 
 	// Now take the registry through a number of operations
 	checkExerciseRepository(t, repository, remover)
 
-	expectedOps := map[string]int{
-		"manifest:push":   1,
-		"manifest:pull":   1,
-		"manifest:delete": 1,
-		"layer:push":      2,
-		"layer:pull":      2,
-		"layer:delete":    2,
-		"tag:delete":      1,
-		"repo:delete":     1,
-	}
-
-	if !reflect.DeepEqual(tl.ops, expectedOps) {
-		t.Fatalf("counts do not match:\n%v\n !=\n%v", tl.ops, expectedOps)
-	}
+	return tl.ops
 }
 
 type testListener struct {
@@ -108,6 +145,21 @@ func (tl *testListener) TagDeleted(repo reference.Named, tag string) error {
 	return nil
 }
 
+func (tl *testListener) TagCreated(repo reference.Named, tag string, desc distribution.Descriptor) error {
+	tl.ops["tag:create"]++
+	return nil
+}
+
+func (tl *testListener) TagMoved(repo reference.Named, tag string, desc distribution.Descriptor, previous digest.Digest) error {
+	tl.ops["tag:move"]++
+	return nil
+}
+
+func (tl *testListener) TagRemoved(repo reference.Named, tag string, previous digest.Digest) error {
+	tl.ops["tag:remove"]++
+	return nil
+}
+
 func (tl *testListener) RepoDeleted(repo reference.Named) error {
 	tl.ops["repo:delete"]++
 	return nil
@@ -204,6 +256,14 @@ func checkExerciseRepository(t *testing.T, repository distribution.Repository, r
 		t.Fatalf("unexpected error fetching manifest: %v", err)
 	}
 
+	// tag the manifest twice, then move the tag
+	tags := repository.Tags(ctx)
+	for _, d := range []digest.Digest{dgst, dgst, blobDigests[0]} {
+		if err := tags.Tag(ctx, tag, distribution.Descriptor{Digest: d}); err != nil {
+			t.Fatalf("unexpected error tagging: %v", err)
+		}
+	}
+
 	err = manifests.Delete(ctx, dgst)
 	if err != nil {
 		t.Fatalf("unexpected error deleting blob: %v", err)
@@ -216,9 +276,12 @@ func checkExerciseRepository(t *testing.T, repository distribution.Repository, r
 		}
 	}
 
-	err = repository.Tags(ctx).Untag(ctx, m.Tag)
-	if err != nil {
-		t.Fatalf("unexpected error deleting tag: %v", err)
+	// deleting the tag again is a no-op, without tag removed event
+	for i := 0; i < 2; i++ {
+		err = repository.Tags(ctx).Untag(ctx, m.Tag)
+		if err != nil {
+			t.Fatalf("unexpected error deleting tag: %v", err)
+		}
 	}
 
 	err = remover.Remove(ctx, repository.Named())
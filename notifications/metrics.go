@@ -5,18 +5,32 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
+
+	prometheus "github.com/docker/distribution/metrics"
+	"github.com/docker/go-metrics"
+)
+
+var (
+	// queuePending, queueBacklogAge and queueDropped are the metrics of the
+	// persistent queues, by endpoint
+	queuePending    = prometheus.NotificationsNamespace.NewLabeledGauge("queue_pending", "The number of events pending in the queue of the endpoint", "", "endpoint")
+	queueBacklogAge = prometheus.NotificationsNamespace.NewLabeledGauge("queue_backlog_age", "The age of the oldest event pending in the queue of the endpoint", metrics.Seconds, "endpoint")
+	queueDropped    = prometheus.NotificationsNamespace.NewLabeledCounter("queue_dropped", "The number of events dropped from the full queue of the endpoint", "endpoint")
 )
 
 // EndpointMetrics track various actions taken by the endpoint, typically by
 // number of events. The goal of this to export it via expvar but we may find
 // some other future solution to be better.
 type EndpointMetrics struct {
-	Pending   int            // events pending in queue
-	Events    int            // total events incoming
-	Successes int            // total events written successfully
-	Failures  int            // total events failed
-	Errors    int            // total events errored
-	Statuses  map[string]int // status code histogram, per call event
+	Pending    int            // events pending in queue
+	Events     int            // total events incoming
+	Successes  int            // total events written successfully
+	Failures   int            // total events failed
+	Errors     int            // total events errored
+	Dropped    int            // total events dropped from a full persistent queue
+	BacklogAge time.Duration  // age of the oldest event pending in a persistent queue
+	Statuses   map[string]int // status code histogram, per call event
 }
 
 // safeMetrics guards the metrics implementation with a lock and provides a
@@ -24,6 +38,8 @@ type EndpointMetrics struct {
 type safeMetrics struct {
 	EndpointMetrics
 	sync.Mutex // protects statuses map
+
+	oldest time.Time // queue time of the oldest event pending, if persistent
 }
 
 // newSafeMetrics returns safeMetrics with map allocated.
@@ -48,6 +64,22 @@ func (sm *safeMetrics) eventQueueListener() eventQueueListener {
 	}
 }
 
+// sinkListener returns the listener for a sink other than http that updates
+// the relevant counters.
+func (sm *safeMetrics) sinkListener() sinkListener {
+	return &endpointMetricsHTTPStatusListener{
+		safeMetrics: sm,
+	}
+}
+
+// diskQueueListener returns a listener that maintains the counters of a
+// persistent queue.
+func (sm *safeMetrics) diskQueueListener() diskQueueListener {
+	return &endpointMetricsEventQueueListener{
+		safeMetrics: sm,
+	}
+}
+
 // endpointMetricsHTTPStatusListener increments counters related to http sinks
 // for the relevant events.
 type endpointMetricsHTTPStatusListener struct {
@@ -70,6 +102,12 @@ func (emsl *endpointMetricsHTTPStatusListener) failure(status int, events ...Eve
 	emsl.Failures += len(events)
 }
 
+func (emsl *endpointMetricsHTTPStatusListener) delivered(events ...Event) {
+	emsl.safeMetrics.Lock()
+	defer emsl.safeMetrics.Unlock()
+	emsl.Successes += len(events)
+}
+
 func (emsl *endpointMetricsHTTPStatusListener) err(err error, events ...Event) {
 	emsl.safeMetrics.Lock()
 	defer emsl.safeMetrics.Unlock()
@@ -95,6 +133,19 @@ func (eqc *endpointMetricsEventQueueListener) egress(events ...Event) {
 	eqc.Pending -= len(events)
 }
 
+func (eqc *endpointMetricsEventQueueListener) dropped(events ...Event) {
+	eqc.Lock()
+	defer eqc.Unlock()
+	eqc.Pending -= len(events)
+	eqc.Dropped += len(events)
+}
+
+func (eqc *endpointMetricsEventQueueListener) backlog(oldest time.Time) {
+	eqc.Lock()
+	defer eqc.Unlock()
+	eqc.oldest = oldest
+}
+
 // endpoints is global registry of endpoints used to report metrics to expvar
 var endpoints struct {
 	registered []*Endpoint
@@ -109,7 +160,22 @@ func register(e *Endpoint) {
 	endpoints.registered = append(endpoints.registered, e)
 }
 
+// unregister removes the endpoint from expvar once it is closed.
+func unregister(e *Endpoint) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	for i, registered := range endpoints.registered {
+		if registered == e {
+			endpoints.registered = append(endpoints.registered[:i], endpoints.registered[i+1:]...)
+			return
+		}
+	}
+}
+
 func init() {
+	metrics.Register(prometheus.NotificationsNamespace)
+
 	// NOTE(stevvooe): Setup registry metrics structure to report to expvar.
 	// Ideally, we do more metrics through logging but we need some nice
 	// realtime metrics for queue state for now.
@@ -17,7 +17,7 @@ func TestMetricsExpvar(t *testing.T) {
 		t.Fatalf("expected nil, got %#v", v)
 	}
 
-	NewEndpoint("x", "y", EndpointConfig{})
+	endpoint := NewEndpoint("x", "y", EndpointConfig{})
 
 	if err := json.Unmarshal([]byte(endpointsVar.String()), &v); err != nil {
 		t.Fatalf("unexpected error unmarshaling endpoints: %v", err)
@@ -25,4 +25,16 @@ func TestMetricsExpvar(t *testing.T) {
 	if slice, ok := v.([]interface{}); !ok || len(slice) != 1 {
 		t.Logf("expected one-element []interface{}, got %#v", v)
 	}
+
+	// closed endpoints are no longer reported
+	if err := endpoint.Close(); err != nil {
+		t.Fatalf("unexpected error closing endpoint: %v", err)
+	}
+	v = nil
+	if err := json.Unmarshal([]byte(endpointsVar.String()), &v); err != nil {
+		t.Fatalf("unexpected error unmarshaling endpoints: %v", err)
+	}
+	if v != nil {
+		t.Fatalf("expected nil, got %#v", v)
+	}
 }
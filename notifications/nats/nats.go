@@ -0,0 +1,319 @@
+// Package nats provides a notification sink publishing the events to a NATS
+// server.
+//
+// Each event is published as a message holding an envelope of the event, to
+// the configured subject followed by the components of the repository of the
+// event: the events of library/ubuntu are published to events.library.ubuntu
+// for the subject events. The events are published in order over a single
+// connection, so that subscribers receive the events of a repository in order.
+//
+// The connection may use TLS, and authenticate with a user and password or a
+// token. Other authentication methods, such as NKeys, are not supported.
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/notifications"
+)
+
+const (
+	defaultPort    = "4222"
+	defaultTimeout = 10 * time.Second
+)
+
+func init() {
+	notifications.RegisterSink("nats", New)
+}
+
+// Options are the options of a NATS sink.
+type Options struct {
+	// URL is the address of the server, such as nats://localhost:4222.
+	// Credentials may be given as its user information. The tls scheme
+	// enables TLS.
+	URL string
+
+	// Subject is the subject prefixing the subjects the events are
+	// published to.
+	Subject string
+
+	// User and Password authenticate the registry, if the server requires
+	// it, in place of those of the URL.
+	User     string
+	Password string
+
+	// Token authenticates the registry, if the server requires it.
+	Token string
+
+	// Timeout bounds the connection to the server and each write.
+	Timeout time.Duration
+
+	// TLS enables TLS with the configuration, if not nil.
+	TLS *tls.Config
+}
+
+// sink publishes events to a NATS server. The writes are serialized and each
+// one returns once the server processed all the messages.
+type sink struct {
+	Options
+	addr string
+
+	mu     sync.Mutex
+	closed bool
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// New returns a sink from the options of the configuration: url, subject,
+// user, password, token, timeout and tls.
+func New(options map[string]interface{}) (notifications.Sink, error) {
+	opts := Options{Timeout: defaultTimeout}
+	for name, v := range map[string]*string{"url": &opts.URL, "subject": &opts.Subject, "user": &opts.User, "password": &opts.Password, "token": &opts.Token} {
+		if value, ok := options[name]; ok {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("nats: the %s must be a string, %#v invalid", name, value)
+			}
+			*v = s
+		}
+	}
+	if v, ok := options["timeout"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("nats: the timeout must be a duration, %#v invalid", v)
+		}
+		timeout, err := time.ParseDuration(s)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("nats: the timeout must be a positive duration, %q invalid", s)
+		}
+		opts.Timeout = timeout
+	}
+
+	tlsConfig, err := notifications.SinkTLSConfig(options["tls"])
+	if err != nil {
+		return nil, fmt.Errorf("nats: %v", err)
+	}
+	opts.TLS = tlsConfig
+
+	return NewSink(opts)
+}
+
+// NewSink returns a sink publishing the events under the subject of the
+// options. The server is only contacted once events are written.
+func NewSink(opts Options) (notifications.Sink, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("nats: no url configured")
+	}
+	if opts.Subject == "" || strings.ContainsAny(opts.Subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("nats: invalid subject %q", opts.Subject)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+
+	rawURL := opts.URL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "nats://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("nats: invalid url %q: %v", opts.URL, err)
+	}
+	if (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		return nil, fmt.Errorf("nats: invalid url %q", opts.URL)
+	}
+	if u.Scheme == "tls" && opts.TLS == nil {
+		opts.TLS = &tls.Config{}
+	}
+
+	s := &sink{Options: opts, addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if u.User != nil && s.User == "" {
+		s.User = u.User.Username()
+		s.Password, _ = u.User.Password()
+	}
+	return s, nil
+}
+
+func (s *sink) String() string {
+	scheme := "nats"
+	if s.TLS != nil {
+		scheme = "tls"
+	}
+	return fmt.Sprintf("%s://%s/%s", scheme, s.addr, s.Subject)
+}
+
+// Write publishes the events, returning once the server processed them.
+func (s *sink) Write(events ...notifications.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return notifications.ErrSinkClosed
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := s.publish(events); err != nil {
+		s.disconnect()
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (s *sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("nats: sink already closed")
+	}
+	s.closed = true
+	s.disconnect()
+	return nil
+}
+
+func (s *sink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+	}
+}
+
+func (s *sink) publish(events []notifications.Event) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	var b strings.Builder
+	for _, event := range events {
+		payload, err := json.Marshal(notifications.Envelope{Events: []notifications.Event{event}})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "PUB %s %d\r\n%s\r\n", s.subject(event), len(payload), payload)
+	}
+	return s.flush(b.String())
+}
+
+// subject returns the subject of the event, made of the components of its
+// repository.
+func (s *sink) subject(event notifications.Event) string {
+	if event.Target.Repository == "" {
+		return s.Subject
+	}
+	return s.Subject + "." + strings.Replace(event.Target.Repository, "/", ".", -1)
+}
+
+// connect connects and authenticates to the server, upgrading the
+// connection to TLS once the server sent its INFO if TLS is enabled.
+func (s *sink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, s.Timeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+
+	if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return err
+	}
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired  bool `json:"tls_required"`
+		TLSAvailable bool `json:"tls_available"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		return fmt.Errorf("nats: invalid INFO %q: %v", strings.TrimSpace(line), err)
+	}
+
+	switch {
+	case s.TLS != nil && !info.TLSRequired && !info.TLSAvailable:
+		return fmt.Errorf("nats: the server does not support TLS")
+	case s.TLS != nil:
+		config := s.TLS.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(s.addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("nats: TLS handshake: %v", err)
+		}
+		s.conn, s.reader = tlsConn, bufio.NewReader(tlsConn)
+	case info.TLSRequired:
+		return fmt.Errorf("nats: the server requires TLS: use a tls:// url or configure the tls option")
+	}
+
+	connect, err := json.Marshal(struct {
+		Verbose     bool   `json:"verbose"`
+		Pedantic    bool   `json:"pedantic"`
+		TLSRequired bool   `json:"tls_required"`
+		Name        string `json:"name"`
+		Lang        string `json:"lang"`
+		Version     string `json:"version"`
+		User        string `json:"user,omitempty"`
+		Pass        string `json:"pass,omitempty"`
+		Token       string `json:"auth_token,omitempty"`
+	}{
+		TLSRequired: s.TLS != nil,
+		Name:        "registry",
+		Lang:        "go",
+		Version:     "1.0.0",
+		User:        s.User,
+		Pass:        s.Password,
+		Token:       s.Token,
+	})
+	if err != nil {
+		return err
+	}
+	return s.flush("CONNECT " + string(connect) + "\r\n")
+}
+
+// flush sends the commands followed by a PING and waits for the PONG, which
+// the server sends once it processed the commands.
+func (s *sink) flush(commands string) error {
+	if err := s.conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write([]byte(commands + "PING\r\n")); err != nil {
+		return err
+	}
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK and INFO updates are ignored
+	}
+}
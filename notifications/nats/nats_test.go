@@ -0,0 +1,328 @@
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/notifications"
+)
+
+func TestSink(t *testing.T) {
+	server := newTestServer(t, "secret")
+	defer server.Close()
+
+	s, err := notifications.GetSink("nats", map[string]interface{}{
+		"url":     "nats://" + server.Addr(),
+		"subject": "registry.events",
+		"token":   "secret",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	defer s.Close()
+
+	var events []notifications.Event
+	for i, repository := range []string{"library/ubuntu", "team/app", "library/ubuntu"} {
+		var event notifications.Event
+		event.ID = strconv.Itoa(i)
+		event.Target.Repository = repository
+		events = append(events, event)
+	}
+	if err := s.Write(events[:2]...); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := s.Write(events[2]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	expected := []string{"registry.events.library.ubuntu 0", "registry.events.team.app 1", "registry.events.library.ubuntu 2"}
+	var received []string
+	for _, m := range server.messages {
+		var envelope notifications.Envelope
+		if err := json.Unmarshal(m.payload, &envelope); err != nil || len(envelope.Events) != 1 {
+			t.Fatalf("unexpected message %s: %v", m.payload, err)
+		}
+		received = append(received, m.subject+" "+envelope.Events[0].ID)
+	}
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected messages %v, expected %v", received, expected)
+	}
+	if server.connections != 1 {
+		t.Fatalf("unexpected connections: %d", server.connections)
+	}
+}
+
+func TestSinkError(t *testing.T) {
+	server := newTestServer(t, "secret")
+	defer server.Close()
+
+	s, err := NewSink(Options{URL: server.Addr(), Subject: "events", Token: "wrong"})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	var event notifications.Event
+	event.Target.Repository = "library/ubuntu"
+	if err := s.Write(event); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("expected an authorization error, got %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+	if err := s.Write(event); err != notifications.ErrSinkClosed {
+		t.Fatalf("unexpected error writing after close: %v", err)
+	}
+}
+
+func TestSinkTLS(t *testing.T) {
+	config, ca, cleanup := newTestTLS(t)
+	defer cleanup()
+	server := newSecureTestServer(t, config, "registry", "secret")
+	defer server.Close()
+
+	var event notifications.Event
+	event.Target.Repository = "library/ubuntu"
+
+	plain, err := NewSink(Options{URL: server.Addr(), Subject: "events", User: "registry", Password: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	defer plain.Close()
+	if err := plain.Write(event); err == nil || !strings.Contains(err.Error(), "the server requires TLS") {
+		t.Fatalf("expected an error as TLS is required, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		options  map[string]interface{}
+		expected string
+	}{
+		{
+			name: "tls url",
+			options: map[string]interface{}{
+				"url": "tls://registry:secret@" + server.Addr(), "tls": map[interface{}]interface{}{"ca": ca},
+			},
+		},
+		{
+			name: "user option",
+			options: map[string]interface{}{
+				"url": "nats://wrong@" + server.Addr(), "user": "registry", "password": "secret", "tls": map[interface{}]interface{}{"ca": ca},
+			},
+		},
+		{
+			name:     "wrong password",
+			options:  map[string]interface{}{"url": "tls://registry:wrong@" + server.Addr(), "tls": map[interface{}]interface{}{"ca": ca}},
+			expected: "Authorization Violation",
+		},
+		{
+			name:     "unknown authority",
+			options:  map[string]interface{}{"url": "tls://registry:secret@" + server.Addr()},
+			expected: "certificate",
+		},
+	} {
+		options := map[string]interface{}{"subject": "events"}
+		for k, v := range tc.options {
+			options[k] = v
+		}
+		s, err := New(options)
+		if err != nil {
+			t.Fatalf("%s: unexpected error creating sink: %v", tc.name, err)
+		}
+		err = s.Write(event)
+		s.Close()
+		switch {
+		case tc.expected == "" && err != nil:
+			t.Errorf("%s: unexpected error writing: %v", tc.name, err)
+		case tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)):
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 2 {
+		t.Fatalf("unexpected messages: %d", len(server.messages))
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"subject": "events"},
+		{"url": "localhost"},
+		{"url": "localhost", "subject": "events.>"},
+		{"url": "http://localhost", "subject": "events"},
+		{"url": "localhost", "subject": "events", "timeout": 10},
+		{"url": "localhost", "subject": "events", "tls": "yes"},
+		{"url": "localhost", "subject": "events", "tls": map[string]interface{}{"ca": "/nonexistent"}},
+	} {
+		if _, err := New(options); err == nil {
+			t.Errorf("expected an error creating a sink with %v", options)
+		}
+	}
+
+	s, err := New(map[string]interface{}{"url": "nats-1", "subject": "events"})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	if url := fmt.Sprint(s); url != "nats://nats-1:4222/events" {
+		t.Fatalf("unexpected url %s", url)
+	}
+
+	s, err = New(map[string]interface{}{"url": "nats://nats-1", "subject": "events", "tls": true})
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	if url := fmt.Sprint(s); url != "tls://nats-1:4222/events" {
+		t.Fatalf("unexpected url %s", url)
+	}
+}
+
+// newTestTLS returns the TLS configuration of a server, with the path of the
+// file of its certificate authority.
+func newTestTLS(t *testing.T) (config *tls.Config, ca string, cleanup func()) {
+	server := httptest.NewUnstartedServer(nil)
+	server.StartTLS()
+	server.Close()
+
+	dir, err := ioutil.TempDir("", "nats-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca = filepath.Join(dir, "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, pemBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: server.TLS.Certificates}, ca, func() { os.RemoveAll(dir) }
+}
+
+// testServer is an in-process stand-in for a NATS server, serving the
+// commands of the sink.
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	token    string
+
+	// tls, if set, is required by the server, which then authenticates
+	// with user and password.
+	tls            *tls.Config
+	user, password string
+
+	mu          sync.Mutex
+	connections int
+	messages    []testMessage
+}
+
+type testMessage struct {
+	subject string
+	payload []byte
+}
+
+func newTestServer(t *testing.T, token string) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	s := &testServer{t: t, listener: listener, token: token}
+	go s.serve()
+	return s
+}
+
+// newSecureTestServer returns a server requiring TLS with the configuration
+// and authenticating with user and password.
+func newSecureTestServer(t *testing.T, config *tls.Config, user, password string) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	s := &testServer{t: t, listener: listener, tls: config, user: user, password: password}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *testServer) serveConn(conn net.Conn) {
+	defer func() { conn.Close() }()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"auth_required\":true,\"tls_required\":%t}\r\n", s.tls != nil)
+	if s.tls != nil {
+		conn = tls.Server(conn, s.tls)
+	}
+
+	r := bufio.NewReader(conn)
+	authorized := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch op := strings.ToUpper(fields[0]); {
+		case op == "CONNECT":
+			var options struct {
+				Token string `json:"auth_token"`
+				User  string `json:"user"`
+				Pass  string `json:"pass"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), fields[0])), &options); err != nil {
+				s.t.Errorf("invalid CONNECT %q: %v", line, err)
+			}
+			if options.Token != s.token || options.User != s.user || options.Pass != s.password {
+				fmt.Fprintf(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+			authorized = true
+		case op == "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case op == "PUB" && authorized && len(fields) == 3:
+			n, _ := strconv.Atoi(fields[2])
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, testMessage{subject: fields[1], payload: payload[:n]})
+			s.mu.Unlock()
+		default:
+			fmt.Fprintf(conn, "-ERR 'Unknown Protocol Operation'\r\n")
+			return
+		}
+	}
+}
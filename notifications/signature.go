@@ -0,0 +1,98 @@
+package notifications
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampHeader is the header of the time, in seconds since the Unix
+	// epoch, at which a signed notification request was sent.
+	TimestampHeader = "Docker-Distribution-Timestamp"
+
+	// SignatureHeader is the header of the signatures of a notification
+	// request, one per secret of the endpoint, separated by commas. Each is
+	// the hex encoded HMAC-SHA256 of the timestamp, a dot and the body,
+	// prefixed by "sha256=".
+	SignatureHeader = "Docker-Distribution-Signature"
+
+	// DefaultSignatureTolerance is the age after which receivers should
+	// reject signed requests, so that they may not be replayed.
+	DefaultSignatureTolerance = 5 * time.Minute
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	// ErrSignatureMissing is returned when a request is not signed.
+	ErrSignatureMissing = errors.New("notifications: request not signed")
+
+	// ErrSignatureInvalid is returned when no signature of a request matches
+	// the secrets.
+	ErrSignatureInvalid = errors.New("notifications: invalid signature")
+
+	// ErrSignatureExpired is returned when a request was signed too long ago,
+	// or in the future.
+	ErrSignatureExpired = errors.New("notifications: signature expired")
+)
+
+// signRequest sets the signature headers of the request with the body, one
+// signature per secret.
+func signRequest(header http.Header, body []byte, secrets []string, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signatures := make([]string, len(secrets))
+	for i, secret := range secrets {
+		signatures[i] = signaturePrefix + hex.EncodeToString(signature(secret, timestamp, body))
+	}
+	header.Set(TimestampHeader, timestamp)
+	header.Set(SignatureHeader, strings.Join(signatures, ","))
+}
+
+func signature(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// VerifySignature verifies that the body of a notification request received
+// with header was signed with one of secrets, at most tolerance ago. Listing
+// both the previous and the new secret of an endpoint while it is rotated
+// accepts the requests signed with either of them.
+func VerifySignature(header http.Header, body []byte, secrets []string, tolerance time.Duration) error {
+	timestamp := header.Get(TimestampHeader)
+	signatures := header.Get(SignatureHeader)
+	if timestamp == "" || signatures == "" {
+		return ErrSignatureMissing
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+
+	for _, secret := range secrets {
+		expected := signature(secret, timestamp, body)
+		for _, s := range strings.Split(signatures, ",") {
+			s = strings.TrimSpace(s)
+			if !strings.HasPrefix(s, signaturePrefix) {
+				continue
+			}
+			actual, err := hex.DecodeString(strings.TrimPrefix(s, signaturePrefix))
+			if err == nil && hmac.Equal(actual, expected) {
+				return nil
+			}
+		}
+	}
+	return ErrSignatureInvalid
+}
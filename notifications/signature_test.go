@@ -0,0 +1,108 @@
+package notifications
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedHTTPSink(t *testing.T) {
+	var verified []error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("unexpected error reading body: %v", err)
+		}
+		// the receiver rotates from old to new
+		err = VerifySignature(r.Header, body, []string{"new", "old"}, DefaultSignatureTolerance)
+		verified = append(verified, err)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		secrets  []string
+		expected error
+	}{
+		{secrets: []string{"old"}},
+		{secrets: []string{"old", "new"}},
+		{secrets: []string{"new"}},
+		{secrets: []string{"other"}, expected: ErrSignatureInvalid},
+		{expected: ErrSignatureMissing},
+	} {
+		verified = nil
+		sink := newHTTPSink(server.URL, 0, nil, nil)
+		sink.secrets = tc.secrets
+		err := sink.Write(createTestEvent("push", "library/test", "manifest"))
+		if (err == nil) != (tc.expected == nil) {
+			t.Fatalf("unexpected error writing with secrets %v: %v", tc.secrets, err)
+		}
+		if len(verified) != 1 || verified[0] != tc.expected {
+			t.Fatalf("unexpected verification with secrets %v: %v, expected %v", tc.secrets, verified, tc.expected)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"events":[]}`)
+	secrets := []string{"secret"}
+
+	for _, tc := range []struct {
+		name     string
+		header   func(h http.Header)
+		body     []byte
+		expected error
+	}{
+		{name: "valid", header: func(h http.Header) {}},
+		{
+			name:     "tampered body",
+			header:   func(h http.Header) {},
+			body:     []byte(`{"events":[{}]}`),
+			expected: ErrSignatureInvalid,
+		},
+		{
+			name: "tampered timestamp",
+			header: func(h http.Header) {
+				h.Set(TimestampHeader, h.Get(TimestampHeader)+"0")
+			},
+			expected: ErrSignatureExpired,
+		},
+		{
+			name: "replayed",
+			header: func(h http.Header) {
+				signRequest(h, body, secrets, time.Now().Add(-10*time.Minute))
+			},
+			expected: ErrSignatureExpired,
+		},
+		{
+			name: "malformed signature",
+			header: func(h http.Header) {
+				h.Set(SignatureHeader, strings.TrimPrefix(h.Get(SignatureHeader), signaturePrefix))
+			},
+			expected: ErrSignatureInvalid,
+		},
+		{
+			name: "unsigned",
+			header: func(h http.Header) {
+				h.Del(SignatureHeader)
+			},
+			expected: ErrSignatureMissing,
+		},
+	} {
+		header := make(http.Header)
+		signRequest(header, body, secrets, time.Now())
+		tc.header(header)
+		received := body
+		if tc.body != nil {
+			received = tc.body
+		}
+		if err := VerifySignature(header, received, secrets, DefaultSignatureTolerance); err != tc.expected {
+			t.Errorf("%s: unexpected error %v, expected %v", tc.name, err, tc.expected)
+		}
+	}
+}
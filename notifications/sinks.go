@@ -210,6 +210,33 @@ func (eq *eventQueue) next() []Event {
 	return block
 }
 
+// sinkListener is called on the results of writes to a sink.
+type sinkListener interface {
+	delivered(events ...Event)
+	err(err error, events ...Event)
+}
+
+// listenedSink reports the results of the writes to a sink to a listener.
+type listenedSink struct {
+	Sink
+	listener sinkListener
+}
+
+func (ls *listenedSink) Write(events ...Event) error {
+	if err := ls.Sink.Write(events...); err != nil {
+		if err != ErrSinkClosed {
+			ls.listener.err(err, events...)
+		}
+		return err
+	}
+	ls.listener.delivered(events...)
+	return nil
+}
+
+func (ls *listenedSink) String() string {
+	return fmt.Sprint(ls.Sink)
+}
+
 // ignoredSink discards events with ignored target media types and actions.
 // passes the rest along.
 type ignoredSink struct {
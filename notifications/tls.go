@@ -0,0 +1,78 @@
+package notifications
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// SinkTLSConfig returns the TLS configuration of the tls option of a sink,
+// nil if TLS is not enabled. The option is either a boolean, enabling TLS
+// with the system certificate authorities, or a map of the files of the
+// certificate authorities, ca, and of the client certificate and key,
+// certificate and key, along with insecureskipverify.
+func SinkTLSConfig(option interface{}) (*tls.Config, error) {
+	var options map[string]interface{}
+	switch v := option.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !v {
+			return nil, nil
+		}
+		return &tls.Config{}, nil
+	case map[string]interface{}:
+		options = v
+	case map[interface{}]interface{}:
+		options = make(map[string]interface{}, len(v))
+		for key, value := range v {
+			options[fmt.Sprint(key)] = value
+		}
+	default:
+		return nil, fmt.Errorf("the tls option must be a boolean or a map, %#v invalid", option)
+	}
+
+	var files struct{ ca, certificate, key string }
+	for name, v := range map[string]*string{"ca": &files.ca, "certificate": &files.certificate, "key": &files.key} {
+		if value, ok := options[name]; ok {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("the tls %s must be the path of a file, %#v invalid", name, value)
+			}
+			*v = s
+		}
+	}
+
+	config := &tls.Config{}
+	if v, ok := options["insecureskipverify"]; ok {
+		skip, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("the tls insecureskipverify must be a boolean, %#v invalid", v)
+		}
+		config.InsecureSkipVerify = skip
+	}
+
+	if files.ca != "" {
+		pem, err := ioutil.ReadFile(files.ca)
+		if err != nil {
+			return nil, fmt.Errorf("reading the tls ca: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the tls ca %s", files.ca)
+		}
+	}
+
+	if (files.certificate == "") != (files.key == "") {
+		return nil, fmt.Errorf("the tls certificate and key must be configured together")
+	}
+	if files.certificate != "" {
+		certificate, err := tls.LoadX509KeyPair(files.certificate, files.key)
+		if err != nil {
+			return nil, fmt.Errorf("loading the tls certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
@@ -52,6 +52,38 @@ var (
 		HTTPStatusCode: http.StatusBadRequest,
 	})
 
+	// ErrorCodePaginationNumberInvalid is returned when the n parameter of a
+	// paginated list is not a number or is negative.
+	ErrorCodePaginationNumberInvalid = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "PAGINATION_NUMBER_INVALID",
+		Message: "invalid number of results requested",
+		Description: `Returned when the "n" parameter (number of results
+		to return) is not an integer, or "n" is negative.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	// ErrorCodeTagImmutable is returned when a manifest push or deletion
+	// would move or remove an immutable tag.
+	ErrorCodeTagImmutable = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "TAG_IMMUTABLE",
+		Message: "tag is immutable",
+		Description: `The registry policy does not allow the tag to be
+		moved to another manifest or removed once it exists. Pushing the
+		manifest the tag already references is allowed.`,
+		HTTPStatusCode: http.StatusConflict,
+	})
+
+	// ErrorCodeQuotaExceeded is returned when a blob upload or manifest
+	// push would take a repository or its namespace over its quota.
+	ErrorCodeQuotaExceeded = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "QUOTA_EXCEEDED",
+		Message: "storage quota exceeded",
+		Description: `Storing the content would take the repository, or
+		the namespace containing it, over the number of bytes or tags the
+		registry policy allows. Deleting content releases quota.`,
+		HTTPStatusCode: http.StatusForbidden,
+	})
+
 	// ErrorCodeNameUnknown when the repository name is not known.
 	ErrorCodeNameUnknown = errcode.Register(errGroup, errcode.ErrorDescriptor{
 		Value:   "NAME_UNKNOWN",
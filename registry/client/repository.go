@@ -192,6 +192,9 @@ func (r *repository) Tags(ctx context.Context) distribution.TagService {
 	}
 }
 
+// lookupPageSize is the number of tags listed per request by Lookup.
+const lookupPageSize = 100
+
 // tags implements remote tagging operations.
 type tags struct {
 	client *http.Client
@@ -250,6 +253,47 @@ func (t *tags) All(ctx context.Context) ([]string, error) {
 	}
 }
 
+// List fills tags with the tags following last, returning the number of tags
+// filled along with io.EOF if there are no more tags.
+func (t *tags) List(ctx context.Context, tags []string, last string) (int, error) {
+	var numFilled int
+	var returnErr error
+
+	values := buildCatalogValues(len(tags), last)
+	u, err := t.ub.BuildTagsURL(t.name, values)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := t.client.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if SuccessStatus(resp.StatusCode) {
+		var tagsResponse struct {
+			Tags []string `json:"tags"`
+		}
+		decoder := json.NewDecoder(resp.Body)
+
+		if err := decoder.Decode(&tagsResponse); err != nil {
+			return 0, err
+		}
+
+		numFilled = copy(tags, tagsResponse.Tags)
+
+		link := resp.Header.Get("Link")
+		if link == "" {
+			returnErr = io.EOF
+		}
+	} else {
+		return 0, HandleErrorResponse(resp)
+	}
+
+	return numFilled, returnErr
+}
+
 func descriptorFromResponse(response *http.Response) (distribution.Descriptor, error) {
 	desc := distribution.Descriptor{}
 	headers := response.Header
@@ -347,16 +391,125 @@ func (t *tags) Get(ctx context.Context, tag string) (distribution.Descriptor, er
 	}
 }
 
+// Lookup scans the tags of the repository a page at a time, issuing a HEAD
+// request for each of them to find those referencing the given digest.
 func (t *tags) Lookup(ctx context.Context, digest distribution.Descriptor) ([]string, error) {
-	panic("not implemented")
+	var found []string
+
+	page := make([]string, lookupPageSize)
+	last := ""
+	for {
+		n, err := t.List(ctx, page, last)
+		if err != nil && err != io.EOF {
+			return found, err
+		}
+
+		for _, tag := range page[:n] {
+			desc, err := t.Get(ctx, tag)
+			if err != nil {
+				return found, err
+			}
+			if desc.Digest == digest.Digest {
+				found = append(found, tag)
+			}
+		}
+
+		if err == io.EOF || n == 0 {
+			return found, nil
+		}
+		last = page[n-1]
+	}
 }
 
+// Tag points the tag at the manifest described by desc by fetching the
+// manifest and putting it again under the tag.
 func (t *tags) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
-	panic("not implemented")
+	ref, err := reference.WithDigest(t.name, desc.Digest)
+	if err != nil {
+		return err
+	}
+	u, err := t.ub.BuildManifestURL(ref)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	for _, mediaType := range distribution.ManifestMediaTypes() {
+		req.Header.Add("Accept", mediaType)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !SuccessStatus(resp.StatusCode) {
+		return HandleErrorResponse(resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	tagRef, err := reference.WithTag(t.name, tag)
+	if err != nil {
+		return err
+	}
+	u, err = t.ub.BuildManifestURL(tagRef)
+	if err != nil {
+		return err
+	}
+
+	putRequest, err := http.NewRequest("PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	putRequest.Header.Set("Content-Type", resp.Header.Get("Content-Type"))
+
+	putResp, err := t.client.Do(putRequest)
+	if err != nil {
+		return err
+	}
+	defer putResp.Body.Close()
+
+	if SuccessStatus(putResp.StatusCode) {
+		return nil
+	}
+	return HandleErrorResponse(putResp)
 }
 
+// Untag removes the tag from the repository, leaving the manifest it
+// references in place.
 func (t *tags) Untag(ctx context.Context, tag string) error {
-	panic("not implemented")
+	ref, err := reference.WithTag(t.name, tag)
+	if err != nil {
+		return err
+	}
+	u, err := t.ub.BuildManifestURL(ref)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if SuccessStatus(resp.StatusCode) {
+		return nil
+	}
+	return HandleErrorResponse(resp)
 }
 
 type manifests struct {
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"fmt"
+	"os"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(DriverTestCmd)
+	DriverTestCmd.Flags().StringVarP(&reportFormat, "format", "f", "junit", "format of the report, junit or json")
+	DriverTestCmd.Flags().StringVarP(&reportFile, "output", "o", "", "write the report to this file rather than to the standard output")
+	DriverTestCmd.Flags().StringVar(&testFilter, "run", "", "run only the tests matching this regular expression")
+	DriverTestCmd.Flags().BoolVar(&shortTests, "short", false, "skip or shorten the long running tests, such as the ones writing 5GB files")
+}
+
+var reportFormat string
+var reportFile string
+var testFilter string
+var shortTests bool
+
+// DriverTestCmd is the cobra command that corresponds to the driver-test
+// subcommand
+var DriverTestCmd = &cobra.Command{
+	Use:   "driver-test <config>",
+	Short: "`driver-test` runs the storage driver conformance tests against the configured driver",
+	Long: "`driver-test` runs the storage driver conformance tests against the storage driver selected by the configuration, " +
+		"which must point to an empty location, and reports the results in the JUnit or JSON format",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if reportFormat != "junit" && reportFormat != "json" {
+			fmt.Fprintf(os.Stderr, "unknown report format: %s\n", reportFormat)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driverType := config.Storage.Type()
+		newDriver := func() (storagedriver.StorageDriver, error) {
+			return factory.Create(driverType, config.Storage.Parameters())
+		}
+
+		// the tests expect an empty driver, and clean up after themselves
+		// by deleting the paths they wrote
+		driver, err := newDriver()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", driverType, err)
+			os.Exit(1)
+		}
+		if children, err := driver.List(ctx, "/"); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				fmt.Fprintf(os.Stderr, "failed to list the %s driver root: %v", driverType, err)
+				os.Exit(1)
+			}
+		} else if len(children) > 0 {
+			fmt.Fprintf(os.Stderr, "the %s driver root is not empty, point the configuration to an empty location", driverType)
+			os.Exit(1)
+		}
+
+		results, err := testsuites.Run(newDriver, testsuites.RunOptions{
+			Filter: testFilter,
+			Short:  shortTests,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run the driver tests: %v", err)
+			os.Exit(1)
+		}
+		report := testsuites.NewReport(driverType, results)
+
+		out := os.Stdout
+		if reportFile != "" {
+			if out, err = os.Create(reportFile); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to create the report: %v", err)
+				os.Exit(1)
+			}
+		}
+		if reportFormat == "json" {
+			err = report.WriteJSON(out)
+		} else {
+			err = report.WriteJUnit(out)
+		}
+		if err == nil {
+			err = out.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write the report: %v", err)
+			os.Exit(1)
+		}
+
+		fmt.Fprintf(os.Stderr, "%s: %d tests, %d failed, %d skipped\n", driverType, report.Tests, report.Failures, report.Skipped)
+		if !report.Passed() {
+			os.Exit(1)
+		}
+	},
+}
@@ -196,6 +196,123 @@ func TestCatalogAPI(t *testing.T) {
 	}
 }
 
+func TestTagsAPIPagination(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/tagspagination")
+	tags := []string{"1.0", "1.1", "latest", "v2", "v2.1"}
+	for _, tag := range []string{"v2", "1.1", "latest", "v2.1", "1.0"} {
+		createRepository(env, t, imageName.Name(), tag)
+	}
+
+	tagsURL, err := env.builder.BuildTagsURL(imageName, url.Values{"n": []string{"2"}})
+	if err != nil {
+		t.Fatalf("unexpected error building tags url: %v", err)
+	}
+
+	var pages [][]string
+	for tagsURL != "" {
+		resp, err := http.Get(tagsURL)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		checkResponse(t, "listing tags", resp, http.StatusOK)
+
+		var tagsResponse tagsAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tagsResponse); err != nil {
+			t.Fatalf("unexpected error decoding tags: %v", err)
+		}
+		pages = append(pages, tagsResponse.Tags)
+
+		tagsURL = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			matches := regexp.MustCompile("<(/v2/foo/tagspagination/tags/list.*)>; rel=\"next\"").FindStringSubmatch(link)
+			if len(matches) != 2 {
+				t.Fatalf("unexpected link header: %q", link)
+			}
+			linkURL, _ := url.Parse(matches[1])
+			if linkURL.Query().Get("last") != tagsResponse.Tags[len(tagsResponse.Tags)-1] {
+				t.Fatalf("unexpected last entry in link header: %q", link)
+			}
+
+			base, _ := url.Parse(env.server.URL)
+			tagsURL = base.ResolveReference(linkURL).String()
+		}
+	}
+
+	expected := [][]string{tags[0:2], tags[2:4], tags[4:]}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("unexpected pages: %v != %v", pages, expected)
+	}
+
+	// without n, all the tags after last are returned
+	for _, tc := range []struct {
+		query    url.Values
+		expected []string
+	}{
+		{query: url.Values{}, expected: tags},
+		{query: url.Values{"last": []string{"latest"}}, expected: tags[3:]},
+	} {
+		tagsURL, err = env.builder.BuildTagsURL(imageName, tc.query)
+		if err != nil {
+			t.Fatalf("unexpected error building tags url: %v", err)
+		}
+		resp, err := http.Get(tagsURL)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		checkResponse(t, "listing tags", resp, http.StatusOK)
+
+		var tagsResponse tagsAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tagsResponse); err != nil {
+			t.Fatalf("unexpected error decoding tags: %v", err)
+		}
+		if !reflect.DeepEqual(tagsResponse.Tags, tc.expected) || resp.Header.Get("Link") != "" {
+			t.Fatalf("unexpected tags with %v: %v", tc.query, tagsResponse.Tags)
+		}
+	}
+
+	// an invalid n is rejected
+	for _, n := range []string{"", "-1", "ten"} {
+		tagsURL, err = env.builder.BuildTagsURL(imageName, url.Values{"n": []string{n}})
+		if err != nil {
+			t.Fatalf("unexpected error building tags url: %v", err)
+		}
+		resp, err := http.Get(tagsURL)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, "listing tags with n="+n, resp, http.StatusBadRequest)
+		checkBodyHasErrorCodes(t, "listing tags with n="+n, resp, v2.ErrorCodePaginationNumberInvalid)
+	}
+
+	// a large n is reduced to the maximum
+	tagsURL, err = env.builder.BuildTagsURL(imageName, url.Values{"n": []string{"1000000000000"}})
+	if err != nil {
+		t.Fatalf("unexpected error building tags url: %v", err)
+	}
+	resp, err := http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "listing tags with a large n", resp, http.StatusOK)
+
+	var tagsResponse tagsAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tagsResponse); err != nil {
+		t.Fatalf("unexpected error decoding tags: %v", err)
+	}
+	if !reflect.DeepEqual(tagsResponse.Tags, tags) || resp.Header.Get("Link") != "" {
+		t.Fatalf("unexpected tags with a large n: %v", tagsResponse.Tags)
+	}
+}
+
 func checkLink(t *testing.T, urlStr string, numEntries int, last string) url.Values {
 	re := regexp.MustCompile("<(/v2/_catalog.*)>; rel=\"next\"")
 	matches := re.FindStringSubmatch(urlStr)
@@ -747,20 +864,32 @@ func TestDeleteReadOnly(t *testing.T) {
 	uploadURLBase, _ := startPushLayer(t, env, imageName)
 	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
 
-	env.app.readOnly = true
+	env.app.SetReadOnly(true)
 
 	resp, err := httpDelete(layerURL)
 	if err != nil {
 		t.Fatalf("unexpected error deleting layer: %v", err)
 	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "deleting layer in read-only mode", resp, http.StatusServiceUnavailable)
+	checkHeaders(t, resp, http.Header{"Retry-After": []string{"60"}})
+	checkBodyHasErrorCodes(t, "deleting layer in read-only mode", resp, errcode.ErrorCodeUnavailable)
+
+	// the layer can still be pulled
+	resp, err = http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+	defer resp.Body.Close()
 
-	checkResponse(t, "deleting layer in read-only mode", resp, http.StatusMethodNotAllowed)
+	checkResponse(t, "fetching layer in read-only mode", resp, http.StatusOK)
 }
 
 func TestStartPushReadOnly(t *testing.T) {
 	env := newTestEnv(t, true)
 	defer env.Shutdown()
-	env.app.readOnly = true
+	env.app.SetReadOnly(true)
 
 	imageName, _ := reference.WithName("foo/bar")
 
@@ -775,7 +904,13 @@ func TestStartPushReadOnly(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "starting push in read-only mode", resp, http.StatusMethodNotAllowed)
+	checkResponse(t, "starting push in read-only mode", resp, http.StatusServiceUnavailable)
+	checkHeaders(t, resp, http.Header{"Retry-After": []string{"60"}})
+	checkBodyHasErrorCodes(t, "starting push in read-only mode", resp, errcode.ErrorCodeUnavailable)
+
+	// pushes start again once the registry is writable
+	env.app.SetReadOnly(false)
+	startPushLayer(t, env, imageName)
 }
 
 func httpDelete(url string) (*http.Response, error) {
@@ -2594,3 +2729,283 @@ func TestProxyManifestGetByTag(t *testing.T) {
 		"Docker-Content-Digest": []string{newDigest.String()},
 	})
 }
+
+func TestProxyMultipleUpstreams(t *testing.T) {
+	truthConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	truthConfig.Compatibility.Schema1.Enabled = true
+	truthConfig.HTTP.Headers = headerConfig
+
+	imageName, _ := reference.WithName("foo/bar")
+	tag := "latest"
+
+	digests := make(map[string]digest.Digest)
+	var upstreams []configuration.ProxyUpstream
+	for _, prefix := range []string{"one", "two"} {
+		truthEnv := newTestEnvWithConfig(t, &truthConfig)
+		defer truthEnv.Shutdown()
+
+		digests[prefix] = createRepository(truthEnv, t, imageName.Name(), tag)
+		upstreams = append(upstreams, configuration.ProxyUpstream{
+			Prefix:    prefix,
+			RemoteURL: truthEnv.server.URL,
+		})
+	}
+
+	proxyConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			Upstreams: upstreams,
+		},
+	}
+	proxyConfig.Compatibility.Schema1.Enabled = true
+	proxyConfig.HTTP.Headers = headerConfig
+
+	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+	defer proxyEnv.Shutdown()
+
+	for prefix, dgst := range digests {
+		name, _ := reference.WithName(prefix + "/" + imageName.Name())
+		tagRef, _ := reference.WithTag(name, tag)
+		manifestTagURL, err := proxyEnv.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+
+		resp, err := http.Get(manifestTagURL)
+		checkErr(t, err, "fetching manifest from proxy by tag")
+		defer resp.Body.Close()
+		checkResponse(t, "fetching manifest from proxy by tag", resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Docker-Content-Digest": []string{dgst.String()},
+		})
+	}
+
+	// repositories outside of the upstream prefixes are unknown
+	name, _ := reference.WithName("three/" + imageName.Name())
+	tagRef, _ := reference.WithTag(name, tag)
+	manifestTagURL, err := proxyEnv.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	resp, err := http.Get(manifestTagURL)
+	checkErr(t, err, "fetching manifest from proxy by tag")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest of unknown upstream", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching manifest of unknown upstream", resp, v2.ErrorCodeNameUnknown)
+}
+
+func TestProxyPushThrough(t *testing.T) {
+	truthConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	truthConfig.Compatibility.Schema1.Enabled = true
+	truthConfig.HTTP.Headers = headerConfig
+
+	truthEnv := newTestEnvWithConfig(t, &truthConfig)
+	defer truthEnv.Shutdown()
+	remoteDigest := createRepository(truthEnv, t, "foo/bar", "latest")
+
+	proxyConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			Upstreams: []configuration.ProxyUpstream{
+				{Prefix: "mirror", RemoteURL: truthEnv.server.URL},
+			},
+			PushThrough: true,
+		},
+	}
+	proxyConfig.Compatibility.Schema1.Enabled = true
+	proxyConfig.HTTP.Headers = headerConfig
+
+	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+	defer proxyEnv.Shutdown()
+
+	// repositories outside of the upstreams accept pushes
+	localName, _ := reference.WithName("private/app")
+	localDigest := createRepository(proxyEnv, t, localName.Name(), "latest")
+
+	mirrorName, _ := reference.WithName("mirror/foo/bar")
+	for name, dgst := range map[reference.Named]digest.Digest{
+		localName:  localDigest,
+		mirrorName: remoteDigest,
+	} {
+		tagRef, _ := reference.WithTag(name, "latest")
+		manifestURL, err := proxyEnv.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+
+		resp, err := http.Get(manifestURL)
+		checkErr(t, err, "fetching manifest")
+		defer resp.Body.Close()
+		checkResponse(t, "fetching manifest", resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Docker-Content-Digest": []string{dgst.String()},
+		})
+	}
+
+	// upstream namespaces remain read-only
+	uploadURL, err := proxyEnv.builder.BuildBlobUploadURL(mirrorName)
+	checkErr(t, err, "building upload url")
+
+	resp, err := http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload to mirrored repository")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload to mirrored repository", resp, http.StatusMethodNotAllowed)
+}
+
+func TestImmutableTags(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"delete":     configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	config.Policy.Immutability.Rules = []configuration.ImmutabilityRule{
+		{Repositories: []string{"foo/*"}, Tags: []string{"^v[0-9]"}},
+	}
+
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	releaseDigest := createRepository(env, t, imageName.Name(), "v1")
+	createRepository(env, t, imageName.Name(), "latest")
+
+	manifestURL := func(tag string) string {
+		ref, _ := reference.WithTag(imageName, tag)
+		u, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest url")
+		return u
+	}
+
+	fetchManifest := func(tag string) *schema1.SignedManifest {
+		resp, err := http.Get(manifestURL(tag))
+		checkErr(t, err, "fetching manifest")
+		defer resp.Body.Close()
+		checkResponse(t, "fetching manifest", resp, http.StatusOK)
+
+		var sm schema1.SignedManifest
+		if err := json.NewDecoder(resp.Body).Decode(&sm); err != nil {
+			t.Fatalf("error decoding fetched manifest: %v", err)
+		}
+		return &sm
+	}
+	release := fetchManifest("v1")
+	latest := fetchManifest("latest")
+
+	// pushing the manifest an immutable tag references is allowed
+	resp := putManifest(t, "putting same manifest", manifestURL("v1"), "", release)
+	checkResponse(t, "putting same manifest", resp, http.StatusCreated)
+
+	// moving it is not
+	resp = putManifest(t, "moving immutable tag", manifestURL("v1"), "", latest)
+	checkResponse(t, "moving immutable tag", resp, http.StatusConflict)
+	checkBodyHasErrorCodes(t, "moving immutable tag", resp, v2.ErrorCodeTagImmutable)
+
+	// new tags matching the rule can still be created, and other tags moved
+	resp = putManifest(t, "creating new immutable tag", manifestURL("v2"), "", latest)
+	checkResponse(t, "creating new immutable tag", resp, http.StatusCreated)
+	resp = putManifest(t, "moving mutable tag", manifestURL("latest"), "", release)
+	checkResponse(t, "moving mutable tag", resp, http.StatusCreated)
+
+	resp, err := httpDelete(manifestURL("v1"))
+	checkErr(t, err, "deleting immutable tag")
+	checkResponse(t, "deleting immutable tag", resp, http.StatusConflict)
+	checkBodyHasErrorCodes(t, "deleting immutable tag", resp, v2.ErrorCodeTagImmutable)
+
+	// deleting the manifest would remove its immutable tags
+	digestRef, _ := reference.WithDigest(imageName, releaseDigest)
+	digestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = httpDelete(digestURL)
+	checkErr(t, err, "deleting manifest")
+	checkResponse(t, "deleting manifest with immutable tag", resp, http.StatusConflict)
+	checkBodyHasErrorCodes(t, "deleting manifest with immutable tag", resp, v2.ErrorCodeTagImmutable)
+
+	resp, err = http.Get(manifestURL("v1"))
+	checkErr(t, err, "fetching manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching immutable tag", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{releaseDigest.String()},
+	})
+
+	resp, err = httpDelete(manifestURL("latest"))
+	checkErr(t, err, "deleting mutable tag")
+	checkResponse(t, "deleting mutable tag", resp, http.StatusAccepted)
+}
+
+func TestQuotas(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	config.Policy.Quota.Repositories = []configuration.QuotaRule{
+		{Names: []string{"foo/*"}, Tags: 1},
+	}
+	config.Policy.Quota.Namespaces = []configuration.QuotaRule{
+		{Names: []string{"small"}, Size: 1},
+	}
+
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	createRepository(env, t, imageName.Name(), "v1")
+
+	ref, _ := reference.WithTag(imageName, "v1")
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Get(manifestURL)
+	checkErr(t, err, "fetching manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest", resp, http.StatusOK)
+	var sm schema1.SignedManifest
+	if err := json.NewDecoder(resp.Body).Decode(&sm); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	// pushing the same tag again does not create a new tag
+	resp = putManifest(t, "putting same tag", manifestURL, "", &sm)
+	checkResponse(t, "putting same tag", resp, http.StatusCreated)
+
+	ref, _ = reference.WithTag(imageName, "v2")
+	manifestURL, err = env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest url")
+	resp = putManifest(t, "putting tag over quota", manifestURL, "", &sm)
+	checkResponse(t, "putting tag over quota", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "putting tag over quota", resp, v2.ErrorCodeQuotaExceeded)
+
+	// the namespace quota is too small for any layer
+	smallName, _ := reference.WithName("small/app")
+	layer, dgst, err := testutil.CreateRandomTarFile()
+	checkErr(t, err, "creating random layer")
+	uploadURLBase, _ := startPushLayer(t, env, smallName)
+	resp, err = doPushLayer(t, env.builder, smallName, dgst, uploadURLBase, layer)
+	checkErr(t, err, "pushing layer")
+	checkResponse(t, "pushing layer over quota", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "pushing layer over quota", resp, v2.ErrorCodeQuotaExceeded)
+}
@@ -10,9 +10,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/distribution"
@@ -29,6 +31,7 @@ import (
 	registrymiddleware "github.com/docker/distribution/registry/middleware/registry"
 	repositorymiddleware "github.com/docker/distribution/registry/middleware/repository"
 	"github.com/docker/distribution/registry/proxy"
+	"github.com/docker/distribution/registry/replication"
 	"github.com/docker/distribution/registry/storage"
 	memorycache "github.com/docker/distribution/registry/storage/cache/memory"
 	rediscache "github.com/docker/distribution/registry/storage/cache/redis"
@@ -58,11 +61,15 @@ type App struct {
 
 	Config *configuration.Configuration
 
-	router           *mux.Router                    // main application router, configured with dispatchers
-	driver           storagedriver.StorageDriver    // driver maintains the app global storage driver instance.
-	registry         distribution.Namespace         // registry is the primary registry backend for the app instance.
-	repoRemover      distribution.RepositoryRemover // repoRemover provides ability to delete repos
-	accessController auth.AccessController          // main access controller for application
+	router      *mux.Router                    // main application router, configured with dispatchers
+	driver      storagedriver.StorageDriver    // driver maintains the app global storage driver instance.
+	registry    distribution.Namespace         // registry is the primary registry backend for the app instance.
+	repoRemover distribution.RepositoryRemover // repoRemover provides ability to delete repos
+
+	// mu guards the fields replaced when the configuration is reloaded
+	mu                   sync.RWMutex
+	accessController     auth.AccessController      // main access controller for application
+	repositoryMiddleware []configuration.Middleware // repository middleware applied to each request
 
 	// httpHost is a parsed representation of the http.host parameter from
 	// the configuration. Only the Scheme and Host fields are used.
@@ -72,8 +79,29 @@ type App struct {
 	events struct {
 		sink   notifications.Sink
 		source notifications.SourceRecord
+
+		// endpoints is the sink of the configured endpoints, replaced
+		// when the configuration is reloaded
+		endpoints       *endpointSink
+		endpointsConfig configuration.Notifications
 	}
 
+	// logHooks are the hooks of the log configuration
+	logHooks *logHooks
+
+	// healthRegistry is where the checks of the health configuration are
+	// registered, by the names in healthChecks
+	healthRegistry *health.Registry
+	healthChecks   []string
+	healthConfig   configuration.Health
+
+	// replicator copies pushed content to other registries, if configured
+	replicator *replication.Replicator
+
+	// storageCheckers are the storage middlewares reporting their health,
+	// such as the circuit breaker of the retry middleware, by name
+	storageCheckers map[string]health.Checker
+
 	redis *redis.Pool
 
 	// trustKey is a deprecated key used to sign manifests converted to
@@ -84,8 +112,16 @@ type App struct {
 	// isCache is true if this registry is configured as a pull through cache
 	isCache bool
 
-	// readOnly is true if the registry is in a read-only maintenance mode
-	readOnly bool
+	// readOnly is the read-only maintenance mode, which may be switched at
+	// runtime
+	readOnly readOnlyMode
+
+	// deleteEnabled is true if manifests and tags may be deleted
+	deleteEnabled bool
+
+	// immutableTags reports whether a tag may not be moved or removed, nil
+	// if no tags are immutable
+	immutableTags storage.TagImmutabilityFunc
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -96,7 +132,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		Config:  config,
 		Context: ctx,
 		router:  v2.RouterWithPrefix(config.HTTP.Prefix),
-		isCache: config.Proxy.RemoteURL != "",
+		isCache: config.Proxy.Enabled(),
 	}
 
 	// Register the handler dispatchers.
@@ -111,9 +147,9 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
 
 	// override the storage driver's UA string for registry outbound HTTP requests
-	storageParams := config.Storage.Parameters()
-	if storageParams == nil {
-		storageParams = make(configuration.Parameters)
+	storageParams := make(configuration.Parameters)
+	for k, v := range config.Storage.Parameters() {
+		storageParams[k] = v
 	}
 	storageParams["useragent"] = fmt.Sprintf("docker-distribution/%s %s", version.Version, runtime.Version())
 
@@ -127,6 +163,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	purgeConfig := uploadPurgeDefaultConfig()
+	gcConfig := garbageCollectDefaultConfig()
 	if mc, ok := config.Storage["maintenance"]; ok {
 		if v, ok := mc["uploadpurging"]; ok {
 			purgeConfig, ok = v.(map[interface{}]interface{})
@@ -134,23 +171,26 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				panic("uploadpurging config key must contain additional keys")
 			}
 		}
-		if v, ok := mc["readonly"]; ok {
-			readOnly, ok := v.(map[interface{}]interface{})
+		if v, ok := mc["garbagecollect"]; ok {
+			gc, ok := v.(map[interface{}]interface{})
 			if !ok {
-				panic("readonly config key must contain additional keys")
+				panic("garbagecollect config key must contain additional keys")
 			}
-			if readOnlyEnabled, ok := readOnly["enabled"]; ok {
-				app.readOnly, ok = readOnlyEnabled.(bool)
-				if !ok {
-					panic("readonly's enabled config key must have a boolean value")
-				}
+			for k, v := range gc {
+				gcConfig[k] = v
 			}
 		}
 	}
 
-	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	readOnly, retryAfter, err := readOnlyConfig(config)
+	if err != nil {
+		panic(err)
+	}
+	app.readOnly.enabled, app.readOnly.configured, app.readOnly.retryAfter = readOnly, readOnly, retryAfter
 
-	app.driver, err = applyStorageMiddleware(app.driver, config.Middleware["storage"])
+	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig, &app.readOnly)
+
+	app.driver, app.storageCheckers, err = applyStorageMiddleware(app.driver, config.Middleware["storage"])
 	if err != nil {
 		panic(err)
 	}
@@ -199,6 +239,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		if ok {
 			if deleteEnabled, ok := e.(bool); ok && deleteEnabled {
 				options = append(options, storage.EnableDelete)
+				app.deleteEnabled = true
 			}
 		}
 	}
@@ -220,6 +261,32 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.EnableRedirect)
 	}
 
+	// configure compression
+	if compressionConfig, ok := config.Storage["compression"]; ok {
+		if enabled, ok := compressionConfig["enabled"].(bool); ok && enabled {
+			var minSize int64
+			switch v := compressionConfig["minsize"].(type) {
+			case nil:
+			case int:
+				minSize = int64(v)
+			default:
+				panic(fmt.Sprintf("invalid type for compression minsize: %#v", v))
+			}
+
+			var level string
+			switch v := compressionConfig["level"].(type) {
+			case nil:
+			case string:
+				level = v
+			default:
+				panic(fmt.Sprintf("invalid type for compression level: %#v", v))
+			}
+
+			options = append(options, storage.BlobCompression(minSize, level))
+			dcontext.GetLogger(app).Infof("blob compression enabled")
+		}
+	}
+
 	if !config.Validation.Enabled {
 		config.Validation.Enabled = !config.Validation.Disabled
 	}
@@ -257,6 +324,17 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	// configure tag immutability
+	if immutability := config.Policy.Immutability; len(immutability.Rules) > 0 {
+		app.immutableTags = newTagImmutability(immutability).immutable
+		options = append(options, storage.ImmutableTags(app.immutableTags))
+	}
+
+	// configure storage quotas
+	if quota := config.Policy.Quota; len(quota.Repositories) > 0 || len(quota.Namespaces) > 0 {
+		options = append(options, storage.Quotas(newQuotaPolicy(quota).limits))
+	}
+
 	// configure storage caches
 	if cc, ok := config.Storage["cache"]; ok {
 		v, ok := cc["blobdescriptor"]
@@ -300,30 +378,43 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	if len(config.Replication.Targets) > 0 {
+		app.configureReplication(config)
+	}
+
+	startGarbageCollector(app, app.driver, app.registry, dcontext.GetLogger(app), gcConfig, &app.readOnly)
+
+	if retention := config.Policy.Retention; len(retention.Rules) > 0 {
+		startTagRetention(app, newTagPruner(app, app.registry, retention), dcontext.GetLogger(app), retention.Interval, &app.readOnly)
+	}
+
 	app.registry, err = applyRegistryMiddleware(app, app.registry, config.Middleware["registry"])
 	if err != nil {
 		panic(err)
 	}
 
-	authType := config.Auth.Type()
-
-	if authType != "" && !strings.EqualFold(authType, "none") {
-		accessController, err := auth.GetAccessController(config.Auth.Type(), config.Auth.Parameters())
-		if err != nil {
-			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
-		}
-		app.accessController = accessController
-		dcontext.GetLogger(app).Debugf("configured %q access controller", authType)
+	app.accessController, err = newAccessController(config)
+	if err != nil {
+		panic(err.Error())
 	}
+	if app.accessController != nil {
+		dcontext.GetLogger(app).Debugf("configured %q access controller", config.Auth.Type())
+	}
+	app.repositoryMiddleware = config.Middleware["repository"]
 
 	// configure as a pull through cache
-	if config.Proxy.RemoteURL != "" {
+	if config.Proxy.Enabled() {
 		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy)
 		if err != nil {
 			panic(err.Error())
 		}
 		app.isCache = true
-		dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		if config.Proxy.RemoteURL != "" {
+			dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		}
+		for _, upstream := range config.Proxy.Upstreams {
+			dcontext.GetLogger(app).Infof("Registry configured as a proxy cache to %s for %s", upstream.RemoteURL, upstream.Prefix)
+		}
 	}
 	var ok bool
 	app.repoRemover, ok = app.registry.(distribution.RepositoryRemover)
@@ -334,6 +425,15 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	return app
 }
 
+// RegisterReplicationStatus exposes the replication status on the debug
+// server at /debug/replication, if replication is configured. Like
+// RegisterHealthChecks, it may panic if called twice in the same process.
+func (app *App) RegisterReplicationStatus() {
+	if app.replicator != nil {
+		http.Handle("/debug/replication", app.replicator)
+	}
+}
+
 // RegisterHealthChecks is an awful hack to defer health check registration
 // control to callers. This should only ever be called once per registry
 // process, typically in a main function. The correct way would be register
@@ -350,12 +450,41 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 		healthRegistry = healthRegistries[0]
 	}
 
-	if app.Config.Health.StorageDriver.Enabled {
-		interval := app.Config.Health.StorageDriver.Interval
+	app.healthRegistry = healthRegistry
+	checks, err := app.newHealthChecks(app.Config.Health)
+	if err != nil {
+		panic(err)
+	}
+	app.registerHealthChecks(checks)
+	app.healthConfig = app.Config.Health
+
+	// the storage middlewares report their state, which is cheap to check
+	for name, checker := range app.storageCheckers {
+		healthRegistry.Register("storagemiddleware_"+name, checker)
+	}
+}
+
+// healthCheck is a check of the health configuration, run periodically
+// once registered.
+type healthCheck struct {
+	name      string
+	check     health.Checker
+	interval  time.Duration
+	threshold int
+}
+
+// newHealthChecks returns the checks of the health configuration, failing if
+// two of them have the same name.
+func (app *App) newHealthChecks(config configuration.Health) ([]healthCheck, error) {
+	var healthChecks []healthCheck
+	add := func(name string, check health.Checker, interval time.Duration, threshold int) {
 		if interval == 0 {
 			interval = defaultCheckInterval
 		}
+		healthChecks = append(healthChecks, healthCheck{name: name, check: check, interval: interval, threshold: threshold})
+	}
 
+	if config.StorageDriver.Enabled {
 		storageDriverCheck := func() error {
 			_, err := app.driver.Stat(app, "/") // "/" should always exist
 			if _, ok := err.(storagedriver.PathNotFoundError); ok {
@@ -363,60 +492,52 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 			}
 			return err
 		}
-
-		if app.Config.Health.StorageDriver.Threshold != 0 {
-			healthRegistry.RegisterPeriodicThresholdFunc("storagedriver_"+app.Config.Storage.Type(), interval, app.Config.Health.StorageDriver.Threshold, storageDriverCheck)
-		} else {
-			healthRegistry.RegisterPeriodicFunc("storagedriver_"+app.Config.Storage.Type(), interval, storageDriverCheck)
-		}
+		add("storagedriver_"+app.Config.Storage.Type(), health.CheckFunc(storageDriverCheck), config.StorageDriver.Interval, config.StorageDriver.Threshold)
 	}
 
-	for _, fileChecker := range app.Config.Health.FileCheckers {
-		interval := fileChecker.Interval
-		if interval == 0 {
-			interval = defaultCheckInterval
-		}
-		dcontext.GetLogger(app).Infof("configuring file health check path=%s, interval=%d", fileChecker.File, interval/time.Second)
-		healthRegistry.Register(fileChecker.File, health.PeriodicChecker(checks.FileChecker(fileChecker.File), interval))
+	for _, fileChecker := range config.FileCheckers {
+		add(fileChecker.File, checks.FileChecker(fileChecker.File), fileChecker.Interval, 0)
 	}
 
-	for _, httpChecker := range app.Config.Health.HTTPCheckers {
-		interval := httpChecker.Interval
-		if interval == 0 {
-			interval = defaultCheckInterval
-		}
-
+	for _, httpChecker := range config.HTTPCheckers {
 		statusCode := httpChecker.StatusCode
 		if statusCode == 0 {
 			statusCode = 200
 		}
+		add(httpChecker.URI, checks.HTTPChecker(httpChecker.URI, statusCode, httpChecker.Timeout, httpChecker.Headers), httpChecker.Interval, httpChecker.Threshold)
+	}
 
-		checker := checks.HTTPChecker(httpChecker.URI, statusCode, httpChecker.Timeout, httpChecker.Headers)
-
-		if httpChecker.Threshold != 0 {
-			dcontext.GetLogger(app).Infof("configuring HTTP health check uri=%s, interval=%d, threshold=%d", httpChecker.URI, interval/time.Second, httpChecker.Threshold)
-			healthRegistry.Register(httpChecker.URI, health.PeriodicThresholdChecker(checker, interval, httpChecker.Threshold))
-		} else {
-			dcontext.GetLogger(app).Infof("configuring HTTP health check uri=%s, interval=%d", httpChecker.URI, interval/time.Second)
-			healthRegistry.Register(httpChecker.URI, health.PeriodicChecker(checker, interval))
-		}
+	for _, tcpChecker := range config.TCPCheckers {
+		add(tcpChecker.Addr, checks.TCPChecker(tcpChecker.Addr, tcpChecker.Timeout), tcpChecker.Interval, tcpChecker.Threshold)
 	}
 
-	for _, tcpChecker := range app.Config.Health.TCPCheckers {
-		interval := tcpChecker.Interval
-		if interval == 0 {
-			interval = defaultCheckInterval
+	names := make(map[string]bool)
+	for _, c := range healthChecks {
+		if names[c.name] {
+			return nil, fmt.Errorf("duplicate health check %s", c.name)
 		}
+		names[c.name] = true
+	}
+	return healthChecks, nil
+}
 
-		checker := checks.TCPChecker(tcpChecker.Addr, tcpChecker.Timeout)
+// registerHealthChecks replaces the checks of the health configuration
+// registered with healthChecks.
+func (app *App) registerHealthChecks(healthChecks []healthCheck) {
+	for _, name := range app.healthChecks {
+		app.healthRegistry.Unregister(name)
+	}
+	app.healthChecks = nil
 
-		if tcpChecker.Threshold != 0 {
-			dcontext.GetLogger(app).Infof("configuring TCP health check addr=%s, interval=%d, threshold=%d", tcpChecker.Addr, interval/time.Second, tcpChecker.Threshold)
-			healthRegistry.Register(tcpChecker.Addr, health.PeriodicThresholdChecker(checker, interval, tcpChecker.Threshold))
+	for _, c := range healthChecks {
+		if c.threshold != 0 {
+			dcontext.GetLogger(app).Infof("configuring health check %s, interval=%s, threshold=%d", c.name, c.interval, c.threshold)
+			app.healthRegistry.Register(c.name, health.PeriodicThresholdChecker(c.check, c.interval, c.threshold))
 		} else {
-			dcontext.GetLogger(app).Infof("configuring TCP health check addr=%s, interval=%d", tcpChecker.Addr, interval/time.Second)
-			healthRegistry.Register(tcpChecker.Addr, health.PeriodicChecker(checker, interval))
+			dcontext.GetLogger(app).Infof("configuring health check %s, interval=%s", c.name, c.interval)
+			app.healthRegistry.Register(c.name, health.PeriodicChecker(c.check, c.interval))
 		}
+		app.healthChecks = append(app.healthChecks, c.name)
 	}
 }
 
@@ -445,49 +566,140 @@ func (app *App) register(routeName string, dispatch dispatchFunc) {
 
 // configureEvents prepares the event sink for action.
 func (app *App) configureEvents(configuration *configuration.Configuration) {
-	// Configure all of the endpoint sinks.
+	// NOTE(stevvooe): Moving to a new queuing implementation is as easy as
+	// replacing broadcaster with a rabbitmq implementation. It's recommended
+	// that the registry instances also act as the workers to keep deployment
+	// simple.
+	sink, err := app.newEndpointSink(configuration.Notifications)
+	if err != nil {
+		panic(fmt.Sprintf("unable to configure notifications: %v", err))
+	}
+	app.events.endpoints = &endpointSink{sink: sink}
+	app.events.endpointsConfig = configuration.Notifications
+	app.events.sink = app.events.endpoints
+
+	// Populate registry event source
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = configuration.HTTP.Addr
+	} else {
+		// try to pick the port off the config
+		_, port, err := net.SplitHostPort(configuration.HTTP.Addr)
+		if err == nil {
+			hostname = net.JoinHostPort(hostname, port)
+		}
+	}
+
+	app.events.source = notifications.SourceRecord{
+		Addr:       hostname,
+		InstanceID: dcontext.GetStringValue(app, "instance.id"),
+	}
+}
+
+// newEndpointSink returns a sink broadcasting events to the enabled
+// endpoints and brokers, replaying the events left in their persistent
+// queues.
+func (app *App) newEndpointSink(config configuration.Notifications) (notifications.Sink, error) {
+	directories := make(map[string]string)
+	queue := func(name string, disabled bool, queue configuration.EndpointQueue) error {
+		if disabled || queue.Directory == "" {
+			return nil
+		}
+		dir := filepath.Clean(queue.Directory)
+		if other, ok := directories[dir]; ok {
+			return fmt.Errorf("endpoints %s and %s share the queue directory %s", other, name, dir)
+		}
+		directories[dir] = name
+		return nil
+	}
+	for _, endpoint := range config.Endpoints {
+		if err := queue(endpoint.Name, endpoint.Disabled, endpoint.Queue); err != nil {
+			return nil, err
+		}
+	}
+	for _, broker := range config.Brokers {
+		if err := queue(broker.Name, broker.Disabled, broker.Queue); err != nil {
+			return nil, err
+		}
+	}
+
 	var sinks []notifications.Sink
-	for _, endpoint := range configuration.Notifications.Endpoints {
+	closeSinks := func() {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}
+	for _, endpoint := range config.Endpoints {
 		if endpoint.Disabled {
 			dcontext.GetLogger(app).Infof("endpoint %s disabled, skipping", endpoint.Name)
 			continue
 		}
 
 		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
-		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
+		endpoint, err := notifications.OpenEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
 			Timeout:           endpoint.Timeout,
 			Threshold:         endpoint.Threshold,
 			Backoff:           endpoint.Backoff,
 			Headers:           endpoint.Headers,
+			Secrets:           endpoint.Secrets,
 			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
 			Ignore:            endpoint.Ignore,
+			Queue:             endpoint.Queue,
+			Filter:            endpoint.Filter,
 		})
+		if err != nil {
+			closeSinks()
+			return nil, err
+		}
 
 		sinks = append(sinks, endpoint)
 	}
 
-	// NOTE(stevvooe): Moving to a new queuing implementation is as easy as
-	// replacing broadcaster with a rabbitmq implementation. It's recommended
-	// that the registry instances also act as the workers to keep deployment
-	// simple.
-	app.events.sink = notifications.NewBroadcaster(sinks...)
+	for _, broker := range config.Brokers {
+		if broker.Disabled {
+			dcontext.GetLogger(app).Infof("broker %s disabled, skipping", broker.Name)
+			continue
+		}
 
-	// Populate registry event source
-	hostname, err := os.Hostname()
-	if err != nil {
-		hostname = configuration.HTTP.Addr
-	} else {
-		// try to pick the port off the config
-		_, port, err := net.SplitHostPort(configuration.HTTP.Addr)
+		sink, err := notifications.GetSink(broker.Type, broker.Options)
 		if err == nil {
-			hostname = net.JoinHostPort(hostname, port)
+			dcontext.GetLogger(app).Infof("configuring broker %v (%v)", broker.Name, sink)
+			sink, err = notifications.OpenSinkEndpoint(broker.Name, sink, notifications.EndpointConfig{
+				Threshold: broker.Threshold,
+				Backoff:   broker.Backoff,
+				Ignore:    broker.Ignore,
+				Queue:     broker.Queue,
+				Filter:    broker.Filter,
+			})
+		}
+		if err != nil {
+			closeSinks()
+			return nil, fmt.Errorf("unable to configure broker %s: %v", broker.Name, err)
 		}
+
+		sinks = append(sinks, sink)
 	}
 
-	app.events.source = notifications.SourceRecord{
-		Addr:       hostname,
-		InstanceID: dcontext.GetStringValue(app, "instance.id"),
+	return notifications.NewBroadcaster(sinks...), nil
+}
+
+// configureReplication starts replicating pushed content to the configured
+// targets. Content is read from the local storage, without middleware. The
+// replication queue is not written to in read-only mode.
+func (app *App) configureReplication(configuration *configuration.Configuration) {
+	replicator, err := replication.NewReplicator(app, app.registry, app.driver, configuration.Replication, app.readOnly.startJob)
+	if err != nil {
+		panic(fmt.Sprintf("unable to configure replication: %v", err))
 	}
+	app.replicator = replicator
+
+	// the replicator consumes the same events as the endpoints, through the
+	// same queue, so that requests do not wait for the jobs to be stored
+	queued, err := notifications.OpenSinkEndpoint("replication", replicator, notifications.EndpointConfig{})
+	if err != nil {
+		panic(fmt.Sprintf("unable to configure replication: %v", err))
+	}
+	app.events.sink = notifications.NewBroadcaster(app.events.sink, queued)
 }
 
 type redisStartAtKey struct{}
@@ -582,9 +794,14 @@ func (app *App) configureLogHook(configuration *configuration.Configuration) {
 		return
 	}
 
-	logger := entry.Logger
+	app.logHooks = &logHooks{hooks: newLogHooks(configuration.Log.Hooks)}
+	entry.Logger.Hooks.Add(app.logHooks)
+}
 
-	for _, configHook := range configuration.Log.Hooks {
+// newLogHooks returns the enabled hooks of the log configuration.
+func newLogHooks(configHooks []configuration.LogHook) logrus.LevelHooks {
+	hooks := make(logrus.LevelHooks)
+	for _, configHook := range configHooks {
 		if !configHook.Disabled {
 			switch configHook.Type {
 			case "mail":
@@ -598,11 +815,12 @@ func (app *App) configureLogHook(configuration *configuration.Configuration) {
 					From:     configHook.MailOptions.From,
 					To:       configHook.MailOptions.To,
 				}
-				logger.Hooks.Add(hook)
+				hooks.Add(hook)
 			default:
 			}
 		}
 	}
+	return hooks
 }
 
 // configureSecret creates a random secret if a secret wasn't included in the
@@ -711,7 +929,11 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 				context.App.repoRemover,
 				app.eventBridge(context, r))
 
-			context.Repository, err = applyRepoMiddleware(app, context.Repository, app.Config.Middleware["repository"])
+			app.mu.RLock()
+			repositoryMiddleware := app.repositoryMiddleware
+			app.mu.RUnlock()
+
+			context.Repository, err = applyRepoMiddleware(app, context.Repository, repositoryMiddleware)
 			if err != nil {
 				dcontext.GetLogger(context).Errorf("error initializing repository middleware: %v", err)
 				context.Errors = append(context.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
@@ -810,7 +1032,11 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	dcontext.GetLogger(context).Debug("authorizing request")
 	repo := getName(context)
 
-	if app.accessController == nil {
+	app.mu.RLock()
+	accessController := app.accessController
+	app.mu.RUnlock()
+
+	if accessController == nil {
 		return nil // access controller is not enabled.
 	}
 
@@ -840,7 +1066,7 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 		accessRecords = appendCatalogAccessRecord(accessRecords, r)
 	}
 
-	ctx, err := app.accessController.Authorized(context.Context, accessRecords...)
+	ctx, err := accessController.Authorized(context.Context, accessRecords...)
 	if err != nil {
 		switch err := err.(type) {
 		case auth.Challenge:
@@ -981,16 +1207,21 @@ func applyRepoMiddleware(ctx context.Context, repository distribution.Repository
 	return repository, nil
 }
 
-// applyStorageMiddleware wraps a storage driver with the configured middlewares
-func applyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, error) {
+// applyStorageMiddleware wraps a storage driver with the configured
+// middlewares, returning the ones implementing health.Checker by name.
+func applyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, map[string]health.Checker, error) {
+	checkers := make(map[string]health.Checker)
 	for _, mw := range middlewares {
 		smw, err := storagemiddleware.Get(mw.Name, mw.Options, driver)
 		if err != nil {
-			return nil, fmt.Errorf("unable to configure storage middleware (%s): %v", mw.Name, err)
+			return nil, nil, fmt.Errorf("unable to configure storage middleware (%s): %v", mw.Name, err)
+		}
+		if checker, ok := smw.(health.Checker); ok {
+			checkers[mw.Name] = checker
 		}
 		driver = smw
 	}
-	return driver, nil
+	return driver, checkers, nil
 }
 
 // uploadPurgeDefaultConfig provides a default configuration for upload
@@ -1010,8 +1241,9 @@ func badPurgeUploadConfig(reason string) {
 }
 
 // startUploadPurger schedules a goroutine which will periodically
-// check upload directories for old files and delete them
-func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageDriver, log dcontext.Logger, config map[interface{}]interface{}) {
+// check upload directories for old files and delete them, unless the
+// registry is in read-only mode
+func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageDriver, log dcontext.Logger, config map[interface{}]interface{}, readOnly *readOnlyMode) {
 	if config["enabled"] == false {
 		return
 	}
@@ -1066,9 +1298,96 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 		time.Sleep(jitter)
 
 		for {
-			storage.PurgeUploads(ctx, storageDriver, time.Now().Add(-purgeAgeDuration), !dryRunBool)
+			if ctx, done, allowed := readOnly.startJob(ctx); allowed {
+				storage.PurgeUploads(ctx, storageDriver, time.Now().Add(-purgeAgeDuration), !dryRunBool)
+				done()
+			} else {
+				log.Warnf("Registry is read-only, skipping upload purge")
+			}
 			log.Infof("Starting upload purge in %s", intervalDuration)
 			time.Sleep(intervalDuration)
 		}
 	}()
 }
+
+// garbageCollectDefaultConfig provides the default configuration for online
+// garbage collection. Values present in the configuration file override
+// these.
+func garbageCollectDefaultConfig() map[interface{}]interface{} {
+	config := map[interface{}]interface{}{}
+	config["enabled"] = false
+	config["interval"] = "24h"
+	config["graceperiod"] = "1h"
+	config["dryrun"] = false
+	return config
+}
+
+func badGarbageCollectConfig(reason string) {
+	panic(fmt.Sprintf("Unable to parse garbage collect configuration: %s", reason))
+}
+
+// startGarbageCollector schedules a goroutine which will periodically mark
+// and sweep unreferenced blobs while the registry continues to serve
+// requests. Blobs written or linked within the grace period are retained.
+// Collections are skipped while the registry is in read-only mode, and
+// interrupted when it is switched on.
+func startGarbageCollector(ctx context.Context, storageDriver storagedriver.StorageDriver, registry distribution.Namespace, log dcontext.Logger, config map[interface{}]interface{}, readOnly *readOnlyMode) {
+	if config["enabled"] != true {
+		return
+	}
+
+	intervalStr, ok := config["interval"].(string)
+	if !ok {
+		badGarbageCollectConfig("interval is not a string")
+	}
+	intervalDuration, err := time.ParseDuration(intervalStr)
+	if err != nil {
+		badGarbageCollectConfig(fmt.Sprintf("Cannot parse interval: %s", err.Error()))
+	}
+
+	gracePeriodStr, ok := config["graceperiod"].(string)
+	if !ok {
+		badGarbageCollectConfig("graceperiod is not a string")
+	}
+	gracePeriod, err := time.ParseDuration(gracePeriodStr)
+	if err != nil {
+		badGarbageCollectConfig(fmt.Sprintf("Cannot parse graceperiod: %s", err.Error()))
+	}
+	if gracePeriod <= 0 {
+		badGarbageCollectConfig("graceperiod must be positive")
+	}
+
+	dryRun, ok := config["dryrun"].(bool)
+	if !ok {
+		badGarbageCollectConfig("cannot parse dryrun")
+	}
+
+	go func() {
+		rand.Seed(time.Now().Unix())
+		jitter := time.Duration(rand.Int()%60) * time.Minute
+		log.Infof("Starting garbage collection in %s", jitter)
+		time.Sleep(jitter)
+
+		for {
+			if ctx, done, allowed := readOnly.startJob(ctx); !allowed {
+				log.Warnf("Registry is read-only, skipping garbage collection")
+			} else {
+				log.Infof("Garbage collection starting: gracePeriod=%s, dryRun=%t", gracePeriod, dryRun)
+				err := storage.MarkAndSweep(ctx, storageDriver, registry, storage.GCOpts{
+					DryRun:      dryRun,
+					GracePeriod: gracePeriod,
+					Quiet:       true,
+				})
+				done()
+				if err != nil {
+					log.Errorf("Garbage collection failed: %v", err)
+				} else {
+					log.Infof("Garbage collection finished")
+				}
+			}
+
+			log.Infof("Starting garbage collection in %s", intervalDuration)
+			time.Sleep(intervalDuration)
+		}
+	}()
+}
@@ -24,15 +24,12 @@ func blobUploadDispatcher(ctx *Context, r *http.Request) http.Handler {
 	}
 
 	handler := handlers.MethodHandler{
-		"GET":  http.HandlerFunc(buh.GetUploadStatus),
-		"HEAD": http.HandlerFunc(buh.GetUploadStatus),
-	}
-
-	if !ctx.readOnly {
-		handler["POST"] = http.HandlerFunc(buh.StartBlobUpload)
-		handler["PATCH"] = http.HandlerFunc(buh.PatchBlobData)
-		handler["PUT"] = http.HandlerFunc(buh.PutBlobUploadComplete)
-		handler["DELETE"] = http.HandlerFunc(buh.CancelBlobUpload)
+		"GET":    http.HandlerFunc(buh.GetUploadStatus),
+		"HEAD":   http.HandlerFunc(buh.GetUploadStatus),
+		"POST":   ctx.writeHandler(buh.StartBlobUpload),
+		"PATCH":  ctx.writeHandler(buh.PatchBlobData),
+		"PUT":    ctx.writeHandler(buh.PutBlobUploadComplete),
+		"DELETE": ctx.writeHandler(buh.CancelBlobUpload),
 	}
 
 	if buh.UUID != "" {
@@ -235,6 +232,8 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		switch err := err.(type) {
 		case distribution.ErrBlobInvalidDigest:
 			buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err))
+		case distribution.ErrQuotaExceeded:
+			buh.Errors = append(buh.Errors, v2.ErrorCodeQuotaExceeded.WithDetail(err))
 		case errcode.Error:
 			buh.Errors = append(buh.Errors, err)
 		default:
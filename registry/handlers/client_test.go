@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+)
+
+// TestClientTagOperations exercises the tag operations of the registry client
+// against a local registry.
+func TestClientTagOperations(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/clienttags")
+	latest := createRepository(env, t, imageName.Name(), "latest")
+	other := createRepository(env, t, imageName.Name(), "other")
+
+	repo, err := client.NewRepository(imageName, env.server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating repository: %v", err)
+	}
+	tags := repo.Tags(env.ctx)
+
+	if err := tags.Tag(env.ctx, "stable", distribution.Descriptor{Digest: latest}); err != nil {
+		t.Fatalf("unexpected error tagging: %v", err)
+	}
+	desc, err := tags.Get(env.ctx, "stable")
+	if err != nil {
+		t.Fatalf("unexpected error getting tag: %v", err)
+	}
+	if desc.Digest != latest {
+		t.Fatalf("unexpected digest for tag: %s != %s", desc.Digest, latest)
+	}
+
+	found, err := tags.Lookup(env.ctx, distribution.Descriptor{Digest: latest})
+	if err != nil {
+		t.Fatalf("unexpected error looking up tags: %v", err)
+	}
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, []string{"latest", "stable"}) {
+		t.Fatalf("unexpected tags found: %v", found)
+	}
+
+	// move the tag to another manifest
+	if err := tags.Tag(env.ctx, "stable", distribution.Descriptor{Digest: other}); err != nil {
+		t.Fatalf("unexpected error tagging: %v", err)
+	}
+	found, err = tags.Lookup(env.ctx, distribution.Descriptor{Digest: other})
+	if err != nil {
+		t.Fatalf("unexpected error looking up tags: %v", err)
+	}
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, []string{"other", "stable"}) {
+		t.Fatalf("unexpected tags found: %v", found)
+	}
+
+	if err := tags.Untag(env.ctx, "stable"); err != nil {
+		t.Fatalf("unexpected error untagging: %v", err)
+	}
+	if _, err := tags.Get(env.ctx, "stable"); err == nil {
+		t.Fatalf("expected error getting removed tag")
+	}
+	if err := tags.Untag(env.ctx, "stable"); err == nil {
+		t.Fatalf("expected error removing unknown tag")
+	}
+
+	// the manifest remains available by digest
+	manifests, err := repo.Manifests(env.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := manifests.Exists(env.ctx, other)
+	if err != nil {
+		t.Fatalf("unexpected error checking manifest: %v", err)
+	}
+	if !exists {
+		t.Fatalf("manifest removed along with its tag")
+	}
+
+	if err := tags.Tag(env.ctx, "missing", distribution.Descriptor{Digest: "sha256:ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"}); err == nil {
+		t.Fatalf("expected error tagging unknown manifest")
+	}
+}
+
+func TestClientUntagDeleteDisabled(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/clienttags")
+	createRepository(env, t, imageName.Name(), "latest")
+
+	repo, err := client.NewRepository(imageName, env.server.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating repository: %v", err)
+	}
+	tags := repo.Tags(env.ctx)
+
+	if err := tags.Untag(env.ctx, "latest"); err == nil {
+		t.Fatalf("expected error untagging with deletes disabled")
+	}
+	if _, err := tags.Get(env.ctx, "latest"); err != nil {
+		t.Fatalf("unexpected error getting tag: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -12,6 +13,8 @@ import (
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/health"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
 )
 
 func TestFileHealthCheck(t *testing.T) {
@@ -65,6 +68,50 @@ func TestFileHealthCheck(t *testing.T) {
 	}
 }
 
+// checkedDriver is a storage middleware reporting the health status set.
+type checkedDriver struct {
+	storagedriver.StorageDriver
+	status error
+}
+
+func (d *checkedDriver) Check() error {
+	return d.status
+}
+
+func TestStorageMiddlewareHealthCheck(t *testing.T) {
+	var checked *checkedDriver
+	storagemiddleware.Register("checked", func(driver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+		checked = &checkedDriver{StorageDriver: driver}
+		return checked, nil
+	})
+
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"storage": {{Name: "checked"}},
+		},
+	}
+
+	app := NewApp(context.Background(), config)
+	healthRegistry := health.NewRegistry()
+	app.RegisterHealthChecks(healthRegistry)
+
+	if status := healthRegistry.CheckStatus(); len(status) != 0 {
+		t.Fatalf("unexpected health check results: %v", status)
+	}
+
+	checked.status = errors.New("circuit breaker open")
+	status := healthRegistry.CheckStatus()
+	if status["storagemiddleware_checked"] != "circuit breaker open" {
+		t.Fatalf("unexpected health check results: %v", status)
+	}
+}
+
 func TestTCPHealthCheck(t *testing.T) {
 	interval := time.Second
 
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/sirupsen/logrus"
@@ -51,3 +52,28 @@ func (hook *logHook) Levels() []logrus.Level {
 	}
 	return levels
 }
+
+// logHooks fires the hooks of the log configuration, which are replaced when
+// the configuration is reloaded.
+type logHooks struct {
+	mu    sync.RWMutex
+	hooks logrus.LevelHooks
+}
+
+// Fire forwards the entry to the hooks of its level
+func (h *logHooks) Fire(entry *logrus.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.hooks.Fire(entry.Level, entry)
+}
+
+// Levels contains all the levels, the hooks filtering their own
+func (h *logHooks) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logHooks) replace(hooks logrus.LevelHooks) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = hooks
+}
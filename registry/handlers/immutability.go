@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// immutabilityRule is a compiled configuration.ImmutabilityRule.
+type immutabilityRule struct {
+	repositories configuration.RepositoryPatterns
+	tags         []*regexp.Regexp
+}
+
+// tagImmutability decides which tags may not be moved or removed, exempting
+// the configured admins.
+type tagImmutability struct {
+	rules  []immutabilityRule
+	admins map[string]struct{}
+}
+
+// newTagImmutability compiles the immutability configuration, panicking if it
+// is invalid.
+func newTagImmutability(config configuration.Immutability) *tagImmutability {
+	ti := &tagImmutability{
+		admins: make(map[string]struct{}, len(config.Admins)),
+	}
+
+	for i, r := range config.Rules {
+		if len(r.Repositories) == 0 {
+			panic(fmt.Sprintf("policy.immutability.rules[%d]: no repositories", i))
+		}
+		if err := r.Repositories.Validate(); err != nil {
+			panic(fmt.Sprintf("policy.immutability.rules[%d].repositories: %s", i, err))
+		}
+
+		rule := immutabilityRule{repositories: r.Repositories}
+		for _, s := range r.Tags {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				panic(fmt.Sprintf("policy.immutability.rules[%d].tags: %s", i, err))
+			}
+			rule.tags = append(rule.tags, re)
+		}
+
+		ti.rules = append(ti.rules, rule)
+	}
+
+	for _, name := range config.Admins {
+		if name == "" {
+			panic("policy.immutability.admins: empty user name")
+		}
+		ti.admins[name] = struct{}{}
+	}
+
+	return ti
+}
+
+// immutable reports whether the tag of the named repository is immutable for
+// the user authenticated in ctx. It is a storage.TagImmutabilityFunc.
+func (ti *tagImmutability) immutable(ctx context.Context, repository, tag string) bool {
+	if _, ok := ti.admins[dcontext.GetStringValue(ctx, auth.UserNameKey)]; ok {
+		return false
+	}
+
+	for _, r := range ti.rules {
+		if r.matches(repository, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the rule makes the tag of the named repository
+// immutable.
+func (r immutabilityRule) matches(repository, tag string) bool {
+	if !r.repositories.Matches(repository) {
+		return false
+	}
+
+	if len(r.tags) == 0 {
+		return true
+	}
+	for _, re := range r.tags {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
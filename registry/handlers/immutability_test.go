@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/auth"
+)
+
+func TestTagImmutability(t *testing.T) {
+	ti := newTagImmutability(configuration.Immutability{
+		Rules: []configuration.ImmutabilityRule{
+			{Repositories: []string{"library/*"}, Tags: []string{"^v[0-9]", "^stable$"}},
+			{Repositories: []string{"releases/*"}},
+		},
+		Admins: []string{"admin"},
+	})
+
+	anonymous := context.Background()
+	user := auth.WithUser(anonymous, auth.UserInfo{Name: "user"})
+	admin := auth.WithUser(anonymous, auth.UserInfo{Name: "admin"})
+
+	for _, testcase := range []struct {
+		ctx        context.Context
+		repository string
+		tag        string
+		expected   bool
+	}{
+		{anonymous, "library/ubuntu", "v1", true},
+		{user, "library/ubuntu", "v1.2", true},
+		{user, "library/ubuntu", "stable", true},
+		{user, "library/ubuntu", "stable-1", false},
+		{user, "library/ubuntu", "latest", false},
+		{user, "library/ubuntu/nested", "v1", false},
+		{user, "releases/app", "latest", true},
+		{user, "other/app", "v1", false},
+		{admin, "library/ubuntu", "v1", false},
+		{admin, "releases/app", "latest", false},
+	} {
+		if ti.immutable(testcase.ctx, testcase.repository, testcase.tag) != testcase.expected {
+			t.Errorf("unexpected immutability of %s:%s for %q", testcase.repository, testcase.tag, dcontext.GetStringValue(testcase.ctx, auth.UserNameKey))
+		}
+	}
+}
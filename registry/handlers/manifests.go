@@ -56,17 +56,12 @@ func manifestDispatcher(ctx *Context, r *http.Request) http.Handler {
 		manifestHandler.Digest = dgst
 	}
 
-	mhandler := handlers.MethodHandler{
-		"GET":  http.HandlerFunc(manifestHandler.GetManifest),
-		"HEAD": http.HandlerFunc(manifestHandler.GetManifest),
+	return handlers.MethodHandler{
+		"GET":    http.HandlerFunc(manifestHandler.GetManifest),
+		"HEAD":   http.HandlerFunc(manifestHandler.GetManifest),
+		"PUT":    ctx.writeHandler(manifestHandler.PutManifest),
+		"DELETE": ctx.writeHandler(manifestHandler.DeleteManifest),
 	}
-
-	if !ctx.readOnly {
-		mhandler["PUT"] = http.HandlerFunc(manifestHandler.PutManifest)
-		mhandler["DELETE"] = http.HandlerFunc(manifestHandler.DeleteManifest)
-	}
-
-	return mhandler
 }
 
 // manifestHandler handles http operations on image manifests.
@@ -372,6 +367,8 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 					}
 				}
 			}
+		case distribution.ErrQuotaExceeded:
+			imh.Errors = append(imh.Errors, v2.ErrorCodeQuotaExceeded.WithDetail(err))
 		case errcode.Error:
 			imh.Errors = append(imh.Errors, err)
 		default:
@@ -385,7 +382,14 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		tags := imh.Repository.Tags(imh)
 		err = tags.Tag(imh, imh.Tag, desc)
 		if err != nil {
-			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			switch err.(type) {
+			case distribution.ErrTagImmutable:
+				imh.Errors = append(imh.Errors, v2.ErrorCodeTagImmutable.WithDetail(err))
+			case distribution.ErrQuotaExceeded:
+				imh.Errors = append(imh.Errors, v2.ErrorCodeQuotaExceeded.WithDetail(err))
+			default:
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
 			return
 		}
 
@@ -488,12 +492,38 @@ func (imh *manifestHandler) applyResourcePolicy(manifest distribution.Manifest)
 func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("DeleteImageManifest")
 
+	if imh.Tag != "" {
+		imh.deleteTag(w)
+		return
+	}
+
 	manifests, err := imh.Repository.Manifests(imh)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
 		return
 	}
 
+	tagService := imh.Repository.Tags(imh)
+
+	referencedTags, err := tagService.Lookup(imh, distribution.Descriptor{Digest: imh.Digest})
+	if err != nil {
+		if err == distribution.ErrUnsupported {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnsupported)
+			return
+		}
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
+	// deleting the manifest removes its tags, so refuse it while any of them
+	// is immutable
+	for _, tag := range referencedTags {
+		if imh.immutableTag(tag) {
+			imh.Errors = append(imh.Errors, v2.ErrorCodeTagImmutable.WithDetail(distribution.ErrTagImmutable{Tag: tag}))
+			return
+		}
+	}
+
 	err = manifests.Delete(imh, imh.Digest)
 	if err != nil {
 		switch err {
@@ -513,19 +543,52 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
+	for _, tag := range referencedTags {
+		if err := tagService.Untag(imh, tag); err != nil {
+			imh.Errors = append(imh.Errors, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// deleteTag removes the tag of the request, leaving the manifest it references
+// in place.
+func (imh *manifestHandler) deleteTag(w http.ResponseWriter) {
+	if !imh.App.deleteEnabled {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
 	tagService := imh.Repository.Tags(imh)
-	referencedTags, err := tagService.Lookup(imh, distribution.Descriptor{Digest: imh.Digest})
-	if err != nil {
-		imh.Errors = append(imh.Errors, err)
+	if _, err := tagService.Get(imh, imh.Tag); err != nil {
+		switch err.(type) {
+		case distribution.ErrTagUnknown, distribution.ErrRepositoryUnknown:
+			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithDetail(err))
+		default:
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
 		return
 	}
 
-	for _, tag := range referencedTags {
-		if err := tagService.Untag(imh, tag); err != nil {
-			imh.Errors = append(imh.Errors, err)
+	if err := tagService.Untag(imh, imh.Tag); err != nil {
+		if _, ok := err.(distribution.ErrTagImmutable); ok {
+			imh.Errors = append(imh.Errors, v2.ErrorCodeTagImmutable.WithDetail(err))
 			return
 		}
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
 	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// immutableTag reports whether the tag of the repository may not be moved or
+// removed by the user making the request.
+func (imh *manifestHandler) immutableTag(tag string) bool {
+	if imh.App.immutableTags == nil {
+		return false
+	}
+	return imh.App.immutableTags(imh, imh.Repository.Named().Name(), tag)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/registry/storage"
+)
+
+// quotaRule is a validated configuration.QuotaRule.
+type quotaRule struct {
+	names  configuration.RepositoryPatterns
+	limits storage.QuotaLimits
+}
+
+// quotaPolicy decides the storage limits of repositories and namespaces.
+type quotaPolicy struct {
+	repositories []quotaRule
+	namespaces   []quotaRule
+}
+
+// newQuotaPolicy validates the quota configuration, panicking if it is
+// invalid.
+func newQuotaPolicy(config configuration.Quota) *quotaPolicy {
+	return &quotaPolicy{
+		repositories: newQuotaRules("policy.quota.repositories", config.Repositories),
+		namespaces:   newQuotaRules("policy.quota.namespaces", config.Namespaces),
+	}
+}
+
+func newQuotaRules(section string, rules []configuration.QuotaRule) []quotaRule {
+	var compiled []quotaRule
+	for i, r := range rules {
+		if len(r.Names) == 0 {
+			panic(fmt.Sprintf("%s[%d]: no names", section, i))
+		}
+		if err := r.Names.Validate(); err != nil {
+			panic(fmt.Sprintf("%s[%d].names: %s", section, i, err))
+		}
+		if r.Size < 0 || r.Tags < 0 {
+			panic(fmt.Sprintf("%s[%d]: negative limit", section, i))
+		}
+
+		compiled = append(compiled, quotaRule{
+			names:  r.Names,
+			limits: storage.QuotaLimits{Size: r.Size, Tags: r.Tags},
+		})
+	}
+	return compiled
+}
+
+// limits returns the limits of the named repository and of its namespace. It
+// is a storage.QuotaFunc.
+func (qp *quotaPolicy) limits(repository, namespace string) (repositoryLimits, namespaceLimits storage.QuotaLimits) {
+	return matchQuota(qp.repositories, repository), matchQuota(qp.namespaces, namespace)
+}
+
+// matchQuota returns the limits of the first rule matching name, or no
+// limits at all.
+func matchQuota(rules []quotaRule, name string) storage.QuotaLimits {
+	for _, r := range rules {
+		if r.names.Matches(name) {
+			return r.limits
+		}
+	}
+	return storage.QuotaLimits{}
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/registry/storage"
+)
+
+func TestQuotaPolicy(t *testing.T) {
+	qp := newQuotaPolicy(configuration.Quota{
+		Repositories: []configuration.QuotaRule{
+			{Names: []string{"ci/*"}, Size: 100, Tags: 10},
+			{Names: []string{"ci/*", "library/*"}, Size: 1000},
+		},
+		Namespaces: []configuration.QuotaRule{
+			{Names: []string{"ci"}, Size: 5000},
+			{Names: []string{"*"}, Tags: 50},
+		},
+	})
+
+	for _, testcase := range []struct {
+		repository, namespace string
+		repositoryLimits      storage.QuotaLimits
+		namespaceLimits       storage.QuotaLimits
+	}{
+		{"ci/app", "ci", storage.QuotaLimits{Size: 100, Tags: 10}, storage.QuotaLimits{Size: 5000}},
+		{"library/ubuntu", "library", storage.QuotaLimits{Size: 1000}, storage.QuotaLimits{Tags: 50}},
+		{"ci/app/nested", "ci", storage.QuotaLimits{}, storage.QuotaLimits{Size: 5000}},
+		{"other", "other", storage.QuotaLimits{}, storage.QuotaLimits{Tags: 50}},
+	} {
+		repositoryLimits, namespaceLimits := qp.limits(testcase.repository, testcase.namespace)
+		if repositoryLimits != testcase.repositoryLimits || namespaceLimits != testcase.namespaceLimits {
+			t.Errorf("unexpected limits for %s: %+v, %+v", testcase.repository, repositoryLimits, namespaceLimits)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+// defaultReadOnlyRetryAfter is the delay clients are asked to wait before
+// retrying the writes rejected in read-only mode, unless configured.
+const defaultReadOnlyRetryAfter = time.Minute
+
+// readOnlyMode is the read-only maintenance mode of the registry. It may be
+// switched while the registry serves requests.
+type readOnlyMode struct {
+	mu         sync.RWMutex
+	enabled    bool
+	retryAfter time.Duration
+
+	// configured is the mode last read from the configuration, which only
+	// overrides the mode switched at runtime when it changes
+	configured bool
+
+	// writes is the number of write requests and background jobs being
+	// served, and idle is closed once it drops to zero
+	writes int
+	idle   chan struct{}
+
+	// switchedOn is closed when the mode is switched on, stopping the
+	// background jobs running
+	switchedOn chan struct{}
+}
+
+// startWrite returns whether a write may be served, counting it until done
+// is called, or the delay clients are asked to wait before retrying it.
+func (m *readOnlyMode) startWrite() (allowed bool, retryAfter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.enabled {
+		return false, m.retryAfter
+	}
+	if m.writes == 0 {
+		m.idle = make(chan struct{})
+	}
+	m.writes++
+	return true, 0
+}
+
+// startJob returns whether a background job writing to the storage, such as
+// a garbage collection, may run, counting it like a write until done is
+// called. The job must run with the context returned, which is canceled when
+// the mode is switched on. The context is returned unchanged when the job may
+// not run.
+func (m *readOnlyMode) startJob(ctx context.Context) (jobCtx context.Context, done func(), allowed bool) {
+	m.mu.Lock()
+	if m.enabled {
+		m.mu.Unlock()
+		return ctx, func() {}, false
+	}
+	if m.writes == 0 {
+		m.idle = make(chan struct{})
+	}
+	m.writes++
+	if m.switchedOn == nil {
+		m.switchedOn = make(chan struct{})
+	}
+	switchedOn := m.switchedOn
+	m.mu.Unlock()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-switchedOn:
+			cancel()
+		case <-jobCtx.Done():
+		}
+	}()
+
+	var once sync.Once
+	return jobCtx, func() {
+		once.Do(func() {
+			cancel()
+			m.doneWrite()
+		})
+	}, true
+}
+
+func (m *readOnlyMode) doneWrite() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes--
+	if m.writes == 0 {
+		close(m.idle)
+	}
+}
+
+// wait waits until no write is being served, or the context is done.
+func (m *readOnlyMode) wait(ctx context.Context) error {
+	m.mu.RLock()
+	writes, idle := m.writes, m.idle
+	m.mu.RUnlock()
+	if writes == 0 {
+		return nil
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readOnlyConfig returns whether the maintenance section of the storage
+// configuration enables the read-only mode, and the delay clients are asked
+// to wait before retrying their writes.
+func readOnlyConfig(config *configuration.Configuration) (enabled bool, retryAfter time.Duration, err error) {
+	retryAfter = defaultReadOnlyRetryAfter
+
+	v, ok := config.Storage["maintenance"]["readonly"]
+	if !ok {
+		return false, retryAfter, nil
+	}
+	readOnly, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return false, 0, fmt.Errorf("readonly config key must contain additional keys")
+	}
+	if readOnlyEnabled, ok := readOnly["enabled"]; ok {
+		enabled, ok = readOnlyEnabled.(bool)
+		if !ok {
+			return false, 0, fmt.Errorf("readonly's enabled config key must have a boolean value")
+		}
+	}
+	if v, ok := readOnly["retryafter"]; ok {
+		s, ok := v.(string)
+		if !ok {
+			return false, 0, fmt.Errorf("readonly's retryafter config key must be a duration")
+		}
+		retryAfter, err = time.ParseDuration(s)
+		if err != nil || retryAfter <= 0 {
+			return false, 0, fmt.Errorf("readonly's retryafter config key must be a positive duration, %q invalid", s)
+		}
+	}
+	return enabled, retryAfter, nil
+}
+
+// ReadOnly reports whether the registry is in read-only maintenance mode.
+func (app *App) ReadOnly() bool {
+	app.readOnly.mu.RLock()
+	defer app.readOnly.mu.RUnlock()
+	return app.readOnly.enabled
+}
+
+// SetReadOnly switches the read-only maintenance mode. Requests already
+// being served complete, while writes received afterwards are rejected until
+// the mode is switched off. Switching the mode on stops the background jobs
+// writing to the storage, such as online garbage collection, tag retention,
+// upload purging and replication. Use WaitWrites to wait until the writes
+// already being served complete and the jobs stopped.
+func (app *App) SetReadOnly(enabled bool) {
+	app.readOnly.mu.Lock()
+	defer app.readOnly.mu.Unlock()
+	if app.readOnly.enabled != enabled {
+		dcontext.GetLogger(app).Infof("read-only mode switched to %t", enabled)
+	}
+	app.readOnly.enabled = enabled
+	if enabled && app.readOnly.switchedOn != nil {
+		close(app.readOnly.switchedOn)
+		app.readOnly.switchedOn = nil
+	}
+}
+
+// WaitWrites waits until no write request is being served, such as a manifest
+// push or an upload, and no background job writing to the storage is running,
+// or until the context is done. Once it returns nil after switching on the
+// read-only mode, the storage is no longer written to by the registry and
+// offline garbage collection may run.
+func (app *App) WaitWrites(ctx context.Context) error {
+	return app.readOnly.wait(ctx)
+}
+
+// setReadOnlyConfig applies the read-only mode configured. A mode switched
+// at runtime is kept until the configured mode changes.
+func (app *App) setReadOnlyConfig(enabled bool, retryAfter time.Duration) {
+	app.readOnly.mu.Lock()
+	app.readOnly.retryAfter = retryAfter
+	changed := app.readOnly.configured != enabled
+	app.readOnly.configured = enabled
+	current := app.readOnly.enabled
+	app.readOnly.mu.Unlock()
+
+	if changed {
+		app.SetReadOnly(enabled)
+	} else if current != enabled {
+		dcontext.GetLogger(app).Infof("keeping the read-only mode switched to %t at runtime, the configured mode did not change", current)
+	}
+}
+
+// RegisterReadOnlyMode exposes the read-only maintenance mode on the debug
+// server at /debug/readonly. GET requests return the mode and the number of
+// writes being served, background jobs included, PUT requests switch the mode
+// with a {"enabled": true} body. Switching the mode on waits until the writes
+// being served complete and the background jobs stopped, for at most the
+// duration of the optional wait query parameter, returning a 503 response if
+// they do not. Like RegisterHealthChecks, it may panic if
+// called twice in the same process.
+func (app *App) RegisterReadOnlyMode() {
+	http.Handle("/debug/readonly", http.HandlerFunc(app.serveReadOnlyMode))
+}
+
+type readOnlyStatus struct {
+	Enabled bool `json:"enabled"`
+	// Writes is the number of write requests being served and background
+	// jobs writing to the storage
+	Writes int `json:"writes"`
+}
+
+func (app *App) serveReadOnlyMode(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		ctx := r.Context()
+		if v := r.URL.Query().Get("wait"); v != "" {
+			wait, err := time.ParseDuration(v)
+			if err != nil || wait < 0 {
+				http.Error(w, fmt.Sprintf("invalid wait duration %q", v), http.StatusBadRequest)
+				return
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, wait)
+			defer cancel()
+		}
+
+		var mode readOnlyStatus
+		if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+			http.Error(w, fmt.Sprintf("invalid read-only mode: %v", err), http.StatusBadRequest)
+			return
+		}
+		app.SetReadOnly(mode.Enabled)
+		if mode.Enabled {
+			if err := app.WaitWrites(ctx); err != nil {
+				// the mode remains switched on, the writes may be waited for
+				// again
+				status = http.StatusServiceUnavailable
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	app.readOnly.mu.RLock()
+	mode := readOnlyStatus{Enabled: app.readOnly.enabled, Writes: app.readOnly.writes}
+	app.readOnly.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(mode); err != nil {
+		dcontext.GetLogger(app).Errorf("error encoding read-only mode: %v", err)
+	}
+}
+
+// writeHandler returns the handler of a write operation, rejecting the
+// requests with a Retry-After header while the registry is in read-only mode.
+// The writes served are counted until they complete, see WaitWrites.
+func (ctx *Context) writeHandler(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter := ctx.App.readOnly.startWrite()
+		if allowed {
+			defer ctx.App.readOnly.doneWrite()
+			handler(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnavailable.WithMessage("registry is in read-only maintenance mode"))
+	})
+}
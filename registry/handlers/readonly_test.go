@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+func TestReadOnlyModeEndpoint(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	for _, tc := range []struct {
+		method, body string
+		status       int
+		response     string
+	}{
+		{"GET", "", http.StatusOK, `{"enabled":false,"writes":0}`},
+		{"PUT", `{"enabled": true}`, http.StatusOK, `{"enabled":true,"writes":0}`},
+		{"GET", "", http.StatusOK, `{"enabled":true,"writes":0}`},
+		{"PUT", `enabled`, http.StatusBadRequest, ""},
+		{"POST", `{"enabled": false}`, http.StatusMethodNotAllowed, ""},
+		{"PUT", `{"enabled": false}`, http.StatusOK, `{"enabled":false,"writes":0}`},
+	} {
+		w := httptest.NewRecorder()
+		env.app.serveReadOnlyMode(w, httptest.NewRequest(tc.method, "/debug/readonly", strings.NewReader(tc.body)))
+		if w.Code != tc.status {
+			t.Fatalf("%s %s: unexpected status %d: %s", tc.method, tc.body, w.Code, w.Body)
+		}
+		if tc.response != "" && strings.TrimSpace(w.Body.String()) != tc.response {
+			t.Fatalf("%s %s: unexpected response %s", tc.method, tc.body, w.Body)
+		}
+	}
+	if env.app.ReadOnly() {
+		t.Fatal("expected the registry to be writable")
+	}
+}
+
+func TestReadOnlyModeWaitsForWrites(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	ctx := &Context{App: env.app}
+	write := ctx.writeHandler(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	done := make(chan struct{})
+	go func() {
+		write.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/", nil))
+		close(done)
+	}()
+	<-started
+
+	switchOn := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		env.app.serveReadOnlyMode(w, httptest.NewRequest("PUT", url, strings.NewReader(`{"enabled": true}`)))
+		return w
+	}
+
+	w := switchOn("/debug/readonly?wait=10ms")
+	if w.Code != http.StatusServiceUnavailable || strings.TrimSpace(w.Body.String()) != `{"enabled":true,"writes":1}` {
+		t.Fatalf("unexpected response with a write being served: %d %s", w.Code, w.Body)
+	}
+	if !env.app.ReadOnly() {
+		t.Fatal("expected the registry to be read-only")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	w = switchOn("/debug/readonly")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"enabled":true,"writes":0}` {
+		t.Fatalf("unexpected response once the write completed: %d %s", w.Code, w.Body)
+	}
+	<-done
+
+	if w := switchOn("/debug/readonly?wait=soon"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status with an invalid wait: %d", w.Code)
+	}
+}
+
+func TestReadOnlyModeStopsJobs(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	ctx, done, allowed := env.app.readOnly.startJob(env.app)
+	if !allowed {
+		t.Fatal("expected the job to be allowed")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		done()
+		close(stopped)
+	}()
+
+	env.app.SetReadOnly(true)
+	if err := env.app.WaitWrites(context.Background()); err != nil {
+		t.Fatalf("unexpected error waiting for the job: %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("expected the job to be waited for")
+	}
+	done()
+
+	if _, _, allowed := env.app.readOnly.startJob(env.app); allowed {
+		t.Fatal("expected the job to be refused in read-only mode")
+	}
+	env.app.SetReadOnly(false)
+	ctx, done, allowed = env.app.readOnly.startJob(env.app)
+	if !allowed || ctx.Err() != nil {
+		t.Fatal("expected the job to be allowed once the mode is switched off")
+	}
+	done()
+	if ctx.Err() == nil {
+		t.Fatal("expected the context of the job to be canceled once done")
+	}
+}
+
+func TestReloadReadOnly(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	readOnlyConfig := func(readOnly map[interface{}]interface{}) *configuration.Configuration {
+		return &configuration.Configuration{
+			Storage: configuration.Storage{
+				"testdriver":  configuration.Parameters{},
+				"maintenance": configuration.Parameters{"readonly": readOnly},
+			},
+		}
+	}
+
+	if err := env.app.Reload(readOnlyConfig(map[interface{}]interface{}{"enabled": true, "retryafter": "90s"})); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if !env.app.ReadOnly() {
+		t.Fatal("expected the registry to be read-only")
+	}
+
+	imageName, _ := reference.WithName("foo/bar")
+	layerUploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building layer upload url: %v", err)
+	}
+	resp, err := http.Post(layerUploadURL, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error starting layer push: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "starting push in read-only mode", resp, http.StatusServiceUnavailable)
+	checkHeaders(t, resp, http.Header{"Retry-After": []string{"90"}})
+	checkBodyHasErrorCodes(t, "starting push in read-only mode", resp, errcode.ErrorCodeUnavailable)
+
+	// invalid configurations are not applied
+	for _, readOnly := range []map[interface{}]interface{}{
+		{"enabled": "no"},
+		{"enabled": false, "retryafter": "soon"},
+		{"enabled": false, "retryafter": "-1s"},
+	} {
+		if err := env.app.Reload(readOnlyConfig(readOnly)); err == nil {
+			t.Fatalf("expected an error reloading %v", readOnly)
+		}
+		if !env.app.ReadOnly() {
+			t.Fatalf("read-only mode switched reloading %v", readOnly)
+		}
+	}
+
+	// removing the section makes the registry writable
+	if err := env.app.Reload(&configuration.Configuration{Storage: configuration.Storage{"testdriver": configuration.Parameters{}}}); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if env.app.ReadOnly() {
+		t.Fatal("expected the registry to be writable")
+	}
+	startPushLayer(t, env, imageName)
+
+	// the mode switched at runtime is kept until the configured mode changes
+	env.app.SetReadOnly(true)
+	if err := env.app.Reload(readOnlyConfig(map[interface{}]interface{}{"enabled": false})); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if !env.app.ReadOnly() {
+		t.Fatal("read-only mode switched at runtime not kept")
+	}
+	if err := env.app.Reload(readOnlyConfig(map[interface{}]interface{}{"enabled": true})); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	env.app.SetReadOnly(false)
+	if err := env.app.Reload(readOnlyConfig(map[interface{}]interface{}{"enabled": true})); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if env.app.ReadOnly() {
+		t.Fatal("read-only mode switched off at runtime not kept")
+	}
+	if err := env.app.Reload(readOnlyConfig(map[interface{}]interface{}{"enabled": false})); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if err := env.app.Reload(readOnlyConfig(map[interface{}]interface{}{"enabled": true})); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if !env.app.ReadOnly() {
+		t.Fatal("expected the registry to be read-only once the configured mode changed")
+	}
+}
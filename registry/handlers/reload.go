@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/registry/auth"
+)
+
+// Reload applies the sections of the configuration which may change while
+// the registry is running: the read-only maintenance mode, the log hooks, the
+// notification endpoints and brokers, the access controller, the repository middleware
+// and the health checks. Requests being served complete with the previous
+// settings. The notification endpoints and the health checks are only
+// replaced if their section changed, so that the events queued and the
+// status of the checks are kept. Nothing is applied if any of these sections
+// is invalid.
+func (app *App) Reload(config *configuration.Configuration) error {
+	readOnly, retryAfter, err := readOnlyConfig(config)
+	if err != nil {
+		return err
+	}
+	accessController, err := newAccessController(config)
+	if err != nil {
+		return err
+	}
+	var healthChecks []healthCheck
+	reloadHealth := app.healthRegistry != nil && !reflect.DeepEqual(app.healthConfig, config.Health)
+	if reloadHealth {
+		if healthChecks, err = app.newHealthChecks(config.Health); err != nil {
+			return err
+		}
+	}
+	var endpoints notifications.Sink
+	endpointsConfig := config.Notifications
+	endpointsConfig.EventConfig = app.events.endpointsConfig.EventConfig
+	if app.events.endpoints != nil && !reflect.DeepEqual(app.events.endpointsConfig, endpointsConfig) {
+		if endpoints, err = app.newEndpointSink(config.Notifications); err != nil {
+			return err
+		}
+	}
+
+	app.mu.Lock()
+	app.accessController = accessController
+	app.repositoryMiddleware = config.Middleware["repository"]
+	app.mu.Unlock()
+
+	app.setReadOnlyConfig(readOnly, retryAfter)
+
+	if app.logHooks != nil {
+		app.logHooks.replace(newLogHooks(config.Log.Hooks))
+	}
+
+	if endpoints != nil {
+		previous := app.events.endpoints.replace(endpoints)
+		app.events.endpointsConfig = endpointsConfig
+
+		// the events queued in memory are delivered before the previous
+		// endpoints are closed, without delaying the requests. The new
+		// persistent queues replay the events of the previous ones once
+		// they are closed.
+		go func() {
+			if err := previous.Close(); err != nil {
+				dcontext.GetLogger(app).Errorf("error closing notification endpoints: %v", err)
+			}
+		}()
+	}
+
+	if reloadHealth {
+		app.registerHealthChecks(healthChecks)
+		app.healthConfig = config.Health
+	}
+
+	return nil
+}
+
+// newAccessController returns the access controller of the configuration,
+// nil if authorization is not configured.
+func newAccessController(config *configuration.Configuration) (auth.AccessController, error) {
+	authType := config.Auth.Type()
+	if authType == "" || strings.EqualFold(authType, "none") {
+		return nil, nil
+	}
+
+	accessController, err := auth.GetAccessController(authType, config.Auth.Parameters())
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure authorization (%s): %v", authType, err)
+	}
+	return accessController, nil
+}
+
+// endpointSink forwards events to the sink of the notification endpoints,
+// which is replaced when the configuration is reloaded.
+type endpointSink struct {
+	mu   sync.RWMutex
+	sink notifications.Sink
+}
+
+// Write writes the events to the current endpoints.
+func (s *endpointSink) Write(events ...notifications.Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sink.Write(events...)
+}
+
+// Close closes the current endpoints.
+func (s *endpointSink) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sink.Close()
+}
+
+// replace makes the sink forward events to sink, returning the previous one
+// once no more events are written to it.
+func (s *endpointSink) replace(sink notifications.Sink) notifications.Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.sink
+	s.sink = sink
+	return previous
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/health"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/testutil"
+)
+
+func TestReload(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	healthRegistry := health.NewRegistry()
+	env.app.RegisterHealthChecks(healthRegistry)
+
+	var mu sync.Mutex
+	var actions []string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envelope notifications.Envelope
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, event := range envelope.Events {
+			actions = append(actions, event.Action)
+		}
+	}))
+	defer endpoint.Close()
+
+	dir, err := ioutil.TempDir("", "reload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// file checks fail while the file exists
+	downFile := filepath.Join(dir, "down")
+	if err := ioutil.WriteFile(downFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	newConfig := func(auth configuration.Auth) *configuration.Configuration {
+		config := &configuration.Configuration{
+			Storage: configuration.Storage{"testdriver": configuration.Parameters{}},
+			Auth:    auth,
+		}
+		config.Notifications.Endpoints = []configuration.Endpoint{{Name: "endpoint", URL: endpoint.URL}}
+		config.Health.FileCheckers = []configuration.FileChecker{{File: downFile, Interval: 10 * time.Millisecond}}
+		return config
+	}
+
+	if err := env.app.Reload(newConfig(nil)); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+
+	// the events are sent to the endpoint added
+	imageName, _ := reference.WithName("foo/bar")
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		received := len(actions)
+		mu.Unlock()
+		if received > 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("no event received by the endpoint")
+		}
+	}
+
+	// the health checks are replaced
+	time.Sleep(50 * time.Millisecond)
+	if status := healthRegistry.CheckStatus(); len(status) != 1 {
+		t.Fatalf("unexpected health checks: %v", status)
+	}
+
+	// the access controller is replaced, while the health checks which did
+	// not change keep their status
+	sillyAuth := configuration.Auth{"silly": {"realm": "realm-test", "service": "service-test"}}
+	if err := env.app.Reload(newConfig(sillyAuth)); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if status := healthRegistry.CheckStatus(); len(status) != 1 {
+		t.Fatalf("health checks replaced: %v", status)
+	}
+	checkBaseStatus(t, env, http.StatusUnauthorized)
+
+	// invalid configurations are not applied
+	config := newConfig(configuration.Auth{"missing": {}})
+	config.Health.FileCheckers = nil
+	if err := env.app.Reload(config); err == nil {
+		t.Fatal("expected an error reloading an unknown access controller")
+	}
+	config = newConfig(nil)
+	config.Health.FileCheckers = append(config.Health.FileCheckers, config.Health.FileCheckers[0])
+	if err := env.app.Reload(config); err == nil {
+		t.Fatal("expected an error reloading duplicate health checks")
+	}
+	queue := configuration.EndpointQueue{Directory: filepath.Join(dir, "queue")}
+	config = newConfig(nil)
+	config.Notifications.Endpoints = []configuration.Endpoint{
+		{Name: "endpoint", URL: endpoint.URL, Queue: queue},
+		{Name: "other", URL: endpoint.URL, Queue: queue},
+	}
+	if err := env.app.Reload(config); err == nil {
+		t.Fatal("expected an error reloading endpoints sharing a queue directory")
+	}
+	queue.DropPolicy = "random"
+	config.Notifications.Endpoints = config.Notifications.Endpoints[:1]
+	config.Notifications.Endpoints[0].Queue = queue
+	if err := env.app.Reload(config); err == nil {
+		t.Fatal("expected an error reloading an unknown drop policy")
+	}
+	config = newConfig(nil)
+	config.Notifications.Brokers = []configuration.Broker{{Name: "broker", Type: "missing"}}
+	if err := env.app.Reload(config); err == nil {
+		t.Fatal("expected an error reloading an unknown broker type")
+	}
+	config = newConfig(nil)
+	config.Notifications.Endpoints[0].Filter.Include = []configuration.FilterRule{{Repository: "prod/["}}
+	if err := env.app.Reload(config); err == nil {
+		t.Fatal("expected an error reloading an invalid filter")
+	}
+	checkBaseStatus(t, env, http.StatusUnauthorized)
+	time.Sleep(50 * time.Millisecond)
+	if status := healthRegistry.CheckStatus(); len(status) != 1 {
+		t.Fatalf("unexpected health checks: %v", status)
+	}
+
+	config = &configuration.Configuration{Storage: configuration.Storage{"testdriver": configuration.Parameters{}}}
+	if err := env.app.Reload(config); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	checkBaseStatus(t, env, http.StatusOK)
+	if status := healthRegistry.CheckStatus(); len(status) != 0 {
+		t.Fatalf("unexpected health checks: %v", status)
+	}
+}
+
+func checkBaseStatus(t *testing.T, env *testEnv, status int) {
+	baseURL, err := env.builder.BuildBaseURL()
+	if err != nil {
+		t.Fatalf("unexpected error building base url: %v", err)
+	}
+	resp, err := http.Get(baseURL)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "issuing base request", resp, status)
+}
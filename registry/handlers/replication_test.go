@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/reference"
+)
+
+func TestReplicationToPeer(t *testing.T) {
+	targetEnv := newTestEnv(t, false)
+	defer targetEnv.Shutdown()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Replication: configuration.Replication{
+			Targets: []configuration.ReplicationTarget{
+				{Name: "peer", URL: targetEnv.server.URL},
+			},
+			Backoff: 10 * time.Millisecond,
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/replicated")
+	dgst := createRepository(env, t, imageName.Name(), "latest")
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := targetEnv.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	var resp *http.Response
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		resp, err = http.Head(manifestURL)
+		checkErr(t, err, "checking replicated manifest")
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+	}
+	checkResponse(t, "checking replicated manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// the status is updated once the job is removed from the queue
+	status := env.app.replicator.Status()["peer"][imageName.Name()]
+	for start := time.Now(); status.LastDigest != dgst && time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		status = env.app.replicator.Status()["peer"][imageName.Name()]
+	}
+	if status.LastDigest != dgst || status.Pending != 0 || status.LastError != "" {
+		t.Fatalf("unexpected replication status: %+v", status)
+	}
+}
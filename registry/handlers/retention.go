@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/uuid"
+)
+
+// defaultRetentionInterval is the default time in between evaluations of
+// the tag retention rules.
+const defaultRetentionInterval = 24 * time.Hour
+
+// retentionActor is the actor name recorded in events for tags removed by
+// the retention job.
+const retentionActor = "registry-retention"
+
+// retentionRule is a compiled configuration.RetentionRule.
+type retentionRule struct {
+	repositories configuration.RepositoryPatterns
+	rule         storage.TagRetentionRule
+}
+
+// tagPruner removes tags according to the configured retention rules.
+type tagPruner struct {
+	registry distribution.Namespace // storage namespace, without middleware
+	rules    []retentionRule
+	dryRun   bool
+	listener notifications.Listener
+	// immutable reports the tags to leave in place, if any
+	immutable storage.TagImmutabilityFunc
+}
+
+// newTagPruner compiles the retention configuration, panicking if it is
+// invalid.
+func newTagPruner(app *App, registry distribution.Namespace, config configuration.Retention) *tagPruner {
+	pruner := &tagPruner{
+		registry:  registry,
+		dryRun:    config.DryRun,
+		immutable: app.immutableTags,
+	}
+
+	for i, r := range config.Rules {
+		if len(r.Repositories) == 0 {
+			panic(fmt.Sprintf("policy.retention.rules[%d]: no repositories", i))
+		}
+		if err := r.Repositories.Validate(); err != nil {
+			panic(fmt.Sprintf("policy.retention.rules[%d].repositories: %s", i, err))
+		}
+
+		rule := retentionRule{
+			repositories: r.Repositories,
+			rule: storage.TagRetentionRule{
+				KeepLast:  r.KeepLast,
+				OlderThan: r.OlderThan,
+			},
+		}
+		for _, s := range r.KeepTags {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				panic(fmt.Sprintf("policy.retention.rules[%d].keeptags: %s", i, err))
+			}
+			rule.rule.KeepTags = append(rule.rule.KeepTags, re)
+		}
+
+		pruner.rules = append(pruner.rules, rule)
+	}
+
+	// without a configured host, only relative urls can be built
+	urlBuilder := v2.NewURLBuilder(&app.httpHost, app.httpHost.Host == "")
+	pruner.listener = notifications.NewBridge(urlBuilder, app.events.source, notifications.ActorRecord{Name: retentionActor},
+		notifications.RequestRecord{ID: uuid.Generate().String()}, app.events.sink, app.Config.Notifications.EventConfig.IncludeReferences)
+
+	return pruner
+}
+
+// match returns the first rule applying to the named repository.
+func (tp *tagPruner) match(name string) (storage.TagRetentionRule, bool) {
+	for _, r := range tp.rules {
+		if r.repositories.Matches(name) {
+			return r.rule, true
+		}
+	}
+	return storage.TagRetentionRule{}, false
+}
+
+// prune evaluates the retention rules against every repository, returning
+// the references of the tags which were removed, or which would have been
+// removed in dry-run mode, stopping once the context is done.
+func (tp *tagPruner) prune(ctx context.Context) ([]reference.NamedTagged, error) {
+	enumerator, ok := tp.registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	var pruned []reference.NamedTagged
+	now := time.Now()
+	err := enumerator.Enumerate(ctx, func(repoName string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rule, ok := tp.match(repoName)
+		if !ok {
+			return nil
+		}
+
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := tp.registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+
+		expired, err := storage.ExpiredTags(ctx, repository, rule, now)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate tags of %s: %v", repoName, err)
+		}
+
+		// untag through the listener so that delete events are emitted
+		repository, _ = notifications.Listen(repository, nil, tp.listener)
+		tags := repository.Tags(ctx)
+		for _, tag := range expired {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			ref, err := reference.WithTag(named, tag)
+			if err != nil {
+				return err
+			}
+
+			if tp.immutable != nil && tp.immutable(ctx, repoName, tag) {
+				dcontext.GetLogger(ctx).Debugf("retention: keeping immutable tag %s", ref)
+				continue
+			}
+
+			if tp.dryRun {
+				dcontext.GetLogger(ctx).Infof("retention: would remove tag %s", ref)
+			} else {
+				dcontext.GetLogger(ctx).Infof("retention: removing tag %s", ref)
+				if err := tags.Untag(ctx, tag); err != nil {
+					return fmt.Errorf("failed to remove tag %s: %v", ref, err)
+				}
+			}
+			pruned = append(pruned, ref)
+		}
+
+		return nil
+	})
+
+	return pruned, err
+}
+
+// startTagRetention schedules a goroutine which will periodically remove
+// tags according to the configured retention rules, unless the registry is in
+// read-only mode. Pruning is interrupted when the mode is switched on.
+func startTagRetention(ctx context.Context, pruner *tagPruner, log dcontext.Logger, interval time.Duration, readOnly *readOnlyMode) {
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+
+	go func() {
+		rand.Seed(time.Now().Unix())
+		jitter := time.Duration(rand.Int()%60) * time.Minute
+		log.Infof("Starting tag retention in %s", jitter)
+		time.Sleep(jitter)
+
+		for {
+			if ctx, done, allowed := readOnly.startJob(ctx); !allowed {
+				log.Warnf("Registry is read-only, skipping tag retention")
+			} else {
+				pruned, err := pruner.prune(ctx)
+				done()
+				if err != nil {
+					log.Errorf("Tag retention failed: %v", err)
+				}
+				log.Infof("Tag retention finished. Num pruned=%d, dryRun=%t", len(pruned), pruner.dryRun)
+			}
+
+			log.Infof("Starting tag retention in %s", interval)
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+type eventRecorder struct {
+	events []notifications.Event
+}
+
+func (er *eventRecorder) Write(events ...notifications.Event) error {
+	er.events = append(er.events, events...)
+	return nil
+}
+
+func (er *eventRecorder) Close() error {
+	return nil
+}
+
+func TestTagRetention(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	tagServices := make(map[string]distribution.TagService)
+	for _, name := range []string{"ci/app", "prod/app"} {
+		named, _ := reference.WithName(name)
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tagServices[name] = repo.Tags(ctx)
+
+		// repositories are only enumerated once they contain layers
+		desc, err := repo.Blobs(ctx).Put(ctx, "application/octet-stream", []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tag := range []string{"build-1", "v1.0", "build-2", "build-3"} {
+			if err := tagServices[name].Tag(ctx, tag, desc); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+
+	recorder := &eventRecorder{}
+	app := &App{
+		Config:  &configuration.Configuration{},
+		Context: ctx,
+	}
+	app.events.sink = recorder
+
+	config := configuration.Retention{
+		DryRun: true,
+		Rules: []configuration.RetentionRule{
+			{
+				Repositories: []string{"ci/*"},
+				KeepLast:     1,
+				KeepTags:     []string{"^v"},
+			},
+		},
+	}
+
+	pruned, err := newTagPruner(app, registry, config).prune(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error pruning tags: %v", err)
+	}
+	if len(pruned) != 2 || len(recorder.events) != 0 {
+		t.Fatalf("unexpected dry run result: %v, %d events", pruned, len(recorder.events))
+	}
+
+	config.DryRun = false
+	if _, err := newTagPruner(app, registry, config).prune(ctx); err != nil {
+		t.Fatalf("unexpected error pruning tags: %v", err)
+	}
+
+	for name, expected := range map[string][]string{
+		"ci/app":   {"build-3", "v1.0"},
+		"prod/app": {"build-1", "build-2", "build-3", "v1.0"},
+	} {
+		tags, err := tagServices[name].All(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(tags)
+		if !reflect.DeepEqual(tags, expected) {
+			t.Errorf("unexpected tags in %s: %v != %v", name, tags, expected)
+		}
+	}
+
+	// each tag removed emits a delete and a tag_delete event
+	if len(recorder.events) != 4 {
+		t.Fatalf("unexpected number of events: %d", len(recorder.events))
+	}
+	for i, event := range recorder.events {
+		tag := []string{"build-1", "build-2"}[i/2]
+		action := []string{notifications.EventActionDelete, notifications.EventActionTagDelete}[i%2]
+		if event.Action != action || event.Target.Repository != "ci/app" || event.Target.Tag != tag {
+			t.Errorf("unexpected event: %+v", event)
+		}
+		if action == notifications.EventActionTagDelete && event.Target.PreviousDigest == "" {
+			t.Errorf("no previous digest in event: %+v", event)
+		}
+		if event.Actor.Name != retentionActor {
+			t.Errorf("unexpected actor: %q", event.Actor.Name)
+		}
+	}
+}
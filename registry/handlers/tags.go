@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/registry/api/errcode"
@@ -10,6 +14,10 @@ import (
 	"github.com/gorilla/handlers"
 )
 
+// maximumReturnedTags is the maximum number of tags returned by a request
+// with the n parameter: a larger n is reduced to it.
+const maximumReturnedTags = 1000
+
 // tagsDispatcher constructs the tags handler api endpoint.
 func tagsDispatcher(ctx *Context, r *http.Request) http.Handler {
 	tagsHandler := &tagsHandler{
@@ -31,13 +39,51 @@ type tagsAPIResponse struct {
 	Tags []string `json:"tags"`
 }
 
-// GetTags returns a json list of tags for a specific image name.
+// GetTags returns a json list of tags for a specific image name. The list is
+// paginated with the n and last query parameters, in the same way as the
+// catalog. All the tags after last are returned when n is absent, and at most
+// maximumReturnedTags when it is larger.
 func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	var moreEntries = true
+
+	q := r.URL.Query()
+	lastEntry := q.Get("last")
+
+	var (
+		tags   []string
+		filled int
+		err    error
+	)
 	tagService := th.Repository.Tags(th)
-	tags, err := tagService.All(th)
-	if err != nil {
+	if _, paginated := q["n"]; !paginated {
+		tags, err = allTagsAfter(th, tagService, lastEntry)
+		filled = len(tags)
+		if err == nil {
+			err = io.EOF
+		}
+	} else {
+		maxEntries, convErr := strconv.Atoi(q.Get("n"))
+		if convErr != nil || maxEntries < 0 {
+			th.Errors = append(th.Errors, v2.ErrorCodePaginationNumberInvalid.WithDetail(map[string]string{"n": q.Get("n")}))
+			return
+		}
+		if maxEntries > maximumReturnedTags {
+			maxEntries = maximumReturnedTags
+		}
+
+		tags = make([]string, maxEntries)
+		if maxEntries > 0 {
+			filled, err = distribution.ListTags(th, tagService, tags, lastEntry)
+		} else {
+			err = io.EOF
+		}
+	}
+
+	if err == io.EOF {
+		moreEntries = false
+	} else if err != nil {
 		switch err := err.(type) {
 		case distribution.ErrRepositoryUnknown:
 			th.Errors = append(th.Errors, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": th.Repository.Named().Name()}))
@@ -51,12 +97,37 @@ func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
+	// Add a link header if there are more entries to retrieve
+	if moreEntries {
+		lastEntry = tags[len(tags)-1]
+		urlStr, err := createLinkEntry(r.URL.String(), len(tags), lastEntry)
+		if err != nil {
+			th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		w.Header().Set("Link", urlStr)
+	}
+
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(tagsAPIResponse{
 		Name: th.Repository.Named().Name(),
-		Tags: tags,
+		Tags: tags[0:filled],
 	}); err != nil {
 		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
 	}
 }
+
+// allTagsAfter returns the tags of the repository sorted lexically, starting
+// after last if it is set.
+func allTagsAfter(ctx context.Context, tagService distribution.TagService, last string) ([]string, error) {
+	tags, err := tagService.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+	if last != "" {
+		tags = tags[sort.Search(len(tags), func(i int) bool { return tags[i] > last }):]
+	}
+	return tags, nil
+}
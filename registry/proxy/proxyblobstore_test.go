@@ -182,6 +182,7 @@ func makeTestEnv(t *testing.T, name string) *testEnv {
 		remoteStore:    truthBlobs,
 		localStore:     localBlobs,
 		scheduler:      s,
+		ttl:            repositoryTTL,
 		authChallenger: &mockChallenger{},
 	}
 
@@ -144,6 +144,7 @@ func newManifestStoreTestEnv(t *testing.T, name, tag string) *manifestStoreTestE
 			localManifests:  localManifests,
 			remoteManifests: truthManifests,
 			scheduler:       s,
+			ttl:             repositoryTTL,
 			repositoryName:  nameRef,
 			authChallenger:  &mockChallenger{},
 		},
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/configuration"
@@ -20,21 +23,61 @@ import (
 	"github.com/docker/distribution/registry/storage/driver"
 )
 
-// proxyingRegistry fetches content from a remote registry and caches it locally
+// proxyingRegistry fetches content from remote registries and caches it locally
 type proxyingRegistry struct {
-	embedded       distribution.Namespace // provides local registry functionality
-	scheduler      *scheduler.TTLExpirationScheduler
+	embedded    distribution.Namespace // provides local registry functionality
+	scheduler   *scheduler.TTLExpirationScheduler
+	upstreams   []*upstream // ordered from the longest to the shortest prefix
+	pushThrough bool        // serve repositories outside the upstreams locally
+}
+
+// upstream is a remote registry whose repositories are mirrored under a
+// prefix of the local repository names.
+type upstream struct {
+	prefix         string // empty for the catch-all remote
 	remoteURL      url.URL
+	ttl            time.Duration
 	authChallenger authChallenger
 }
 
 // NewRegistryPullThroughCache creates a registry acting as a pull through cache
 func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	remoteURL, err := url.Parse(config.RemoteURL)
-	if err != nil {
-		return nil, err
+	if config.PushThrough && config.RemoteURL != "" {
+		return nil, fmt.Errorf("proxy push-through requires upstreams without remoteurl")
+	}
+
+	var upstreams []*upstream
+	if config.RemoteURL != "" {
+		u, err := newUpstream("", config.RemoteURL, config.Username, config.Password, 0)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	prefixes := make(map[string]struct{})
+	for _, c := range config.Upstreams {
+		prefix := strings.Trim(strings.TrimSuffix(c.Prefix, "/*"), "/")
+		if prefix == "" {
+			return nil, fmt.Errorf("proxy upstream %s has no prefix", c.RemoteURL)
+		}
+		if _, ok := prefixes[prefix]; ok {
+			return nil, fmt.Errorf("duplicate proxy upstream prefix %s", prefix)
+		}
+		prefixes[prefix] = struct{}{}
+
+		u, err := newUpstream(prefix, c.RemoteURL, c.Username, c.Password, c.TTL)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
 	}
 
+	// the most specific prefix wins, the catch-all remote comes last
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return len(upstreams[i].prefix) > len(upstreams[j].prefix)
+	})
+
 	v := storage.NewVacuum(ctx, driver)
 	s := scheduler.New(ctx, driver, "/scheduler-state.json")
 	s.OnBlobExpire(func(ref reference.Reference) error {
@@ -57,6 +100,12 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 			return err
 		}
 
+		// Locally hosted repositories may link the same blob, leave its
+		// data to garbage collection
+		if config.PushThrough {
+			return nil
+		}
+
 		err = v.RemoveBlob(r.Digest().String())
 		if err != nil {
 			return err
@@ -88,20 +137,40 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 		return nil
 	})
 
-	err = s.Start()
+	err := s.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyingRegistry{
+		embedded:    registry,
+		scheduler:   s,
+		upstreams:   upstreams,
+		pushThrough: config.PushThrough,
+	}, nil
+}
+
+// newUpstream configures the credentials used to access a remote registry.
+// A zero ttl selects the default.
+func newUpstream(prefix, rawURL, username, password string, ttl time.Duration) (*upstream, error) {
+	remoteURL, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, err
 	}
 
-	cs, err := configureAuth(config.Username, config.Password, config.RemoteURL)
+	cs, err := configureAuth(username, password, rawURL)
 	if err != nil {
 		return nil, err
 	}
 
-	return &proxyingRegistry{
-		embedded:  registry,
-		scheduler: s,
+	if ttl <= 0 {
+		ttl = repositoryTTL
+	}
+
+	return &upstream{
+		prefix:    prefix,
 		remoteURL: *remoteURL,
+		ttl:       ttl,
 		authChallenger: &remoteAuthChallenger{
 			remoteURL: *remoteURL,
 			cm:        challenge.NewSimpleManager(),
@@ -110,6 +179,25 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 	}, nil
 }
 
+// route returns the upstream serving the named repository, along with the
+// name of the repository in the remote registry.
+func (pr *proxyingRegistry) route(name reference.Named) (*upstream, reference.Named, error) {
+	for _, u := range pr.upstreams {
+		if u.prefix == "" {
+			return u, name, nil
+		}
+		if strings.HasPrefix(name.Name(), u.prefix+"/") {
+			remoteName, err := reference.WithName(strings.TrimPrefix(name.Name(), u.prefix+"/"))
+			if err != nil {
+				return nil, nil, err
+			}
+			return u, remoteName, nil
+		}
+	}
+
+	return nil, nil, distribution.ErrRepositoryUnknown{Name: name.Name()}
+}
+
 func (pr *proxyingRegistry) Scope() distribution.Scope {
 	return distribution.GlobalScope
 }
@@ -119,14 +207,22 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 }
 
 func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
-	c := pr.authChallenger
+	u, remoteName, err := pr.route(name)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok && pr.pushThrough {
+			// not mirrored, the repository is hosted locally
+			return pr.embedded.Repository(ctx, name)
+		}
+		return nil, err
+	}
+	c := u.authChallenger
 
 	tkopts := auth.TokenHandlerOptions{
 		Transport:   http.DefaultTransport,
 		Credentials: c.credentialStore(),
 		Scopes: []auth.Scope{
 			auth.RepositoryScope{
-				Repository: name.Name(),
+				Repository: remoteName.Name(),
 				Actions:    []string{"pull"},
 			},
 		},
@@ -146,7 +242,7 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(name, pr.remoteURL.String(), tr)
+	remoteRepo, err := client.NewRepository(remoteName, u.remoteURL.String(), tr)
 	if err != nil {
 		return nil, err
 	}
@@ -161,8 +257,9 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 			localStore:     localRepo.Blobs(ctx),
 			remoteStore:    remoteRepo.Blobs(ctx),
 			scheduler:      pr.scheduler,
+			ttl:            u.ttl,
 			repositoryName: name,
-			authChallenger: pr.authChallenger,
+			authChallenger: c,
 		},
 		manifests: &proxyManifestStore{
 			repositoryName:  name,
@@ -170,13 +267,14 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 			remoteManifests: remoteManifests,
 			ctx:             ctx,
 			scheduler:       pr.scheduler,
-			authChallenger:  pr.authChallenger,
+			ttl:             u.ttl,
+			authChallenger:  c,
 		},
 		name: name,
 		tags: &proxyTagService{
 			localTags:      localRepo.Tags(ctx),
 			remoteTags:     remoteRepo.Tags(ctx),
-			authChallenger: pr.authChallenger,
+			authChallenger: c,
 		},
 	}, nil
 }
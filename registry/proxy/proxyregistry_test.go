@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestProxyingRegistryRoute(t *testing.T) {
+	pr := &proxyingRegistry{
+		upstreams: []*upstream{
+			{prefix: "quay/internal"},
+			{prefix: "dockerhub"},
+			{prefix: "quay"},
+		},
+	}
+
+	for _, testcase := range []struct {
+		name     string
+		prefix   string
+		expected string
+	}{
+		{"dockerhub/library/ubuntu", "dockerhub", "library/ubuntu"},
+		{"quay/coreos/etcd", "quay", "coreos/etcd"},
+		{"quay/internal/app", "quay/internal", "app"},
+		{"quayio/coreos/etcd", "", ""},
+		{"dockerhub", "", ""},
+	} {
+		name, _ := reference.WithName(testcase.name)
+		u, remoteName, err := pr.route(name)
+		if testcase.prefix == "" {
+			if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+				t.Errorf("%s: expected unknown repository, got %v", testcase.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", testcase.name, err)
+			continue
+		}
+		if u.prefix != testcase.prefix || remoteName.Name() != testcase.expected {
+			t.Errorf("%s: routed to %s as %s, expected %s as %s", testcase.name, u.prefix, remoteName, testcase.prefix, testcase.expected)
+		}
+	}
+
+	// a remote without prefix serves the remaining repositories unchanged
+	pr.upstreams = append(pr.upstreams, &upstream{})
+	name, _ := reference.WithName("quayio/coreos/etcd")
+	u, remoteName, err := pr.route(name)
+	if err != nil || u.prefix != "" || remoteName.Name() != name.Name() {
+		t.Errorf("unexpected route for %s: %v, %v", name, remoteName, err)
+	}
+}
+
+func TestPushThroughRequiresUpstreams(t *testing.T) {
+	config := configuration.Proxy{
+		RemoteURL:   "https://registry-1.docker.io",
+		PushThrough: true,
+	}
+	if _, err := NewRegistryPullThroughCache(context.Background(), nil, inmemory.New(), config); err == nil {
+		t.Fatalf("expected error combining push-through with a remote for all repositories")
+	}
+}
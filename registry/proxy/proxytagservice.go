@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"io"
 
 	"github.com/docker/distribution"
 )
@@ -61,6 +62,17 @@ func (pt proxyTagService) All(ctx context.Context) ([]string, error) {
 	return pt.localTags.All(ctx)
 }
 
+func (pt proxyTagService) List(ctx context.Context, tags []string, last string) (int, error) {
+	err := pt.authChallenger.tryEstablishChallenges(ctx)
+	if err == nil {
+		n, err := distribution.ListTags(ctx, pt.remoteTags, tags, last)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+	}
+	return distribution.ListTags(ctx, pt.localTags, tags, last)
+}
+
 func (pt proxyTagService) Lookup(ctx context.Context, digest distribution.Descriptor) ([]string, error) {
 	return []string{}, distribution.ErrUnsupported
 }
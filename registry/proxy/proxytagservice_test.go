@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"io"
 	"reflect"
 	"sort"
 	"sync"
@@ -58,6 +59,21 @@ func (m *mockTagStore) All(ctx context.Context) ([]string, error) {
 	return tags, nil
 }
 
+func (m *mockTagStore) List(ctx context.Context, tags []string, last string) (int, error) {
+	all, _ := m.All(ctx)
+	sort.Strings(all)
+
+	i := sort.SearchStrings(all, last)
+	if i < len(all) && all[i] == last {
+		i++
+	}
+	n := copy(tags, all[i:])
+	if i+n == len(all) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 func (m *mockTagStore) Lookup(ctx context.Context, digest distribution.Descriptor) ([]string, error) {
 	panic("not implemented")
 }
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -34,6 +35,10 @@ import (
 // this channel gets notified when process receives signal. It is global to ease unit testing
 var quit = make(chan os.Signal, 1)
 
+// reload gets notified when the process receives SIGHUP, to reload the
+// configuration. It is global to ease unit testing
+var reload = make(chan os.Signal, 1)
+
 // ServeCmd is a cobra command for running the registry.
 var ServeCmd = &cobra.Command{
 	Use:   "serve <config>",
@@ -65,6 +70,11 @@ var ServeCmd = &cobra.Command{
 			log.Fatalln(err)
 		}
 
+		signal.Notify(reload, syscall.SIGHUP)
+		go registry.reloadOnSignal(func() (*configuration.Configuration, error) {
+			return resolveConfiguration(args)
+		})
+
 		if config.HTTP.Debug.Prometheus.Enabled {
 			path := config.HTTP.Debug.Prometheus.Path
 			if path == "" {
@@ -83,9 +93,14 @@ var ServeCmd = &cobra.Command{
 // A Registry represents a complete instance of the registry.
 // TODO(aaronl): It might make sense for Registry to become an interface.
 type Registry struct {
+	mu     sync.Mutex // guards config, replaced when reloaded
 	config *configuration.Configuration
 	app    *handlers.App
 	server *http.Server
+
+	// certificate is the TLS certificate served, if loaded from the
+	// configured files
+	certificate *certificate
 }
 
 // NewRegistry creates a new registry from a context and configuration struct.
@@ -106,6 +121,8 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 	// TODO(aaronl): The global scope of the health checks means NewRegistry
 	// can only be called once per process.
 	app.RegisterHealthChecks()
+	app.RegisterReplicationStatus()
+	app.RegisterReadOnlyMode()
 	handler := configureReporting(app)
 	handler = alive("/", handler)
 	handler = health.Handler(handler)
@@ -119,15 +136,18 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 	}
 
 	return &Registry{
-		app:    app,
-		config: config,
-		server: server,
+		app:         app,
+		config:      config,
+		server:      server,
+		certificate: &certificate{},
 	}, nil
 }
 
 // ListenAndServe runs the registry's HTTP server.
 func (registry *Registry) ListenAndServe() error {
+	registry.mu.Lock()
 	config := registry.config
+	registry.mu.Unlock()
 
 	ln, err := listener.NewListener(config.HTTP.Net, config.HTTP.Addr)
 	if err != nil {
@@ -184,11 +204,12 @@ func (registry *Registry) ListenAndServe() error {
 			}
 			tlsConf.GetCertificate = m.GetCertificate
 		} else {
-			tlsConf.Certificates = make([]tls.Certificate, 1)
-			tlsConf.Certificates[0], err = tls.LoadX509KeyPair(config.HTTP.TLS.Certificate, config.HTTP.TLS.Key)
-			if err != nil {
+			// the certificate is loaded again when the configuration is
+			// reloaded
+			if err := registry.certificate.load(config.HTTP.TLS.Certificate, config.HTTP.TLS.Key); err != nil {
 				return err
 			}
+			tlsConf.GetCertificate = registry.certificate.get
 		}
 
 		if len(config.HTTP.TLS.ClientCAs) != 0 {
@@ -272,30 +293,11 @@ func configureReporting(app *handlers.App) http.Handler {
 func configureLogging(ctx context.Context, config *configuration.Configuration) (context.Context, error) {
 	log.SetLevel(logLevel(config.Log.Level))
 
-	formatter := config.Log.Formatter
-	if formatter == "" {
-		formatter = "text" // default formatter
-	}
-
-	switch formatter {
-	case "json":
-		log.SetFormatter(&log.JSONFormatter{
-			TimestampFormat: time.RFC3339Nano,
-		})
-	case "text":
-		log.SetFormatter(&log.TextFormatter{
-			TimestampFormat: time.RFC3339Nano,
-		})
-	case "logstash":
-		log.SetFormatter(&logstash.LogstashFormatter{
-			TimestampFormat: time.RFC3339Nano,
-		})
-	default:
-		// just let the library use default on empty string.
-		if config.Log.Formatter != "" {
-			return ctx, fmt.Errorf("unsupported logging formatter: %q", config.Log.Formatter)
-		}
+	formatter, err := logFormatter(config)
+	if err != nil {
+		return ctx, err
 	}
+	log.SetFormatter(formatter)
 
 	if config.Log.Formatter != "" {
 		log.Debugf("using %q logging formatter", config.Log.Formatter)
@@ -315,6 +317,25 @@ func configureLogging(ctx context.Context, config *configuration.Configuration)
 	return ctx, nil
 }
 
+// logFormatter returns the formatter of the log configuration.
+func logFormatter(config *configuration.Configuration) (log.Formatter, error) {
+	switch config.Log.Formatter {
+	case "json":
+		return &log.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		}, nil
+	case "text", "":
+		return &log.TextFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		}, nil
+	case "logstash":
+		return &logstash.LogstashFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported logging formatter: %q", config.Log.Formatter)
+}
+
 func logLevel(level configuration.Loglevel) log.Level {
 	l, err := log.ParseLevel(string(level))
 	if err != nil {
@@ -98,3 +98,59 @@ func TestGracefulShutdown(t *testing.T) {
 		t.Error("Body is not {}; ", string(body))
 	}
 }
+
+func TestRestartRequired(t *testing.T) {
+	newConfig := func() *configuration.Configuration {
+		config := &configuration.Configuration{}
+		config.Log.Level = "info"
+		config.HTTP.Addr = ":5000"
+		config.HTTP.TLS.Certificate = "/certs/domain.crt"
+		config.HTTP.TLS.Key = "/certs/domain.key"
+		config.Storage = configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{
+				"readonly": map[interface{}]interface{}{"enabled": false},
+			},
+		}
+		return config
+	}
+
+	running := newConfig()
+	running.HTTP.Secret = "generated"
+	running.Validation.Enabled = true
+
+	// the sections reloaded may change
+	reloaded := newConfig()
+	reloaded.Log.Level = "debug"
+	reloaded.HTTP.TLS.Certificate = "/certs/renewed.crt"
+	reloaded.Storage["maintenance"]["readonly"] = map[interface{}]interface{}{"enabled": true}
+	reloaded.Auth = configuration.Auth{"silly": configuration.Parameters{}}
+	reloaded.Notifications.Endpoints = []configuration.Endpoint{{Name: "endpoint"}}
+	reloaded.Middleware = map[string][]configuration.Middleware{"repository": {{Name: "middleware"}}}
+	if restart := restartRequired(running, reloaded); len(restart) != 0 {
+		t.Fatalf("unexpected sections requiring a restart: %v", restart)
+	}
+
+	reloaded.HTTP.Addr = ":5001"
+	reloaded.Storage["maintenance"]["uploadpurging"] = map[interface{}]interface{}{"enabled": false}
+	reloaded.Middleware["storage"] = []configuration.Middleware{{Name: "middleware"}}
+	reloaded.Notifications.EventConfig.IncludeReferences = true
+	expected := []string{"storage", "middleware.storage", "http", "notifications.events"}
+	if restart := restartRequired(running, reloaded); !reflect.DeepEqual(restart, expected) {
+		t.Fatalf("unexpected sections requiring a restart: %v != %v", restart, expected)
+	}
+
+	// the sections reloaded are applied, the others still require a restart
+	applied := appliedConfig(running, reloaded)
+	if applied.HTTP.TLS.Certificate != "/certs/renewed.crt" || applied.Auth["silly"] == nil || applied.HTTP.Addr != ":5000" {
+		t.Fatalf("unexpected configuration applied: %+v", applied)
+	}
+	if restart := restartRequired(applied, reloaded); !reflect.DeepEqual(restart, expected) {
+		t.Fatalf("unexpected sections requiring a restart once reloaded: %v != %v", restart, expected)
+	}
+	reloaded = newConfig()
+	reloaded.HTTP.TLS.Certificate = "/certs/renewed.crt"
+	if restart := restartRequired(applied, reloaded); len(restart) != 0 {
+		t.Fatalf("unexpected sections requiring a restart once reverted: %v", restart)
+	}
+}
@@ -0,0 +1,215 @@
+package registry
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reload applies the sections of config which may change while the registry
+// is running, without interrupting the connections: the log level, formatter
+// and hooks, the TLS certificate, and the sections the application reloads.
+// Nothing is applied if any of these sections is invalid. The sections
+// which changed but are only applied when the registry starts are returned.
+func (registry *Registry) Reload(config *configuration.Configuration) (restart []string, err error) {
+	formatter, err := logFormatter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var cert *tls.Certificate
+	if registry.certificate.loaded() && config.HTTP.TLS.Certificate != "" {
+		c, err := tls.LoadX509KeyPair(config.HTTP.TLS.Certificate, config.HTTP.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		cert = &c
+	}
+
+	if err := registry.app.Reload(config); err != nil {
+		return nil, err
+	}
+
+	log.SetLevel(logLevel(config.Log.Level))
+	log.SetFormatter(formatter)
+	if cert != nil {
+		registry.certificate.set(cert)
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	restart = restartRequired(registry.config, config)
+	registry.config = appliedConfig(registry.config, config)
+	return restart, nil
+}
+
+// reloadOnSignal reloads the configuration each time the process receives
+// SIGHUP. Invalid configurations are logged and ignored.
+func (registry *Registry) reloadOnSignal(resolve func() (*configuration.Configuration, error)) {
+	for range reload {
+		config, err := resolve()
+		if err != nil {
+			dcontext.GetLogger(registry.app).Errorf("error reloading configuration: %v", err)
+			continue
+		}
+		restart, err := registry.Reload(config)
+		if err != nil {
+			dcontext.GetLogger(registry.app).Errorf("error reloading configuration: %v", err)
+			continue
+		}
+		dcontext.GetLogger(registry.app).Info("configuration reloaded")
+		if len(restart) > 0 {
+			dcontext.GetLogger(registry.app).Warnf("configuration changes to %s require a restart", strings.Join(restart, ", "))
+		}
+	}
+}
+
+// restartRequired returns the sections of the configuration which differ
+// between running and reloaded but which the registry only applies when it
+// starts.
+func restartRequired(running, reloaded *configuration.Configuration) []string {
+	var sections []string
+	changed := func(section string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			sections = append(sections, section)
+		}
+	}
+
+	changed("log.accesslog", running.Log.AccessLog, reloaded.Log.AccessLog)
+	changed("log.fields", running.Log.Fields, reloaded.Log.Fields)
+	changed("storage", withoutReadOnly(running.Storage), withoutReadOnly(reloaded.Storage))
+	changed("middleware.registry", running.Middleware["registry"], reloaded.Middleware["registry"])
+	changed("middleware.storage", running.Middleware["storage"], reloaded.Middleware["storage"])
+	changed("reporting", running.Reporting, reloaded.Reporting)
+
+	runningHTTP, reloadedHTTP := running.HTTP, reloaded.HTTP
+	if runningHTTP.TLS.Certificate != "" && reloadedHTTP.TLS.Certificate != "" {
+		// the certificate files are reloaded
+		runningHTTP.TLS.Certificate, runningHTTP.TLS.Key = "", ""
+		reloadedHTTP.TLS.Certificate, reloadedHTTP.TLS.Key = "", ""
+	}
+	if reloadedHTTP.Secret == "" {
+		// the secret generated when the registry started is kept
+		reloadedHTTP.Secret = runningHTTP.Secret
+	}
+	changed("http", runningHTTP, reloadedHTTP)
+
+	changed("notifications.events", running.Notifications.EventConfig, reloaded.Notifications.EventConfig)
+	changed("redis", running.Redis, reloaded.Redis)
+	changed("proxy", running.Proxy, reloaded.Proxy)
+	changed("replication", running.Replication, reloaded.Replication)
+	changed("compatibility", running.Compatibility, reloaded.Compatibility)
+
+	runningValidation, reloadedValidation := running.Validation, reloaded.Validation
+	if !reloadedValidation.Enabled {
+		// as the application does when it starts
+		reloadedValidation.Enabled = !reloadedValidation.Disabled
+	}
+	changed("validation", runningValidation, reloadedValidation)
+	changed("policy", running.Policy, reloaded.Policy)
+	return sections
+}
+
+// appliedConfig returns the configuration in effect once reloaded is
+// applied to the registry running with running: the sections of reloaded,
+// but for those only applied when the registry starts.
+func appliedConfig(running, reloaded *configuration.Configuration) *configuration.Configuration {
+	applied := *reloaded
+
+	applied.Log.AccessLog = running.Log.AccessLog
+	applied.Log.Fields = running.Log.Fields
+
+	applied.Storage = withoutReadOnly(running.Storage)
+	if readOnly, ok := reloaded.Storage["maintenance"]["readonly"]; ok {
+		if applied.Storage["maintenance"] == nil {
+			applied.Storage["maintenance"] = configuration.Parameters{}
+		}
+		applied.Storage["maintenance"]["readonly"] = readOnly
+	}
+
+	applied.Middleware = make(map[string][]configuration.Middleware, len(reloaded.Middleware))
+	for k, v := range reloaded.Middleware {
+		applied.Middleware[k] = v
+	}
+	for _, k := range []string{"registry", "storage"} {
+		if v, ok := running.Middleware[k]; ok {
+			applied.Middleware[k] = v
+		} else {
+			delete(applied.Middleware, k)
+		}
+	}
+	applied.Reporting = running.Reporting
+
+	applied.HTTP = running.HTTP
+	if running.HTTP.TLS.Certificate != "" && reloaded.HTTP.TLS.Certificate != "" {
+		applied.HTTP.TLS.Certificate, applied.HTTP.TLS.Key = reloaded.HTTP.TLS.Certificate, reloaded.HTTP.TLS.Key
+	}
+
+	applied.Notifications.EventConfig = running.Notifications.EventConfig
+	applied.Redis = running.Redis
+	applied.Proxy = running.Proxy
+	applied.Replication = running.Replication
+	applied.Compatibility = running.Compatibility
+	applied.Validation = running.Validation
+	applied.Policy = running.Policy
+	return &applied
+}
+
+// withoutReadOnly returns the storage configuration without the read-only
+// maintenance mode, which is reloaded.
+func withoutReadOnly(storage configuration.Storage) configuration.Storage {
+	s := make(configuration.Storage, len(storage))
+	for k, v := range storage {
+		s[k] = v
+	}
+	if maintenance, ok := s["maintenance"]; ok {
+		m := make(configuration.Parameters, len(maintenance))
+		for k, v := range maintenance {
+			if k != "readonly" {
+				m[k] = v
+			}
+		}
+		s["maintenance"] = m
+	}
+	return s
+}
+
+// certificate is the TLS certificate served, replaced when the
+// configuration is reloaded.
+type certificate struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (c *certificate) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.set(&cert)
+	return nil
+}
+
+func (c *certificate) set(cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = cert
+}
+
+func (c *certificate) loaded() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert != nil
+}
+
+// get implements tls.Config.GetCertificate.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
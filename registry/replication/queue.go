@@ -0,0 +1,197 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+// queueRoot is the storage path under which the pending jobs of every
+// target are kept, one file per job.
+const queueRoot = "/replication"
+
+// job is the replication of a manifest to a target. Jobs are persisted until
+// they succeed, so that they survive restarts of the registry.
+type job struct {
+	ID          string        `json:"id"`
+	Repository  string        `json:"repository"`
+	Digest      digest.Digest `json:"digest"`
+	Tag         string        `json:"tag,omitempty"`
+	Queued      time.Time     `json:"queued"`
+	Attempts    int           `json:"attempts"`
+	NextAttempt time.Time     `json:"nextAttempt"`
+	LastError   string        `json:"lastError,omitempty"`
+}
+
+// queue stores the jobs of a target on a storage driver. The jobs are read
+// from storage once and then kept in memory, so that a push only costs the
+// write of its job. The storage is listed again every refreshInterval to
+// pick up the jobs queued, and drop those completed, by the other registry
+// instances sharing it.
+type queue struct {
+	driver          driver.StorageDriver
+	root            string
+	refreshInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]job // by ID
+	// refreshed is the time the jobs were last listed, zero until they
+	// are first read from storage
+	refreshed time.Time
+}
+
+func newQueue(storageDriver driver.StorageDriver, target string) *queue {
+	return &queue{
+		driver:          storageDriver,
+		root:            path.Join(queueRoot, target),
+		refreshInterval: pollInterval,
+		pending:         make(map[string]job),
+	}
+}
+
+// add persists a new job for the manifest.
+func (q *queue) add(ctx context.Context, repository string, dgst digest.Digest, tag string) (*job, error) {
+	now := time.Now()
+	j := &job{
+		// ordered by creation, so that listing yields the jobs in order
+		ID:          fmt.Sprintf("%019d-%s", now.UnixNano(), uuid.Generate()),
+		Repository:  repository,
+		Digest:      dgst,
+		Tag:         tag,
+		Queued:      now,
+		NextAttempt: now,
+	}
+
+	return j, q.put(ctx, j)
+}
+
+// put writes the job, replacing a previous version of it.
+func (q *queue) put(ctx context.Context, j *job) error {
+	content, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	if err := q.driver.PutContent(ctx, path.Join(q.root, j.ID), content); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending[j.ID] = *j
+	return nil
+}
+
+// remove deletes a completed job.
+func (q *queue) remove(ctx context.Context, j *job) error {
+	err := q.driver.Delete(ctx, path.Join(q.root, j.ID))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, j.ID)
+	return nil
+}
+
+// jobs returns the pending jobs, oldest first. The jobs returned are copies,
+// which are persisted by put.
+func (q *queue) jobs(ctx context.Context) ([]*job, error) {
+	q.mu.Lock()
+	stale := q.refreshed.IsZero() || time.Since(q.refreshed) >= q.refreshInterval
+	q.mu.Unlock()
+	if stale {
+		if err := q.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := make([]string, 0, len(q.pending))
+	for id := range q.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	jobs := make([]*job, 0, len(ids))
+	for _, id := range ids {
+		j := q.pending[id]
+		jobs = append(jobs, &j)
+	}
+	return jobs, nil
+}
+
+// refresh lists the jobs in storage, reading those which are not known yet
+// and forgetting those which were completed.
+func (q *queue) refresh(ctx context.Context) error {
+	q.mu.Lock()
+	known := make(map[string]bool, len(q.pending))
+	for id := range q.pending {
+		known[id] = true
+	}
+	q.mu.Unlock()
+
+	paths, err := q.driver.List(ctx, q.root)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+		paths = nil
+	}
+
+	listed := make(map[string]bool, len(paths))
+	read := make(map[string]job)
+	for _, p := range paths {
+		id := path.Base(p)
+		listed[id] = true
+		if known[id] {
+			continue
+		}
+
+		content, err := q.driver.GetContent(ctx, p)
+		if err != nil {
+			if _, ok := err.(driver.PathNotFoundError); ok {
+				// completed since listing
+				continue
+			}
+			return err
+		}
+
+		var j job
+		if err := json.Unmarshal(content, &j); err != nil {
+			return fmt.Errorf("invalid replication job %s: %v", p, err)
+		}
+		read[id] = j
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// the jobs added while listing are kept, only the jobs known before
+	// are dropped when missing from storage
+	for id := range known {
+		if !listed[id] {
+			delete(q.pending, id)
+		}
+	}
+	for id, j := range read {
+		// a job put while listing is more recent than the one read
+		if _, ok := q.pending[id]; !ok {
+			q.pending[id] = j
+		}
+	}
+	q.refreshed = time.Now()
+	return nil
+}
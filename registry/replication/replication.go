@@ -0,0 +1,564 @@
+// Package replication copies the manifests pushed to the registry, along with
+// the blobs they reference, to other registries.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	dcontext "github.com/docker/distribution/context"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	defaultBackoff    = 10 * time.Second
+	defaultMaxBackoff = time.Hour
+
+	// pollInterval is the longest time a target waits before looking for
+	// new jobs, which may have been queued by another registry instance
+	// sharing the storage.
+	pollInterval = time.Minute
+)
+
+// errTagChanged is returned when the tag of a job was moved to another
+// manifest, or deleted, since the job was queued: the job is dropped so that
+// the tag is not moved back to the manifest of the job on the target.
+var errTagChanged = errors.New("tag changed since the job was queued")
+
+// errNotAllowed is returned by Write when the guard does not allow writing
+// to the storage, so that the events are retried.
+var errNotAllowed = errors.New("replication queue may not be written to")
+
+// Guard returns whether the replicator may write to the storage, and if so
+// the context to write with, which is canceled when writes must stop, and a
+// function to call once done writing.
+type Guard func(ctx context.Context) (guarded context.Context, done func(), allowed bool)
+
+// permanentError is returned when a job can never succeed, such as when the
+// manifest of the job was deleted since it was queued. The job is dropped
+// rather than retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// localError makes the errors returned when local content is missing
+// permanent.
+func localError(err error) error {
+	switch err.(type) {
+	case distribution.ErrManifestUnknownRevision, distribution.ErrManifestUnknown:
+		return permanentError{err}
+	}
+	if err == distribution.ErrBlobUnknown {
+		return permanentError{err}
+	}
+	return err
+}
+
+// RepositoryStatus describes the replication of a repository to a target.
+type RepositoryStatus struct {
+	// Pending is the number of manifests waiting to be replicated.
+	Pending int `json:"pending"`
+
+	// LastReplicated is the time at which a manifest was last replicated.
+	LastReplicated time.Time `json:"lastReplicated,omitempty"`
+
+	// LastDigest is the digest of the manifest last replicated.
+	LastDigest digest.Digest `json:"lastDigest,omitempty"`
+
+	// LastError describes the last failed attempt, and is cleared by the
+	// next successful replication.
+	LastError string `json:"lastError,omitempty"`
+
+	// LastErrorTime is the time of the last failed attempt.
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Replicator replicates pushed manifests to the configured targets. It is a
+// notifications.Sink, queuing a job for every manifest push event it
+// receives. Jobs are persisted on the storage driver and retried with an
+// exponential backoff until they succeed, unless their content was deleted
+// or their tag moved since they were queued.
+type Replicator struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	guard      Guard
+	registry   distribution.Namespace
+	targets    []*target
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu     sync.Mutex
+	status map[string]map[string]*RepositoryStatus // by target and repository
+	closed bool
+	wg     sync.WaitGroup
+}
+
+var _ notifications.Sink = &Replicator{}
+
+// NewReplicator returns a Replicator copying content read from registry to
+// the targets in config, and starts replicating the jobs queued in storage.
+// Jobs are queued and replicated only while guard allows writing to the
+// storage, the queue being stored there; a nil guard always allows it.
+func NewReplicator(ctx context.Context, registry distribution.Namespace, storageDriver driver.StorageDriver, config configuration.Replication, guard Guard) (*Replicator, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	if guard == nil {
+		guard = func(ctx context.Context) (context.Context, func(), bool) {
+			return ctx, func() {}, true
+		}
+	}
+	r := &Replicator{
+		ctx:        ctx,
+		cancel:     cancel,
+		guard:      guard,
+		registry:   registry,
+		backoff:    config.Backoff,
+		maxBackoff: config.MaxBackoff,
+		status:     make(map[string]map[string]*RepositoryStatus),
+	}
+	if r.backoff <= 0 {
+		r.backoff = defaultBackoff
+	}
+	if r.maxBackoff <= 0 {
+		r.maxBackoff = defaultMaxBackoff
+	}
+
+	for _, tc := range config.Targets {
+		if tc.Disabled {
+			dcontext.GetLogger(ctx).Infof("replication target %s disabled, skipping", tc.Name)
+			continue
+		}
+		if _, ok := r.status[tc.Name]; ok {
+			cancel()
+			return nil, fmt.Errorf("duplicate replication target %s", tc.Name)
+		}
+
+		t, err := newTarget(tc, newQueue(storageDriver, tc.Name))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		r.targets = append(r.targets, t)
+		r.status[t.name] = make(map[string]*RepositoryStatus)
+	}
+
+	for _, t := range r.targets {
+		r.wg.Add(1)
+		go r.run(t)
+	}
+
+	return r, nil
+}
+
+// Write queues the replication of the manifests pushed in events.
+func (r *Replicator) Write(events ...notifications.Event) error {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return notifications.ErrSinkClosed
+	}
+
+	ctx, done, allowed := r.guard(r.ctx)
+	if !allowed {
+		return errNotAllowed
+	}
+	defer done()
+
+	for _, event := range events {
+		if !replicates(event) {
+			continue
+		}
+
+		for _, t := range r.targets {
+			if !t.matches(event.Target.Repository) {
+				continue
+			}
+
+			if _, err := t.queue.add(ctx, event.Target.Repository, event.Target.Digest, event.Target.Tag); err != nil {
+				return fmt.Errorf("failed to queue replication of %s@%s to %s: %v", event.Target.Repository, event.Target.Digest, t.name, err)
+			}
+
+			r.mu.Lock()
+			r.repositoryStatus(t.name, event.Target.Repository).Pending++
+			r.mu.Unlock()
+
+			select {
+			case t.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicator) String() string {
+	return "replication"
+}
+
+// replicates reports whether the event is the push of a manifest which is to
+// be replicated.
+func replicates(event notifications.Event) bool {
+	if event.Action != notifications.EventActionPush || event.Request.UserAgent == userAgent {
+		return false
+	}
+	return isManifest(event.Target.MediaType)
+}
+
+// Close stops replication. Pending jobs remain queued in storage.
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return fmt.Errorf("replicator: already closed")
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// Status returns the replication status of the repositories queued or
+// replicated since the registry started, by target and repository name.
+func (r *Replicator) Status() map[string]map[string]RepositoryStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := make(map[string]map[string]RepositoryStatus, len(r.status))
+	for name, repositories := range r.status {
+		status[name] = make(map[string]RepositoryStatus, len(repositories))
+		for repository, s := range repositories {
+			status[name][repository] = *s
+		}
+	}
+	return status
+}
+
+// ServeHTTP writes the replication status as JSON. The repository query
+// parameter restricts it to one repository, by target name.
+func (r *Replicator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var response interface{} = r.Status()
+
+	if repository := req.URL.Query().Get("repository"); repository != "" {
+		byTarget := make(map[string]RepositoryStatus)
+		for name, repositories := range r.Status() {
+			if s, ok := repositories[repository]; ok {
+				byTarget[name] = s
+			}
+		}
+		response = byTarget
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		dcontext.GetLogger(r.ctx).Errorf("error writing replication status: %v", err)
+	}
+}
+
+// repositoryStatus returns the status of a repository for the named target,
+// creating it if needed. r.mu must be held.
+func (r *Replicator) repositoryStatus(target, repository string) *RepositoryStatus {
+	s, ok := r.status[target][repository]
+	if !ok {
+		s = &RepositoryStatus{}
+		r.status[target][repository] = s
+	}
+	return s
+}
+
+// run replicates the jobs of a target until the replicator is closed.
+func (r *Replicator) run(t *target) {
+	defer r.wg.Done()
+
+	for {
+		next := r.process(t)
+
+		timer := time.NewTimer(next)
+		select {
+		case <-t.wake:
+		case <-timer.C:
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// process attempts the due jobs of a target, returning the time until the
+// next job is due.
+func (r *Replicator) process(t *target) time.Duration {
+	log := dcontext.GetLoggerWithField(r.ctx, "replication.target", t.name)
+
+	ctx, done, allowed := r.guard(r.ctx)
+	if !allowed {
+		log.Debugf("replication queue may not be written to, waiting")
+		return pollInterval
+	}
+	defer done()
+
+	jobs, err := t.queue.jobs(ctx)
+	if err != nil {
+		log.Errorf("error reading replication queue: %v", err)
+		return r.backoff
+	}
+
+	next := pollInterval
+	pending := make(map[string]int)
+	for _, j := range jobs {
+		if ctx.Err() != nil {
+			return next
+		}
+
+		if wait := time.Until(j.NextAttempt); wait > 0 {
+			pending[j.Repository]++
+			if wait < next {
+				next = wait
+			}
+			continue
+		}
+
+		err := r.replicate(ctx, t, j)
+		if err == errTagChanged {
+			log.Infof("dropping replication of %s:%s@%s: %v", j.Repository, j.Tag, j.Digest, err)
+			if err := t.queue.remove(ctx, j); err != nil {
+				log.Errorf("error removing replication job %s: %v", j.ID, err)
+			}
+			continue
+		}
+		if _, ok := err.(permanentError); ok {
+			log.Errorf("dropping replication of %s@%s after %d attempts: %v", j.Repository, j.Digest, j.Attempts+1, err)
+			if err := t.queue.remove(ctx, j); err != nil {
+				log.Errorf("error removing replication job %s: %v", j.ID, err)
+			}
+
+			r.mu.Lock()
+			s := r.repositoryStatus(t.name, j.Repository)
+			s.LastError = err.Error()
+			s.LastErrorTime = time.Now()
+			r.mu.Unlock()
+			continue
+		}
+		if err == nil {
+			err = t.queue.remove(ctx, j)
+		}
+
+		r.mu.Lock()
+		s := r.repositoryStatus(t.name, j.Repository)
+		if err == nil {
+			s.LastReplicated = time.Now()
+			s.LastDigest = j.Digest
+			s.LastError = ""
+		} else {
+			s.LastError = err.Error()
+			s.LastErrorTime = time.Now()
+		}
+		r.mu.Unlock()
+
+		if err == nil {
+			log.Infof("replicated %s@%s", j.Repository, j.Digest)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			// interrupted by Close or the guard, not a failure of the target
+			return next
+		}
+
+		j.Attempts++
+		j.LastError = err.Error()
+		wait := r.backoff << uint(j.Attempts-1)
+		if wait > r.maxBackoff || wait <= 0 {
+			wait = r.maxBackoff
+		}
+		j.NextAttempt = time.Now().Add(wait)
+		log.Errorf("error replicating %s@%s (attempt %d), retrying in %s: %v", j.Repository, j.Digest, j.Attempts, wait, err)
+
+		if err := t.queue.put(ctx, j); err != nil {
+			log.Errorf("error updating replication job %s: %v", j.ID, err)
+		}
+
+		pending[j.Repository]++
+		if wait < next {
+			next = wait
+		}
+	}
+
+	r.mu.Lock()
+	for repository, s := range r.status[t.name] {
+		s.Pending = pending[repository]
+	}
+	for repository, n := range pending {
+		r.repositoryStatus(t.name, repository).Pending = n
+	}
+	r.mu.Unlock()
+
+	return next
+}
+
+// replicate copies the manifest of a job, and the content it references, to
+// the target.
+func (r *Replicator) replicate(ctx context.Context, t *target, j *job) error {
+	named, err := reference.WithName(j.Repository)
+	if err != nil {
+		return err
+	}
+
+	local, err := r.registry.Repository(ctx, named)
+	if err != nil {
+		return err
+	}
+
+	// the jobs are retried independently, so that a job failing may be
+	// retried after a later push of the tag was replicated
+	if j.Tag != "" {
+		desc, err := local.Tags(ctx).Get(ctx, j.Tag)
+		switch err.(type) {
+		case nil:
+			if desc.Digest != j.Digest {
+				return errTagChanged
+			}
+		case distribution.ErrTagUnknown:
+			return errTagChanged
+		default:
+			return err
+		}
+	}
+
+	remote, err := t.repository(ctx, named)
+	if err != nil {
+		return err
+	}
+
+	return r.replicateManifest(ctx, t, local, remote, j.Digest, j.Tag)
+}
+
+// replicateManifest copies a manifest to the remote repository after the
+// manifests and blobs it references. The manifest is tagged if tag is set.
+func (r *Replicator) replicateManifest(ctx context.Context, t *target, local, remote distribution.Repository, dgst digest.Digest, tag string) error {
+	localManifests, err := local.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	remoteManifests, err := remote.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	if tag == "" {
+		exists, err := remoteManifests.Exists(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+	}
+
+	manifest, err := localManifests.Get(ctx, dgst)
+	if err != nil {
+		return localError(err)
+	}
+
+	for _, descriptor := range manifest.References() {
+		if isManifest(descriptor.MediaType) {
+			err = r.replicateManifest(ctx, t, local, remote, descriptor.Digest, "")
+		} else {
+			err = r.replicateBlob(ctx, t, local, remote, descriptor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var options []distribution.ManifestServiceOption
+	if tag != "" {
+		options = append(options, distribution.WithTag(tag))
+	}
+	_, err = remoteManifests.Put(ctx, manifest, options...)
+	return err
+}
+
+// replicateBlob copies a blob to the remote repository, mounting it from
+// another repository of the target when one is known to hold it.
+func (r *Replicator) replicateBlob(ctx context.Context, t *target, local, remote distribution.Repository, descriptor distribution.Descriptor) error {
+	remoteBlobs := remote.Blobs(ctx)
+
+	_, err := remoteBlobs.Stat(ctx, descriptor.Digest)
+	if err == nil {
+		t.addMountSource(descriptor.Digest, remote.Named().Name())
+		return nil
+	}
+	if err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	var options []distribution.BlobCreateOption
+	if source, ok := t.mountSource(descriptor.Digest); ok && source != remote.Named().Name() {
+		if named, err := reference.WithName(source); err == nil {
+			if canonical, err := reference.WithDigest(named, descriptor.Digest); err == nil {
+				options = append(options, client.WithMountFrom(canonical))
+			}
+		}
+	}
+
+	writer, err := remoteBlobs.Create(ctx, options...)
+	if _, ok := err.(distribution.ErrBlobMounted); ok {
+		t.addMountSource(descriptor.Digest, remote.Named().Name())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := copyBlob(ctx, local.Blobs(ctx), writer, descriptor.Digest); err != nil {
+		writer.Cancel(ctx)
+		return err
+	}
+
+	t.addMountSource(descriptor.Digest, remote.Named().Name())
+	return nil
+}
+
+// copyBlob uploads the local content of a blob with writer.
+func copyBlob(ctx context.Context, blobs distribution.BlobStore, writer distribution.BlobWriter, dgst digest.Digest) error {
+	reader, err := blobs.Open(ctx, dgst)
+	if err != nil {
+		return localError(err)
+	}
+	defer reader.Close()
+
+	size, err := writer.ReadFrom(reader)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Commit(ctx, distribution.Descriptor{Digest: dgst, Size: size})
+	return err
+}
+
+func isManifest(mediaType string) bool {
+	for _, mt := range distribution.ManifestMediaTypes() {
+		if mediaType == mt {
+			return true
+		}
+	}
+	return false
+}
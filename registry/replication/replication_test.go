@@ -0,0 +1,410 @@
+package replication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/notifications"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func pushEvent(repository, tag string) notifications.Event {
+	var event notifications.Event
+	event.Action = notifications.EventActionPush
+	event.Target.MediaType = schema2.MediaTypeManifest
+	event.Target.Repository = repository
+	event.Target.Digest = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	event.Target.Tag = tag
+	return event
+}
+
+// pushManifest stores a manifest in the repository, tagged with tag, and
+// returns its digest.
+func pushManifest(t *testing.T, registry distribution.Namespace, repository, tag, config string) digest.Digest {
+	ctx := context.Background()
+	named, _ := reference.WithName(repository)
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := schema2.NewManifestBuilder(repo.Blobs(ctx), schema2.MediaTypeImageConfig, []byte(config)).Build(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error building manifest: %v", err)
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, m)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("unexpected error tagging manifest: %v", err)
+	}
+	return dgst
+}
+
+func TestReplicates(t *testing.T) {
+	push := pushEvent("foo/bar", "latest")
+
+	pull := push
+	pull.Action = notifications.EventActionPull
+
+	blob := push
+	blob.Target.MediaType = schema2.MediaTypeLayer
+
+	replicated := push
+	replicated.Request.UserAgent = userAgent
+
+	for _, testcase := range []struct {
+		event    notifications.Event
+		expected bool
+	}{
+		{push, true},
+		{pull, false},
+		{blob, false},
+		{replicated, false},
+	} {
+		if replicates(testcase.event) != testcase.expected {
+			t.Errorf("unexpected result for %s of %s by %q", testcase.event.Action, testcase.event.Target.MediaType, testcase.event.Request.UserAgent)
+		}
+	}
+}
+
+func TestReplicatorGuard(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := configuration.Replication{
+		Targets: []configuration.ReplicationTarget{
+			{Name: "mirror", URL: "http://127.0.0.1:0", Repositories: []string{"foo/*"}},
+		},
+	}
+
+	var allowed bool
+	guard := func(ctx context.Context) (context.Context, func(), bool) {
+		return ctx, func() {}, allowed
+	}
+	replicator, err := NewReplicator(ctx, registry, driver, config, guard)
+	if err != nil {
+		t.Fatalf("unexpected error creating replicator: %v", err)
+	}
+	defer replicator.Close()
+
+	if err := replicator.Write(pushEvent("foo/bar", "latest")); err != errNotAllowed {
+		t.Fatalf("expected the write to be refused by the guard: %v", err)
+	}
+	jobs, err := newQueue(driver, "mirror").jobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing jobs: %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("unexpected jobs queued while not allowed: %d", len(jobs))
+	}
+}
+
+func TestReplicatorRetriesFromStorage(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	config := configuration.Replication{
+		Targets: []configuration.ReplicationTarget{
+			{Name: "mirror", URL: target.URL, Repositories: []string{"foo/*"}},
+		},
+		Backoff: time.Hour,
+	}
+
+	replicator, err := NewReplicator(ctx, registry, driver, config, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating replicator: %v", err)
+	}
+
+	push := pushEvent("foo/bar", "latest")
+	push.Target.Digest = pushManifest(t, registry, "foo/bar", "latest", "{}")
+	if err := replicator.Write(push, pushEvent("other/bar", "latest")); err != nil {
+		t.Fatalf("unexpected error writing events: %v", err)
+	}
+
+	var status RepositoryStatus
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		status = replicator.Status()["mirror"]["foo/bar"]
+		if status.LastError != "" {
+			break
+		}
+	}
+	if status.LastError == "" || status.Pending != 1 {
+		t.Fatalf("unexpected status after failed attempt: %+v", status)
+	}
+	if _, ok := replicator.Status()["mirror"]["other/bar"]; ok {
+		t.Fatalf("unexpected status for repository not replicated to the target")
+	}
+
+	if err := replicator.Close(); err != nil {
+		t.Fatalf("unexpected error closing replicator: %v", err)
+	}
+	if err := replicator.Write(pushEvent("foo/bar", "latest")); err != notifications.ErrSinkClosed {
+		t.Fatalf("expected write to closed replicator to fail: %v", err)
+	}
+
+	// the job survives a restart, keeping its backoff
+	jobs, err := newQueue(driver, "mirror").jobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing jobs: %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("unexpected number of queued jobs: %d", len(jobs))
+	}
+	j := jobs[0]
+	if j.Repository != "foo/bar" || j.Tag != "latest" || j.Attempts != 1 || !strings.Contains(j.LastError, "503") {
+		t.Fatalf("unexpected job: %+v", j)
+	}
+	if time.Until(j.NextAttempt) < 59*time.Minute {
+		t.Fatalf("unexpected next attempt: %v", j.NextAttempt)
+	}
+
+	replicator, err = NewReplicator(ctx, registry, driver, config, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating replicator: %v", err)
+	}
+	defer replicator.Close()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		status = replicator.Status()["mirror"]["foo/bar"]
+		if status.Pending == 1 {
+			break
+		}
+	}
+	if status.Pending != 1 || status.LastError != "" {
+		t.Fatalf("unexpected status after restart: %+v", status)
+	}
+}
+
+func TestReplicatorDropsJobs(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the target knows no content, and accepts no upload
+	var mu sync.Mutex
+	var puts []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			mu.Lock()
+			puts = append(puts, r.URL.Path)
+			mu.Unlock()
+		}
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer target.Close()
+
+	// latest moved from first to second, and deleted was deleted
+	first := pushManifest(t, registry, "foo/bar", "latest", `{"first":true}`)
+	pushManifest(t, registry, "foo/bar", "latest", `{"second":true}`)
+	deleted := pushManifest(t, registry, "foo/bar", "deleted", `{"deleted":true}`)
+	named, _ := reference.WithName("foo/bar")
+	repo, _ := registry.Repository(ctx, named)
+	manifests, _ := repo.Manifests(ctx)
+	if err := manifests.Delete(ctx, deleted); err != nil {
+		t.Fatalf("unexpected error deleting manifest: %v", err)
+	}
+
+	queue := newQueue(driver, "mirror")
+	for _, j := range []struct {
+		dgst digest.Digest
+		tag  string
+	}{
+		{first, "latest"},
+		{deleted, ""},
+	} {
+		if _, err := queue.add(ctx, "foo/bar", j.dgst, j.tag); err != nil {
+			t.Fatalf("unexpected error queuing job: %v", err)
+		}
+	}
+
+	config := configuration.Replication{
+		Targets: []configuration.ReplicationTarget{{Name: "mirror", URL: target.URL}},
+		Backoff: time.Hour,
+	}
+	replicator, err := NewReplicator(ctx, registry, driver, config, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating replicator: %v", err)
+	}
+	defer replicator.Close()
+
+	var jobs []*job
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		jobs, err = newQueue(driver, "mirror").jobs(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error listing jobs: %v", err)
+		}
+		if len(jobs) == 0 {
+			break
+		}
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("unexpected jobs left: %+v", jobs[0])
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(puts) != 0 {
+		t.Fatalf("unexpected content replicated: %v", puts)
+	}
+	if status := replicator.Status()["mirror"]["foo/bar"]; !strings.Contains(status.LastError, "unknown") {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestQueueKeepsJobsInMemory(t *testing.T) {
+	ctx := context.Background()
+	driver := &countingDriver{StorageDriver: inmemory.New()}
+	other := newQueue(driver, "mirror")
+	if _, err := other.add(ctx, "foo/bar", "sha256:aaaa", "v1"); err != nil {
+		t.Fatalf("unexpected error queuing job: %v", err)
+	}
+
+	q := newQueue(driver, "mirror")
+	jobs, err := q.jobs(ctx)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("unexpected jobs: %v, %v", jobs, err)
+	}
+
+	// the jobs queued are not read back from storage
+	reads := driver.reads
+	second, err := q.add(ctx, "foo/bar", "sha256:bbbb", "v2")
+	if err != nil {
+		t.Fatalf("unexpected error queuing job: %v", err)
+	}
+	second.Attempts++
+	if err := q.put(ctx, second); err != nil {
+		t.Fatalf("unexpected error updating job: %v", err)
+	}
+	if err := q.remove(ctx, jobs[0]); err != nil {
+		t.Fatalf("unexpected error removing job: %v", err)
+	}
+	jobs, err = q.jobs(ctx)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != second.ID || jobs[0].Attempts != 1 {
+		t.Fatalf("unexpected jobs: %v, %v", jobs, err)
+	}
+	if driver.reads != reads {
+		t.Fatalf("unexpected reads of the queue: %d", driver.reads-reads)
+	}
+
+	// the jobs of other instances are picked up when refreshing
+	third, err := other.add(ctx, "foo/bar", "sha256:cccc", "v3")
+	if err != nil {
+		t.Fatalf("unexpected error queuing job: %v", err)
+	}
+	if err := other.remove(ctx, second); err != nil {
+		t.Fatalf("unexpected error removing job: %v", err)
+	}
+	q.refreshInterval = 0
+	jobs, err = q.jobs(ctx)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != third.ID {
+		t.Fatalf("unexpected jobs after refreshing: %v, %v", jobs, err)
+	}
+	if driver.reads != reads+1 {
+		t.Fatalf("unexpected reads of the queue: %d", driver.reads-reads)
+	}
+}
+
+// countingDriver counts the files read.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	reads int
+}
+
+func (d *countingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.reads++
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func TestTargetPingTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { pingTimeout = timeout }(pingTimeout)
+	pingTimeout = 100 * time.Millisecond
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	target, err := newTarget(configuration.ReplicationTarget{Name: "mirror", URL: server.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := target.challengeManager()
+		errs <- err
+	}()
+
+	// the target is not locked while it is requested
+	time.Sleep(10 * time.Millisecond)
+	target.addMountSource("sha256:aaaa", "foo/bar")
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("expected an error requesting a target not responding")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the request to the target did not time out")
+	}
+}
+
+func TestNewReplicatorValidatesTargets(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, targets := range [][]configuration.ReplicationTarget{
+		{{Name: "", URL: "https://example.com"}},
+		{{Name: "a/b", URL: "https://example.com"}},
+		{{Name: "mirror", URL: "example.com"}},
+		{{Name: "mirror", URL: "https://example.com", Repositories: []string{"["}}},
+		{{Name: "mirror", URL: "https://example.com"}, {Name: "mirror", URL: "https://example.org"}},
+	} {
+		if _, err := NewReplicator(ctx, registry, driver, configuration.Replication{Targets: targets}, nil); err == nil {
+			t.Errorf("expected error for targets %+v", targets)
+		}
+	}
+}
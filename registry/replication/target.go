@@ -0,0 +1,208 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/opencontainers/go-digest"
+)
+
+// userAgent identifies the requests made by the replicator, so that a target
+// replicating back to this registry does not cause a loop.
+const userAgent = "docker-distribution-replication"
+
+// maxMountSources bounds the number of blobs remembered as mount sources.
+const maxMountSources = 10000
+
+// pingTimeout bounds the request establishing the authentication challenges
+// of a target.
+var pingTimeout = 30 * time.Second
+
+// target is a registry content is replicated to.
+type target struct {
+	name         string
+	url          *url.URL
+	repositories configuration.RepositoryPatterns
+	creds        *credentials
+	queue        *queue
+	wake         chan struct{}
+	// transport sends the requests to the target, identified by userAgent
+	transport http.RoundTripper
+
+	mu sync.Mutex
+	// challenges is nil until the authentication challenges of the
+	// target have been established
+	challenges challenge.Manager
+	// mountSources records a repository of the target known to contain
+	// each blob, allowing it to be mounted instead of uploaded
+	mountSources map[digest.Digest]string
+}
+
+func newTarget(config configuration.ReplicationTarget, q *queue) (*target, error) {
+	if config.Name == "" || strings.Contains(config.Name, "/") {
+		return nil, fmt.Errorf("invalid replication target name %q", config.Name)
+	}
+
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url for replication target %s: %v", config.Name, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid url for replication target %s: %q", config.Name, config.URL)
+	}
+
+	if err := config.Repositories.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid repository pattern for replication target %s: %v", config.Name, err)
+	}
+
+	tr := transport.NewTransport(http.DefaultTransport,
+		transport.NewHeaderRequestModifier(http.Header{"User-Agent": []string{userAgent}}))
+
+	return &target{
+		name:         config.Name,
+		url:          u,
+		repositories: config.Repositories,
+		creds: &credentials{
+			username: config.Username,
+			password: config.Password,
+			hosts:    map[string]struct{}{u.Host: {}},
+		},
+		queue:        q,
+		wake:         make(chan struct{}, 1),
+		transport:    tr,
+		mountSources: make(map[digest.Digest]string),
+	}, nil
+}
+
+// matches reports whether the named repository is replicated to the target.
+func (t *target) matches(name string) bool {
+	return len(t.repositories) == 0 || t.repositories.Matches(name)
+}
+
+// challengeManager returns the authentication challenges of the target,
+// establishing them if needed. The target is requested without holding the
+// lock of the target, within pingTimeout.
+func (t *target) challengeManager() (challenge.Manager, error) {
+	t.mu.Lock()
+	cm := t.challenges
+	t.mu.Unlock()
+	if cm != nil {
+		return cm, nil
+	}
+
+	client := &http.Client{Transport: t.transport, Timeout: pingTimeout}
+	resp, err := client.Get(t.url.String() + "/v2/")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	cm = challenge.NewSimpleManager()
+	if err := cm.AddResponse(resp); err != nil {
+		return nil, err
+	}
+
+	// only hand the credentials to the token services the target trusts
+	for _, c := range challenge.ResponseChallenges(resp) {
+		if realm, err := url.Parse(c.Parameters["realm"]); err == nil && realm.Host != "" {
+			t.creds.addHost(realm.Host)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.challenges == nil {
+		t.challenges = cm
+	}
+	return t.challenges, nil
+}
+
+// repository returns a client for the named repository of the target.
+func (t *target) repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
+	cm, err := t.challengeManager()
+	if err != nil {
+		return nil, err
+	}
+
+	tr := transport.NewTransport(t.transport,
+		auth.NewAuthorizer(cm,
+			auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+				Transport:   http.DefaultTransport,
+				Credentials: t.creds,
+				Scopes: []auth.Scope{
+					auth.RepositoryScope{
+						Repository: name.Name(),
+						Actions:    []string{"pull", "push"},
+					},
+				},
+			}),
+			auth.NewBasicHandler(t.creds)))
+
+	return client.NewRepository(name, t.url.String(), tr)
+}
+
+// mountSource returns a repository of the target holding the blob, if known.
+func (t *target) mountSource(dgst digest.Digest) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	name, ok := t.mountSources[dgst]
+	return name, ok
+}
+
+// addMountSource records that the named repository of the target holds the
+// blob.
+func (t *target) addMountSource(dgst digest.Digest, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.mountSources) >= maxMountSources {
+		t.mountSources = make(map[digest.Digest]string)
+	}
+	t.mountSources[dgst] = name
+}
+
+// credentials provides the configured credentials of a target to the hosts
+// of the target and of its token services.
+type credentials struct {
+	username string
+	password string
+
+	mu    sync.Mutex
+	hosts map[string]struct{}
+}
+
+func (c *credentials) addHost(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosts[host] = struct{}{}
+}
+
+func (c *credentials) Basic(u *url.URL) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.hosts[u.Host]; !ok {
+		return "", ""
+	}
+	return c.username, c.password
+}
+
+func (c *credentials) RefreshToken(u *url.URL, service string) string {
+	return ""
+}
+
+func (c *credentials) SetRefreshToken(u *url.URL, service, token string) {
+}
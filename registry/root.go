@@ -17,8 +17,12 @@ var showVersion bool
 func init() {
 	RootCmd.AddCommand(ServeCmd)
 	RootCmd.AddCommand(GCCmd)
+	RootCmd.AddCommand(QuotaUsageCmd)
 	GCCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the blobs")
 	GCCmd.Flags().BoolVarP(&removeUntagged, "delete-untagged", "m", false, "delete manifests that are not currently referenced via tag")
+	GCCmd.Flags().StringVarP(&checkpointFile, "checkpoint", "c", "", "save the progress of the mark phase to this file")
+	GCCmd.Flags().BoolVarP(&resume, "resume", "r", false, "resume an interrupted garbage collection from the checkpoint file")
+	GCCmd.Flags().IntVar(&markSetCapacity, "mark-set-capacity", 0, "bound the memory of the mark set, not of the manifests and blobs to delete, with a bloom filter sized for this many blobs")
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
 }
 
@@ -38,6 +42,9 @@ var RootCmd = &cobra.Command{
 
 var dryRun bool
 var removeUntagged bool
+var checkpointFile string
+var resume bool
+var markSetCapacity int
 
 // GCCmd is the cobra command that corresponds to the garbage-collect subcommand
 var GCCmd = &cobra.Command{
@@ -52,6 +59,12 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if resume && checkpointFile == "" {
+			fmt.Fprintln(os.Stderr, "--resume requires --checkpoint")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
 		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
@@ -71,15 +84,26 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		registry, err := storage.NewRegistry(ctx, driver, storage.Schema1SigningKey(k))
+		options := []storage.RegistryOption{storage.Schema1SigningKey(k)}
+		if quota := config.Policy.Quota; len(quota.Repositories) > 0 || len(quota.Namespaces) > 0 {
+			// collecting only releases usage, the limits are not needed
+			options = append(options, storage.Quotas(func(repository, namespace string) (storage.QuotaLimits, storage.QuotaLimits) {
+				return storage.QuotaLimits{}, storage.QuotaLimits{}
+			}))
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver, options...)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
 			os.Exit(1)
 		}
 
 		err = storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{
-			DryRun:         dryRun,
-			RemoveUntagged: removeUntagged,
+			DryRun:          dryRun,
+			RemoveUntagged:  removeUntagged,
+			CheckpointFile:  checkpointFile,
+			Resume:          resume,
+			MarkSetCapacity: markSetCapacity,
 		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to garbage collect: %v", err)
@@ -87,3 +111,43 @@ var GCCmd = &cobra.Command{
 		}
 	},
 }
+
+// QuotaUsageCmd is the cobra command that corresponds to the
+// recompute-quota-usage subcommand
+var QuotaUsageCmd = &cobra.Command{
+	Use:   "recompute-quota-usage <config>",
+	Short: "`recompute-quota-usage` rewrites the storage usage of repositories from their content",
+	Long:  "`recompute-quota-usage` rewrites the storage usage of repositories and namespaces from their content",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		if err := storage.RecomputeQuotaUsage(ctx, driver, registry); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to recompute quota usage: %v", err)
+			os.Exit(1)
+		}
+	},
+}
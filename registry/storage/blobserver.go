@@ -24,7 +24,7 @@ type blobServer struct {
 }
 
 func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
-	desc, err := bs.statter.Stat(ctx, dgst)
+	desc, index, err := bs.stat(ctx, dgst)
 	if err != nil {
 		return err
 	}
@@ -34,7 +34,13 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		return err
 	}
 
-	if bs.redirect {
+	var br distribution.ReadSeekCloser
+	if index != nil {
+		// compressed blobs cannot be served from the storage
+		br = newCompressedFileReader(ctx, bs.driver, desc.Digest, index)
+	}
+
+	if bs.redirect && br == nil {
 		redirectURL, err := bs.driver.URLFor(ctx, path, map[string]interface{}{"method": r.Method})
 		switch err.(type) {
 		case nil:
@@ -50,9 +56,11 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		}
 	}
 
-	br, err := newFileReader(ctx, bs.driver, path, desc.Size)
-	if err != nil {
-		return err
+	if br == nil {
+		br, err = newBlobReader(ctx, bs.driver, desc.Digest, desc.Size)
+		if err != nil {
+			return err
+		}
 	}
 	defer br.Close()
 
@@ -76,3 +84,42 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, br)
 	return nil
 }
+
+// stat returns the descriptor for the blob and, when redirecting, the index of
+// its compressed content if the blob is stored compressed. The index is only
+// read once the data of the blob is found missing.
+func (bs *blobServer) stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, *compressionIndex, error) {
+	if !bs.redirect {
+		desc, err := bs.statter.Stat(ctx, dgst)
+		return desc, nil, err
+	}
+	if statter, ok := bs.statter.(*blobStatter); ok {
+		return statter.stat(ctx, dgst)
+	}
+
+	// the descriptor may come from a cache, without checking the data
+	desc, err := bs.statter.Stat(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, nil, err
+	}
+	path, err := pathFor(blobDataPathSpec{digest: desc.Digest})
+	if err != nil {
+		return distribution.Descriptor{}, nil, err
+	}
+	switch _, err := bs.driver.Stat(ctx, path); err.(type) {
+	case nil:
+		return desc, nil, nil
+	case driver.PathNotFoundError:
+	default:
+		return distribution.Descriptor{}, nil, err
+	}
+
+	index, err := readCompressionIndex(ctx, bs.driver, desc.Digest)
+	if err != nil {
+		return distribution.Descriptor{}, nil, err
+	}
+	if index == nil {
+		return distribution.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+	return desc, index, nil
+}
@@ -17,6 +17,10 @@ import (
 type blobStore struct {
 	driver  driver.StorageDriver
 	statter distribution.BlobStatter
+	tracker *gcTracker       // guards content linked during garbage collection
+	quota   *quotaAccountant // nil unless quotas are enabled
+
+	compression *blobCompression // nil unless compression is enabled
 }
 
 var _ distribution.BlobProvider = &blobStore{}
@@ -32,7 +36,7 @@ func (bs *blobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error
 	if err != nil {
 		switch err.(type) {
 		case driver.PathNotFoundError:
-			return nil, distribution.ErrBlobUnknown
+			return bs.getCompressed(ctx, dgst)
 		}
 
 		return nil, err
@@ -41,18 +45,29 @@ func (bs *blobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error
 	return p, nil
 }
 
-func (bs *blobStore) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
-	desc, err := bs.statter.Stat(ctx, dgst)
+// getCompressed returns the content of a blob stored compressed.
+func (bs *blobStore) getCompressed(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	index, err := readCompressionIndex(ctx, bs.driver, dgst)
 	if err != nil {
 		return nil, err
 	}
+	if index == nil {
+		return nil, distribution.ErrBlobUnknown
+	}
+
+	cr := newCompressedFileReader(ctx, bs.driver, dgst, index)
+	defer cr.Close()
 
-	path, err := bs.path(desc.Digest)
+	return readAllLimited(cr, maxBlobGetSize)
+}
+
+func (bs *blobStore) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	desc, err := bs.statter.Stat(ctx, dgst)
 	if err != nil {
 		return nil, err
 	}
 
-	return newFileReader(ctx, bs.driver, path, desc.Size)
+	return newBlobReader(ctx, bs.driver, desc.Digest, desc.Size)
 }
 
 // Put stores the content p in the blob store, calculating the digest. If the
@@ -100,9 +115,14 @@ func (bs *blobStore) Enumerate(ctx context.Context, ingester func(dgst digest.Di
 		}
 
 		currentPath := fileInfo.Path()
-		// we only want to parse paths that end with /data
-		_, fileName := path.Split(currentPath)
-		if fileName != "data" {
+		// we only want to parse paths that end with /data, or with the index
+		// of the compressed content for the blobs stored compressed
+		dir, fileName := path.Split(currentPath)
+		switch fileName {
+		case "data":
+		case "data.zst.index":
+			currentPath = path.Join(dir, "data")
+		default:
 			return nil
 		}
 
@@ -162,21 +182,28 @@ var _ distribution.BlobDescriptorService = &blobStatter{}
 // in the main blob store. If this method returns successfully, there is
 // strong guarantee that the blob exists and is available.
 func (bs *blobStatter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	desc, _, err := bs.stat(ctx, dgst)
+	return desc, err
+}
+
+// stat returns the descriptor for the blob, along with the index of its
+// compressed content if the blob is stored compressed.
+func (bs *blobStatter) stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, *compressionIndex, error) {
 	path, err := pathFor(blobDataPathSpec{
 		digest: dgst,
 	})
 
 	if err != nil {
-		return distribution.Descriptor{}, err
+		return distribution.Descriptor{}, nil, err
 	}
 
 	fi, err := bs.driver.Stat(ctx, path)
 	if err != nil {
 		switch err := err.(type) {
 		case driver.PathNotFoundError:
-			return distribution.Descriptor{}, distribution.ErrBlobUnknown
+			return bs.statCompressed(ctx, dgst)
 		default:
-			return distribution.Descriptor{}, err
+			return distribution.Descriptor{}, nil, err
 		}
 	}
 
@@ -185,7 +212,7 @@ func (bs *blobStatter) Stat(ctx context.Context, dgst digest.Digest) (distributi
 		// calculated a blob path and then detected a directory. We log the
 		// error and then error on the side of not knowing about the blob.
 		dcontext.GetLogger(ctx).Warnf("blob path should not be a directory: %q", path)
-		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+		return distribution.Descriptor{}, nil, distribution.ErrBlobUnknown
 	}
 
 	// TODO(stevvooe): Add method to resolve the mediatype. We can store and
@@ -200,7 +227,25 @@ func (bs *blobStatter) Stat(ctx context.Context, dgst digest.Digest) (distributi
 		// for the specific repository.
 		MediaType: "application/octet-stream",
 		Digest:    dgst,
-	}, nil
+	}, nil, nil
+}
+
+// statCompressed returns the descriptor for a blob stored compressed, of the
+// size of the blob uncompressed, and the index of its compressed content.
+func (bs *blobStatter) statCompressed(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, *compressionIndex, error) {
+	index, err := readCompressionIndex(ctx, bs.driver, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, nil, err
+	}
+	if index == nil {
+		return distribution.Descriptor{}, nil, distribution.ErrBlobUnknown
+	}
+
+	return distribution.Descriptor{
+		Size:      index.Size,
+		MediaType: "application/octet-stream",
+		Digest:    dgst,
+	}, index, nil
 }
 
 func (bs *blobStatter) Clear(ctx context.Context, dgst digest.Digest) error {
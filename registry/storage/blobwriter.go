@@ -71,13 +71,25 @@ func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor)
 		return distribution.Descriptor{}, err
 	}
 
+	// Protect the blob from a concurrent garbage collection before checking
+	// whether it already exists in the blob store.
+	defer bw.blobStore.tracker.track(canonical.Digest)()
+
+	charge, err := bw.blobStore.chargeQuota(ctx, canonical.Digest, canonical.Size)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
 	if err := bw.moveBlob(ctx, canonical); err != nil {
+		charge.refund(ctx)
 		return distribution.Descriptor{}, err
 	}
 
 	if err := bw.blobStore.linkBlob(ctx, canonical, desc.Digest); err != nil {
+		charge.refund(ctx)
 		return distribution.Descriptor{}, err
 	}
+	charge.keep()
 
 	if err := bw.removeResources(ctx); err != nil {
 		return distribution.Descriptor{}, err
@@ -317,6 +329,13 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc distribution.Descriptor
 		return nil
 	}
 
+	// The same goes for the blobs stored compressed.
+	if index, err := readCompressionIndex(ctx, bw.blobStore.driver, desc.Digest); err != nil {
+		return err
+	} else if index != nil {
+		return nil
+	}
+
 	// If no data was received, we may not actually have a file on disk. Check
 	// the size here and write a zero-length file to blobPath if this is the
 	// case. For the most part, this should only ever happen with zero-length
@@ -344,7 +363,12 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc distribution.Descriptor
 
 	// TODO(stevvooe): We should also write the mediatype when executing this move.
 
-	return bw.blobStore.driver.Move(ctx, bw.path, blobPath)
+	if err := bw.blobStore.driver.Move(ctx, bw.path, blobPath); err != nil {
+		return err
+	}
+
+	bw.blobStore.compression.schedule(ctx, desc)
+	return nil
 }
 
 // removeResources should clean up all resources associated with the upload
@@ -0,0 +1,522 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// Blobs may be stored compressed with zstd, in place of their data. The
+// compressed content is a sequence of independent zstd frames, each holding
+// compressionFrameSize bytes of the blob, so that reads at an offset only
+// decompress from the frame holding the offset. The index of the compressed
+// content records the compressed size of each frame, and is written last so
+// that a blob is either stored as data or as complete compressed content.
+//
+// Blobs are served, read and hashed as the bytes originally pushed, so that
+// compression is invisible to clients and to the digests.
+const (
+	compressionAlgorithm = "zstd"
+	compressionFrameSize = 4 << 20
+
+	// compressionMaxRatio is the ratio of the compressed size to the size of
+	// a blob above which the blob is kept uncompressed.
+	compressionMaxRatio = 0.9
+)
+
+// compressedMagics are the leading bytes of formats already compressed,
+// which are not worth compressing again.
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                     // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},         // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00}, // xz
+	{'B', 'Z', 'h'},                  // bzip2
+	{0x04, 0x22, 0x4d, 0x18},         // lz4
+	{'P', 'K', 0x03, 0x04},           // zip
+}
+
+// compressionIndex describes the compressed content of a blob.
+type compressionIndex struct {
+	Algorithm string `json:"algorithm"`
+	// Size is the size of the blob, uncompressed.
+	Size int64 `json:"size"`
+	// FrameSize is the uncompressed size of every frame but the last one.
+	FrameSize int64 `json:"frameSize"`
+	// Frames are the compressed sizes of the frames.
+	Frames []int64 `json:"frames"`
+}
+
+// The committed blobs are compressed by compressionWorkers goroutines, with
+// up to compressionQueueSize blobs waiting, above which the blobs committed
+// are left uncompressed.
+const (
+	compressionWorkers   = 4
+	compressionQueueSize = 1024
+)
+
+// BlobCompression returns a functional option for NewRegistry. Blobs of at
+// least minSize bytes written through blob writers are stored compressed
+// with zstd at the given level, one of fastest, default, better or best,
+// unless they are already compressed or do not compress enough to be worth
+// it. Compressed blobs remain readable without the option.
+// Blobs are committed as data, and compressed in the background.
+func BlobCompression(minSize int64, level string) RegistryOption {
+	return func(registry *registry) error {
+		if level == "" {
+			level = "default"
+		}
+		ok, encoderLevel := zstd.EncoderLevelFromString(level)
+		if !ok {
+			return fmt.Errorf("unknown compression level: %s", level)
+		}
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+		if err != nil {
+			return err
+		}
+
+		c := &blobCompression{
+			minSize: minSize,
+			encoder: encoder,
+			driver:  registry.blobStore.driver,
+			tracker: registry.blobStore.tracker,
+			queue:   make(chan distribution.Descriptor, compressionQueueSize),
+		}
+		for i := 0; i < compressionWorkers; i++ {
+			go c.run()
+		}
+		registry.blobStore.compression = c
+		return nil
+	}
+}
+
+// blobCompression compresses the blobs once committed.
+type blobCompression struct {
+	minSize int64
+	encoder *zstd.Encoder // shared, EncodeAll is safe for concurrent use
+	driver  storagedriver.StorageDriver
+	tracker *gcTracker
+
+	queue   chan distribution.Descriptor
+	pending sync.WaitGroup // blobs queued or being compressed
+	locks   keyedLocks     // by digest, serializing compressions of a blob
+}
+
+// schedule queues the committed blob described by desc for compression,
+// when worth it. The blob is left uncompressed when the queue is full.
+func (c *blobCompression) schedule(ctx context.Context, desc distribution.Descriptor) {
+	if c == nil || desc.Size < c.minSize || desc.Size == 0 {
+		return
+	}
+
+	c.pending.Add(1)
+	select {
+	case c.queue <- desc:
+	default:
+		c.pending.Done()
+		dcontext.GetLogger(ctx).Warnf("compression queue full, leaving blob %s uncompressed", desc.Digest)
+	}
+}
+
+// wait waits for the blobs scheduled to be compressed.
+func (c *blobCompression) wait() {
+	if c != nil {
+		c.pending.Wait()
+	}
+}
+
+func (c *blobCompression) run() {
+	ctx := dcontext.Background()
+	for desc := range c.queue {
+		if err := c.compress(ctx, desc); err != nil {
+			dcontext.GetLoggerWithField(ctx, "digest", desc.Digest).Errorf("error compressing blob: %v", err)
+		}
+		c.pending.Done()
+	}
+}
+
+// compress stores the blob described by desc compressed, in place of its
+// data. The blob is left as data when not worth compressing.
+//
+// The compressed content is written to a path of its own, then moved into
+// place, and the index written, before the data is deleted, so that the
+// readers of the blob always find it whole.
+func (c *blobCompression) compress(ctx context.Context, desc distribution.Descriptor) error {
+	unlock := c.locks.lock(desc.Digest.String())
+	defer unlock()
+	// keep the blob from being collected while compressed
+	defer c.tracker.track(desc.Digest)()
+
+	path, err := pathFor(blobDataPathSpec{digest: desc.Digest})
+	if err != nil {
+		return err
+	}
+	dataPath, err := pathFor(blobCompressedDataPathSpec{digest: desc.Digest})
+	if err != nil {
+		return err
+	}
+	indexPath, err := pathFor(blobCompressionIndexPathSpec{digest: desc.Digest})
+	if err != nil {
+		return err
+	}
+
+	// compressed by another registry sharing the storage, which may not have
+	// deleted the data yet
+	if index, err := readCompressionIndex(ctx, c.driver, desc.Digest); err != nil {
+		return err
+	} else if index != nil {
+		return deleteData(ctx, c.driver, path)
+	}
+
+	rc, err := c.driver.Reader(ctx, path, 0)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil // deleted since committed
+		}
+		return err
+	}
+	defer rc.Close()
+
+	index := compressionIndex{
+		Algorithm: compressionAlgorithm,
+		Size:      desc.Size,
+		FrameSize: compressionFrameSize,
+	}
+
+	var (
+		tempPath   = dataPath + "." + uuid.Generate().String()
+		fw         storagedriver.FileWriter
+		frame      = make([]byte, compressionFrameSize)
+		compressed []byte
+		read       int64
+		written    int64
+	)
+	abort := func(err error) error {
+		if fw != nil {
+			fw.Cancel()
+			fw.Close()
+		}
+		return err
+	}
+
+	for {
+		n, err := io.ReadFull(rc, frame)
+		if n > 0 {
+			if read == 0 && isCompressed(frame[:n]) {
+				return nil
+			}
+			read += int64(n)
+
+			compressed = c.encoder.EncodeAll(frame[:n], compressed[:0])
+			written += int64(len(compressed))
+			// give up early on the blobs which barely compress
+			if float64(written) > float64(read)*compressionMaxRatio {
+				return abort(nil)
+			}
+
+			if fw == nil {
+				if fw, err = c.driver.Writer(ctx, tempPath, false); err != nil {
+					return err
+				}
+			}
+			if _, err := fw.Write(compressed); err != nil {
+				return abort(err)
+			}
+			index.Frames = append(index.Frames, int64(len(compressed)))
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return abort(err)
+		}
+	}
+
+	if read != desc.Size {
+		return abort(fmt.Errorf("compressing %s: read %d bytes of %d", desc.Digest, read, desc.Size))
+	}
+
+	if err := fw.Commit(); err != nil {
+		return abort(err)
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	if err := c.driver.Move(ctx, tempPath, dataPath); err != nil {
+		c.driver.Delete(ctx, tempPath)
+		return err
+	}
+
+	p, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := c.driver.PutContent(ctx, indexPath, p); err != nil {
+		return err
+	}
+	if err := deleteData(ctx, c.driver, path); err != nil {
+		return err
+	}
+
+	dcontext.GetLoggerWithFields(ctx, map[interface{}]interface{}{
+		"digest":          desc.Digest,
+		"size":            desc.Size,
+		"compressed.size": written,
+	}).Debug("blob stored compressed")
+	return nil
+}
+
+// deleteData deletes the data of a blob stored compressed.
+func deleteData(ctx context.Context, driver storagedriver.StorageDriver, path string) error {
+	if err := driver.Delete(ctx, path); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// isCompressed reports whether p starts like the content of a compressed
+// format.
+func isCompressed(p []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(p, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCompressionIndex returns the index of the compressed content of the
+// blob, or nil when the blob is not stored compressed.
+func readCompressionIndex(ctx context.Context, driver storagedriver.StorageDriver, dgst digest.Digest) (*compressionIndex, error) {
+	indexPath, err := pathFor(blobCompressionIndexPathSpec{digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := driver.GetContent(ctx, indexPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var index compressionIndex
+	if err := json.Unmarshal(p, &index); err != nil {
+		return nil, fmt.Errorf("invalid compression index of %s: %v", dgst, err)
+	}
+	if index.Algorithm != compressionAlgorithm {
+		return nil, fmt.Errorf("unsupported compression of %s: %s", dgst, index.Algorithm)
+	}
+	if index.FrameSize <= 0 || int64(len(index.Frames)) != (index.Size+index.FrameSize-1)/index.FrameSize {
+		return nil, fmt.Errorf("invalid compression index of %s", dgst)
+	}
+	return &index, nil
+}
+
+// newBlobReader returns a reader of the blob, of the size determined with a
+// stat call. The blob is read from its data, falling back to its compressed
+// content once the data is found missing.
+func newBlobReader(ctx context.Context, driver storagedriver.StorageDriver, dgst digest.Digest, size int64) (distribution.ReadSeekCloser, error) {
+	path, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+
+	fr, err := newFileReader(ctx, driver, path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobReader{
+		ReadSeekCloser: fr,
+		ctx:            ctx,
+		driver:         driver,
+		digest:         dgst,
+		size:           size,
+	}, nil
+}
+
+// blobReader reads the data of a blob, switching to a compressedFileReader
+// when the data turns out to be missing.
+type blobReader struct {
+	distribution.ReadSeekCloser
+
+	ctx    context.Context
+	driver storagedriver.StorageDriver
+	digest digest.Digest
+	size   int64
+
+	compressed bool
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	offset, err := br.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := br.ReadSeekCloser.Read(p)
+	// the fileReader reads missing files as empty
+	if n > 0 || err != io.EOF || offset >= br.size || br.compressed {
+		return n, err
+	}
+
+	index, err := readCompressionIndex(br.ctx, br.driver, br.digest)
+	if err != nil {
+		return 0, err
+	}
+	if index == nil {
+		return 0, io.EOF
+	}
+
+	br.ReadSeekCloser.Close()
+	cr := newCompressedFileReader(br.ctx, br.driver, br.digest, index)
+	if _, err := cr.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	br.ReadSeekCloser = cr
+	br.compressed = true
+
+	return br.ReadSeekCloser.Read(p)
+}
+
+// compressedFileReader provides a read seeker interface to the compressed
+// content of a blob, reading the bytes of the blob.
+type compressedFileReader struct {
+	ctx    context.Context
+	driver storagedriver.StorageDriver
+	path   string
+	index  *compressionIndex
+
+	rc     io.ReadCloser
+	dec    *zstd.Decoder
+	offset int64
+	err    error // terminal error, if set, reader is closed
+}
+
+func newCompressedFileReader(ctx context.Context, driver storagedriver.StorageDriver, dgst digest.Digest, index *compressionIndex) *compressedFileReader {
+	path, err := pathFor(blobCompressedDataPathSpec{digest: dgst})
+	return &compressedFileReader{
+		ctx:    ctx,
+		driver: driver,
+		path:   path,
+		index:  index,
+		err:    err,
+	}
+}
+
+func (cr *compressedFileReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.offset >= cr.index.Size {
+		return 0, io.EOF
+	}
+
+	if cr.dec == nil {
+		if err := cr.open(); err != nil {
+			cr.reset()
+			return 0, err
+		}
+	}
+
+	if remaining := cr.index.Size - cr.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := cr.dec.Read(p)
+	cr.offset += int64(n)
+
+	if err == io.EOF && cr.offset < cr.index.Size {
+		err = io.ErrUnexpectedEOF
+	} else if err == nil && cr.offset >= cr.index.Size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// open starts decompressing at the frame holding the offset, skipping to the
+// offset.
+func (cr *compressedFileReader) open() error {
+	frame := cr.offset / cr.index.FrameSize
+	var start int64
+	for _, size := range cr.index.Frames[:frame] {
+		start += size
+	}
+
+	rc, err := cr.driver.Reader(cr.ctx, cr.path, start)
+	if err != nil {
+		return err
+	}
+	cr.rc = rc
+
+	dec, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return err
+	}
+	cr.dec = dec
+
+	skip := cr.offset - frame*cr.index.FrameSize
+	if _, err := io.CopyN(ioutil.Discard, dec, skip); err != nil {
+		return fmt.Errorf("decompressing %s: %v", cr.path, err)
+	}
+	return nil
+}
+
+func (cr *compressedFileReader) Seek(offset int64, whence int) (int64, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	newOffset := cr.offset
+	switch whence {
+	case io.SeekCurrent:
+		newOffset += offset
+	case io.SeekEnd:
+		newOffset = cr.index.Size + offset
+	case io.SeekStart:
+		newOffset = offset
+	}
+
+	if newOffset < 0 {
+		return cr.offset, fmt.Errorf("cannot seek to negative position")
+	}
+	if newOffset != cr.offset {
+		cr.reset()
+		cr.offset = newOffset
+	}
+	return cr.offset, nil
+}
+
+func (cr *compressedFileReader) Close() error {
+	if cr.err != nil {
+		return cr.err
+	}
+	cr.reset()
+	cr.err = fmt.Errorf("compressedFileReader: closed")
+	return nil
+}
+
+// reset releases the decompression, to start again at the offset.
+func (cr *compressedFileReader) reset() {
+	if cr.dec != nil {
+		cr.dec.Close()
+		cr.dec = nil
+	}
+	if cr.rc != nil {
+		cr.rc.Close()
+		cr.rc = nil
+	}
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/storage/cache/memory"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// compressibleContent returns size bytes of text-like content.
+func compressibleContent(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "line %d of a compressible blob\n", i)
+	}
+	return buf.Bytes()[:size]
+}
+
+// uploadBlob pushes the content as a blob, returning its digest once the
+// blob is compressed.
+func uploadBlob(t *testing.T, bs distribution.BlobIngester, content []byte) digest.Digest {
+	dgst := digest.FromBytes(content)
+	desc := distribution.Descriptor{Digest: dgst, Size: int64(len(content))}
+	if _, err := addBlob(context.Background(), bs, desc, bytes.NewReader(content)); err != nil {
+		t.Fatalf("error uploading blob: %v", err)
+	}
+	bs.(*linkedBlobStore).blobStore.compression.wait()
+	return dgst
+}
+
+func newCompressionTestRepository(t *testing.T, driver storagedriver.StorageDriver, options ...RegistryOption) distribution.BlobStore {
+	ctx := context.Background()
+	registry, err := NewRegistry(ctx, driver, options...)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	name, _ := reference.WithName("foo/compressed")
+	repository, err := registry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	return repository.Blobs(ctx)
+}
+
+// storedCompressed reports whether the blob is stored compressed, checking
+// that it is not stored as data as well.
+func storedCompressed(t *testing.T, driver storagedriver.StorageDriver, dgst digest.Digest) bool {
+	ctx := context.Background()
+	index, err := readCompressionIndex(ctx, driver, dgst)
+	if err != nil {
+		t.Fatalf("error reading the compression index: %v", err)
+	}
+
+	dataPath, _ := pathFor(blobDataPathSpec{digest: dgst})
+	_, err = driver.Stat(ctx, dataPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok != (index != nil) {
+		t.Fatalf("blob stored both as data and compressed, or neither: %v", err)
+	}
+	return index != nil
+}
+
+func TestBlobCompression(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	bs := newCompressionTestRepository(t, driver, BlobCompression(1024, "fastest"), EnableRedirect)
+
+	content := compressibleContent(2*compressionFrameSize + 12345)
+	dgst := uploadBlob(t, bs, content)
+
+	if !storedCompressed(t, driver, dgst) {
+		t.Fatal("blob not stored compressed")
+	}
+
+	desc, err := bs.Stat(ctx, dgst)
+	if err != nil {
+		t.Fatalf("error statting blob: %v", err)
+	}
+	if desc.Size != int64(len(content)) {
+		t.Fatalf("unexpected size: %d != %d", desc.Size, len(content))
+	}
+
+	rs, err := bs.Open(ctx, dgst)
+	if err != nil {
+		t.Fatalf("error opening blob: %v", err)
+	}
+	defer rs.Close()
+
+	for _, offset := range []int64{0, 1, compressionFrameSize - 1, compressionFrameSize, 2*compressionFrameSize + 7, int64(len(content))} {
+		if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("error seeking to %d: %v", offset, err)
+		}
+		p, err := ioutil.ReadAll(rs)
+		if err != nil {
+			t.Fatalf("error reading at %d: %v", offset, err)
+		}
+		if !bytes.Equal(p, content[offset:]) {
+			t.Fatalf("unexpected content read at %d", offset)
+		}
+	}
+
+	// the content is served as pushed, honoring ranges
+	for _, tc := range []struct {
+		rangeHeader string
+		status      int
+		expected    []byte
+	}{
+		{"", http.StatusOK, content},
+		{"bytes=10-19", http.StatusPartialContent, content[10:20]},
+		{fmt.Sprintf("bytes=%d-", compressionFrameSize+3), http.StatusPartialContent, content[compressionFrameSize+3:]},
+		{"bytes=-5", http.StatusPartialContent, content[len(content)-5:]},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if tc.rangeHeader != "" {
+			r.Header.Set("Range", tc.rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		if err := bs.ServeBlob(ctx, w, r, dgst); err != nil {
+			t.Fatalf("error serving blob: %v", err)
+		}
+		if w.Code != tc.status {
+			t.Fatalf("unexpected status serving %q: %d != %d", tc.rangeHeader, w.Code, tc.status)
+		}
+		if !bytes.Equal(w.Body.Bytes(), tc.expected) {
+			t.Fatalf("unexpected content serving %q", tc.rangeHeader)
+		}
+		if served := digest.FromBytes(w.Body.Bytes()); tc.rangeHeader == "" && served != dgst {
+			t.Fatalf("unexpected digest served: %s != %s", served, dgst)
+		}
+	}
+
+	// blobs stored compressed are enumerated
+	reg, err := NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enumerated []digest.Digest
+	err = reg.Blobs().Enumerate(ctx, func(d digest.Digest) error {
+		enumerated = append(enumerated, d)
+		return nil
+	})
+	if err != nil || len(enumerated) != 1 || enumerated[0] != dgst {
+		t.Fatalf("unexpected blobs enumerated: %v, %v", enumerated, err)
+	}
+
+	// a push of the same blob is accepted without compressing it again
+	uploadBlob(t, bs, content)
+}
+
+func TestBlobCompressionSkipped(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	bs := newCompressionTestRepository(t, driver, BlobCompression(1024, ""))
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(compressibleContent(1 << 20))
+	gw.Close()
+
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for name, content := range map[string][]byte{
+		"small":          compressibleContent(1023),
+		"compressed":     gzipped.Bytes(),
+		"incompressible": random,
+	} {
+		dgst := uploadBlob(t, bs, content)
+		if storedCompressed(t, driver, dgst) {
+			t.Fatalf("%s blob stored compressed", name)
+		}
+
+		p, err := bs.Get(ctx, dgst)
+		if err != nil || !bytes.Equal(p, content) {
+			t.Fatalf("unexpected %s blob content: %v", name, err)
+		}
+	}
+}
+
+func TestBlobCompressionDisabled(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	bs := newCompressionTestRepository(t, driver, BlobCompression(0, "best"))
+
+	content := compressibleContent(1 << 20)
+	dgst := uploadBlob(t, bs, content)
+
+	// compressed blobs remain readable once compression is disabled
+	bs = newCompressionTestRepository(t, driver)
+	p, err := bs.Get(ctx, dgst)
+	if err != nil || !bytes.Equal(p, content) {
+		t.Fatalf("unexpected blob content: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=100-")
+	if err := bs.ServeBlob(ctx, w, r, dgst); err != nil {
+		t.Fatalf("error serving blob: %v", err)
+	}
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content[100:]) {
+		t.Fatalf("unexpected response: %d", w.Code)
+	}
+
+	if _, err := NewRegistry(ctx, driver, BlobCompression(0, "extreme")); err == nil {
+		t.Fatal("expected an error with an unknown level")
+	}
+}
+
+// redirectDriver redirects to the paths of the files, and counts the reads
+// of the compression indexes.
+type redirectDriver struct {
+	storagedriver.StorageDriver
+	indexReads int
+}
+
+func (d *redirectDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if strings.HasSuffix(path, "/data.zst.index") {
+		d.indexReads++
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *redirectDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "https://storage.example.com" + path, nil
+}
+
+func TestBlobCompressionRedirect(t *testing.T) {
+	ctx := context.Background()
+
+	for _, cached := range []bool{false, true} {
+		driver := &redirectDriver{StorageDriver: inmemory.New()}
+		options := []RegistryOption{BlobCompression(1024, "fastest"), EnableRedirect}
+		if cached {
+			options = append(options, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+		}
+		bs := newCompressionTestRepository(t, driver, options...)
+
+		// the index of a blob stored as data is not read
+		uncompressed := uploadBlob(t, bs, compressibleContent(1023))
+		driver.indexReads = 0
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if err := bs.ServeBlob(ctx, w, r, uncompressed); err != nil {
+			t.Fatalf("error serving blob: %v", err)
+		}
+		if w.Code != http.StatusTemporaryRedirect || driver.indexReads != 0 {
+			t.Fatalf("unexpected response, cached %t: %d, %d index reads", cached, w.Code, driver.indexReads)
+		}
+
+		// blobs stored compressed are served by the registry
+		content := compressibleContent(compressionFrameSize)
+		compressed := uploadBlob(t, bs, content)
+		w = httptest.NewRecorder()
+		if err := bs.ServeBlob(ctx, w, r, compressed); err != nil {
+			t.Fatalf("error serving blob: %v", err)
+		}
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Fatalf("unexpected response, cached %t: %d", cached, w.Code)
+		}
+	}
+}
+
+func TestBlobCompressionConcurrent(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	bs := newCompressionTestRepository(t, driver, BlobCompression(1024, "fastest"))
+	blobStore := bs.(*linkedBlobStore).blobStore
+	compression := blobStore.compression
+
+	content := compressibleContent(64 << 10)
+	dataPath, _ := pathFor(blobDataPathSpec{digest: digest.FromBytes(content)})
+	if err := driver.PutContent(ctx, dataPath, content); err != nil {
+		t.Fatalf("error writing blob data: %v", err)
+	}
+
+	// commits of the same blob racing to compress it
+	desc := distribution.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := compression.compress(ctx, desc); err != nil {
+				t.Errorf("error compressing blob: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !storedCompressed(t, driver, desc.Digest) {
+		t.Fatal("blob not stored compressed")
+	}
+	files, err := driver.List(ctx, path.Dir(dataPath))
+	if err != nil {
+		t.Fatalf("error listing the blob directory: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("unexpected files left in the blob directory: %v", files)
+	}
+
+	p, err := blobStore.Get(ctx, desc.Digest)
+	if err != nil || !bytes.Equal(p, content) {
+		t.Fatalf("unexpected blob content: %v", err)
+	}
+}
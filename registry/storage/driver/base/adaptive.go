@@ -0,0 +1,446 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	prometheus "github.com/docker/distribution/metrics"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/go-metrics"
+)
+
+// OperationClass is a class of storage driver calls sharing a concurrency
+// budget in an adaptive regulator.
+type OperationClass string
+
+// The operation classes of the adaptive regulator.
+const (
+	// OperationRead covers GetContent, Reader and Stat.
+	OperationRead OperationClass = "read"
+	// OperationWrite covers PutContent, Writer, the writes of file writers
+	// and Move.
+	OperationWrite OperationClass = "write"
+	// OperationList covers List and the listings of Walk.
+	OperationList OperationClass = "list"
+	// OperationDelete covers Delete.
+	OperationDelete OperationClass = "delete"
+)
+
+// operationClasses are the operation classes with their default maximum
+// concurrency.
+var operationClasses = map[OperationClass]uint64{
+	OperationRead:   128,
+	OperationWrite:  64,
+	OperationList:   16,
+	OperationDelete: 32,
+}
+
+const defaultBackoff = 0.5
+
+var (
+	regulatorQueueDepth = prometheus.StorageNamespace.NewLabeledGauge("regulator_queue_depth", "The number of storage calls waiting for the regulator", "", "driver", "class")
+	regulatorWait       = prometheus.StorageNamespace.NewLabeledTimer("regulator_wait", "The number of seconds storage calls wait for the regulator", "driver", "class")
+	regulatorLimit      = prometheus.StorageNamespace.NewLabeledGauge("regulator_limit", "The concurrency currently allowed by the regulator", "", "driver", "class")
+	regulatorThrottled  = prometheus.StorageNamespace.NewLabeledCounter("regulator_throttled", "The number of storage calls throttled by the storage service", "driver", "class")
+)
+
+// AdaptiveRegulatorParameters configures an adaptive regulator.
+type AdaptiveRegulatorParameters struct {
+	// MaxConcurrency is the maximum number of concurrent calls of each
+	// operation class.
+	MaxConcurrency map[OperationClass]uint64
+	// MinConcurrency is the number of concurrent calls of each operation
+	// class allowed however throttled the calls are.
+	MinConcurrency uint64
+	// Backoff is the factor applied to the concurrency of an operation
+	// class when a call is throttled, between 0 and 1.
+	Backoff float64
+}
+
+// GetAdaptiveRegulatorParameters takes the adaptive regulator parameter as
+// decoded from the YAML configuration, either true or a map of the maximum
+// concurrency by operation class along with the min and backoff keys. It
+// returns nil when the parameter is not set.
+//
+// If the parameter supplied is invalid this returns an error.
+func GetAdaptiveRegulatorParameters(param interface{}) (*AdaptiveRegulatorParameters, error) {
+	params := &AdaptiveRegulatorParameters{
+		MaxConcurrency: make(map[OperationClass]uint64, len(operationClasses)),
+		MinConcurrency: 1,
+		Backoff:        defaultBackoff,
+	}
+	for class, def := range operationClasses {
+		params.MaxConcurrency[class] = def
+	}
+
+	var options map[string]interface{}
+	switch v := param.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !v {
+			return nil, nil
+		}
+	case string:
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value '%v'", param)
+		}
+		if !enabled {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		options = v
+	case map[interface{}]interface{}:
+		options = make(map[string]interface{}, len(v))
+		for key, value := range v {
+			options[fmt.Sprint(key)] = value
+		}
+	default:
+		return nil, fmt.Errorf("invalid value '%#v'", param)
+	}
+
+	for key, value := range options {
+		var err error
+		switch key {
+		case "min":
+			params.MinConcurrency, err = GetLimitFromParameter(value, 1, 1)
+		case "backoff":
+			params.Backoff, err = getFactorFromParameter(value)
+		default:
+			class := OperationClass(key)
+			if _, ok := operationClasses[class]; !ok {
+				return nil, fmt.Errorf("unknown operation class %q", key)
+			}
+			params.MaxConcurrency[class], err = GetLimitFromParameter(value, 1, operationClasses[class])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	for class, max := range params.MaxConcurrency {
+		if max < params.MinConcurrency {
+			return nil, fmt.Errorf("%s: the maximum concurrency must not be lower than min, %d", class, params.MinConcurrency)
+		}
+	}
+	return params, nil
+}
+
+func getFactorFromParameter(param interface{}) (float64, error) {
+	var factor float64
+	switch v := param.(type) {
+	case float64:
+		factor = v
+	case int:
+		factor = float64(v)
+	case string:
+		var err error
+		if factor, err = strconv.ParseFloat(v, 64); err != nil {
+			return 0, fmt.Errorf("parameter must be a number, '%v' invalid", param)
+		}
+	default:
+		return 0, fmt.Errorf("invalid value '%#v'", param)
+	}
+	if factor <= 0 || factor >= 1 {
+		return 0, fmt.Errorf("parameter must be between 0 and 1, %v invalid", factor)
+	}
+	return factor, nil
+}
+
+// adaptiveRegulator regulates the concurrent calls to a driver with a
+// concurrency limit by operation class, adjusted with additive increase and
+// multiplicative decrease: calls completing while the limit is reached raise
+// the limit by one every limit calls, up to the maximum, while throttled
+// calls cut the limit by the backoff factor.
+type adaptiveRegulator struct {
+	storagedriver.StorageDriver
+	limiters    map[OperationClass]*aimdLimiter
+	isThrottled func(error) bool
+}
+
+// NewAdaptiveRegulator wraps the given driver to regulate its concurrent
+// calls, separately for each operation class. The limit of a class starts at
+// its maximum and backs off when isThrottled reports that an error returned
+// by the driver means that the storage service throttles the calls, such as
+// an S3 SlowDown error or an HTTP 503 response.
+func NewAdaptiveRegulator(driver storagedriver.StorageDriver, params AdaptiveRegulatorParameters, isThrottled func(error) bool) storagedriver.StorageDriver {
+	r := &adaptiveRegulator{
+		StorageDriver: driver,
+		limiters:      make(map[OperationClass]*aimdLimiter, len(operationClasses)),
+		isThrottled:   isThrottled,
+	}
+	backoff := params.Backoff
+	if backoff <= 0 || backoff >= 1 {
+		backoff = defaultBackoff
+	}
+	for class, def := range operationClasses {
+		max, ok := params.MaxConcurrency[class]
+		if !ok || max == 0 {
+			max = def
+		}
+		min := params.MinConcurrency
+		if min == 0 || min > max {
+			min = 1
+		}
+		r.limiters[class] = newAIMDLimiter(driver.Name(), class, min, max, backoff)
+	}
+	return r
+}
+
+// do runs fn with the concurrency budget of class, unless ctx is done while
+// waiting for it.
+func (r *adaptiveRegulator) do(ctx context.Context, class OperationClass, fn func() error) error {
+	l := r.limiters[class]
+	started, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn()
+	l.release(started, err != nil && r.isThrottled(err))
+	return err
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+// This should primarily be used for small objects.
+func (r *adaptiveRegulator) GetContent(ctx context.Context, path string) (content []byte, err error) {
+	err = r.do(ctx, OperationRead, func() error {
+		content, err = r.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// This should primarily be used for small objects.
+func (r *adaptiveRegulator) PutContent(ctx context.Context, path string, content []byte) error {
+	return r.do(ctx, OperationWrite, func() error {
+		return r.StorageDriver.PutContent(ctx, path, content)
+	})
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path"
+// with a given byte offset.
+// May be used to resume reading a stream by providing a nonzero offset.
+func (r *adaptiveRegulator) Reader(ctx context.Context, path string, offset int64) (rc io.ReadCloser, err error) {
+	err = r.do(ctx, OperationRead, func() error {
+		rc, err = r.StorageDriver.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit. The
+// writes of the FileWriter are regulated as well.
+func (r *adaptiveRegulator) Writer(ctx context.Context, path string, append bool) (fw storagedriver.FileWriter, err error) {
+	err = r.do(ctx, OperationWrite, func() error {
+		fw, err = r.StorageDriver.Writer(ctx, path, append)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &regulatedFileWriter{FileWriter: fw, regulator: r, ctx: ctx}, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current
+// size in bytes and the creation time.
+func (r *adaptiveRegulator) Stat(ctx context.Context, path string) (fi storagedriver.FileInfo, err error) {
+	err = r.do(ctx, OperationRead, func() error {
+		fi, err = r.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (r *adaptiveRegulator) List(ctx context.Context, path string) (children []string, err error) {
+	err = r.do(ctx, OperationList, func() error {
+		children, err = r.StorageDriver.List(ctx, path)
+		return err
+	})
+	return children, err
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (r *adaptiveRegulator) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return r.do(ctx, OperationWrite, func() error {
+		return r.StorageDriver.Move(ctx, sourcePath, destPath)
+	})
+}
+
+// Walk traverses a filesystem defined within driver, starting from the given
+// path, calling f on each file. The walk holds the budget of a list call
+// while the driver lists the files, but not while f runs, as f may call the
+// driver.
+func (r *adaptiveRegulator) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	l := r.limiters[OperationList]
+	started, err := l.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	held := true
+	var walkErr error
+	err = r.StorageDriver.Walk(ctx, path, func(fileInfo storagedriver.FileInfo) error {
+		l.release(started, false)
+		held = false
+
+		if walkErr = f(fileInfo); walkErr != nil && walkErr != storagedriver.ErrSkipDir {
+			return walkErr
+		}
+		var err error
+		if started, err = l.acquire(ctx); err != nil {
+			return err
+		}
+		held = true
+		return walkErr
+	})
+	if held {
+		l.release(started, err != nil && err != walkErr && r.isThrottled(err))
+	}
+	return err
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (r *adaptiveRegulator) Delete(ctx context.Context, path string) error {
+	return r.do(ctx, OperationDelete, func() error {
+		return r.StorageDriver.Delete(ctx, path)
+	})
+}
+
+// regulatedFileWriter regulates the calls of a FileWriter which may write to
+// the storage service, such as the upload of the parts of a multipart
+// upload.
+type regulatedFileWriter struct {
+	storagedriver.FileWriter
+	regulator *adaptiveRegulator
+	// ctx is the context the writer was opened with, which Write and Commit
+	// stop waiting for the budget on. Close and Cancel always wait, so that
+	// the writer is released.
+	ctx context.Context
+}
+
+func (w *regulatedFileWriter) Write(p []byte) (n int, err error) {
+	err = w.regulator.do(w.ctx, OperationWrite, func() error {
+		n, err = w.FileWriter.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (w *regulatedFileWriter) Close() error {
+	return w.regulator.do(context.Background(), OperationWrite, w.FileWriter.Close)
+}
+
+func (w *regulatedFileWriter) Cancel() error {
+	return w.regulator.do(context.Background(), OperationWrite, w.FileWriter.Cancel)
+}
+
+func (w *regulatedFileWriter) Commit() error {
+	return w.regulator.do(w.ctx, OperationWrite, w.FileWriter.Commit)
+}
+
+// aimdLimiter limits the concurrent calls of an operation class.
+type aimdLimiter struct {
+	mu sync.Mutex
+	// wake is closed to wake up the calls waiting for the limit, if any
+	wake chan struct{}
+
+	min, max float64
+	backoff  float64
+
+	limit     float64
+	inFlight  int
+	decreased time.Time // when the limit was last cut
+
+	queueDepth metrics.Gauge
+	wait       metrics.Timer
+	limitGauge metrics.Gauge
+	throttled  metrics.Counter
+}
+
+func newAIMDLimiter(driver string, class OperationClass, min, max uint64, backoff float64) *aimdLimiter {
+	l := &aimdLimiter{
+		min:        float64(min),
+		max:        float64(max),
+		backoff:    backoff,
+		limit:      float64(max),
+		queueDepth: regulatorQueueDepth.WithValues(driver, string(class)),
+		wait:       regulatorWait.WithValues(driver, string(class)),
+		limitGauge: regulatorLimit.WithValues(driver, string(class)),
+		throttled:  regulatorThrottled.WithValues(driver, string(class)),
+	}
+	l.limitGauge.Set(l.limit)
+	return l
+}
+
+// acquire waits until a call is allowed, returning when it started, or
+// ctx's error if ctx is done first.
+func (l *aimdLimiter) acquire(ctx context.Context) (time.Time, error) {
+	start := time.Now()
+
+	l.mu.Lock()
+	if float64(l.inFlight) >= math.Floor(l.limit) {
+		l.queueDepth.Inc()
+		defer l.queueDepth.Dec()
+		for float64(l.inFlight) >= math.Floor(l.limit) {
+			if l.wake == nil {
+				l.wake = make(chan struct{})
+			}
+			wake := l.wake
+			l.mu.Unlock()
+
+			select {
+			case <-wake:
+			case <-ctx.Done():
+				return time.Time{}, ctx.Err()
+			}
+			l.mu.Lock()
+		}
+	}
+	l.inFlight++
+	l.mu.Unlock()
+
+	l.wait.UpdateSince(start)
+	return time.Now(), nil
+}
+
+// release ends a call started at started, adjusting the limit to whether
+// the call was throttled.
+func (l *aimdLimiter) release(started time.Time, throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	saturated := float64(l.inFlight) >= math.Floor(l.limit)
+	l.inFlight--
+
+	switch {
+	case throttled:
+		l.throttled.Inc(1)
+		// the calls started before the last cut were throttled under the
+		// previous limit, cutting again for them would overreact
+		if started.After(l.decreased) {
+			l.limit = math.Max(l.min, l.limit*l.backoff)
+			l.decreased = time.Now()
+		}
+	case saturated:
+		// the limit only grows while it is reached, so that it stays close to
+		// the concurrency actually sustained by the storage
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+	l.limitGauge.Set(l.limit)
+
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
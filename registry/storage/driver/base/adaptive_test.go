@@ -0,0 +1,287 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+var errSlowDown = errors.New("slow down")
+
+// throttlingDriver throttles its Stat calls while throttle is set, blocking
+// them on block when set.
+type throttlingDriver struct {
+	storagedriver.StorageDriver
+
+	mu       sync.Mutex
+	throttle bool
+	block    chan struct{}
+}
+
+func (d *throttlingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	d.mu.Lock()
+	throttle, block := d.throttle, d.block
+	d.mu.Unlock()
+
+	if block != nil {
+		<-block
+	}
+	if throttle {
+		return nil, errSlowDown
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{Path: path, IsDir: true}}, nil
+}
+
+func (d *throttlingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return nil
+}
+
+func (d *throttlingDriver) Name() string {
+	return "throttling"
+}
+
+func isSlowDown(err error) bool {
+	return err == errSlowDown
+}
+
+func TestAdaptiveRegulatorBackoff(t *testing.T) {
+	ctx := context.Background()
+	d := &throttlingDriver{}
+	r := NewAdaptiveRegulator(d, AdaptiveRegulatorParameters{
+		MaxConcurrency: map[OperationClass]uint64{OperationRead: 16},
+		MinConcurrency: 2,
+		Backoff:        0.5,
+	}, isSlowDown).(*adaptiveRegulator)
+	reads := r.limiters[OperationRead]
+
+	d.throttle = true
+	for i, expected := range []float64{8, 4, 2, 2} {
+		if _, err := r.Stat(ctx, "/"); err != errSlowDown {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reads.limit != expected {
+			t.Fatalf("unexpected limit after %d throttled calls: %v != %v", i+1, reads.limit, expected)
+		}
+	}
+
+	// the limit recovers while the calls saturate it
+	d.throttle = false
+	d.block = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Stat(ctx, "/")
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(d.block)
+	wg.Wait()
+	if reads.limit <= 2 || reads.limit > 16 {
+		t.Fatalf("limit did not recover: %v", reads.limit)
+	}
+
+	// the other classes keep their budget
+	if limit := r.limiters[OperationWrite].limit; limit != float64(operationClasses[OperationWrite]) {
+		t.Fatalf("unexpected write limit: %v", limit)
+	}
+}
+
+func TestAdaptiveRegulatorLimit(t *testing.T) {
+	ctx := context.Background()
+	d := &throttlingDriver{block: make(chan struct{})}
+	r := NewAdaptiveRegulator(d, AdaptiveRegulatorParameters{
+		MaxConcurrency: map[OperationClass]uint64{OperationRead: 2},
+	}, isSlowDown).(*adaptiveRegulator)
+	reads := r.limiters[OperationRead]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Stat(ctx, "/")
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	reads.mu.Lock()
+	inFlight := reads.inFlight
+	reads.mu.Unlock()
+	if inFlight != 2 {
+		t.Fatalf("unexpected concurrent calls: %d != 2", inFlight)
+	}
+
+	// calls of other classes are not held up by the reads
+	if err := r.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	close(d.block)
+	wg.Wait()
+}
+
+func TestAdaptiveRegulatorCancel(t *testing.T) {
+	d := &throttlingDriver{block: make(chan struct{})}
+	r := NewAdaptiveRegulator(d, AdaptiveRegulatorParameters{
+		MaxConcurrency: map[OperationClass]uint64{OperationRead: 1},
+	}, isSlowDown).(*adaptiveRegulator)
+	reads := r.limiters[OperationRead]
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Stat(context.Background(), "/")
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// a call waiting for the budget gives up once its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Stat(ctx, "/")
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call kept waiting after its context was canceled")
+	}
+
+	close(d.block)
+	<-done
+	reads.mu.Lock()
+	inFlight := reads.inFlight
+	reads.mu.Unlock()
+	if inFlight != 0 {
+		t.Fatalf("unexpected calls in flight: %d", inFlight)
+	}
+}
+
+// walkingDriver walks two files, calling listing whenever it lists files.
+type walkingDriver struct {
+	throttlingDriver
+	listing func()
+}
+
+func (d *walkingDriver) List(ctx context.Context, path string) ([]string, error) {
+	return nil, nil
+}
+
+func (d *walkingDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	for _, p := range []string{"/a", "/b"} {
+		d.listing()
+		if err := f(storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{Path: p}}); err != nil {
+			return err
+		}
+	}
+	d.listing()
+	if d.throttle {
+		return errSlowDown
+	}
+	return nil
+}
+
+func TestAdaptiveRegulatorWalk(t *testing.T) {
+	d := &walkingDriver{}
+	r := NewAdaptiveRegulator(d, AdaptiveRegulatorParameters{
+		MaxConcurrency: map[OperationClass]uint64{OperationList: 1},
+	}, isSlowDown).(*adaptiveRegulator)
+	lists := r.limiters[OperationList]
+
+	// the walk holds the list budget while listing, and releases it while
+	// the files are visited, which may list as well
+	d.listing = func() {
+		lists.mu.Lock()
+		defer lists.mu.Unlock()
+		if lists.inFlight != 1 {
+			t.Errorf("unexpected list calls in flight while walking: %d", lists.inFlight)
+		}
+	}
+	var visited []string
+	err := r.Walk(context.Background(), "/", func(fileInfo storagedriver.FileInfo) error {
+		visited = append(visited, fileInfo.Path())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := r.List(ctx, "/")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(visited) != 2 {
+		t.Fatalf("unexpected files visited: %v", visited)
+	}
+	if lists.inFlight != 0 {
+		t.Fatalf("unexpected list calls in flight after walking: %d", lists.inFlight)
+	}
+
+	// throttled walks back off the list budget
+	r = NewAdaptiveRegulator(d, AdaptiveRegulatorParameters{
+		MaxConcurrency: map[OperationClass]uint64{OperationList: 4},
+		Backoff:        0.5,
+	}, isSlowDown).(*adaptiveRegulator)
+	d.listing = func() {}
+	d.throttle = true
+	if err := r.Walk(context.Background(), "/", func(storagedriver.FileInfo) error { return nil }); err != errSlowDown {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if limit := r.limiters[OperationList].limit; limit != 2 {
+		t.Fatalf("unexpected list limit: %v", limit)
+	}
+}
+
+func TestGetAdaptiveRegulatorParameters(t *testing.T) {
+	for _, param := range []interface{}{nil, false, "false"} {
+		params, err := GetAdaptiveRegulatorParameters(param)
+		if err != nil || params != nil {
+			t.Fatalf("unexpected parameters for %#v: %v, %v", param, params, err)
+		}
+	}
+
+	params, err := GetAdaptiveRegulatorParameters(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.MaxConcurrency[OperationList] != operationClasses[OperationList] || params.MinConcurrency != 1 || params.Backoff != defaultBackoff {
+		t.Fatalf("unexpected default parameters: %+v", params)
+	}
+
+	params, err = GetAdaptiveRegulatorParameters(map[interface{}]interface{}{
+		"read":    256,
+		"delete":  "8",
+		"min":     4,
+		"backoff": 0.75,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.MaxConcurrency[OperationRead] != 256 || params.MaxConcurrency[OperationDelete] != 8 || params.MaxConcurrency[OperationWrite] != operationClasses[OperationWrite] {
+		t.Fatalf("unexpected maximum concurrency: %v", params.MaxConcurrency)
+	}
+	if params.MinConcurrency != 4 || params.Backoff != 0.75 {
+		t.Fatalf("unexpected parameters: %+v", params)
+	}
+
+	for _, param := range []interface{}{
+		"sometimes",
+		map[string]interface{}{"copy": 4},
+		map[string]interface{}{"backoff": 1},
+		map[string]interface{}{"read": "many"},
+		map[string]interface{}{"list": 2, "min": 4},
+	} {
+		if _, err := GetAdaptiveRegulatorParameters(param); err == nil {
+			t.Fatalf("expected an error for %#v", param)
+		}
+	}
+}
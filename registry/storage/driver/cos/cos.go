@@ -3,14 +3,19 @@ package cos
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
@@ -25,6 +30,12 @@ const (
 	listMax          = 1000
 	minChunkSize     = 1 << 20
 	defaultChunkSize = 2 * minChunkSize
+	// defaultUploadConcurrency is the default number of parts of a file
+	// writer uploaded concurrently.
+	defaultUploadConcurrency = 4
+	// maxUploadConcurrency bounds the number of parts of a file writer
+	// uploaded concurrently, each holding a chunk in memory.
+	maxUploadConcurrency = 64
 )
 
 const (
@@ -49,11 +60,15 @@ type Driver struct {
 }
 
 type driver struct {
-	Client        *cos.Client
-	SecretID      string
-	SecretKey     string
-	RootDirectory string
-	ChunkSize     int64
+	Client            *cos.Client
+	SecretID          string
+	SecretKey         string
+	RootDirectory     string
+	ChunkSize         int64
+	UploadConcurrency int
+	Secure            bool
+	CDNDomain         string
+	CDNSignKey        string
 }
 
 //DriverParameters A struct that encapsulates all of the driver parameters after all values have been set
@@ -65,6 +80,17 @@ type DriverParameters struct {
 	Secure        bool
 	ChunkSize     int64
 	RootDirectory string
+	// UploadConcurrency is the number of parts of a file writer uploaded
+	// concurrently.
+	UploadConcurrency int
+	// CDNDomain is the domain of a CDN serving the bucket, used by URLFor
+	// instead of presigned COS URLs when set.
+	CDNDomain string
+	// CDNSignKey is the key signing the CDN URLs with the type A
+	// authentication of the CDN, leaving them unsigned when empty.
+	CDNSignKey string
+	// AdaptiveConcurrency regulates the concurrent calls to COS when set.
+	AdaptiveConcurrency *base.AdaptiveRegulatorParameters
 }
 
 func init() {
@@ -145,13 +171,43 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		}
 	}
 
+	uploadConcurrency := uint64(defaultUploadConcurrency)
+	if param, ok := parameters["uploadconcurrency"]; ok {
+		var err error
+		uploadConcurrency, err = base.GetLimitFromParameter(param, 1, defaultUploadConcurrency)
+		if err != nil {
+			return nil, fmt.Errorf("uploadconcurrency config error: %v", err)
+		}
+		if uploadConcurrency > maxUploadConcurrency {
+			return nil, fmt.Errorf("The uploadconcurrency %d parameter should be a number that is smaller than or equal to %d", uploadConcurrency, maxUploadConcurrency)
+		}
+	}
+
+	cdnDomain := parameters["cdndomain"]
+	if cdnDomain == nil {
+		cdnDomain = ""
+	}
+	cdnSignKey := parameters["cdnsignkey"]
+	if cdnSignKey == nil {
+		cdnSignKey = ""
+	}
+
+	adaptiveConcurrency, err := base.GetAdaptiveRegulatorParameters(parameters["adaptiveconcurrency"])
+	if err != nil {
+		return nil, fmt.Errorf("adaptiveconcurrency config error: %v", err)
+	}
+
 	params := DriverParameters{
-		SecretID:  fmt.Sprint(secretID),
-		SecretKey: fmt.Sprint(secretKey),
-		Bucket:    fmt.Sprint(bucket),
-		Region:    fmt.Sprint(regionName),
-		ChunkSize: chunkSize,
-		Secure:    secureBool,
+		SecretID:            fmt.Sprint(secretID),
+		SecretKey:           fmt.Sprint(secretKey),
+		Bucket:              fmt.Sprint(bucket),
+		Region:              fmt.Sprint(regionName),
+		ChunkSize:           chunkSize,
+		Secure:              secureBool,
+		UploadConcurrency:   int(uploadConcurrency),
+		CDNDomain:           fmt.Sprint(cdnDomain),
+		CDNSignKey:          fmt.Sprint(cdnSignKey),
+		AdaptiveConcurrency: adaptiveConcurrency,
 	}
 
 	return New(params)
@@ -167,17 +223,30 @@ func New(params DriverParameters) (*Driver, error) {
 			SecretKey: params.SecretKey,
 		},
 	})
+	uploadConcurrency := params.UploadConcurrency
+	if uploadConcurrency < 1 {
+		uploadConcurrency = 1
+	}
 	d := &driver{
-		Client:        client,
-		SecretID:      params.SecretID,
-		SecretKey:     params.SecretKey,
-		RootDirectory: "",
-		ChunkSize:     params.ChunkSize,
+		Client:            client,
+		SecretID:          params.SecretID,
+		SecretKey:         params.SecretKey,
+		RootDirectory:     "",
+		ChunkSize:         params.ChunkSize,
+		UploadConcurrency: uploadConcurrency,
+		Secure:            params.Secure,
+		CDNDomain:         params.CDNDomain,
+		CDNSignKey:        params.CDNSignKey,
+	}
+	var sd storagedriver.StorageDriver = d
+	if params.AdaptiveConcurrency != nil {
+		sd = base.NewAdaptiveRegulator(d, *params.AdaptiveConcurrency, isThrottled)
 	}
+
 	return &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
-				StorageDriver: d,
+				StorageDriver: sd,
 			},
 		},
 	}, nil
@@ -239,27 +308,83 @@ func (d *driver) Writer(ctx context.Context, path string, append bool) (storaged
 		uploadID := multi.UploadID
 		return d.newWriter(key, uploadID, nil), nil
 	}
-	opt := &cos.ListMultipartUploadsOptions{
-		Prefix: key,
+	// resume the upload from the parts already uploaded, which may have
+	// been uploaded before a restart of the registry
+	uploadID, err := d.findUpload(ctx, key)
+	if err != nil {
+		return nil, parseError(path, err)
 	}
-	// list parts on uploading
-	v, _, err := d.Client.Bucket.ListMultipartUploads(ctx, opt)
+	if uploadID == "" {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	parts, err := d.listParts(ctx, key, uploadID)
 	if err != nil {
 		return nil, parseError(path, err)
 	}
-	for _, upload := range v.Uploads {
-		if key != upload.Key {
-			continue
+	return d.newWriter(key, uploadID, uploadedParts(parts)), nil
+}
+
+// listParts returns the parts uploaded to a multipart upload, which COS lists
+// by pages of up to 1000 parts. The SDK takes no option for the marker of the
+// next page, so it is appended to the upload ID, which the SDK adds to the
+// query as is.
+func (d *driver) listParts(ctx context.Context, key, uploadID string) ([]cos.Object, error) {
+	var parts []cos.Object
+	query := uploadID
+	for {
+		v, _, err := d.Client.Object.ListParts(ctx, key, query)
+		if err != nil {
+			return nil, err
 		}
-		uploadID := upload.UploadID
-		v, _, err := d.Client.Object.ListParts(ctx, key, uploadID)
+		parts = append(parts, v.Parts...)
+		if !v.IsTruncated {
+			return parts, nil
+		}
+		if v.NextPartNumberMarker <= v.PartNumberMarker {
+			return nil, fmt.Errorf("truncated list of the parts of upload %s without a next marker", uploadID)
+		}
+		query = uploadID + "&part-number-marker=" + strconv.Itoa(v.NextPartNumberMarker)
+	}
+}
+
+// findUpload returns the ID of the latest multipart upload in progress to
+// key, or an empty string if there is none.
+func (d *driver) findUpload(ctx context.Context, key string) (string, error) {
+	var uploadID, initiated string
+	opt := &cos.ListMultipartUploadsOptions{
+		Prefix: key,
+	}
+	for {
+		v, _, err := d.Client.Bucket.ListMultipartUploads(ctx, opt)
 		if err != nil {
-			return nil, parseError(path, err)
+			return "", err
+		}
+		for _, upload := range v.Uploads {
+			// the initiation times are in the ISO 8601 format, ordered as
+			// strings
+			if upload.Key == key && (uploadID == "" || upload.Initiated > initiated) {
+				uploadID, initiated = upload.UploadID, upload.Initiated
+			}
+		}
+		if !v.IsTruncated {
+			return uploadID, nil
+		}
+		opt.KeyMarker, opt.UploadIDMarker = v.NextKeyMarker, v.NextUploadIDMarker
+	}
+}
+
+// uploadedParts returns the parts of a multipart upload which can be
+// resumed. As parts are uploaded concurrently, some of them may be missing
+// when the upload was interrupted: only the parts before the first missing
+// one hold the beginning of the file, the following ones are uploaded again.
+func uploadedParts(parts []cos.Object) []cos.Object {
+	sort.Sort(cos.ObjectList(parts))
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			return parts[:i]
 		}
-		parts := v.Parts
-		return d.newWriter(key, uploadID, parts), nil
 	}
-	return nil, storagedriver.PathNotFoundError{Path: path}
+	return parts
 }
 
 func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
@@ -452,6 +577,10 @@ func (d *driver) URLFor(ctx context.Context, path string, options map[string]int
 			expiresTime = et
 		}
 	}
+	if d.CDNDomain != "" {
+		return d.cdnURL(path, now)
+	}
+
 	duration := expiresTime.Sub(now)
 	url, err := d.Client.Object.GetPresignedURL(ctx, methodString, d.cosPath(path), d.SecretID, d.SecretKey, duration, nil)
 	if err != nil {
@@ -462,6 +591,36 @@ func (d *driver) URLFor(ctx context.Context, path string, options map[string]int
 	return signedURL, nil
 }
 
+// cdnURL returns the URL of the content stored at "path" on the CDN,
+// signed with the type A authentication of the CDN when a key is set. The
+// validity of signed URLs is configured on the CDN, from the time they are
+// signed.
+func (d *driver) cdnURL(path string, now time.Time) (string, error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   d.CDNDomain,
+		Path:   "/" + d.cosPath(path),
+	}
+	if !d.Secure {
+		u.Scheme = "http"
+	}
+	if d.CDNSignKey != "" {
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		u.RawQuery = "sign=" + signCDNPath(u.EscapedPath(), d.CDNSignKey, now.Unix(), hex.EncodeToString(nonce))
+	}
+	return u.String(), nil
+}
+
+// signCDNPath computes the type A signature of a CDN path,
+// timestamp-rand-uid-md5(path-timestamp-rand-uid-key), with a zero uid.
+func signCDNPath(path, key string, timestamp int64, nonce string) string {
+	hash := md5.Sum([]byte(fmt.Sprintf("%s-%d-%s-0-%s", path, timestamp, nonce, key)))
+	return fmt.Sprintf("%d-%s-0-%s", timestamp, nonce, hex.EncodeToString(hash[:]))
+}
+
 func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
 	return storagedriver.WalkFallback(ctx, d, path, f)
 }
@@ -477,9 +636,13 @@ func (d *driver) newWriter(key, uploadID string, parts []cos.Object) storagedriv
 		uploadID: uploadID,
 		parts:    parts,
 		size:     size,
+		limiter:  make(chan struct{}, d.UploadConcurrency),
 	}
 }
 
+// writer uploads the parts of a multipart upload concurrently, up to the
+// upload concurrency of the driver. Errors uploading parts are returned by
+// the following calls.
 type writer struct {
 	driver      *driver
 	key         string
@@ -491,6 +654,11 @@ type writer struct {
 	closed      bool
 	committed   bool
 	cancelled   bool
+
+	uploads sync.WaitGroup
+	limiter chan struct{}
+	mu      sync.Mutex // guards parts and err while parts are uploading
+	err     error
 }
 
 func (w *writer) Write(p []byte) (int, error) {
@@ -501,19 +669,14 @@ func (w *writer) Write(p []byte) (int, error) {
 	} else if w.cancelled {
 		return 0, fmt.Errorf("already cancelled")
 	}
+	if err := w.uploadErr(); err != nil {
+		return 0, err
+	}
 
 	// If the last written part is smaller than minChunkSize, we need to make a
 	// new multipart upload :sadface:
 	if len(w.parts) > 0 && int(w.parts[len(w.parts)-1].Size) < minChunkSize {
-		opt := &cos.CompleteMultipartUploadOptions{}
-		for _, p := range w.parts {
-			opt.Parts = append(opt.Parts, cos.Object{
-				PartNumber: p.PartNumber,
-				ETag:       p.ETag,
-			})
-		}
-		sort.Sort(cos.ObjectList(opt.Parts))
-		_, _, err := w.driver.Client.Object.CompleteMultipartUpload(context.Background(), w.key, w.uploadID, opt)
+		_, _, err := w.driver.Client.Object.CompleteMultipartUpload(context.Background(), w.key, w.uploadID, w.completeOptions())
 
 		if err != nil {
 			w.driver.Client.Object.AbortMultipartUpload(context.Background(), w.key, w.uploadID)
@@ -545,6 +708,8 @@ func (w *writer) Write(p []byte) (int, error) {
 			if err != nil {
 				return 0, err
 			}
+			part.PartNumber = 1
+			part.Size = int(w.size)
 			w.parts = []cos.Object{part}
 		}
 	}
@@ -595,7 +760,10 @@ func (w *writer) Close() error {
 		return fmt.Errorf("already closed")
 	}
 	w.closed = true
-	return w.flushPart()
+	if err := w.flushPart(); err != nil {
+		return err
+	}
+	return w.wait()
 }
 
 func (w *writer) Cancel() error {
@@ -605,6 +773,7 @@ func (w *writer) Cancel() error {
 		return fmt.Errorf("already committed")
 	}
 	w.cancelled = true
+	w.wait()
 	_, err := w.driver.Client.Object.AbortMultipartUpload(context.Background(), w.key, w.uploadID)
 	return err
 }
@@ -618,14 +787,14 @@ func (w *writer) Commit() error {
 		return fmt.Errorf("already cancelled")
 	}
 	err := w.flushPart()
+	if err == nil {
+		err = w.wait()
+	}
 	if err != nil {
 		return err
 	}
 	w.committed = true
-	opt := &cos.CompleteMultipartUploadOptions{
-		Parts: w.parts,
-	}
-	_, _, err = w.driver.Client.Object.CompleteMultipartUpload(context.Background(), w.key, w.uploadID, opt)
+	_, _, err = w.driver.Client.Object.CompleteMultipartUpload(context.Background(), w.key, w.uploadID, w.completeOptions())
 	if err != nil {
 		w.driver.Client.Object.AbortMultipartUpload(context.Background(), w.key, w.uploadID)
 		return err
@@ -633,6 +802,19 @@ func (w *writer) Commit() error {
 	return nil
 }
 
+// completeOptions lists the uploaded parts to complete the multipart upload.
+func (w *writer) completeOptions() *cos.CompleteMultipartUploadOptions {
+	opt := &cos.CompleteMultipartUploadOptions{}
+	for _, p := range w.parts {
+		opt.Parts = append(opt.Parts, cos.Object{
+			PartNumber: p.PartNumber,
+			ETag:       p.ETag,
+		})
+	}
+	sort.Sort(cos.ObjectList(opt.Parts))
+	return opt
+}
+
 // flushPart flushes buffers to write a part to cos.
 // Only called by Write (with both buffers full) and Close/Commit (always)
 func (w *writer) flushPart() error {
@@ -647,26 +829,66 @@ func (w *writer) flushPart() error {
 		w.pendingPart = nil
 	}
 
+	w.uploadPart(w.readyPart)
+	w.readyPart = w.pendingPart
+	w.pendingPart = nil
+	return w.uploadErr()
+}
+
+// uploadPart uploads the next part in the background, waiting while as many
+// parts as the upload concurrency are being uploaded.
+func (w *writer) uploadPart(part []byte) {
+	w.limiter <- struct{}{}
+
+	w.mu.Lock()
 	partNumber := len(w.parts) + 1
-	resp, err := w.driver.Client.Object.UploadPart(
-		context.Background(),
-		w.key,
-		w.uploadID,
-		partNumber,
-		bytes.NewReader(w.readyPart),
-		nil,
-	)
-	if err != nil {
-		return err
-	}
-	etag := resp.Header.Get("Etag")
 	w.parts = append(w.parts, cos.Object{
-		ETag:       etag,
 		PartNumber: partNumber,
+		Size:       len(part),
 	})
-	w.readyPart = w.pendingPart
-	w.pendingPart = nil
-	return nil
+	w.mu.Unlock()
+
+	uploadID := w.uploadID
+	w.uploads.Add(1)
+	go func() {
+		defer func() {
+			<-w.limiter
+			w.uploads.Done()
+		}()
+
+		resp, err := w.driver.Client.Object.UploadPart(
+			context.Background(),
+			w.key,
+			uploadID,
+			partNumber,
+			bytes.NewReader(part),
+			nil,
+		)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
+		w.parts[partNumber-1].ETag = resp.Header.Get("Etag")
+	}()
+}
+
+// uploadErr returns the first error uploading a part.
+func (w *writer) uploadErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// wait waits for the parts being uploaded, returning the first error
+// uploading a part.
+func (w *writer) wait() error {
+	w.uploads.Wait()
+	return w.uploadErr()
 }
 
 func (d *driver) cosPath(path string) string {
@@ -758,6 +980,15 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 	return err
 }
 
+// isThrottled reports whether COS rejected a call for exceeding the request
+// rate, with an HTTP 503 or 429 response.
+func isThrottled(err error) bool {
+	if cosErr, ok := err.(*cos.ErrorResponse); ok && cosErr.Response != nil {
+		return cosErr.Response.StatusCode == http.StatusServiceUnavailable || cosErr.Response.StatusCode == http.StatusTooManyRequests || cosErr.Code == "SlowDown"
+	}
+	return false
+}
+
 func parseError(path string, err error) error {
 	if cosErr, ok := err.(*cos.ErrorResponse); ok && cosErr.Response.StatusCode == http.StatusNotFound && (cosErr.Code == "NoSuchKey" || cosErr.Code == "") {
 		return storagedriver.PathNotFoundError{Path: path}
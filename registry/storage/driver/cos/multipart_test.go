@@ -0,0 +1,384 @@
+package cos
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Coding/cos-go-sdk-v5"
+)
+
+type fakeUpload struct {
+	key       string
+	initiated string
+	parts     map[int][]byte
+}
+
+// fakeCOS implements the multipart uploads of the COS API, recording how
+// many parts are uploaded concurrently.
+type fakeCOS struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]*fakeUpload
+	nextID   int
+	inFlight int
+	maxParts int
+}
+
+func newFakeCOS() *fakeCOS {
+	return &fakeCOS{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]*fakeUpload),
+	}
+}
+
+func (f *fakeCOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == "GET" && uploads:
+		f.listUploads(w)
+	case r.Method == "POST" && uploads:
+		f.mu.Lock()
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeUpload{
+			key:       key,
+			initiated: fmt.Sprintf("2020-01-01T00:00:%02d.000Z", f.nextID),
+			parts:     make(map[int][]byte),
+		}
+		f.mu.Unlock()
+		writeXML(w, cos.InitiateMultipartUploadResult{Key: key, UploadID: id})
+	case r.Method == "PUT" && uploadID != "":
+		f.uploadPart(w, r, uploadID)
+	case r.Method == "GET" && uploadID != "":
+		f.listParts(w, uploadID, query.Get("part-number-marker"))
+	case r.Method == "POST" && uploadID != "":
+		f.complete(w, r, key, uploadID)
+	case r.Method == "DELETE" && uploadID != "":
+		f.mu.Lock()
+		delete(f.uploads, uploadID)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET":
+		f.mu.Lock()
+		content, ok := f.objects[key]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeCOS) listUploads(w http.ResponseWriter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result cos.ListMultipartUploadsResult
+	for id, upload := range f.uploads {
+		result.Uploads = append(result.Uploads, struct {
+			Key          string
+			UploadID     string `xml:"UploadId"`
+			StorageClass string
+			Initiator    *cos.Initiator
+			Owner        *cos.Owner
+			Initiated    string
+		}{Key: upload.key, UploadID: id, Initiated: upload.initiated})
+	}
+	writeXML(w, result)
+}
+
+func (f *fakeCOS) uploadPart(w http.ResponseWriter, r *http.Request, uploadID string) {
+	partNumber, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxParts {
+		f.maxParts = f.inFlight
+	}
+	f.mu.Unlock()
+
+	// let the other parts start uploading
+	time.Sleep(20 * time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+	upload, ok := f.uploads[uploadID]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	upload.parts[partNumber] = content
+	w.Header().Set("Etag", etag(partNumber))
+}
+
+// listParts lists the parts of an upload by pages of up to 1000 parts, after
+// the part number marker.
+func (f *fakeCOS) listParts(w http.ResponseWriter, uploadID, marker string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload, ok := f.uploads[uploadID]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	result := cos.ObjectListPartsResult{MaxParts: 1000}
+	result.PartNumberMarker, _ = strconv.Atoi(marker)
+	var partNumbers []int
+	for partNumber := range upload.parts {
+		if partNumber > result.PartNumberMarker {
+			partNumbers = append(partNumbers, partNumber)
+		}
+	}
+	sort.Ints(partNumbers)
+	if len(partNumbers) > result.MaxParts {
+		partNumbers = partNumbers[:result.MaxParts]
+		result.IsTruncated = true
+		result.NextPartNumberMarker = partNumbers[len(partNumbers)-1]
+	}
+	for _, partNumber := range partNumbers {
+		result.Parts = append(result.Parts, cos.Object{
+			PartNumber: partNumber,
+			ETag:       etag(partNumber),
+			Size:       len(upload.parts[partNumber]),
+		})
+	}
+	writeXML(w, result)
+}
+
+func (f *fakeCOS) complete(w http.ResponseWriter, r *http.Request, key, uploadID string) {
+	var opt cos.CompleteMultipartUploadOptions
+	if err := xml.NewDecoder(r.Body).Decode(&opt); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload, ok := f.uploads[uploadID]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var content []byte
+	for i, part := range opt.Parts {
+		if part.PartNumber != i+1 || part.ETag != etag(part.PartNumber) || upload.parts[part.PartNumber] == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content = append(content, upload.parts[part.PartNumber]...)
+	}
+	f.objects[key] = content
+	delete(f.uploads, uploadID)
+	writeXML(w, cos.CompleteMultipartUploadResult{Key: key})
+}
+
+func etag(partNumber int) string {
+	return fmt.Sprintf("\"etag-%d\"", partNumber)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+// newFakeDriver returns a driver storing to f, served by the returned server.
+func newFakeDriver(f *fakeCOS, uploadConcurrency int) (*driver, *httptest.Server) {
+	server := httptest.NewServer(f)
+	u, _ := url.Parse(server.URL)
+	return &driver{
+		Client:            cos.NewClient(&cos.BaseURL{BucketURL: u}, nil),
+		ChunkSize:         minChunkSize,
+		UploadConcurrency: uploadConcurrency,
+	}, server
+}
+
+func TestWriterConcurrentUploads(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCOS()
+	d, server := newFakeDriver(f, 3)
+	defer server.Close()
+
+	contents := make([]byte, 10*minChunkSize+12345)
+	rand.Read(contents)
+
+	fw, err := d.Writer(ctx, "/file", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	// writes smaller than the chunks, as with HTTP request bodies
+	for offset := 0; offset < len(contents); offset += 300 << 10 {
+		end := offset + 300<<10
+		if end > len(contents) {
+			end = len(contents)
+		}
+		if _, err := fw.Write(contents[offset:end]); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+
+	if !bytes.Equal(f.objects["file"], contents) {
+		t.Fatal("content differs")
+	}
+	if f.maxParts < 2 || f.maxParts > 3 {
+		t.Fatalf("unexpected concurrent uploads: %d", f.maxParts)
+	}
+}
+
+func TestWriterResume(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCOS()
+	d, server := newFakeDriver(f, 4)
+	defer server.Close()
+
+	contents := make([]byte, 6*minChunkSize+100)
+	rand.Read(contents)
+
+	fw, err := d.Writer(ctx, "/file", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := fw.Write(contents[:5*minChunkSize]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	// an older upload to the same file is ignored
+	f.uploads["0"] = &fakeUpload{key: "file", initiated: "2019-01-01T00:00:00.000Z", parts: map[int][]byte{1: []byte("stale")}}
+
+	fw, err = d.Writer(ctx, "/file", true)
+	if err != nil {
+		t.Fatalf("unexpected error resuming writer: %v", err)
+	}
+	if fw.Size() != 5*minChunkSize {
+		t.Fatalf("unexpected size resuming: %d", fw.Size())
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	// interrupted while uploading the third part, the upload resumes
+	// from the second one
+	for _, upload := range f.uploads {
+		if upload.key == "file" && upload.initiated > "2020" {
+			delete(upload.parts, 3)
+		}
+	}
+	fw, err = d.Writer(ctx, "/file", true)
+	if err != nil {
+		t.Fatalf("unexpected error resuming writer: %v", err)
+	}
+	if fw.Size() != 2*minChunkSize {
+		t.Fatalf("unexpected size resuming after an interruption: %d", fw.Size())
+	}
+	if _, err := fw.Write(contents[fw.Size():]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+
+	if !bytes.Equal(f.objects["file"], contents) {
+		t.Fatal("content differs")
+	}
+
+	if _, err := d.Writer(ctx, "/missing", true); err == nil {
+		t.Fatal("expected an error resuming a missing upload")
+	}
+}
+
+func TestURLForCDN(t *testing.T) {
+	ctx := context.Background()
+	d := &driver{CDNDomain: "cdn.example.com", Secure: true}
+
+	u, err := d.URLFor(ctx, "/docker/registry/v2/blobs/data", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u != "https://cdn.example.com/docker/registry/v2/blobs/data" {
+		t.Fatalf("unexpected URL: %s", u)
+	}
+
+	d.CDNSignKey = "secret"
+	u, err = d.URLFor(ctx, "/docker/registry/v2/blobs/data", map[string]interface{}{"method": "HEAD"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatalf("invalid URL %s: %v", u, err)
+	}
+	sign := strings.Split(parsed.Query().Get("sign"), "-")
+	if len(sign) != 4 {
+		t.Fatalf("unexpected signature: %s", u)
+	}
+	timestamp, _ := strconv.ParseInt(sign[0], 10, 64)
+	if expected := signCDNPath(parsed.Path, "secret", timestamp, sign[1]); parsed.Query().Get("sign") != expected {
+		t.Fatalf("unexpected signature: %s != %s", parsed.Query().Get("sign"), expected)
+	}
+
+	if _, err := d.URLFor(ctx, "/data", map[string]interface{}{"method": "POST"}); err == nil {
+		t.Fatal("expected an error with an unsupported method")
+	}
+}
+
+func TestWriterResumeManyParts(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCOS()
+	d, server := newFakeDriver(f, 4)
+	defer server.Close()
+
+	fw, err := d.Writer(ctx, "/file", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+
+	// the parts are listed by pages of 1000
+	for _, upload := range f.uploads {
+		for partNumber := 1; partNumber <= 2500; partNumber++ {
+			upload.parts[partNumber] = []byte("part")
+		}
+	}
+	fw, err = d.Writer(ctx, "/file", true)
+	if err != nil {
+		t.Fatalf("unexpected error resuming writer: %v", err)
+	}
+	if fw.Size() != 2500*int64(len("part")) {
+		t.Fatalf("unexpected size resuming: %d", fw.Size())
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+}
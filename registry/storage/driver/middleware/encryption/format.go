@@ -0,0 +1,307 @@
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Encrypted files start with a header holding the data key of the file,
+// encrypted with a master key of the KeyProvider:
+//
+//	magic        4 bytes, "DENC"
+//	version      1 byte
+//	key ID size  1 byte
+//	key ID       32 bytes, padded with zeros
+//	nonce        12 bytes
+//	data key     32 bytes, encrypted with the master key, plus a 16 bytes tag
+//
+// The content follows, split in chunks of chunkSize bytes each encrypted with
+// the data key, so that reads at an offset only decrypt the chunks from the
+// offset. A chunk is authenticated with its index, and the last chunk is
+// marked as such, so that chunks can be neither reordered nor dropped.
+//
+// The last chunk, shorter than the other ones, is only written once the
+// file is committed. Until then the content following the last full chunk is
+// kept encrypted in a tail file next to the file, so that writes can be
+// appended to the file.
+const (
+	headerMagic   = "DENC"
+	formatVersion = 1
+
+	maxKeyIDLength = 32
+	keySize        = 32
+	nonceSize      = 12
+	tagSize        = 16
+
+	headerSize = len(headerMagic) + 2 + maxKeyIDLength + nonceSize + keySize + tagSize
+
+	chunkSize          = 64 << 10
+	encryptedChunkSize = chunkSize + tagSize
+
+	// tailSuffix is appended to the path of a file to get its tail file.
+	tailSuffix = ".enctail"
+	// tailOverhead is the size of a tail file beyond the tail content.
+	tailOverhead = nonceSize + tagSize
+)
+
+// newAEAD returns the AES-256-GCM cipher of the key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader generates a data key, returning its cipher and the header of a
+// new file holding it.
+func newHeader(keys KeyProvider) (cipher.AEAD, []byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	master, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, headerMagic...)
+	header = append(header, formatVersion, byte(len(id)))
+	header = append(header, id...)
+	header = append(header, make([]byte, maxKeyIDLength-len(id))...)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	header = append(header, nonce...)
+	// the prefix of the header is authenticated along with the data key
+	header = master.Seal(header, nonce, dataKey, header[:len(header)-nonceSize])
+
+	return aead, header, nil
+}
+
+// parseHeader returns the cipher of the data key held by the header.
+func parseHeader(keys KeyProvider, header []byte) (cipher.AEAD, error) {
+	if len(header) < headerSize || string(header[:len(headerMagic)]) != headerMagic {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	p := header[len(headerMagic):]
+	if p[0] != formatVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", p[0])
+	}
+	if int(p[1]) > maxKeyIDLength {
+		return nil, fmt.Errorf("invalid encryption header")
+	}
+	id := string(p[2 : 2+p[1]])
+	p = p[2+maxKeyIDLength:]
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	master, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := header[:headerSize-keySize-tagSize]
+	dataKey, err := master.Open(nil, p[:nonceSize], p[nonceSize:nonceSize+keySize+tagSize], prefix[:len(prefix)-nonceSize])
+	if err != nil {
+		return nil, fmt.Errorf("decrypting the data key: %v", err)
+	}
+	return newAEAD(dataKey)
+}
+
+// chunkNonce returns the nonce of the chunk at index. The data key is unique
+// to the file and each chunk is written once, so that nonces are never
+// reused.
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// layout returns the number of full chunks of an encrypted file of the given
+// size, and the size of the content of its last chunk, or -1 when the file is
+// not committed yet.
+func layout(size int64) (chunks int64, last int64, err error) {
+	size -= int64(headerSize)
+	if size < 0 {
+		return 0, 0, fmt.Errorf("not an encrypted file")
+	}
+
+	chunks, rest := size/encryptedChunkSize, size%encryptedChunkSize
+	switch {
+	case rest == 0:
+		return chunks, -1, nil
+	case rest < tagSize:
+		return 0, 0, fmt.Errorf("truncated encrypted file")
+	default:
+		return chunks, rest - tagSize, nil
+	}
+}
+
+// encryptContent returns the content encrypted as a committed file.
+func encryptContent(keys KeyProvider, content []byte) ([]byte, error) {
+	aead, header, err := newHeader(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := int64(len(content) / chunkSize)
+	p := make([]byte, 0, headerSize+len(content)+int(chunks+1)*tagSize)
+	p = append(p, header...)
+	for i := int64(0); i < chunks; i++ {
+		p = aead.Seal(p, chunkNonce(i, false), content[i*chunkSize:(i+1)*chunkSize], nil)
+	}
+	return aead.Seal(p, chunkNonce(chunks, true), content[chunks*chunkSize:], nil), nil
+}
+
+// sealTail encrypts the content following the full chunks of a file which
+// is not committed yet.
+func sealTail(aead cipher.AEAD, index int64, tail []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize, tailOverhead+len(tail))
+	// the tail is written again as it grows, so its nonce is random
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, tail, tailAdditionalData(index)), nil
+}
+
+// openTail decrypts the tail file following the full chunks of a file.
+func openTail(aead cipher.AEAD, index int64, p []byte) ([]byte, error) {
+	if len(p) < tailOverhead {
+		return nil, fmt.Errorf("truncated encrypted tail")
+	}
+	tail, err := aead.Open(nil, p[:nonceSize], p[nonceSize:], tailAdditionalData(index))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting the tail: %v", err)
+	}
+	return tail, nil
+}
+
+// tailAdditionalData binds a tail to the index of the chunk it starts, so
+// that a tail is not used once the file grew past it.
+func tailAdditionalData(index int64) []byte {
+	p := make([]byte, 8)
+	binary.BigEndian.PutUint64(p, uint64(index))
+	return p
+}
+
+// decryptingReader decrypts the chunks of a file from a reader positioned at
+// the start of a chunk.
+type decryptingReader struct {
+	rc    io.ReadCloser
+	aead  cipher.AEAD
+	index int64 // of the next chunk
+	// chunks and last describe the layout of the file
+	chunks int64
+	last   int64
+	// tail returns the tail of a file which is not committed
+	tail func() ([]byte, error)
+	// discard is the number of encrypted bytes to discard before the first
+	// chunk
+	discard int64
+	// skip is the number of bytes to skip at the start of the first chunk
+	skip int64
+
+	buf  []byte
+	done bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into buf.
+func (r *decryptingReader) next() error {
+	if r.discard > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r.rc, r.discard); err != nil {
+			return r.readError(err)
+		}
+		r.discard = 0
+	}
+
+	var plaintext []byte
+	switch {
+	case r.index < r.chunks:
+		ciphertext := make([]byte, encryptedChunkSize)
+		if _, err := io.ReadFull(r.rc, ciphertext); err != nil {
+			return r.readError(err)
+		}
+		var err error
+		if plaintext, err = r.aead.Open(ciphertext[:0], chunkNonce(r.index, false), ciphertext, nil); err != nil {
+			return fmt.Errorf("decrypting chunk %d: %v", r.index, err)
+		}
+	case r.last >= 0:
+		ciphertext := make([]byte, r.last+tagSize)
+		if _, err := io.ReadFull(r.rc, ciphertext); err != nil {
+			return r.readError(err)
+		}
+		var err error
+		if plaintext, err = r.aead.Open(ciphertext[:0], chunkNonce(r.index, true), ciphertext, nil); err != nil {
+			return fmt.Errorf("decrypting chunk %d: %v", r.index, err)
+		}
+		r.done = true
+	default:
+		var err error
+		if plaintext, err = r.tail(); err != nil {
+			return err
+		}
+		r.done = true
+	}
+	r.index++
+
+	if r.skip > 0 {
+		if r.skip > int64(len(plaintext)) {
+			r.skip = int64(len(plaintext))
+		}
+		plaintext, r.skip = plaintext[r.skip:], 0
+	}
+	r.buf = plaintext
+	return nil
+}
+
+func (r *decryptingReader) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("truncated encrypted file at chunk %d", r.index)
+	}
+	return err
+}
+
+func (r *decryptingReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	return r.rc.Close()
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+const (
+	// maxCachedHeaders is the maximum number of headers cached.
+	maxCachedHeaders = 1024
+	// maxSkippedChunks is the maximum number of chunks read and discarded to
+	// reach an offset from the header, beyond which the file is opened again
+	// at the offset.
+	maxSkippedChunks = 4
+)
+
+// headerCache caches the headers of committed files by path, so that ranged
+// reads do not read the header of the file again. A header is only used for
+// the file of the same size and modification time, and the headers of the
+// files written, moved or deleted through the middleware are removed.
+type headerCache struct {
+	mu      sync.Mutex
+	headers map[string]cachedHeader
+}
+
+type cachedHeader struct {
+	size    int64
+	modTime time.Time
+	header  []byte
+}
+
+// get returns the header cached for the file, or nil.
+func (c *headerCache) get(path string, fi storagedriver.FileInfo) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.headers[path]
+	if !ok || h.size != fi.Size() || !h.modTime.Equal(fi.ModTime()) {
+		return nil
+	}
+	return h.header
+}
+
+// put caches the header of the file, evicting another header when full.
+func (c *headerCache) put(path string, fi storagedriver.FileInfo, header []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.headers == nil {
+		c.headers = make(map[string]cachedHeader)
+	}
+	if _, ok := c.headers[path]; !ok && len(c.headers) >= maxCachedHeaders {
+		for p := range c.headers {
+			delete(c.headers, p)
+			break
+		}
+	}
+	c.headers[path] = cachedHeader{size: fi.Size(), modTime: fi.ModTime(), header: header}
+}
+
+// remove removes the headers cached for the paths.
+func (c *headerCache) remove(paths ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range paths {
+		delete(c.headers, p)
+	}
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	"gopkg.in/yaml.v2"
+)
+
+// KeyProvider provides the master keys encrypting the data keys of the files.
+type KeyProvider interface {
+	// CurrentKey returns the ID and the key encrypting the new files.
+	CurrentKey() (string, []byte, error)
+	// Key returns the key with the given ID, which encrypted existing files.
+	Key(id string) ([]byte, error)
+}
+
+// KeyProviderInitFunc constructs a KeyProvider from the options of the
+// middleware.
+type KeyProviderInitFunc func(options map[string]interface{}) (KeyProvider, error)
+
+var keyProviders map[string]KeyProviderInitFunc
+
+// RegisterKeyProvider makes a KeyProvider available by name, for the
+// keyprovider option of the middleware.
+func RegisterKeyProvider(name string, initFunc KeyProviderInitFunc) error {
+	if keyProviders == nil {
+		keyProviders = make(map[string]KeyProviderInitFunc)
+	}
+	if _, exists := keyProviders[name]; exists {
+		return fmt.Errorf("name already registered: %s", name)
+	}
+
+	keyProviders[name] = initFunc
+
+	return nil
+}
+
+func getKeyProvider(name string, options map[string]interface{}) (KeyProvider, error) {
+	if initFunc, exists := keyProviders[name]; exists {
+		return initFunc(options)
+	}
+	return nil, fmt.Errorf("no key provider registered with name: %s", name)
+}
+
+func init() {
+	RegisterKeyProvider("file", newFileKeyring)
+}
+
+// keyringCheckInterval is the minimum time between two checks for changes of
+// a keyring file.
+var keyringCheckInterval = 5 * time.Second
+
+// keyringFile is the content of a keyring file, the base64 encoded keys by ID
+// and the ID of the key encrypting the new files.
+type keyringFile struct {
+	Current string            `yaml:"current"`
+	Keys    map[string]string `yaml:"keys"`
+}
+
+// fileKeyring provides the keys of a local keyring file, read again once
+// modified so that keys can be rotated without restarting the registry. The
+// file is checked for changes at most every keyringCheckInterval.
+type fileKeyring struct {
+	path string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	current string
+	keys    map[string][]byte
+	// invalid identifies the invalid keyring last reported, so that it is
+	// only reported once
+	invalid string
+}
+
+// newFileKeyring constructs the file key provider.
+// Required options: keyring, the path of the keyring file
+func newFileKeyring(options map[string]interface{}) (KeyProvider, error) {
+	path, ok := options["keyring"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf("no keyring provided")
+	}
+
+	k := &fileKeyring{path: path}
+	if _, err := k.load(); err != nil {
+		return nil, err
+	}
+	k.checked = time.Now()
+	return k, nil
+}
+
+func (k *fileKeyring) CurrentKey() (string, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.reload()
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *fileKeyring) Key(id string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.reload()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	return key, nil
+}
+
+// reload reads the keyring file again once modified, unless it was checked
+// within keyringCheckInterval. A keyring file which became invalid is
+// reported once, keeping the keys last read.
+func (k *fileKeyring) reload() {
+	if time.Since(k.checked) < keyringCheckInterval {
+		return
+	}
+	k.checked = time.Now()
+
+	invalid, err := k.load()
+	if err == nil {
+		k.invalid = ""
+	} else if invalid != k.invalid {
+		k.invalid = invalid
+		dcontext.GetLogger(context.Background()).Errorf("encryption: keeping the keys last read: %v", err)
+	}
+}
+
+// load reads the keyring file unless it was not modified since last read. On
+// error, it also returns what identifies the invalid keyring: the digest of
+// its content, or the error if it could not be read.
+func (k *fileKeyring) load() (invalid string, err error) {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		err = fmt.Errorf("reading keyring: %v", err)
+		return err.Error(), err
+	}
+	if fi.ModTime().Equal(k.modTime) {
+		return "", nil
+	}
+
+	p, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		err = fmt.Errorf("reading keyring: %v", err)
+		return err.Error(), err
+	}
+
+	if err := k.parse(p); err != nil {
+		return fmt.Sprintf("%x", sha256.Sum256(p)), err
+	}
+
+	// an invalid file is read again until fixed
+	k.modTime = fi.ModTime()
+	return "", nil
+}
+
+// parse sets the keys from the content of the keyring file.
+func (k *fileKeyring) parse(p []byte) error {
+	var file keyringFile
+	if err := yaml.Unmarshal(p, &file); err != nil {
+		return fmt.Errorf("parsing keyring %s: %v", k.path, err)
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		if id == "" || len(id) > maxKeyIDLength {
+			return fmt.Errorf("keyring %s: key IDs must have 1 to %d characters, %q invalid", k.path, maxKeyIDLength, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return fmt.Errorf("keyring %s: key %s must be %d base64 encoded bytes", k.path, id, keySize)
+		}
+		keys[id] = key
+	}
+	if _, ok := keys[file.Current]; !ok {
+		return fmt.Errorf("keyring %s: current key %q not found", k.path, file.Current)
+	}
+
+	k.current = file.Current
+	k.keys = keys
+	return nil
+}
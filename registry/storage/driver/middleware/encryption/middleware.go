@@ -0,0 +1,518 @@
+// Package middleware - encryption at rest of the content of a storage driver
+//
+// The encryption middleware encrypts the content written to the storage
+// driver with keys independent of the storage provider, and decrypts it when
+// read. Each file is encrypted with its own data key, itself encrypted with
+// a master key of a KeyProvider and stored in the file along with the ID of
+// the master key, so that master keys can be rotated while the files they
+// encrypted remain readable.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+func init() {
+	storagemiddleware.Register("encryption", storagemiddleware.InitFunc(newEncryptionStorageMiddleware))
+}
+
+// encryptionStorageMiddleware encrypts the content of the files of the
+// storage driver it wraps.
+type encryptionStorageMiddleware struct {
+	storagedriver.StorageDriver
+	keys    KeyProvider
+	headers headerCache
+}
+
+var _ storagedriver.StorageDriver = &encryptionStorageMiddleware{}
+
+// newEncryptionStorageMiddleware constructs the middleware from its options.
+// Optional options: keyprovider, the name of the KeyProvider, file by default
+// The other options are passed to the KeyProvider.
+func newEncryptionStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	name := "file"
+	if p, ok := options["keyprovider"]; ok {
+		if name, ok = p.(string); !ok || name == "" {
+			return nil, fmt.Errorf("keyprovider must be a non-empty string")
+		}
+	}
+
+	keys, err := getKeyProvider(name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptionStorageMiddleware{
+		StorageDriver: storageDriver,
+		keys:          keys,
+	}, nil
+}
+
+// GetContent retrieves and decrypts the content stored at "path".
+func (em *encryptionStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	p, err := em.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, last, err := layout(int64(len(p)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	aead, err := parseHeader(em.keys, p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	r := &decryptingReader{
+		rc:     ioutil.NopCloser(bytes.NewReader(p[headerSize:])),
+		aead:   aead,
+		chunks: chunks,
+		last:   last,
+		tail: func() ([]byte, error) {
+			return em.tail(ctx, path, aead, chunks)
+		},
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return content, nil
+}
+
+// PutContent encrypts and stores the content at "path", deleting the tail
+// of the file it replaces if any.
+func (em *encryptionStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	p, err := encryptContent(em.keys, content)
+	if err != nil {
+		return err
+	}
+	em.headers.remove(path)
+	if err := em.StorageDriver.PutContent(ctx, path, p); err != nil {
+		return err
+	}
+	return em.deleteTail(ctx, path)
+}
+
+// Reader returns a reader decrypting the content stored at "path" from the
+// given offset. The header and the chunk at the offset are read in a single
+// request, either as the header was cached by an earlier read of the same
+// committed file, or by skipping the chunks before the offset when they are
+// few.
+func (em *encryptionStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return em.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	fi, err := em.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	chunks, last, err := layout(fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	index := offset / chunkSize
+	if index > chunks || (last >= 0 && offset > chunks*chunkSize+last) {
+		// past the end of the content
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	chunkOffset := int64(headerSize) + index*encryptedChunkSize
+
+	var rc io.ReadCloser
+	header := em.headers.get(path, fi)
+	if header == nil || index == 0 {
+		if rc, err = em.StorageDriver.Reader(ctx, path, 0); err != nil {
+			return nil, err
+		}
+		header = make([]byte, headerSize)
+		if _, err := io.ReadFull(rc, header); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("%s: reading the encryption header: %v", path, err)
+		}
+	}
+	aead, err := parseHeader(em.keys, header)
+	if err != nil {
+		if rc != nil {
+			rc.Close()
+		}
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if last >= 0 {
+		em.headers.put(path, fi, header)
+	}
+
+	// the chunks before the offset are discarded from the stream of the
+	// header when they are few, instead of opening another one
+	var discard int64
+	switch {
+	case rc != nil && index <= maxSkippedChunks:
+		discard = chunkOffset - int64(headerSize)
+	case rc != nil:
+		rc.Close()
+		fallthrough
+	default:
+		if rc, err = em.StorageDriver.Reader(ctx, path, chunkOffset); err != nil {
+			return nil, err
+		}
+	}
+
+	return &decryptingReader{
+		rc:     rc,
+		aead:   aead,
+		index:  index,
+		chunks: chunks,
+		last:   last,
+		tail: func() ([]byte, error) {
+			return em.tail(ctx, path, aead, chunks)
+		},
+		discard: discard,
+		skip:    offset % chunkSize,
+	}, nil
+}
+
+// Writer returns a FileWriter encrypting the content written to "path".
+// Files can only be appended to until committed.
+func (em *encryptionStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if append {
+		switch fi, err := em.StorageDriver.Stat(ctx, path); err.(type) {
+		case nil:
+			return em.appendWriter(ctx, path, fi)
+		case storagedriver.PathNotFoundError:
+		default:
+			return nil, err
+		}
+	}
+
+	aead, header, err := newHeader(em.keys)
+	if err != nil {
+		return nil, err
+	}
+	em.headers.remove(path)
+	fw, err := em.StorageDriver.Writer(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	// the tail of the file truncated, not committed yet, is not part of the
+	// new content
+	if err := em.deleteTail(ctx, path); err != nil {
+		fw.Cancel()
+		fw.Close()
+		return nil, err
+	}
+	if _, err := fw.Write(header); err != nil {
+		fw.Cancel()
+		fw.Close()
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		em:   em,
+		ctx:  ctx,
+		path: path,
+		fw:   fw,
+		aead: aead,
+	}, nil
+}
+
+// appendWriter returns a FileWriter appending to the file which is not
+// committed yet, continuing from its tail.
+func (em *encryptionStorageMiddleware) appendWriter(ctx context.Context, path string, fi storagedriver.FileInfo) (storagedriver.FileWriter, error) {
+	chunks, last, err := layout(fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if last >= 0 {
+		return nil, fmt.Errorf("%s: cannot append to a committed encrypted file", path)
+	}
+
+	rc, err := em.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(rc, header)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading the encryption header: %v", path, err)
+	}
+	aead, err := parseHeader(em.keys, header)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	tail, err := em.tail(ctx, path, aead, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	fw, err := em.StorageDriver.Writer(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	if fw.Size() != int64(headerSize)+chunks*encryptedChunkSize {
+		fw.Close()
+		return nil, fmt.Errorf("%s: encrypted file modified while opening it", path)
+	}
+
+	return &encryptingWriter{
+		em:        em,
+		ctx:       ctx,
+		path:      path,
+		fw:        fw,
+		aead:      aead,
+		index:     chunks,
+		buf:       tail,
+		tailFound: true,
+	}, nil
+}
+
+// Stat returns the info of the file at "path", with the size of its content.
+func (em *encryptionStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := em.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return em.decryptedInfo(ctx, fi)
+}
+
+// List returns the files and directories under "path", except the tail files.
+func (em *encryptionStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	children, err := em.StorageDriver.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := children[:0]
+	for _, child := range children {
+		if !strings.HasSuffix(child, tailSuffix) {
+			listed = append(listed, child)
+		}
+	}
+	return listed, nil
+}
+
+// Move moves the file at sourcePath, along with its tail file if any.
+func (em *encryptionStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	em.headers.remove(sourcePath, destPath)
+	if err := em.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+
+	err := em.StorageDriver.Move(ctx, sourcePath+tailSuffix, destPath+tailSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// Delete deletes "path", along with its tail file if any.
+func (em *encryptionStorageMiddleware) Delete(ctx context.Context, path string) error {
+	em.headers.remove(path)
+	if err := em.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	return em.deleteTail(ctx, path)
+}
+
+// URLFor is not supported, as the content would be served encrypted.
+func (em *encryptionStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{DriverName: em.Name()}
+}
+
+// Walk traverses the files and directories under "path", except the tail
+// files, with the sizes of their content.
+func (em *encryptionStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return em.StorageDriver.Walk(ctx, path, func(fileInfo storagedriver.FileInfo) error {
+		if !fileInfo.IsDir() && strings.HasSuffix(fileInfo.Path(), tailSuffix) {
+			return nil
+		}
+		fi, err := em.decryptedInfo(ctx, fileInfo)
+		if err != nil {
+			return err
+		}
+		return f(fi)
+	})
+}
+
+// decryptedInfo returns the info of an encrypted file with the size of its
+// content.
+func (em *encryptionStorageMiddleware) decryptedInfo(ctx context.Context, fi storagedriver.FileInfo) (storagedriver.FileInfo, error) {
+	if fi.IsDir() {
+		return fi, nil
+	}
+
+	chunks, last, err := layout(fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fi.Path(), err)
+	}
+
+	size := chunks * chunkSize
+	if last >= 0 {
+		size += last
+	} else {
+		switch tfi, err := em.StorageDriver.Stat(ctx, fi.Path()+tailSuffix); err.(type) {
+		case nil:
+			size += tfi.Size() - tailOverhead
+		case storagedriver.PathNotFoundError:
+			// being appended to, the tail is already part of the chunks
+		default:
+			return nil, err
+		}
+	}
+
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+		IsDir:   false,
+	}}, nil
+}
+
+// tail returns the decrypted tail of the file at path, which is not
+// committed yet.
+func (em *encryptionStorageMiddleware) tail(ctx context.Context, path string, aead cipher.AEAD, chunks int64) ([]byte, error) {
+	p, err := em.StorageDriver.GetContent(ctx, path+tailSuffix)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, fmt.Errorf("%s: encrypted file truncated, its tail is missing", path)
+		}
+		return nil, err
+	}
+
+	tail, err := openTail(aead, chunks, p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return tail, nil
+}
+
+func (em *encryptionStorageMiddleware) deleteTail(ctx context.Context, path string) error {
+	err := em.StorageDriver.Delete(ctx, path+tailSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// encryptingWriter encrypts the content written in chunks. The content
+// following the last full chunk is written to the tail file on Close, or
+// as the last chunk on Commit.
+type encryptingWriter struct {
+	em   *encryptionStorageMiddleware
+	ctx  context.Context
+	path string
+	fw   storagedriver.FileWriter
+	aead cipher.AEAD
+
+	index int64  // of the next chunk
+	buf   []byte // content of the next chunk
+	// tailFound is set while the tail file holds the start of buf
+	tailFound bool
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	n := len(p)
+	for len(w.buf)+len(p) >= chunkSize {
+		chunk := append(w.buf, p[:chunkSize-len(w.buf)]...)
+		p = p[chunkSize-len(w.buf):]
+		if _, err := w.fw.Write(w.aead.Seal(nil, chunkNonce(w.index, false), chunk, nil)); err != nil {
+			return 0, err
+		}
+		w.index++
+		w.buf = w.buf[:0]
+
+		// the tail is now part of the chunks
+		if w.tailFound {
+			if err := w.em.deleteTail(w.ctx, w.path); err != nil {
+				return 0, err
+			}
+			w.tailFound = false
+		}
+	}
+	w.buf = append(w.buf, p...)
+
+	return n, nil
+}
+
+func (w *encryptingWriter) Size() int64 {
+	return w.index*chunkSize + int64(len(w.buf))
+}
+
+func (w *encryptingWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	if err := w.fw.Close(); err != nil {
+		return err
+	}
+	if w.committed || w.cancelled {
+		return nil
+	}
+
+	tail, err := sealTail(w.aead, w.index, w.buf)
+	if err != nil {
+		return err
+	}
+	return w.em.StorageDriver.PutContent(w.ctx, w.path+tailSuffix, tail)
+}
+
+func (w *encryptingWriter) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+
+	if err := w.fw.Cancel(); err != nil {
+		return err
+	}
+	return w.em.deleteTail(w.ctx, w.path)
+}
+
+func (w *encryptingWriter) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.committed = true
+
+	if _, err := w.fw.Write(w.aead.Seal(nil, chunkNonce(w.index, true), w.buf, nil)); err != nil {
+		return err
+	}
+	if err := w.fw.Commit(); err != nil {
+		return err
+	}
+	if w.tailFound {
+		return w.em.deleteTail(w.ctx, w.path)
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	root, err := ioutil.TempDir("", "encryption-")
+	if err != nil {
+		panic(err)
+	}
+	keyring := filepath.Join(root, "keyring.yaml")
+	if err := writeKeyring(keyring, "a", "a", "b"); err != nil {
+		panic(err)
+	}
+
+	storageDriver := filesystem.New(filesystem.DriverParameters{RootDirectory: filepath.Join(root, "data"), MaxThreads: 100})
+	driver, err := newEncryptionStorageMiddleware(storageDriver, map[string]interface{}{
+		"keyring": keyring,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+// writeKeyring writes a keyring file with a key by ID, made of the ID.
+func writeKeyring(path, current string, ids ...string) error {
+	content := fmt.Sprintf("current: %s\nkeys:\n", current)
+	for _, id := range ids {
+		key := bytes.Repeat([]byte(id), keySize)[:keySize]
+		content += fmt.Sprintf("  %s: %s\n", id, base64.StdEncoding.EncodeToString(key))
+	}
+	return ioutil.WriteFile(path, []byte(content), 0600)
+}
+
+type MiddlewareSuite struct {
+	keyring string
+	root    string
+	backend storagedriver.StorageDriver
+	driver  storagedriver.StorageDriver
+}
+
+var _ = check.Suite(&MiddlewareSuite{})
+
+func (s *MiddlewareSuite) SetUpTest(c *check.C) {
+	dir := c.MkDir()
+	s.keyring = filepath.Join(dir, "keyring.yaml")
+	c.Assert(writeKeyring(s.keyring, "a", "a"), check.IsNil)
+
+	s.root = filepath.Join(dir, "data")
+	s.backend = filesystem.New(filesystem.DriverParameters{RootDirectory: s.root, MaxThreads: 100})
+
+	var err error
+	s.driver, err = newEncryptionStorageMiddleware(s.backend, map[string]interface{}{
+		"keyring": s.keyring,
+	})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *MiddlewareSuite) TestNoConfig(c *check.C) {
+	_, err := newEncryptionStorageMiddleware(nil, map[string]interface{}{})
+	c.Assert(err, check.ErrorMatches, "no keyring provided")
+
+	_, err = newEncryptionStorageMiddleware(nil, map[string]interface{}{"keyprovider": "vault"})
+	c.Assert(err, check.ErrorMatches, "no key provider registered with name: vault")
+}
+
+func (s *MiddlewareSuite) TestInvalidKeyring(c *check.C) {
+	c.Assert(ioutil.WriteFile(s.keyring, []byte("current: b\nkeys:\n  a: c2hvcnQ=\n"), 0600), check.IsNil)
+	_, err := newEncryptionStorageMiddleware(nil, map[string]interface{}{"keyring": s.keyring})
+	c.Assert(err, check.ErrorMatches, ".*key a must be 32 base64 encoded bytes")
+
+	c.Assert(writeKeyring(s.keyring, "b", "a"), check.IsNil)
+	_, err = newEncryptionStorageMiddleware(nil, map[string]interface{}{"keyring": s.keyring})
+	c.Assert(err, check.ErrorMatches, `.*current key "b" not found`)
+}
+
+func (s *MiddlewareSuite) TestEncryptedAtRest(c *check.C) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("secret"), chunkSize)
+
+	c.Assert(s.driver.PutContent(ctx, "/file", content), check.IsNil)
+
+	stored, err := ioutil.ReadFile(filepath.Join(s.root, "file"))
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Contains(stored, []byte("secret")), check.Equals, false)
+
+	fi, err := s.driver.Stat(ctx, "/file")
+	c.Assert(err, check.IsNil)
+	c.Assert(fi.Size(), check.Equals, int64(len(content)))
+
+	// reads at an offset only decrypt the chunks from the offset
+	for _, offset := range []int64{0, 1, chunkSize - 1, chunkSize, 3*chunkSize + 7, int64(len(content))} {
+		rc, err := s.driver.Reader(ctx, "/file", offset)
+		c.Assert(err, check.IsNil)
+		p, err := ioutil.ReadAll(rc)
+		c.Assert(err, check.IsNil)
+		c.Assert(rc.Close(), check.IsNil)
+		c.Assert(bytes.Equal(p, content[offset:]), check.Equals, true, check.Commentf("offset %d", offset))
+	}
+
+	_, err = s.driver.URLFor(ctx, "/file", nil)
+	c.Assert(err, check.FitsTypeOf, storagedriver.ErrUnsupportedMethod{})
+}
+
+func (s *MiddlewareSuite) TestTampering(c *check.C) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("secret"), chunkSize)
+	c.Assert(s.driver.PutContent(ctx, "/file", content), check.IsNil)
+
+	path := filepath.Join(s.root, "file")
+	stored, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+
+	// a flipped bit
+	tampered := append([]byte(nil), stored...)
+	tampered[headerSize+encryptedChunkSize+1] ^= 1
+	c.Assert(ioutil.WriteFile(path, tampered, 0600), check.IsNil)
+	_, err = s.driver.GetContent(ctx, "/file")
+	c.Assert(err, check.ErrorMatches, ".*decrypting chunk 1.*")
+
+	// the last chunk dropped
+	c.Assert(ioutil.WriteFile(path, stored[:headerSize+2*encryptedChunkSize], 0600), check.IsNil)
+	_, err = s.driver.GetContent(ctx, "/file")
+	c.Assert(err, check.ErrorMatches, ".*tail is missing")
+
+	// chunks swapped
+	swapped := append([]byte(nil), stored[:headerSize]...)
+	swapped = append(swapped, stored[headerSize+encryptedChunkSize:headerSize+2*encryptedChunkSize]...)
+	swapped = append(swapped, stored[headerSize:headerSize+encryptedChunkSize]...)
+	swapped = append(swapped, stored[headerSize+2*encryptedChunkSize:]...)
+	c.Assert(ioutil.WriteFile(path, swapped, 0600), check.IsNil)
+	_, err = s.driver.GetContent(ctx, "/file")
+	c.Assert(err, check.ErrorMatches, ".*decrypting chunk 0.*")
+}
+
+func (s *MiddlewareSuite) TestAppend(c *check.C) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("0123456789"), chunkSize/4)
+
+	var written int
+	for _, n := range []int{7, chunkSize, chunkSize / 2} {
+		fw, err := s.driver.Writer(ctx, "/upload/data", written > 0)
+		c.Assert(err, check.IsNil)
+		c.Assert(fw.Size(), check.Equals, int64(written))
+		_, err = fw.Write(content[written : written+n])
+		c.Assert(err, check.IsNil)
+		c.Assert(fw.Close(), check.IsNil)
+		written += n
+
+		// the content is readable before being committed
+		fi, err := s.driver.Stat(ctx, "/upload/data")
+		c.Assert(err, check.IsNil)
+		c.Assert(fi.Size(), check.Equals, int64(written))
+		p, err := s.driver.GetContent(ctx, "/upload/data")
+		c.Assert(err, check.IsNil)
+		c.Assert(bytes.Equal(p, content[:written]), check.Equals, true)
+	}
+
+	children, err := s.driver.List(ctx, "/upload")
+	c.Assert(err, check.IsNil)
+	c.Assert(children, check.DeepEquals, []string{"/upload/data"})
+
+	fw, err := s.driver.Writer(ctx, "/upload/data", true)
+	c.Assert(err, check.IsNil)
+	_, err = fw.Write(content[written:])
+	c.Assert(err, check.IsNil)
+	c.Assert(fw.Commit(), check.IsNil)
+	c.Assert(fw.Close(), check.IsNil)
+
+	c.Assert(s.driver.Move(ctx, "/upload/data", "/blob/data"), check.IsNil)
+	p, err := s.driver.GetContent(ctx, "/blob/data")
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(p, content), check.Equals, true)
+	_, err = os.Stat(filepath.Join(s.root, "upload", "data"+tailSuffix))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	_, err = s.driver.Writer(ctx, "/blob/data", true)
+	c.Assert(err, check.ErrorMatches, ".*cannot append to a committed encrypted file")
+}
+
+func (s *MiddlewareSuite) TestTruncateUpload(c *check.C) {
+	ctx := context.Background()
+	tail := filepath.Join(s.root, "upload", "data"+tailSuffix)
+
+	for _, truncate := range []func() error{
+		func() error {
+			fw, err := s.driver.Writer(ctx, "/upload/data", false)
+			if err != nil {
+				return err
+			}
+			return fw.Close()
+		},
+		func() error {
+			return s.driver.PutContent(ctx, "/upload/data", nil)
+		},
+	} {
+		fw, err := s.driver.Writer(ctx, "/upload/data", false)
+		c.Assert(err, check.IsNil)
+		_, err = fw.Write([]byte("uncommitted"))
+		c.Assert(err, check.IsNil)
+		c.Assert(fw.Close(), check.IsNil)
+		_, err = os.Stat(tail)
+		c.Assert(err, check.IsNil)
+
+		c.Assert(truncate(), check.IsNil)
+		fi, err := s.driver.Stat(ctx, "/upload/data")
+		c.Assert(err, check.IsNil)
+		c.Assert(fi.Size(), check.Equals, int64(0))
+		p, err := s.driver.GetContent(ctx, "/upload/data")
+		c.Assert(err, check.IsNil)
+		c.Assert(p, check.HasLen, 0)
+	}
+}
+
+func (s *MiddlewareSuite) TestKeyRotation(c *check.C) {
+	defer func(interval time.Duration) { keyringCheckInterval = interval }(keyringCheckInterval)
+	keyringCheckInterval = 0
+
+	ctx := context.Background()
+	c.Assert(s.driver.PutContent(ctx, "/old", []byte("old")), check.IsNil)
+
+	// the keyring is read again once modified
+	c.Assert(writeKeyring(s.keyring, "b", "a", "b"), check.IsNil)
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(s.keyring, later, later), check.IsNil)
+	c.Assert(s.driver.PutContent(ctx, "/new", []byte("new")), check.IsNil)
+
+	for path, id := range map[string]string{"/old": "a", "/new": "b"} {
+		stored, err := ioutil.ReadFile(filepath.Join(s.root, path))
+		c.Assert(err, check.IsNil)
+		c.Assert(string(stored[len(headerMagic)+2:len(headerMagic)+3]), check.Equals, id)
+	}
+	p, err := s.driver.GetContent(ctx, "/old")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(p), check.Equals, "old")
+
+	// files remain readable until their key is removed
+	c.Assert(writeKeyring(s.keyring, "b", "b"), check.IsNil)
+	later = later.Add(time.Minute)
+	c.Assert(os.Chtimes(s.keyring, later, later), check.IsNil)
+	_, err = s.driver.GetContent(ctx, "/old")
+	c.Assert(err, check.ErrorMatches, `.*unknown encryption key "a"`)
+	p, err = s.driver.GetContent(ctx, "/new")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(p), check.Equals, "new")
+
+	// an invalid keyring is read again once fixed, even if its modification
+	// time did not change
+	c.Assert(ioutil.WriteFile(s.keyring, []byte("current: c\n"), 0600), check.IsNil)
+	later = later.Add(time.Minute)
+	c.Assert(os.Chtimes(s.keyring, later, later), check.IsNil)
+	c.Assert(s.driver.PutContent(ctx, "/newer", []byte("newer")), check.IsNil)
+	c.Assert(writeKeyring(s.keyring, "c", "b", "c"), check.IsNil)
+	c.Assert(os.Chtimes(s.keyring, later, later), check.IsNil)
+	c.Assert(s.driver.PutContent(ctx, "/newer", []byte("newer")), check.IsNil)
+	stored, err := ioutil.ReadFile(filepath.Join(s.root, "newer"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(stored[len(headerMagic)+2:len(headerMagic)+3]), check.Equals, "c")
+}
+
+func (s *MiddlewareSuite) TestKeyringCheckInterval(c *check.C) {
+	keys, err := newFileKeyring(map[string]interface{}{"keyring": s.keyring})
+	c.Assert(err, check.IsNil)
+	k := keys.(*fileKeyring)
+
+	// the keyring file is not checked again within the interval
+	c.Assert(writeKeyring(s.keyring, "b", "a", "b"), check.IsNil)
+	later := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(s.keyring, later, later), check.IsNil)
+	id, _, err := k.CurrentKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.Equals, "a")
+
+	k.checked = time.Time{}
+	id, _, err = k.CurrentKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.Equals, "b")
+
+	// an invalid keyring is identified by its content, to be reported once
+	c.Assert(ioutil.WriteFile(s.keyring, []byte("current: c\n"), 0600), check.IsNil)
+	later = later.Add(time.Minute)
+	c.Assert(os.Chtimes(s.keyring, later, later), check.IsNil)
+	k.checked = time.Time{}
+	id, _, err = k.CurrentKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.Equals, "b")
+	invalid := k.invalid
+	c.Assert(invalid, check.Not(check.Equals), "")
+
+	later = later.Add(time.Minute)
+	c.Assert(os.Chtimes(s.keyring, later, later), check.IsNil)
+	k.checked = time.Time{}
+	_, _, err = k.CurrentKey()
+	c.Assert(err, check.IsNil)
+	c.Assert(k.invalid, check.Equals, invalid)
+}
+
+// readerCountingDriver counts the readers opened on the driver it wraps.
+type readerCountingDriver struct {
+	storagedriver.StorageDriver
+	readers int
+}
+
+func (d *readerCountingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.readers++
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (s *MiddlewareSuite) TestRangedReads(c *check.C) {
+	backend := &readerCountingDriver{StorageDriver: s.backend}
+	driver, err := newEncryptionStorageMiddleware(backend, map[string]interface{}{
+		"keyring": s.keyring,
+	})
+	c.Assert(err, check.IsNil)
+
+	ctx := context.Background()
+	content := make([]byte, 10*chunkSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	c.Assert(driver.PutContent(ctx, "/file", content), check.IsNil)
+
+	// the first chunks are read in the stream of the header, which is
+	// cached to read the other ones
+	for _, offset := range []int64{2*chunkSize + 10, 9*chunkSize + 10, 10 * chunkSize, 5} {
+		backend.readers = 0
+		rc, err := driver.Reader(ctx, "/file", offset)
+		c.Assert(err, check.IsNil)
+		p, err := ioutil.ReadAll(rc)
+		rc.Close()
+		c.Assert(err, check.IsNil)
+		c.Assert(bytes.Equal(p, content[offset:]), check.Equals, true, check.Commentf("offset %d", offset))
+		c.Assert(backend.readers, check.Equals, 1, check.Commentf("offset %d", offset))
+	}
+
+	// the header of a file written again is read again
+	c.Assert(driver.PutContent(ctx, "/file", content[:len(content)-1]), check.IsNil)
+	backend.readers = 0
+	rc, err := driver.Reader(ctx, "/file", 9*chunkSize)
+	c.Assert(err, check.IsNil)
+	p, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(p, content[9*chunkSize:len(content)-1]), check.Equals, true)
+	c.Assert(backend.readers, check.Equals, 2)
+}
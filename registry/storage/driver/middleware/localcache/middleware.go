@@ -0,0 +1,687 @@
+// Package middleware - local disk cache in front of a remote storage driver
+//
+// The localcache middleware serves the content of a remote driver, such as
+// s3-aws, gcs or cos, from a size bounded cache kept on the local filesystem.
+// Only paths under the configured prefixes are cached. By default these are
+// the blob data files, which are content addressed and never modified once
+// written. Stat always returns the metadata of the remote file.
+//
+// Cached blob data is served without checking the remote file, as the blob
+// store stats it before every read, so that content deleted by another
+// registry instance sharing the remote storage, for instance by its garbage
+// collection, is not served from the cache. A read of any other cached file
+// checks that the remote file still has the size and modification time it
+// had when cached before serving the local bytes.
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	pathpkg "path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	prometheus "github.com/docker/distribution/metrics"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+	"github.com/docker/distribution/uuid"
+	"github.com/docker/go-metrics"
+)
+
+const (
+	// cacheDataRoot is the directory of the local driver holding the cached
+	// content, under the remote path of each file.
+	cacheDataRoot = "/data"
+	// cacheFillRoot is the directory of the local driver holding the
+	// content being cached, moved to cacheDataRoot once complete.
+	cacheFillRoot = "/fill"
+)
+
+// blobsPrefix holds the blob data, which never changes once written.
+const blobsPrefix = "/docker/registry/v2/blobs/"
+
+// defaultCachedPaths caches the blob data.
+var defaultCachedPaths = []string{blobsPrefix}
+
+var (
+	// cacheRequests counts the reads served by the local cache, labeled
+	// Hit, or by the remote driver, labeled Miss
+	cacheRequests = prometheus.StorageNamespace.NewLabeledCounter("localcache_requests", "The number of reads of cached paths", "type")
+	// cacheEvictions counts the files evicted to stay under the size limit
+	cacheEvictions = prometheus.StorageNamespace.NewCounter("localcache_evictions", "The number of files evicted from the local cache")
+	// cacheSize is the total size of the files in the local cache
+	cacheSize = prometheus.StorageNamespace.NewGauge("localcache_size", "The size of the files in the local cache", metrics.Bytes)
+)
+
+func init() {
+	storagemiddleware.Register("localcache", storagemiddleware.InitFunc(newLocalCacheStorageMiddleware))
+}
+
+// cacheEntry is a file of the local cache. modTime is the modification time
+// of the remote file when it was cached, unknown for the files indexed on
+// startup and unused for blob data.
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// localCacheStorageMiddleware reads through a local filesystem driver,
+// evicting the least recently used files when the cache exceeds maxSize.
+// Writes go to the remote driver and invalidate the cached copies.
+type localCacheStorageMiddleware struct {
+	storagedriver.StorageDriver
+	local   storagedriver.StorageDriver
+	maxSize int64
+	paths   []string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element       // of *cacheEntry, by remote path
+	dirs    map[string]map[string]struct{} // paths holding entries, by parent
+	lru     *list.List                     // most recently used first
+	size    int64
+	// epoch changes on every invalidation, so that content read before
+	// a write completes is not cached after it
+	epoch uint64
+	// filling holds the paths whose fill is being moved into the cache
+	filling map[string]struct{}
+}
+
+var _ storagedriver.StorageDriver = &localCacheStorageMiddleware{}
+
+// newLocalCacheStorageMiddleware constructs the middleware from its options.
+// Required options: rootdirectory, maxsize
+// Optional options: paths, the prefixes of the cached paths
+func newLocalCacheStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	root, ok := options["rootdirectory"]
+	if !ok {
+		return nil, fmt.Errorf("no rootdirectory provided")
+	}
+	rootDirectory, ok := root.(string)
+	if !ok || rootDirectory == "" {
+		return nil, fmt.Errorf("rootdirectory must be a non-empty string")
+	}
+
+	maxSize, err := getSizeOption(options, "maxsize")
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maxsize must be positive")
+	}
+
+	paths := defaultCachedPaths
+	if p, ok := options["paths"]; ok {
+		list, ok := p.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("paths must be a non-empty list of strings")
+		}
+		paths = nil
+		for _, v := range list {
+			prefix, ok := v.(string)
+			if !ok || !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("paths must be a list of absolute paths, %#v invalid", v)
+			}
+			paths = append(paths, prefix)
+		}
+	}
+
+	local := filesystem.New(filesystem.DriverParameters{
+		RootDirectory: rootDirectory,
+		MaxThreads:    100,
+	})
+
+	return newLocalCache(context.Background(), storageDriver, local, maxSize, paths)
+}
+
+// newLocalCache returns the middleware caching the paths of remote into
+// local, indexing the files already present in local.
+func newLocalCache(ctx context.Context, remote, local storagedriver.StorageDriver, maxSize int64, paths []string) (*localCacheStorageMiddleware, error) {
+	lc := &localCacheStorageMiddleware{
+		StorageDriver: remote,
+		local:         local,
+		maxSize:       maxSize,
+		paths:         paths,
+		entries:       make(map[string]*list.Element),
+		dirs:          make(map[string]map[string]struct{}),
+		lru:           list.New(),
+		filling:       make(map[string]struct{}),
+	}
+
+	// fills interrupted by a restart are incomplete
+	if err := local.Delete(ctx, cacheFillRoot); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return nil, err
+		}
+	}
+
+	var found []storagedriver.FileInfo
+	err := local.Walk(ctx, cacheDataRoot, func(fileInfo storagedriver.FileInfo) error {
+		if !fileInfo.IsDir() {
+			found = append(found, fileInfo)
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return nil, err
+		}
+	}
+
+	// the most recently written files are the most recently used ones we
+	// know of
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ModTime().After(found[j].ModTime())
+	})
+	for _, fileInfo := range found {
+		lc.add(strings.TrimPrefix(fileInfo.Path(), cacheDataRoot), fileInfo.Size(), time.Time{})
+	}
+	lc.deleteLocal(ctx, lc.evict())
+
+	dcontext.GetLogger(ctx).Infof("localcache: indexed %d files, %d bytes", lc.lru.Len(), lc.size)
+	return lc, nil
+}
+
+// GetContent returns the cached content of path, caching it on a miss.
+func (lc *localCacheStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !lc.cached(path) {
+		return lc.StorageDriver.GetContent(ctx, path)
+	}
+
+	ok, err := lc.lookup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		content, err := lc.local.GetContent(ctx, cacheDataRoot+path)
+		if err == nil {
+			cacheRequests.WithValues("Hit").Inc(1)
+			return content, nil
+		}
+		lc.missing(ctx, path, err)
+	}
+	cacheRequests.WithValues("Miss").Inc(1)
+
+	epoch := lc.currentEpoch()
+	modTime, err := lc.remoteModTime(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := lc.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(content)) <= lc.maxSize {
+		fill, err := lc.newFill(ctx, path, epoch, modTime)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("localcache: error caching %s: %v", path, err)
+			return content, nil
+		}
+		if _, err := fill.Write(content); err != nil {
+			fill.cancel(err)
+			return content, nil
+		}
+		fill.commit()
+	}
+
+	return content, nil
+}
+
+// Reader returns a reader of the cached content of path. On a miss, a reader
+// starting at offset zero caches the content as it is read.
+func (lc *localCacheStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if !lc.cached(path) {
+		return lc.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	ok, err := lc.lookup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		rc, err := lc.local.Reader(ctx, cacheDataRoot+path, offset)
+		if err == nil {
+			cacheRequests.WithValues("Hit").Inc(1)
+			return rc, nil
+		}
+		lc.missing(ctx, path, err)
+	}
+	cacheRequests.WithValues("Miss").Inc(1)
+
+	if offset != 0 {
+		return lc.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	epoch := lc.currentEpoch()
+	modTime, err := lc.remoteModTime(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := lc.StorageDriver.Reader(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	fill, err := lc.newFill(ctx, path, epoch, modTime)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("localcache: error caching %s: %v", path, err)
+		return rc, nil
+	}
+	return &fillReader{ReadCloser: rc, fill: fill}, nil
+}
+
+// Stat returns the file info of the remote file, dropping the cached copy of
+// path if the remote file no longer exists.
+func (lc *localCacheStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := lc.StorageDriver.Stat(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		lc.invalidate(ctx, path)
+	}
+	return fi, err
+}
+
+// PutContent stores the content in the remote driver.
+func (lc *localCacheStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	lc.invalidate(ctx, path)
+	err := lc.StorageDriver.PutContent(ctx, path, content)
+	lc.invalidate(ctx, path)
+	return err
+}
+
+// Writer returns a writer to the remote driver.
+func (lc *localCacheStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	lc.invalidate(ctx, path)
+	fw, err := lc.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingWriter{FileWriter: fw, ctx: ctx, lc: lc, path: path}, nil
+}
+
+// Move moves the remote content.
+func (lc *localCacheStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	lc.invalidate(ctx, destPath)
+	err := lc.StorageDriver.Move(ctx, sourcePath, destPath)
+	lc.invalidate(ctx, sourcePath)
+	lc.invalidate(ctx, destPath)
+	return err
+}
+
+// Delete deletes the remote content and its cached copies.
+func (lc *localCacheStorageMiddleware) Delete(ctx context.Context, path string) error {
+	err := lc.StorageDriver.Delete(ctx, path)
+	lc.invalidate(ctx, path)
+	return err
+}
+
+// cached reports whether path is under one of the cached prefixes.
+func (lc *localCacheStorageMiddleware) cached(path string) bool {
+	for _, prefix := range lc.paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentAddressed reports whether path holds blob data, which is never
+// modified once written.
+func contentAddressed(path string) bool {
+	return strings.HasPrefix(path, blobsPrefix)
+}
+
+// remoteModTime returns the modification time of the remote file about to be
+// cached, which is only needed for files which are not content addressed.
+func (lc *localCacheStorageMiddleware) remoteModTime(ctx context.Context, path string) (time.Time, error) {
+	if contentAddressed(path) {
+		return time.Time{}, nil
+	}
+	fi, err := lc.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// hit returns the cache entry of path, marking it as recently used.
+func (lc *localCacheStorageMiddleware) hit(path string) (cacheEntry, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	e, ok := lc.entries[path]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	lc.lru.MoveToFront(e)
+	return *e.Value.(*cacheEntry), true
+}
+
+// lookup reports whether path is in the cache, marking it as recently used.
+// Unless path holds blob data, the remote file must still have the size and
+// modification time of the cached copy, which is dropped otherwise.
+func (lc *localCacheStorageMiddleware) lookup(ctx context.Context, path string) (bool, error) {
+	entry, ok := lc.hit(path)
+	if !ok {
+		return false, nil
+	}
+	if contentAddressed(path) {
+		return true, nil
+	}
+
+	fi, err := lc.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			lc.invalidate(ctx, path)
+		}
+		return false, err
+	}
+
+	if fi.Size() != entry.size || !fi.ModTime().Equal(entry.modTime) {
+		lc.invalidate(ctx, path)
+		return false, nil
+	}
+	return true, nil
+}
+
+// missing drops path from the index after its local copy could not be read.
+func (lc *localCacheStorageMiddleware) missing(ctx context.Context, path string, err error) {
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		dcontext.GetLogger(ctx).Errorf("localcache: error reading cached %s: %v", path, err)
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if e, ok := lc.entries[path]; ok {
+		lc.remove(e)
+	}
+}
+
+func (lc *localCacheStorageMiddleware) currentEpoch() uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.epoch
+}
+
+// invalidate removes the cached copies of path and of the paths under it.
+func (lc *localCacheStorageMiddleware) invalidate(ctx context.Context, p string) {
+	if !lc.cached(p) && !lc.cached(p+"/") {
+		return
+	}
+	if p != "/" {
+		p = strings.TrimSuffix(p, "/")
+	}
+
+	lc.mu.Lock()
+	lc.epoch++
+	var removed []string
+	lc.removeTree(p, &removed)
+	lc.mu.Unlock()
+
+	lc.deleteLocal(ctx, removed)
+}
+
+// removeTree drops p and the paths under it from the index, appending them
+// to removed. The caller must hold the lock.
+func (lc *localCacheStorageMiddleware) removeTree(p string, removed *[]string) {
+	if e, ok := lc.entries[p]; ok {
+		lc.remove(e)
+		*removed = append(*removed, p)
+	}
+	for child := range lc.dirs[p] {
+		lc.removeTree(child, removed)
+	}
+}
+
+// deleteLocal deletes the cached copies of the paths.
+func (lc *localCacheStorageMiddleware) deleteLocal(ctx context.Context, paths []string) {
+	for _, p := range paths {
+		if err := lc.local.Delete(ctx, cacheDataRoot+p); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				dcontext.GetLogger(ctx).Errorf("localcache: error removing %s: %v", p, err)
+			}
+		}
+	}
+}
+
+// add indexes a cached file as the most recently used. The caller must hold
+// the lock.
+func (lc *localCacheStorageMiddleware) add(path string, size int64, modTime time.Time) {
+	if e, ok := lc.entries[path]; ok {
+		lc.remove(e)
+	}
+	lc.entries[path] = lc.lru.PushFront(&cacheEntry{path: path, size: size, modTime: modTime})
+	lc.size += size
+	cacheSize.Set(float64(lc.size))
+
+	for p := path; p != "/"; p = pathpkg.Dir(p) {
+		parent := pathpkg.Dir(p)
+		children, ok := lc.dirs[parent]
+		if !ok {
+			children = make(map[string]struct{})
+			lc.dirs[parent] = children
+		}
+		if _, ok := children[p]; ok {
+			break
+		}
+		children[p] = struct{}{}
+	}
+}
+
+// remove drops an entry from the index. The caller must hold the lock.
+func (lc *localCacheStorageMiddleware) remove(e *list.Element) {
+	entry := lc.lru.Remove(e).(*cacheEntry)
+	delete(lc.entries, entry.path)
+	lc.size -= entry.size
+	cacheSize.Set(float64(lc.size))
+
+	for p := entry.path; p != "/"; p = pathpkg.Dir(p) {
+		if len(lc.dirs[p]) > 0 {
+			break
+		}
+		parent := pathpkg.Dir(p)
+		delete(lc.dirs[parent], p)
+		if len(lc.dirs[parent]) == 0 {
+			delete(lc.dirs, parent)
+		}
+	}
+}
+
+// evict drops the least recently used files from the index until the cache
+// fits in maxSize, returning their paths to be deleted once the lock is
+// released. Readers of the evicted files keep their open file. The caller
+// must hold the lock.
+func (lc *localCacheStorageMiddleware) evict() []string {
+	var evicted []string
+	for lc.size > lc.maxSize {
+		e := lc.lru.Back()
+		evicted = append(evicted, e.Value.(*cacheEntry).path)
+		lc.remove(e)
+		cacheEvictions.Inc(1)
+	}
+	return evicted
+}
+
+// cacheFill writes the content of a remote file to a temporary local file,
+// moved into the cache once complete.
+type cacheFill struct {
+	ctx      context.Context
+	lc       *localCacheStorageMiddleware
+	path     string
+	tempPath string
+	epoch    uint64
+	modTime  time.Time
+	fw       storagedriver.FileWriter
+	done     bool
+}
+
+func (lc *localCacheStorageMiddleware) newFill(ctx context.Context, path string, epoch uint64, modTime time.Time) (*cacheFill, error) {
+	tempPath := cacheFillRoot + "/" + uuid.Generate().String()
+	fw, err := lc.local.Writer(ctx, tempPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheFill{
+		ctx:      ctx,
+		lc:       lc,
+		path:     path,
+		tempPath: tempPath,
+		epoch:    epoch,
+		modTime:  modTime,
+		fw:       fw,
+	}, nil
+}
+
+// Write copies p to the temporary file, giving up on files larger than the
+// whole cache.
+func (f *cacheFill) Write(p []byte) (int, error) {
+	if f.fw.Size()+int64(len(p)) > f.lc.maxSize {
+		return 0, fmt.Errorf("larger than the cache")
+	}
+	return f.fw.Write(p)
+}
+
+// commit moves the temporary file into the cache unless the remote file was
+// written to since the fill started. The file is moved without holding the
+// lock, and dropped again if the cache was invalidated meanwhile.
+func (f *cacheFill) commit() {
+	if f.done {
+		return
+	}
+	f.done = true
+
+	if err := f.fw.Commit(); err != nil {
+		f.fw.Close()
+		f.abort(err)
+		return
+	}
+	if err := f.fw.Close(); err != nil {
+		f.abort(err)
+		return
+	}
+	size := f.fw.Size()
+
+	lc := f.lc
+	lc.mu.Lock()
+	_, filling := lc.filling[f.path]
+	if lc.epoch != f.epoch || filling {
+		lc.mu.Unlock()
+		f.abort(nil)
+		return
+	}
+	lc.filling[f.path] = struct{}{}
+	lc.mu.Unlock()
+
+	err := lc.local.Move(f.ctx, f.tempPath, cacheDataRoot+f.path)
+
+	lc.mu.Lock()
+	delete(lc.filling, f.path)
+	if err != nil {
+		lc.mu.Unlock()
+		f.abort(err)
+		return
+	}
+	if lc.epoch != f.epoch {
+		lc.mu.Unlock()
+		lc.deleteLocal(f.ctx, []string{f.path})
+		return
+	}
+	lc.add(f.path, size, f.modTime)
+	evicted := lc.evict()
+	lc.mu.Unlock()
+
+	lc.deleteLocal(f.ctx, evicted)
+}
+
+// cancel discards the temporary file.
+func (f *cacheFill) cancel(err error) {
+	if f.done {
+		return
+	}
+	f.done = true
+
+	f.fw.Cancel()
+	f.fw.Close()
+	f.abort(err)
+}
+
+func (f *cacheFill) abort(err error) {
+	if err != nil {
+		dcontext.GetLogger(f.ctx).Errorf("localcache: error caching %s: %v", f.path, err)
+	}
+	if err := f.lc.local.Delete(f.ctx, f.tempPath); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			dcontext.GetLogger(f.ctx).Errorf("localcache: error removing %s: %v", f.tempPath, err)
+		}
+	}
+}
+
+// fillReader caches the content of a remote reader once it is read to the
+// end. Content only partially read is not cached.
+type fillReader struct {
+	io.ReadCloser
+	fill *cacheFill
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.fill.done {
+		if _, err := r.fill.Write(p[:n]); err != nil {
+			r.fill.cancel(err)
+		}
+	}
+	if err == io.EOF {
+		r.fill.commit()
+	}
+	return n, err
+}
+
+func (r *fillReader) Close() error {
+	r.fill.cancel(nil)
+	return r.ReadCloser.Close()
+}
+
+// invalidatingWriter invalidates the cached copies of the file once the
+// written content is committed.
+type invalidatingWriter struct {
+	storagedriver.FileWriter
+	ctx  context.Context
+	lc   *localCacheStorageMiddleware
+	path string
+}
+
+func (w *invalidatingWriter) Commit() error {
+	err := w.FileWriter.Commit()
+	w.lc.invalidate(w.ctx, w.path)
+	return err
+}
+
+// getSizeOption returns the named option as a number of bytes.
+func getSizeOption(options map[string]interface{}, name string) (int64, error) {
+	switch v := options[name].(type) {
+	case nil:
+		return 0, fmt.Errorf("no %s provided", name)
+	case string:
+		size, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be an integer, %v invalid", name, v)
+		}
+		return size, nil
+	case int64:
+		return v, nil
+	case int, uint, int32, uint32, uint64:
+		return reflect.ValueOf(v).Convert(reflect.TypeOf(int64(0))).Int(), nil
+	default:
+		return 0, fmt.Errorf("invalid value for %s: %#v", name, v)
+	}
+}
@@ -0,0 +1,307 @@
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	remoteRoot, err := ioutil.TempDir("", "localcache-remote-")
+	if err != nil {
+		panic(err)
+	}
+	cacheRoot, err := ioutil.TempDir("", "localcache-")
+	if err != nil {
+		panic(err)
+	}
+
+	// cache everything, so that the suite exercises the cache
+	remote := filesystem.New(filesystem.DriverParameters{RootDirectory: remoteRoot, MaxThreads: 100})
+	driver, err := newLocalCacheStorageMiddleware(remote, map[string]interface{}{
+		"rootdirectory": cacheRoot,
+		"maxsize":       "1073741824",
+		"paths":         []interface{}{"/"},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+type MiddlewareSuite struct {
+	remoteRoot string
+	cacheRoot  string
+	remote     storagedriver.StorageDriver
+}
+
+var _ = check.Suite(&MiddlewareSuite{})
+
+func (s *MiddlewareSuite) SetUpTest(c *check.C) {
+	s.remoteRoot = c.MkDir()
+	s.cacheRoot = c.MkDir()
+	s.remote = filesystem.New(filesystem.DriverParameters{RootDirectory: s.remoteRoot, MaxThreads: 100})
+}
+
+func (s *MiddlewareSuite) newCache(c *check.C, maxSize int64) *localCacheStorageMiddleware {
+	driver, err := newLocalCacheStorageMiddleware(s.remote, map[string]interface{}{
+		"rootdirectory": s.cacheRoot,
+		"maxsize":       maxSize,
+		"paths":         []interface{}{"/blobs/"},
+	})
+	c.Assert(err, check.IsNil)
+	return driver.(*localCacheStorageMiddleware)
+}
+
+func isCached(lc *localCacheStorageMiddleware, path string) bool {
+	_, ok := lc.hit(path)
+	return ok
+}
+
+func (s *MiddlewareSuite) TestNoConfig(c *check.C) {
+	_, err := newLocalCacheStorageMiddleware(nil, map[string]interface{}{})
+	c.Assert(err, check.ErrorMatches, "no rootdirectory provided")
+}
+
+func (s *MiddlewareSuite) TestInvalidOptions(c *check.C) {
+	_, err := newLocalCacheStorageMiddleware(nil, map[string]interface{}{
+		"rootdirectory": s.cacheRoot,
+	})
+	c.Assert(err, check.ErrorMatches, "no maxsize provided")
+
+	_, err = newLocalCacheStorageMiddleware(nil, map[string]interface{}{
+		"rootdirectory": s.cacheRoot,
+		"maxsize":       "big",
+	})
+	c.Assert(err, check.ErrorMatches, "maxsize must be an integer, big invalid")
+
+	_, err = newLocalCacheStorageMiddleware(nil, map[string]interface{}{
+		"rootdirectory": s.cacheRoot,
+		"maxsize":       0,
+	})
+	c.Assert(err, check.ErrorMatches, "maxsize must be positive")
+
+	_, err = newLocalCacheStorageMiddleware(nil, map[string]interface{}{
+		"rootdirectory": s.cacheRoot,
+		"maxsize":       100,
+		"paths":         []interface{}{"blobs"},
+	})
+	c.Assert(err, check.ErrorMatches, "paths must be a list of absolute paths, .* invalid")
+}
+
+func (s *MiddlewareSuite) TestReadThrough(c *check.C) {
+	ctx := context.Background()
+	lc := s.newCache(c, 100)
+
+	c.Assert(s.remote.PutContent(ctx, "/blobs/a", []byte("content a")), check.IsNil)
+	c.Assert(s.remote.PutContent(ctx, "/other/b", []byte("content b")), check.IsNil)
+
+	content, err := lc.GetContent(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "content a")
+
+	_, err = lc.GetContent(ctx, "/other/b")
+	c.Assert(err, check.IsNil)
+
+	// only the cached paths are kept locally
+	c.Assert(lc.lru.Len(), check.Equals, 1)
+	c.Assert(lc.size, check.Equals, int64(len("content a")))
+
+	// the bytes are read from the cached copy while the remote file is
+	// unchanged
+	c.Assert(ioutil.WriteFile(s.cacheRoot+cacheDataRoot+"/blobs/a", []byte("cached  a"), 0644), check.IsNil)
+	rc, err := lc.Reader(ctx, "/blobs/a", 6)
+	c.Assert(err, check.IsNil)
+	content, err = ioutil.ReadAll(rc)
+	c.Assert(err, check.IsNil)
+	c.Assert(rc.Close(), check.IsNil)
+	c.Assert(string(content), check.Equals, "  a")
+
+	// the metadata is read from the remote file
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	c.Assert(os.Chtimes(s.remoteRoot+"/blobs/a", modTime, modTime), check.IsNil)
+	fi, err := lc.Stat(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(fi.Path(), check.Equals, "/blobs/a")
+	c.Assert(fi.Size(), check.Equals, int64(len("content a")))
+	c.Assert(fi.ModTime().Equal(modTime), check.Equals, true)
+
+	// the cached copy is dropped once the remote file is modified
+	content, err = lc.GetContent(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "content a")
+
+	// or gone
+	c.Assert(os.Remove(s.remoteRoot+"/blobs/a"), check.IsNil)
+	_, err = lc.Reader(ctx, "/blobs/a", 0)
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+	c.Assert(isCached(lc, "/blobs/a"), check.Equals, false)
+
+	c.Assert(s.remote.PutContent(ctx, "/blobs/a", []byte("content a")), check.IsNil)
+	_, err = lc.GetContent(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(os.Remove(s.remoteRoot+"/blobs/a"), check.IsNil)
+	_, err = lc.Stat(ctx, "/blobs/a")
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+	c.Assert(isCached(lc, "/blobs/a"), check.Equals, false)
+}
+
+// statCountingDriver counts the calls to Stat.
+type statCountingDriver struct {
+	storagedriver.StorageDriver
+	stats int
+}
+
+func (d *statCountingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	d.stats++
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (s *MiddlewareSuite) TestBlobDataNotRevalidated(c *check.C) {
+	ctx := context.Background()
+	remote := &statCountingDriver{StorageDriver: s.remote}
+	driver, err := newLocalCacheStorageMiddleware(remote, map[string]interface{}{
+		"rootdirectory": s.cacheRoot,
+		"maxsize":       100,
+	})
+	c.Assert(err, check.IsNil)
+	lc := driver.(*localCacheStorageMiddleware)
+
+	p := blobsPrefix + "sha256/ab/abcd/data"
+	c.Assert(s.remote.PutContent(ctx, p, []byte("content a")), check.IsNil)
+	_, err = lc.GetContent(ctx, p)
+	c.Assert(err, check.IsNil)
+
+	rc, err := lc.Reader(ctx, p, 0)
+	c.Assert(err, check.IsNil)
+	content, err := ioutil.ReadAll(rc)
+	c.Assert(err, check.IsNil)
+	c.Assert(rc.Close(), check.IsNil)
+	c.Assert(string(content), check.Equals, "content a")
+	c.Assert(remote.stats, check.Equals, 0)
+}
+
+func (s *MiddlewareSuite) TestReaderFill(c *check.C) {
+	ctx := context.Background()
+	lc := s.newCache(c, 100)
+
+	c.Assert(s.remote.PutContent(ctx, "/blobs/a", []byte("content a")), check.IsNil)
+
+	// partial reads are not cached
+	rc, err := lc.Reader(ctx, "/blobs/a", 0)
+	c.Assert(err, check.IsNil)
+	_, err = rc.Read(make([]byte, 3))
+	c.Assert(err, check.IsNil)
+	c.Assert(rc.Close(), check.IsNil)
+	c.Assert(lc.lru.Len(), check.Equals, 0)
+
+	rc, err = lc.Reader(ctx, "/blobs/a", 0)
+	c.Assert(err, check.IsNil)
+	content, err := ioutil.ReadAll(rc)
+	c.Assert(err, check.IsNil)
+	c.Assert(rc.Close(), check.IsNil)
+	c.Assert(string(content), check.Equals, "content a")
+	c.Assert(lc.lru.Len(), check.Equals, 1)
+
+	// the cache is indexed again on startup
+	lc = s.newCache(c, 100)
+	c.Assert(lc.lru.Len(), check.Equals, 1)
+	c.Assert(lc.size, check.Equals, int64(len("content a")))
+}
+
+func (s *MiddlewareSuite) TestEviction(c *check.C) {
+	ctx := context.Background()
+	lc := s.newCache(c, 20)
+
+	for _, p := range []string{"/blobs/a", "/blobs/b", "/blobs/c"} {
+		c.Assert(s.remote.PutContent(ctx, p, []byte("0123456789")), check.IsNil)
+	}
+	c.Assert(s.remote.PutContent(ctx, "/blobs/large", make([]byte, 21)), check.IsNil)
+
+	_, err := lc.GetContent(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	_, err = lc.GetContent(ctx, "/blobs/b")
+	c.Assert(err, check.IsNil)
+	// a is now the most recently used
+	_, err = lc.GetContent(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	_, err = lc.GetContent(ctx, "/blobs/c")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(lc.size, check.Equals, int64(20))
+	c.Assert(isCached(lc, "/blobs/a"), check.Equals, true)
+	c.Assert(isCached(lc, "/blobs/b"), check.Equals, false)
+	c.Assert(isCached(lc, "/blobs/c"), check.Equals, true)
+	_, err = os.Stat(s.cacheRoot + cacheDataRoot + "/blobs/b")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	// files larger than the cache are never cached
+	_, err = lc.GetContent(ctx, "/blobs/large")
+	c.Assert(err, check.IsNil)
+	c.Assert(isCached(lc, "/blobs/large"), check.Equals, false)
+	c.Assert(lc.size, check.Equals, int64(20))
+}
+
+func (s *MiddlewareSuite) TestInvalidation(c *check.C) {
+	ctx := context.Background()
+	lc := s.newCache(c, 100)
+
+	c.Assert(lc.PutContent(ctx, "/blobs/a", []byte("old")), check.IsNil)
+	_, err := lc.GetContent(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(isCached(lc, "/blobs/a"), check.Equals, true)
+
+	c.Assert(lc.PutContent(ctx, "/blobs/a", []byte("new")), check.IsNil)
+	c.Assert(isCached(lc, "/blobs/a"), check.Equals, false)
+	content, err := lc.GetContent(ctx, "/blobs/a")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "new")
+
+	c.Assert(lc.Move(ctx, "/blobs/a", "/blobs/b"), check.IsNil)
+	c.Assert(isCached(lc, "/blobs/a"), check.Equals, false)
+	_, err = lc.GetContent(ctx, "/blobs/b")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(lc.Delete(ctx, "/blobs"), check.IsNil)
+	c.Assert(lc.lru.Len(), check.Equals, 0)
+	_, err = lc.GetContent(ctx, "/blobs/b")
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+func (s *MiddlewareSuite) TestInvalidationIndex(c *check.C) {
+	ctx := context.Background()
+	lc := s.newCache(c, 100)
+
+	for _, p := range []string{"/blobs/x/a", "/blobs/x/y/b", "/blobs/z/c"} {
+		c.Assert(s.remote.PutContent(ctx, p, []byte("content")), check.IsNil)
+		_, err := lc.GetContent(ctx, p)
+		c.Assert(err, check.IsNil)
+	}
+
+	c.Assert(lc.Delete(ctx, "/blobs/x"), check.IsNil)
+	c.Assert(isCached(lc, "/blobs/x/a"), check.Equals, false)
+	c.Assert(isCached(lc, "/blobs/x/y/b"), check.Equals, false)
+	c.Assert(isCached(lc, "/blobs/z/c"), check.Equals, true)
+
+	// the directories of the dropped files are no longer indexed
+	_, ok := lc.dirs["/blobs/x"]
+	c.Assert(ok, check.Equals, false)
+	_, ok = lc.dirs["/blobs/x/y"]
+	c.Assert(ok, check.Equals, false)
+
+	c.Assert(lc.Delete(ctx, "/blobs/z/c"), check.IsNil)
+	c.Assert(lc.lru.Len(), check.Equals, 0)
+	c.Assert(lc.dirs, check.HasLen, 0)
+}
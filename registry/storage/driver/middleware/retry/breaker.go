@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the storage driver while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open: storage driver failing")
+
+type breakerState int
+
+const (
+	// breakerClosed lets every call through
+	breakerClosed breakerState = iota
+	// breakerOpen fails the calls until the cooldown is over
+	breakerOpen
+	// breakerHalfOpen lets a single call through to probe the driver
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a circuit breaker opening after threshold consecutive failures.
+// Once open for the cooldown, it lets a probe call through, closing again if
+// the probe succeeds.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a call may go through, returning ErrCircuitOpen
+// otherwise, and whether the call probes the driver. The calls allowed must
+// be followed by a call to done.
+func (b *breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false, ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the outcome of a call allowed through.
+func (b *breaker) done(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	if !failed {
+		if probe || b.state == breakerClosed {
+			b.state = breakerClosed
+			b.failures = 0
+		}
+		return
+	}
+
+	b.failures++
+	if probe || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// Check implements the health.Checker interface, failing while the circuit
+// is not closed.
+func (b *breaker) Check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		return ErrCircuitOpen
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+// Package middleware - retries and circuit breaker in front of a storage driver
+//
+// The retry middleware retries the idempotent calls to the storage driver
+// it wraps, GetContent, Stat, List and Reader, when they fail with a
+// transient error of the storage backend, waiting a jittered exponential
+// backoff between the attempts. Readers failing while the content is read are
+// opened again at the offset reached.
+//
+// After a number of consecutive failures of any call, the circuit breaker of
+// the middleware opens: calls fail immediately with ErrCircuitOpen, until a
+// probe call succeeds once the cooldown is over. The middleware implements
+// the health.Checker interface, failing while the circuit is not closed, so
+// that load balancers can drain the registry instance. As a drained instance
+// receives no calls, the health check itself probes the driver once the
+// cooldown is over.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	storagemiddleware "github.com/docker/distribution/registry/storage/driver/middleware"
+)
+
+const (
+	defaultMaxAttempts      = 3
+	defaultInitialBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff       = 2 * time.Second
+	defaultFailureThreshold = 10
+	defaultCooldown         = 30 * time.Second
+)
+
+func init() {
+	storagemiddleware.Register("retry", storagemiddleware.InitFunc(newRetryStorageMiddleware))
+}
+
+// retryStorageMiddleware retries the idempotent calls of the storage driver
+// it wraps, behind a circuit breaker.
+type retryStorageMiddleware struct {
+	storagedriver.StorageDriver
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	breaker        *breaker
+
+	mu   sync.Mutex // guards rand
+	rand *rand.Rand
+}
+
+var _ storagedriver.StorageDriver = &retryStorageMiddleware{}
+
+// newRetryStorageMiddleware constructs the middleware from its options.
+// Optional options: maxattempts, initialbackoff, maxbackoff,
+// failurethreshold and cooldown
+func newRetryStorageMiddleware(storageDriver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	maxAttempts, err := getIntOption(options, "maxattempts", defaultMaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	initialBackoff, err := getDurationOption(options, "initialbackoff", defaultInitialBackoff)
+	if err != nil {
+		return nil, err
+	}
+	maxBackoff, err := getDurationOption(options, "maxbackoff", defaultMaxBackoff)
+	if err != nil {
+		return nil, err
+	}
+	if maxBackoff < initialBackoff {
+		return nil, fmt.Errorf("maxbackoff must not be lower than initialbackoff")
+	}
+	failureThreshold, err := getIntOption(options, "failurethreshold", defaultFailureThreshold)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := getDurationOption(options, "cooldown", defaultCooldown)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRetry(storageDriver, maxAttempts, initialBackoff, maxBackoff, newBreaker(failureThreshold, cooldown)), nil
+}
+
+func newRetry(storageDriver storagedriver.StorageDriver, maxAttempts int, initialBackoff, maxBackoff time.Duration, b *breaker) *retryStorageMiddleware {
+	return &retryStorageMiddleware{
+		StorageDriver:  storageDriver,
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		breaker:        b,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// probeTimeout bounds the Stat probing the driver from the health check.
+var probeTimeout = 10 * time.Second
+
+var errProbeTimeout = errors.New("storage driver probe timed out")
+
+// isTransient reports whether err is a failure of the storage backend which
+// may not happen again, rather than an error of the call such as a missing
+// path. Drivers return these failures as storagedriver.Error, enclosing the
+// error of the storage service: the ones with an HTTP status are transient
+// for the 408, 429 and 5xx statuses only, others such as 403 Access Denied
+// are permanent.
+func isTransient(err error) bool {
+	driverErr, ok := err.(storagedriver.Error)
+	if !ok {
+		return false
+	}
+	switch driverErr.Enclosed {
+	case context.Canceled, context.DeadlineExceeded, ErrCircuitOpen:
+		return false
+	}
+	if status := statusCode(driverErr.Enclosed); status >= 400 && status < 500 {
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// statusCode returns the HTTP status of the response of the storage service
+// which err reports, or 0 if unknown. As the middleware does not depend on the
+// SDKs of the drivers, the status is found as their errors expose it: by a
+// StatusCode method (S3), a StatusCode field (Azure, OSS, Swift), a Code field
+// (GCS) or the Response of the error (COS).
+func statusCode(err error) int {
+	if e, ok := err.(interface {
+		StatusCode() int
+	}); ok {
+		return e.StatusCode()
+	}
+
+	v := reflect.ValueOf(err)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return 0
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0
+	}
+	for _, name := range []string{"StatusCode", "Code"} {
+		if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.Int {
+			return int(f.Int())
+		}
+	}
+	if f := v.FieldByName("Response"); f.IsValid() {
+		if resp, ok := f.Interface().(*http.Response); ok && resp != nil {
+			return resp.StatusCode
+		}
+	}
+	return 0
+}
+
+// backoff returns the time to wait before the given retry, drawn at random
+// up to the exponential backoff so that the instances of the registry do not
+// retry in step.
+func (rm *retryStorageMiddleware) backoff(retry int) time.Duration {
+	backoff := rm.maxBackoff
+	if retry < 32 && rm.initialBackoff<<uint(retry) < rm.maxBackoff {
+		backoff = rm.initialBackoff << uint(retry)
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return time.Duration(rm.rand.Int63n(int64(backoff) + 1))
+}
+
+// call runs fn behind the circuit breaker, without retries.
+func (rm *retryStorageMiddleware) call(fn func() error) error {
+	probe, err := rm.breaker.allow()
+	if err != nil {
+		return storagedriver.Error{DriverName: rm.Name(), Enclosed: err}
+	}
+	err = fn()
+	rm.breaker.done(probe, isTransient(err))
+	return err
+}
+
+// retry runs the idempotent fn behind the circuit breaker, retrying it while
+// it fails with a transient error.
+func (rm *retryStorageMiddleware) retry(ctx context.Context, op, path string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < rm.maxAttempts; attempt++ {
+		if attempt > 0 {
+			dcontext.GetLogger(ctx).Warnf("retrying %s %s after error: %v", op, path, err)
+			select {
+			case <-time.After(rm.backoff(attempt - 1)):
+			case <-ctx.Done():
+				return err
+			}
+		}
+
+		err = rm.call(fn)
+		if !isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// GetContent retrieves the content stored at "path", retrying on transient
+// errors.
+func (rm *retryStorageMiddleware) GetContent(ctx context.Context, path string) (content []byte, err error) {
+	err = rm.retry(ctx, "GetContent", path, func() error {
+		content, err = rm.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent stores the content at "path" behind the circuit breaker.
+func (rm *retryStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	return rm.call(func() error {
+		return rm.StorageDriver.PutContent(ctx, path, content)
+	})
+}
+
+// Reader opens the content stored at "path" from offset, retrying on
+// transient errors. The reader returned opens the content again at the
+// offset reached when reading fails.
+func (rm *retryStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	rc, err := rm.open(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &retryReader{
+		ctx:    ctx,
+		rm:     rm,
+		path:   path,
+		offset: offset,
+		rc:     rc,
+	}, nil
+}
+
+func (rm *retryStorageMiddleware) open(ctx context.Context, path string, offset int64) (rc io.ReadCloser, err error) {
+	err = rm.retry(ctx, "Reader", path, func() error {
+		rc, err = rm.StorageDriver.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// Writer returns a FileWriter writing at "path" behind the circuit breaker.
+func (rm *retryStorageMiddleware) Writer(ctx context.Context, path string, append bool) (fw storagedriver.FileWriter, err error) {
+	err = rm.call(func() error {
+		fw, err = rm.StorageDriver.Writer(ctx, path, append)
+		return err
+	})
+	return fw, err
+}
+
+// Stat retrieves the FileInfo of "path", retrying on transient errors.
+func (rm *retryStorageMiddleware) Stat(ctx context.Context, path string) (fi storagedriver.FileInfo, err error) {
+	err = rm.retry(ctx, "Stat", path, func() error {
+		fi, err = rm.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List returns the direct descendants of "path", retrying on transient
+// errors.
+func (rm *retryStorageMiddleware) List(ctx context.Context, path string) (children []string, err error) {
+	err = rm.retry(ctx, "List", path, func() error {
+		children, err = rm.StorageDriver.List(ctx, path)
+		return err
+	})
+	return children, err
+}
+
+// Move moves the object at sourcePath to destPath behind the circuit
+// breaker.
+func (rm *retryStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return rm.call(func() error {
+		return rm.StorageDriver.Move(ctx, sourcePath, destPath)
+	})
+}
+
+// Delete deletes the objects at "path" behind the circuit breaker.
+func (rm *retryStorageMiddleware) Delete(ctx context.Context, path string) error {
+	return rm.call(func() error {
+		return rm.StorageDriver.Delete(ctx, path)
+	})
+}
+
+// Check implements the health.Checker interface, failing while the circuit
+// breaker is not closed. Once the cooldown is over, it probes the driver with
+// a Stat of the root, given up after probeTimeout.
+func (rm *retryStorageMiddleware) Check() error {
+	if err := rm.breaker.Check(); err == nil {
+		return nil
+	}
+
+	rm.call(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		defer cancel()
+		_, err := rm.StorageDriver.Stat(ctx, "/")
+		if ctx.Err() != nil {
+			// unlike a call given up by its caller, a probe timing out is a
+			// failure of the driver
+			err = storagedriver.Error{DriverName: rm.Name(), Enclosed: errProbeTimeout}
+		}
+		return err
+	})
+	return rm.breaker.Check()
+}
+
+// retryReader reads content, opening it again at the offset reached when
+// reading fails.
+type retryReader struct {
+	ctx    context.Context
+	rm     *retryStorageMiddleware
+	path   string
+	offset int64
+	rc     io.ReadCloser
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := r.rc.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || attempt >= r.rm.maxAttempts || r.ctx.Err() != nil {
+			return n, err
+		}
+
+		dcontext.GetLogger(r.ctx).Warnf("reopening %s at %d after error: %v", r.path, r.offset, err)
+		r.rc.Close()
+		rc, openErr := r.rm.open(r.ctx, r.path, r.offset)
+		if openErr != nil {
+			r.rc = errReader{err}
+			return n, err
+		}
+		r.rc = rc
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *retryReader) Close() error {
+	return r.rc.Close()
+}
+
+// errReader replaces a reader which could not be opened again.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func (r errReader) Close() error {
+	return nil
+}
+
+func getIntOption(options map[string]interface{}, name string, def int) (int, error) {
+	var v int
+	switch o := options[name].(type) {
+	case nil:
+		return def, nil
+	case int:
+		v = o
+	case string:
+		var err error
+		if v, err = strconv.Atoi(o); err != nil {
+			return 0, fmt.Errorf("%s must be an integer, %v invalid", name, o)
+		}
+	default:
+		return 0, fmt.Errorf("invalid value for %s: %#v", name, o)
+	}
+	if v < 1 {
+		return 0, fmt.Errorf("%s must be positive, %d invalid", name, v)
+	}
+	return v, nil
+}
+
+func getDurationOption(options map[string]interface{}, name string, def time.Duration) (time.Duration, error) {
+	switch v := options[name].(type) {
+	case nil:
+		return def, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("%s must be a positive duration, %v invalid", name, v)
+		}
+		return d, nil
+	case time.Duration:
+		if v > 0 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be a positive duration, %v invalid", name, options[name])
+}
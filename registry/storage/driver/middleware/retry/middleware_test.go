@@ -0,0 +1,341 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	check "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return newRetryStorageMiddleware(inmemory.New(), nil)
+	}, testsuites.NeverSkip)
+}
+
+var errBackend = errors.New("backend unavailable")
+
+// flakyDriver fails its calls with a driver error enclosing cause, or
+// errBackend, while failures remain, and breaks the readers it returns after
+// breakAfter bytes. Its Stat calls block until their context is done while
+// hang is set.
+type flakyDriver struct {
+	storagedriver.StorageDriver
+
+	mu         sync.Mutex
+	failures   int
+	calls      int
+	cause      error
+	breakAfter int64
+	hang       bool
+}
+
+func (d *flakyDriver) fail() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls++
+	if d.failures > 0 {
+		d.failures--
+		if d.cause != nil {
+			return storagedriver.Error{DriverName: "flaky", Enclosed: d.cause}
+		}
+		return storagedriver.Error{DriverName: "flaky", Enclosed: errBackend}
+	}
+	return nil
+}
+
+func (d *flakyDriver) setFailures(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures = n
+	d.calls = 0
+}
+
+func (d *flakyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *flakyDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := d.fail(); err != nil {
+		return err
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *flakyDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	if d.hang {
+		<-ctx.Done()
+		return nil, storagedriver.Error{DriverName: "flaky", Enclosed: ctx.Err()}
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *flakyDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	rc, err := d.StorageDriver.Reader(ctx, path, offset)
+	if err != nil || d.breakAfter == 0 {
+		return rc, err
+	}
+	return &brokenReader{ReadCloser: rc, remaining: d.breakAfter}, nil
+}
+
+// brokenReader fails once remaining bytes are read.
+type brokenReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, errors.New("connection reset")
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+type MiddlewareSuite struct {
+	flaky   *flakyDriver
+	breaker *breaker
+	retry   *retryStorageMiddleware
+}
+
+var _ = check.Suite(&MiddlewareSuite{})
+
+func (s *MiddlewareSuite) SetUpTest(c *check.C) {
+	s.flaky = &flakyDriver{StorageDriver: inmemory.New()}
+	s.breaker = newBreaker(5, time.Minute)
+	s.retry = newRetry(s.flaky, 3, time.Millisecond, 5*time.Millisecond, s.breaker)
+}
+
+func (s *MiddlewareSuite) TestRetry(c *check.C) {
+	ctx := context.Background()
+	c.Assert(s.flaky.StorageDriver.PutContent(ctx, "/file", []byte("content")), check.IsNil)
+
+	s.flaky.setFailures(2)
+	content, err := s.retry.GetContent(ctx, "/file")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "content")
+	c.Assert(s.flaky.calls, check.Equals, 3)
+
+	// the calls fail after the last attempt
+	s.flaky.setFailures(3)
+	_, err = s.retry.Stat(ctx, "/file")
+	c.Assert(err, check.FitsTypeOf, storagedriver.Error{})
+	c.Assert(s.flaky.calls, check.Equals, 3)
+
+	// errors of the calls are not retried
+	s.flaky.setFailures(0)
+	_, err = s.retry.Stat(ctx, "/missing")
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+	c.Assert(s.flaky.calls, check.Equals, 1)
+
+	// nor are the calls which are not idempotent
+	s.flaky.setFailures(1)
+	c.Assert(s.retry.PutContent(ctx, "/file", []byte("other")), check.NotNil)
+	c.Assert(s.flaky.calls, check.Equals, 1)
+}
+
+func (s *MiddlewareSuite) TestReaderReopens(c *check.C) {
+	ctx := context.Background()
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	c.Assert(s.flaky.StorageDriver.PutContent(ctx, "/file", content), check.IsNil)
+
+	s.flaky.breakAfter = 300
+	rc, err := s.retry.Reader(ctx, "/file", 100)
+	c.Assert(err, check.IsNil)
+	defer rc.Close()
+
+	p, err := ioutil.ReadAll(rc)
+	c.Assert(err, check.IsNil)
+	c.Assert(p, check.DeepEquals, content[100:])
+	c.Assert(s.flaky.calls, check.Equals, 4)
+}
+
+func (s *MiddlewareSuite) TestCircuitBreaker(c *check.C) {
+	ctx := context.Background()
+	now := time.Now()
+	s.breaker.now = func() time.Time { return now }
+
+	// five consecutive failures open the circuit
+	s.flaky.setFailures(5)
+	_, err := s.retry.Stat(ctx, "/")
+	c.Assert(err, check.NotNil)
+	c.Assert(s.retry.Check(), check.IsNil)
+	_, err = s.retry.Stat(ctx, "/")
+	c.Assert(err, check.NotNil)
+	c.Assert(s.retry.Check(), check.Equals, ErrCircuitOpen)
+	c.Assert(s.flaky.calls, check.Equals, 5)
+
+	// calls fail without reaching the driver while the circuit is open
+	s.flaky.setFailures(0)
+	_, err = s.retry.List(ctx, "/")
+	c.Assert(err, check.DeepEquals, storagedriver.Error{DriverName: "inmemory", Enclosed: ErrCircuitOpen})
+	c.Assert(s.flaky.calls, check.Equals, 0)
+
+	// a failing probe opens the circuit again
+	now = now.Add(time.Minute)
+	s.flaky.setFailures(1)
+	c.Assert(s.retry.PutContent(ctx, "/file", nil), check.NotNil)
+	c.Assert(s.retry.Check(), check.Equals, ErrCircuitOpen)
+	_, err = s.retry.Stat(ctx, "/")
+	c.Assert(err, check.DeepEquals, storagedriver.Error{DriverName: "inmemory", Enclosed: ErrCircuitOpen})
+
+	// a successful probe closes the circuit
+	now = now.Add(time.Minute)
+	c.Assert(s.retry.PutContent(ctx, "/file", nil), check.IsNil)
+	c.Assert(s.retry.Check(), check.IsNil)
+	_, err = s.retry.Stat(ctx, "/file")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *MiddlewareSuite) TestHealthCheckProbes(c *check.C) {
+	ctx := context.Background()
+	now := time.Now()
+	s.breaker.now = func() time.Time { return now }
+
+	s.flaky.setFailures(6)
+	for i := 0; i < 2; i++ {
+		s.retry.Stat(ctx, "/")
+	}
+	c.Assert(s.retry.Check(), check.Equals, ErrCircuitOpen)
+	c.Assert(s.flaky.calls, check.Equals, 5)
+
+	// the health check probes the driver once the cooldown is over, without
+	// other calls reaching the drained instance
+	now = now.Add(time.Minute)
+	c.Assert(s.retry.Check(), check.Equals, ErrCircuitOpen)
+	c.Assert(s.flaky.calls, check.Equals, 6)
+	c.Assert(s.retry.Check(), check.Equals, ErrCircuitOpen)
+	c.Assert(s.flaky.calls, check.Equals, 6)
+
+	now = now.Add(time.Minute)
+	c.Assert(s.retry.Check(), check.IsNil)
+	c.Assert(s.flaky.calls, check.Equals, 7)
+}
+
+func (s *MiddlewareSuite) TestHealthCheckProbeTimeout(c *check.C) {
+	defer func(timeout time.Duration) { probeTimeout = timeout }(probeTimeout)
+	probeTimeout = 10 * time.Millisecond
+
+	ctx := context.Background()
+	now := time.Now()
+	s.breaker.now = func() time.Time { return now }
+
+	s.flaky.setFailures(5)
+	for i := 0; i < 5; i++ {
+		s.retry.PutContent(ctx, "/file", nil)
+	}
+	c.Assert(s.retry.Check(), check.Equals, ErrCircuitOpen)
+
+	// a probe given up after the timeout keeps the circuit open
+	s.flaky.hang = true
+	now = now.Add(time.Minute)
+	c.Assert(s.retry.Check(), check.Equals, ErrCircuitOpen)
+	c.Assert(s.flaky.calls, check.Equals, 6)
+
+	s.flaky.hang = false
+	now = now.Add(time.Minute)
+	c.Assert(s.retry.Check(), check.IsNil)
+}
+
+// statusError reports its status as the errors of the S3 SDK do.
+type statusError int
+
+func (e statusError) Error() string   { return http.StatusText(int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+// fieldError reports its status as the errors of the Azure, OSS and Swift
+// SDKs do.
+type fieldError struct {
+	StatusCode int
+}
+
+func (e *fieldError) Error() string { return http.StatusText(e.StatusCode) }
+
+// responseError reports its status as the errors of the COS SDK do.
+type responseError struct {
+	Response *http.Response
+}
+
+func (e *responseError) Error() string { return e.Response.Status }
+
+func (s *MiddlewareSuite) TestTransientErrors(c *check.C) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{errBackend, false},
+		{storagedriver.PathNotFoundError{Path: "/"}, false},
+		{storagedriver.Error{Enclosed: errBackend}, true},
+		{storagedriver.Error{Enclosed: context.Canceled}, false},
+		{storagedriver.Error{Enclosed: statusError(http.StatusForbidden)}, false},
+		{storagedriver.Error{Enclosed: statusError(http.StatusTooManyRequests)}, true},
+		{storagedriver.Error{Enclosed: statusError(http.StatusServiceUnavailable)}, true},
+		{storagedriver.Error{Enclosed: &fieldError{StatusCode: http.StatusNotFound}}, false},
+		{storagedriver.Error{Enclosed: &fieldError{StatusCode: http.StatusRequestTimeout}}, true},
+		{storagedriver.Error{Enclosed: &fieldError{}}, true},
+		{storagedriver.Error{Enclosed: &responseError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}}, false},
+		{storagedriver.Error{Enclosed: &responseError{Response: &http.Response{StatusCode: http.StatusBadGateway}}}, true},
+	} {
+		c.Assert(isTransient(tc.err), check.Equals, tc.transient, check.Commentf("%#v", tc.err))
+	}
+
+	// permanent errors are neither retried nor opening the circuit
+	ctx := context.Background()
+	s.flaky.cause = statusError(http.StatusForbidden)
+	s.flaky.setFailures(10)
+	for i := 0; i < 5; i++ {
+		_, err := s.retry.Stat(ctx, "/")
+		c.Assert(err, check.NotNil)
+	}
+	c.Assert(s.flaky.calls, check.Equals, 5)
+	c.Assert(s.retry.Check(), check.IsNil)
+}
+
+func (s *MiddlewareSuite) TestOptions(c *check.C) {
+	_, err := newRetryStorageMiddleware(s.flaky, map[string]interface{}{
+		"maxattempts":      5,
+		"initialbackoff":   "50ms",
+		"maxbackoff":       "1s",
+		"failurethreshold": "20",
+		"cooldown":         "1m",
+	})
+	c.Assert(err, check.IsNil)
+
+	for _, options := range []map[string]interface{}{
+		{"maxattempts": 0},
+		{"maxattempts": "many"},
+		{"initialbackoff": "soon"},
+		{"initialbackoff": "1s", "maxbackoff": "100ms"},
+		{"cooldown": "-1s"},
+	} {
+		_, err := newRetryStorageMiddleware(s.flaky, options)
+		c.Assert(err, check.NotNil, check.Commentf("%v", options))
+	}
+}
@@ -0,0 +1,791 @@
+// Package mirror provides a storagedriver.StorageDriver keeping the same
+// content in several backing storage drivers, such as s3 buckets in two
+// regions or a filesystem and an azure container.
+//
+// Writes go to every backing driver concurrently and succeed once they
+// succeed on the write quorum. Reads go to the first healthy driver in sync
+// holding the path. A driver failing leaves the read path until the
+// background reconciler repaired the writes it missed, comparing its files
+// with the first driver in sync. Which drivers are in sync, and how far each
+// was reconciled, is kept in every driver so that it survives restarts.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/base"
+	"github.com/docker/distribution/registry/storage/driver/factory"
+)
+
+const (
+	driverName = "mirror"
+
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultReconcileInterval   = 24 * time.Hour
+
+	// reconcileGracePeriod leaves the recently modified files, which may
+	// still be written to, to the next reconciliation.
+	reconcileGracePeriod = 10 * time.Minute
+)
+
+func init() {
+	factory.Register(driverName, &mirrorDriverFactory{})
+}
+
+// mirrorDriverFactory implements the factory.StorageDriverFactory interface
+type mirrorDriverFactory struct{}
+
+func (factory *mirrorDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+// DriverParameters configures a mirror driver.
+type DriverParameters struct {
+	// Drivers are the backing drivers, in order of read preference.
+	Drivers []storagedriver.StorageDriver
+	// WriteQuorum is the number of drivers writes must succeed on. Zero
+	// requires all of them.
+	WriteQuorum int
+	// HealthCheckInterval is the interval between the health checks of the
+	// drivers. Zero uses the default of 10 seconds.
+	HealthCheckInterval time.Duration
+	// ReconcileInterval is the interval between reconciliations of the
+	// drivers. Zero disables the reconciler.
+	ReconcileInterval time.Duration
+}
+
+// backend is a backing driver of the mirror.
+type backend struct {
+	storagedriver.StorageDriver
+	name    string // for the logs, as drivers may be of the same type
+	healthy int32  // accessed atomically
+
+	// synced is set, atomically, while the driver holds every write: it is
+	// cleared when the driver fails and set again once the driver was
+	// reconciled since it recovered, at recovered (unix nanoseconds).
+	synced    int32
+	recovered int64
+
+	// reconciled is the time up to which the modifications of the files
+	// of the driver were reconciled, and copied the modification times of
+	// the files the reconciler wrote to it since, which are as recent but
+	// not new. They are only modified by the reconciler while holding the
+	// state lock.
+	reconciled time.Time
+	copied     map[string]time.Time
+}
+
+func (b *backend) isHealthy() bool {
+	return atomic.LoadInt32(&b.healthy) == 1
+}
+
+// setHealthy records the health of the driver, returning whether it changed.
+// A failing driver is out of sync.
+func (b *backend) setHealthy(healthy bool) bool {
+	var v int32
+	if healthy {
+		v = 1
+		atomic.StoreInt64(&b.recovered, time.Now().UnixNano())
+	} else {
+		atomic.StoreInt32(&b.synced, 0)
+	}
+	return atomic.SwapInt32(&b.healthy, v) != v
+}
+
+func (b *backend) isSynced() bool {
+	return atomic.LoadInt32(&b.synced) == 1
+}
+
+// setSynced records whether the driver holds every write, returning whether
+// it changed.
+func (b *backend) setSynced(synced bool) bool {
+	var v int32
+	if synced {
+		v = 1
+	}
+	return atomic.SwapInt32(&b.synced, v) != v
+}
+
+// recoveredAt returns the time at which the driver was last found healthy
+// after failing.
+func (b *backend) recoveredAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&b.recovered))
+}
+
+type driver struct {
+	backends       []*backend
+	writeQuorum    int
+	reconcileGrace time.Duration
+	reconcileMu    sync.Mutex
+	stateMu        sync.Mutex
+
+	// reconciling is false when the reconciler is disabled, and wake
+	// requests a reconciliation before the next interval
+	reconciling bool
+	wake        chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation mirroring its
+// content in several backing drivers.
+type Driver struct {
+	baseEmbed
+	driver *driver
+}
+
+// Close stops the health checks and the reconciler of the driver.
+func (d *Driver) Close() error {
+	d.driver.closeOnce.Do(func() {
+		close(d.driver.done)
+	})
+	return nil
+}
+
+var _ storagedriver.StorageDriver = &Driver{}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - drivers, the list of the backing drivers, each a map of a driver name to
+// its parameters
+// Optional parameters:
+// - writequorum
+// - healthcheckinterval
+// - reconcileinterval
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	list, ok := parameters["drivers"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no drivers provided")
+	}
+	if len(list) < 2 {
+		return nil, fmt.Errorf("drivers must list at least two drivers")
+	}
+
+	params := DriverParameters{
+		HealthCheckInterval: defaultHealthCheckInterval,
+		ReconcileInterval:   defaultReconcileInterval,
+	}
+	for i, entry := range list {
+		name, driverParameters, err := driverEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("drivers[%d]: %v", i, err)
+		}
+		d, err := factory.Create(name, driverParameters)
+		if err != nil {
+			return nil, fmt.Errorf("drivers[%d]: %v", i, err)
+		}
+		params.Drivers = append(params.Drivers, d)
+	}
+
+	quorum, err := base.GetLimitFromParameter(parameters["writequorum"], 1, uint64(len(list)))
+	if err != nil {
+		return nil, fmt.Errorf("writequorum config error: %s", err.Error())
+	}
+	if quorum > uint64(len(list)) {
+		return nil, fmt.Errorf("writequorum must not exceed the number of drivers, %d", len(list))
+	}
+	params.WriteQuorum = int(quorum)
+
+	if params.HealthCheckInterval, err = getDurationParameter(parameters, "healthcheckinterval", params.HealthCheckInterval); err != nil {
+		return nil, err
+	}
+	if params.HealthCheckInterval <= 0 {
+		return nil, fmt.Errorf("healthcheckinterval must be positive")
+	}
+	if params.ReconcileInterval, err = getDurationParameter(parameters, "reconcileinterval", params.ReconcileInterval); err != nil {
+		return nil, err
+	}
+
+	return New(params), nil
+}
+
+// driverEntry returns the name and parameters of an entry of the drivers
+// list, a map of the driver name to its parameters.
+func driverEntry(entry interface{}) (string, map[string]interface{}, error) {
+	m, err := stringMap(entry)
+	if err != nil || len(m) != 1 {
+		return "", nil, fmt.Errorf("must map exactly one driver name to its parameters")
+	}
+
+	for name, value := range m {
+		if value == nil {
+			return name, map[string]interface{}{}, nil
+		}
+		parameters, err := stringMap(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("parameters of %s: %v", name, err)
+		}
+		return name, parameters, nil
+	}
+	panic("unreachable")
+}
+
+// stringMap converts the maps decoded from the configuration, keyed by
+// interface{}, to maps keyed by string.
+func stringMap(v interface{}) (map[string]interface{}, error) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", k)
+			}
+			converted[key] = v
+		}
+		return converted, nil
+	default:
+		return nil, fmt.Errorf("%#v is not a map", v)
+	}
+}
+
+func getDurationParameter(parameters map[string]interface{}, name string, def time.Duration) (time.Duration, error) {
+	switch v := parameters[name].(type) {
+	case nil:
+		return def, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be a duration, %v invalid", name, v)
+		}
+		return d, nil
+	case time.Duration:
+		return v, nil
+	case int:
+		if v == 0 {
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("%s must be a duration, %v invalid", name, parameters[name])
+}
+
+// New constructs a new Driver mirroring its content in the given drivers.
+func New(params DriverParameters) *Driver {
+	d := &driver{
+		writeQuorum:    params.WriteQuorum,
+		reconcileGrace: reconcileGracePeriod,
+		reconciling:    params.ReconcileInterval > 0,
+		wake:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	for i, sd := range params.Drivers {
+		d.backends = append(d.backends, &backend{
+			StorageDriver: sd,
+			name:          fmt.Sprintf("%s[%d]", sd.Name(), i),
+			healthy:       1,
+			synced:        1,
+		})
+	}
+	if d.writeQuorum <= 0 || d.writeQuorum > len(d.backends) {
+		d.writeQuorum = len(d.backends)
+	}
+	d.loadState(context.Background())
+
+	healthCheckInterval := params.HealthCheckInterval
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = defaultHealthCheckInterval
+	}
+	go d.checkHealth(healthCheckInterval)
+
+	if params.ReconcileInterval > 0 {
+		go d.reconcileEvery(params.ReconcileInterval)
+	}
+
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+		driver: d,
+	}
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := d.read(ctx, func(b *backend) error {
+		var err error
+		content, err = b.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, content []byte) error {
+	errs := d.each(func(i int, b *backend) error {
+		return b.PutContent(ctx, path, content)
+	})
+	return d.quorum(ctx, "PutContent", path, errs)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := d.read(ctx, func(b *backend) error {
+		var err error
+		rc, err = b.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" in every driver.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	writers := make([]storagedriver.FileWriter, len(d.backends))
+	errs := d.each(func(i int, b *backend) error {
+		var err error
+		writers[i], err = b.Writer(ctx, path, append)
+		return err
+	})
+
+	// appending to files of different sizes would only make them diverge
+	// further, leave them to the reconciler. The size of the file is the
+	// one of the driver read first, which holds every write if any does.
+	size := int64(-1)
+	for _, b := range d.readOrder() {
+		if fw := writers[d.index(b)]; fw != nil {
+			size = fw.Size()
+			break
+		}
+	}
+	for i, fw := range writers {
+		if fw != nil && fw.Size() != size {
+			errs[i] = errDiverged{Path: path, Size: fw.Size(), Expected: size}
+			fw.Close()
+			writers[i] = nil
+		}
+	}
+
+	if err := d.quorum(ctx, "Writer", path, errs); err != nil {
+		for _, fw := range writers {
+			if fw != nil {
+				fw.Close()
+			}
+		}
+		return nil, err
+	}
+
+	return &fileWriter{
+		driver:  d,
+		ctx:     ctx,
+		path:    path,
+		writers: writers,
+		size:    size,
+	}, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fi storagedriver.FileInfo
+	err := d.read(ctx, func(b *backend) error {
+		var err error
+		fi, err = b.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List returns a list of the objects that are direct descendants of the given
+// path, but the state of the mirror.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	var children []string
+	err := d.read(ctx, func(b *backend) error {
+		var err error
+		children, err = b.List(ctx, path)
+		return err
+	})
+
+	listed := children[:0]
+	for _, child := range children {
+		if !isState(child) {
+			listed = append(listed, child)
+		}
+	}
+	return listed, err
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	errs := d.each(func(i int, b *backend) error {
+		return b.Move(ctx, sourcePath, destPath)
+	})
+	return d.quorum(ctx, "Move", sourcePath, errs)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	errs := d.each(func(i int, b *backend) error {
+		return b.Delete(ctx, path)
+	})
+
+	// the drivers which missed the path are already up to date
+	for _, err := range errs {
+		if err != nil {
+			continue
+		}
+		for i, err := range errs {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				errs[i] = nil
+			}
+		}
+		break
+	}
+
+	return d.quorum(ctx, "Delete", path, errs)
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path from the first healthy driver in sync.
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return d.readOrder()[0].URLFor(ctx, path, options)
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file but the state of the mirror
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	var err error
+	for _, b := range d.readOrder() {
+		var fErr error
+		e := b.Walk(ctx, path, func(fileInfo storagedriver.FileInfo) error {
+			if isState(fileInfo.Path()) {
+				return storagedriver.ErrSkipDir
+			}
+			fErr = f(fileInfo)
+			return fErr
+		})
+		// f may have been called already unless the path was not found
+		if _, ok := e.(storagedriver.PathNotFoundError); !ok {
+			if e != fErr {
+				d.check(ctx, b, e)
+			}
+			return e
+		}
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// readOrder returns the healthy drivers in sync in order of preference,
+// followed by the healthy drivers which recovered but were not reconciled
+// yet, which may hold stale files, and by the failing ones.
+func (d *driver) readOrder() []*backend {
+	order := make([]*backend, 0, len(d.backends))
+	for _, b := range d.backends {
+		if b.isHealthy() && b.isSynced() {
+			order = append(order, b)
+		}
+	}
+	for _, b := range d.backends {
+		if b.isHealthy() && !b.isSynced() {
+			order = append(order, b)
+		}
+	}
+	for _, b := range d.backends {
+		if !b.isHealthy() {
+			order = append(order, b)
+		}
+	}
+	return order
+}
+
+// index returns the position of the backend in the drivers.
+func (d *driver) index(b *backend) int {
+	for i := range d.backends {
+		if d.backends[i] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+// read calls fn on the drivers in order of preference until it succeeds,
+// returning the error of the first driver otherwise. The drivers which missed
+// a write may not hold the path, so that the next ones are tried as well.
+func (d *driver) read(ctx context.Context, fn func(b *backend) error) error {
+	var err error
+	for _, b := range d.readOrder() {
+		e := fn(b)
+		if e == nil {
+			return nil
+		}
+		d.check(ctx, b, e)
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// each calls fn on every driver concurrently, returning the errors by driver.
+func (d *driver) each(fn func(i int, b *backend) error) []error {
+	errs := make([]error, len(d.backends))
+
+	var wg sync.WaitGroup
+	for i, b := range d.backends {
+		wg.Add(1)
+		go func(i int, b *backend) {
+			defer wg.Done()
+			errs[i] = fn(i, b)
+		}(i, b)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// quorum returns the error of the first failing driver unless the operation
+// succeeded on the write quorum.
+func (d *driver) quorum(ctx context.Context, op, path string, errs []error) error {
+	var succeeded int
+	var err error
+	for i, e := range errs {
+		if e == nil {
+			succeeded++
+			continue
+		}
+		d.check(ctx, d.backends[i], e)
+		if err == nil {
+			err = e
+		}
+	}
+
+	if succeeded < d.writeQuorum {
+		return err
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("mirror: %s %s succeeded on %d of %d drivers: %v", op, path, succeeded, len(d.backends), err)
+	}
+	return nil
+}
+
+// check marks the driver as failing if err is not caused by the request.
+func (d *driver) check(ctx context.Context, b *backend, err error) {
+	switch err.(type) {
+	case nil, storagedriver.PathNotFoundError, storagedriver.InvalidPathError, storagedriver.InvalidOffsetError, errDiverged:
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	if b.setHealthy(false) {
+		dcontext.GetLogger(ctx).Errorf("mirror: driver %s failing: %v", b.name, err)
+		d.saveState(ctx)
+	}
+}
+
+// checkHealth checks the drivers every interval until the driver is closed,
+// so that the failing drivers are used again once they recover.
+func (d *driver) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.checkBackends(context.Background())
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// checkBackends checks the health of the drivers. The drivers recovering are
+// written to again, but only read from once they were reconciled, after the
+// writes in progress while they recovered, which they may have missed.
+func (d *driver) checkBackends(ctx context.Context) {
+	for _, b := range d.backends {
+		_, err := b.Stat(ctx, "/") // "/" should always exist
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			err = nil // the driver is responding, but this path doesn't exist
+		}
+
+		if err != nil {
+			if b.setHealthy(false) {
+				dcontext.GetLogger(ctx).Errorf("mirror: driver %s failing: %v", b.name, err)
+				d.saveState(ctx)
+			}
+			continue
+		}
+		if !b.setHealthy(true) {
+			continue
+		}
+
+		if !d.reconciling {
+			b.setSynced(true)
+			d.saveState(ctx)
+			dcontext.GetLogger(ctx).Warnf("mirror: driver %s recovered, without reconciler to repair the writes it missed", b.name)
+			continue
+		}
+		dcontext.GetLogger(ctx).Infof("mirror: driver %s recovered, reading from it once reconciled", b.name)
+		time.AfterFunc(d.reconcileGrace, func() {
+			select {
+			case d.wake <- struct{}{}:
+			default:
+			}
+		})
+	}
+}
+
+// errDiverged is returned when appending to a file whose size differs from
+// the one in the other drivers.
+type errDiverged struct {
+	Path     string
+	Size     int64
+	Expected int64
+}
+
+func (err errDiverged) Error() string {
+	return fmt.Sprintf("mirror: size %d of %s differs from %d", err.Size, err.Path, err.Expected)
+}
+
+// fileWriter writes to the drivers concurrently, dropping the writers of the
+// failing drivers as long as the write quorum remains.
+type fileWriter struct {
+	driver  *driver
+	ctx     context.Context
+	path    string
+	writers []storagedriver.FileWriter // by driver, nil once dropped
+	size    int64
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	err := w.each("Write", func(fw storagedriver.FileWriter) error {
+		n, err := fw.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *fileWriter) Size() int64 {
+	return w.size
+}
+
+func (w *fileWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	return w.each("Close", storagedriver.FileWriter.Close)
+}
+
+func (w *fileWriter) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+
+	return w.each("Cancel", storagedriver.FileWriter.Cancel)
+}
+
+func (w *fileWriter) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.committed = true
+
+	return w.each("Commit", storagedriver.FileWriter.Commit)
+}
+
+// each calls fn on the remaining writers concurrently, dropping the failing
+// ones, and fails once fewer writers than the write quorum remain.
+func (w *fileWriter) each(op string, fn func(fw storagedriver.FileWriter) error) error {
+	errs := make([]error, len(w.writers))
+
+	var wg sync.WaitGroup
+	for i, fw := range w.writers {
+		if fw == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, fw storagedriver.FileWriter) {
+			defer wg.Done()
+			errs[i] = fn(fw)
+		}(i, fw)
+	}
+	wg.Wait()
+
+	var remaining int
+	var err error
+	for i, e := range errs {
+		if w.writers[i] == nil {
+			continue
+		}
+		if e == nil {
+			remaining++
+			continue
+		}
+
+		b := w.driver.backends[i]
+		dcontext.GetLogger(w.ctx).Warnf("mirror: %s %s failed on driver %s: %v", op, w.path, b.name, e)
+		w.driver.check(w.ctx, b, e)
+		if op != "Close" {
+			w.writers[i].Cancel()
+			w.writers[i].Close()
+		}
+		w.writers[i] = nil
+		if err == nil {
+			err = e
+		}
+	}
+
+	if remaining < w.driver.writeQuorum {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,463 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+func init() {
+	var drivers []storagedriver.StorageDriver
+	for i := 0; i < 2; i++ {
+		root, err := ioutil.TempDir("", "driver-")
+		if err != nil {
+			panic(err)
+		}
+		drivers = append(drivers, filesystem.New(filesystem.DriverParameters{
+			RootDirectory: root,
+			MaxThreads:    100,
+		}))
+	}
+
+	driver := New(DriverParameters{Drivers: drivers})
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+var errBroken = errors.New("broken")
+
+// brokenDriver fails every operation.
+type brokenDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d brokenDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	return nil, errBroken
+}
+
+func (d brokenDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return errBroken
+}
+
+func (d brokenDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return nil, errBroken
+}
+
+func (d brokenDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	return nil, errBroken
+}
+
+func (d brokenDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	return nil, errBroken
+}
+
+func (d brokenDriver) Delete(ctx context.Context, path string) error {
+	return errBroken
+}
+
+func newTestDriver(quorum int, drivers ...storagedriver.StorageDriver) *driver {
+	return New(DriverParameters{
+		Drivers:     drivers,
+		WriteQuorum: quorum,
+	}).StorageDriver.(*driver)
+}
+
+func TestFromParameters(t *testing.T) {
+	for _, tc := range []struct {
+		parameters map[string]interface{}
+		err        string
+	}{
+		{
+			parameters: map[string]interface{}{},
+			err:        "no drivers provided",
+		},
+		{
+			parameters: map[string]interface{}{
+				"drivers": []interface{}{map[interface{}]interface{}{"inmemory": nil}},
+			},
+			err: "drivers must list at least two drivers",
+		},
+		{
+			parameters: map[string]interface{}{
+				"drivers": []interface{}{
+					map[interface{}]interface{}{"inmemory": nil},
+					map[interface{}]interface{}{"unknown": nil},
+				},
+			},
+			err: "drivers[1]: StorageDriver not registered: unknown",
+		},
+		{
+			parameters: map[string]interface{}{
+				"drivers": []interface{}{
+					map[interface{}]interface{}{"inmemory": nil},
+					map[interface{}]interface{}{"inmemory": map[interface{}]interface{}{}},
+				},
+				"writequorum": 3,
+			},
+			err: "writequorum must not exceed the number of drivers, 2",
+		},
+		{
+			parameters: map[string]interface{}{
+				"drivers": []interface{}{
+					map[interface{}]interface{}{"inmemory": nil},
+					map[string]interface{}{"inmemory": map[interface{}]interface{}{}},
+				},
+				"writequorum":       1,
+				"reconcileinterval": "1h",
+			},
+		},
+	} {
+		_, err := FromParameters(tc.parameters)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		} else if err == nil || err.Error() != tc.err {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+}
+
+func TestWriteQuorum(t *testing.T) {
+	ctx := context.Background()
+	a, b := inmemory.New(), inmemory.New()
+
+	d := newTestDriver(2, a, b, brokenDriver{inmemory.New()})
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatalf("unexpected error with a quorum of 2: %v", err)
+	}
+	for _, sd := range []storagedriver.StorageDriver{a, b} {
+		if content, err := sd.GetContent(ctx, "/a"); err != nil || string(content) != "content" {
+			t.Fatalf("content not mirrored: %q, %v", content, err)
+		}
+	}
+
+	fw, err := d.Writer(ctx, "/b", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("written")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := b.GetContent(ctx, "/b"); err != nil || string(content) != "written" {
+		t.Fatalf("written content not mirrored: %q, %v", content, err)
+	}
+
+	if err := d.Delete(ctx, "/a"); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+
+	d = newTestDriver(0, inmemory.New(), brokenDriver{inmemory.New()})
+	if err := d.PutContent(ctx, "/a", []byte("content")); err != errBroken {
+		t.Fatalf("expected error without quorum, got %v", err)
+	}
+	if _, err := d.Writer(ctx, "/a", false); err != errBroken {
+		t.Fatalf("expected writer error without quorum, got %v", err)
+	}
+}
+
+func TestReadFailover(t *testing.T) {
+	ctx := context.Background()
+	a, b := inmemory.New(), inmemory.New()
+	if err := b.PutContent(ctx, "/a", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a missed the write
+	d := newTestDriver(1, a, b)
+	if content, err := d.GetContent(ctx, "/a"); err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content: %q, %v", content, err)
+	}
+	if _, err := d.Stat(ctx, "/missing"); err == nil {
+		t.Fatal("expected error reading a missing path")
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("unexpected error reading a missing path: %v", err)
+	}
+
+	d = newTestDriver(1, brokenDriver{a}, b)
+	if content, err := d.GetContent(ctx, "/a"); err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content: %q, %v", content, err)
+	}
+	if d.backends[0].isHealthy() {
+		t.Fatal("failing driver still healthy")
+	}
+	if order := d.readOrder(); order[0] != d.backends[1] {
+		t.Fatal("failing driver still read first")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	reference, mirror := inmemory.New(), inmemory.New()
+	d := newTestDriver(1, reference, mirror)
+	d.reconcileGrace = 0
+
+	put := func(sd storagedriver.StorageDriver, path, content string) {
+		if err := sd.PutContent(ctx, path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(sd storagedriver.StorageDriver, path, expected string) {
+		content, err := sd.GetContent(ctx, path)
+		if expected == "" {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				t.Fatalf("expected %s to be deleted, got %q, %v", path, content, err)
+			}
+		} else if err != nil || string(content) != expected {
+			t.Fatalf("unexpected content of %s: %q, %v", path, content, err)
+		}
+	}
+
+	put(reference, "/missed", "missed by the mirror")
+	put(reference, "/diverged", "reference")
+	put(mirror, "/diverged", "diverged mirror")
+	put(mirror, "/unknown", "not in the reference")
+	// links all have the same size
+	put(reference, "/link", "sha256:aaaa")
+	put(mirror, "/link", "sha256:bbbb")
+
+	// without knowing when the mirror was last reconciled, the reference
+	// is taken to hold every write
+	if err := d.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect(mirror, "/missed", "missed by the mirror")
+	expect(mirror, "/diverged", "reference")
+	expect(mirror, "/unknown", "")
+	expect(mirror, "/link", "sha256:aaaa")
+
+	// the mirror missed a delete, and the reference a write and a tag move,
+	// since the mirror was reconciled
+	time.Sleep(time.Millisecond)
+	if err := reference.Delete(ctx, "/missed"); err != nil {
+		t.Fatal(err)
+	}
+	put(mirror, "/written", "missed by the reference")
+	put(mirror, "/link", "sha256:cccc")
+	if err := d.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect(mirror, "/missed", "")
+	expect(reference, "/written", "missed by the reference")
+	expect(reference, "/link", "sha256:cccc")
+}
+
+// contentCountingDriver counts the reads of the content of files.
+type contentCountingDriver struct {
+	storagedriver.StorageDriver
+	reads int
+}
+
+func (d *contentCountingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.reads++
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func TestReconcileComparesModifiedFiles(t *testing.T) {
+	ctx := context.Background()
+	reference := &contentCountingDriver{StorageDriver: inmemory.New()}
+	d := newTestDriver(1, reference, inmemory.New())
+	d.reconcileGrace = 0
+	reference.reads = 0
+
+	if err := d.PutContent(ctx, "/link", []byte("sha256:aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := d.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if reference.reads != 1 {
+		t.Fatalf("unexpected reads of the new link: %d", reference.reads)
+	}
+
+	// the link was compared when the mirror was reconciled
+	if err := d.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if reference.reads != 1 {
+		t.Fatalf("unexpected reads of the reconciled link: %d", reference.reads-1)
+	}
+}
+
+func TestReconcileAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	a, b := inmemory.New(), inmemory.New()
+	d := newTestDriver(1, a, b)
+	d.reconcileGrace = 0
+	d.reconciling = true
+
+	if err := d.PutContent(ctx, "/tag", []byte("sha256:aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/deleted", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := d.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a misses a tag move and a delete, and the registry restarts
+	d.backends[0].StorageDriver = brokenDriver{a}
+	if err := d.PutContent(ctx, "/tag", []byte("sha256:bbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	d = newTestDriver(1, a, b)
+	d.reconcileGrace = 0
+	d.reconciling = true
+	if d.backends[0].isSynced() || !d.backends[1].isSynced() {
+		t.Fatal("drivers in sync not restored")
+	}
+	if order := d.readOrder(); order[0] != d.backends[1] {
+		t.Fatal("driver out of sync read first")
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := d.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := a.GetContent(ctx, "/tag"); err != nil || string(content) != "sha256:bbbb" {
+		t.Fatalf("tag move not repaired: %q, %v", content, err)
+	}
+	if content, err := b.GetContent(ctx, "/tag"); err != nil || string(content) != "sha256:bbbb" {
+		t.Fatalf("tag moved back: %q, %v", content, err)
+	}
+	for _, sd := range []storagedriver.StorageDriver{a, b} {
+		if _, err := sd.GetContent(ctx, "/deleted"); err == nil {
+			t.Fatal("deleted file restored")
+		}
+	}
+	if !d.backends[0].isSynced() {
+		t.Fatal("reconciled driver not in sync")
+	}
+}
+
+func TestReadAfterReconcile(t *testing.T) {
+	ctx := context.Background()
+	a, b := inmemory.New(), inmemory.New()
+	d := newTestDriver(1, a, b)
+	d.reconcileGrace = 0
+	d.reconciling = true
+
+	if err := d.PutContent(ctx, "/tag", []byte("sha256:aaaa")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a misses the tag move
+	d.backends[0].StorageDriver = brokenDriver{a}
+	if err := d.PutContent(ctx, "/tag", []byte("sha256:bbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if d.backends[0].isHealthy() || d.backends[0].isSynced() {
+		t.Fatal("failing driver still in sync")
+	}
+
+	d.backends[0].StorageDriver = a
+	d.checkBackends(ctx)
+	if !d.backends[0].isHealthy() {
+		t.Fatal("recovered driver still failing")
+	}
+	if order := d.readOrder(); order[0] != d.backends[1] {
+		t.Fatal("recovered driver read before it was reconciled")
+	}
+	if content, err := d.GetContent(ctx, "/tag"); err != nil || string(content) != "sha256:bbbb" {
+		t.Fatalf("unexpected content: %q, %v", content, err)
+	}
+
+	if err := d.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !d.backends[0].isSynced() {
+		t.Fatal("reconciled driver not in sync")
+	}
+	if order := d.readOrder(); order[0] != d.backends[0] {
+		t.Fatal("reconciled driver not read first")
+	}
+	if content, err := a.GetContent(ctx, "/tag"); err != nil || string(content) != "sha256:bbbb" {
+		t.Fatalf("tag move not repaired: %q, %v", content, err)
+	}
+}
+
+func TestWriterAfterRecovery(t *testing.T) {
+	ctx := context.Background()
+	a, b := inmemory.New(), inmemory.New()
+	d := newTestDriver(1, a, b)
+	d.reconciling = true
+
+	write := func(append bool, content string) {
+		fw, err := d.Writer(ctx, "/upload", append)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(false, "ab")
+
+	// a misses a chunk of the upload
+	d.backends[0].StorageDriver = brokenDriver{a}
+	write(true, "cd")
+
+	// the recovered driver, not reconciled yet, is left out
+	d.backends[0].StorageDriver = a
+	d.checkBackends(ctx)
+	fw, err := d.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	if fw.Size() != 4 {
+		t.Fatalf("unexpected size of the upload: %d", fw.Size())
+	}
+	if _, err := fw.Write([]byte("ef")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := a.GetContent(ctx, "/upload"); err != nil || string(content) != "ab" {
+		t.Fatalf("unexpected content of the recovered driver: %q, %v", content, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	driver := New(DriverParameters{
+		Drivers:           []storagedriver.StorageDriver{inmemory.New(), inmemory.New()},
+		ReconcileInterval: time.Hour,
+	})
+	for i := 0; i < 2; i++ {
+		if err := driver.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-driver.driver.done:
+	default:
+		t.Fatal("driver not closed")
+	}
+}
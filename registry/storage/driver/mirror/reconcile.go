@@ -0,0 +1,269 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// maxCompareSize is the size up to which the content of the files is
+// compared, such as the links, which all have the same size. Larger files,
+// such as the blobs, are compared by modification time, as their content is
+// not rewritten.
+const maxCompareSize = 1 << 20
+
+// modTimeTolerance is the difference of modification time tolerated between
+// drivers holding the same file, whose clocks may drift.
+const modTimeTolerance = time.Minute
+
+// reconcileEvery reconciles the drivers every interval, and once the
+// recovered drivers may be reconciled, until the driver is closed.
+func (d *driver) reconcileEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		case <-d.done:
+			return
+		}
+
+		ctx := context.Background()
+		if err := d.reconcile(ctx); err != nil {
+			dcontext.GetLogger(ctx).Errorf("mirror: reconciliation failed: %v", err)
+		}
+	}
+}
+
+// reconcile repairs the files of the healthy drivers diverging from the
+// reference driver, the first healthy one in sync, by walking both. The
+// drivers which recovered before the files were walked are read from once
+// they are reconciled without error.
+//
+// The files of the reference missing in a driver are copied to the driver.
+// The files of a driver missing in the reference are either writes the
+// reference missed, copied to the reference, or deletes the driver missed,
+// deleted from the driver. Files modified since the driver was last
+// reconciled, other than by the reconciler, are taken for missed writes, the
+// other ones for missed deletes, as are all of them until the driver was
+// reconciled once. Files differing between both are copied from the driver
+// to the reference if the driver's is a missed write, more recent than the
+// reference's, and from the reference to the driver otherwise.
+//
+// How far each driver was reconciled, and whether it is in sync, is saved in
+// the drivers once it is reconciled.
+func (d *driver) reconcile(ctx context.Context) error {
+	d.reconcileMu.Lock()
+	defer d.reconcileMu.Unlock()
+
+	order := d.readOrder()
+	reference := order[0]
+	if !reference.isHealthy() {
+		return fmt.Errorf("no healthy driver")
+	}
+	if reference.setSynced(true) {
+		// every driver failed: the first to recover is as good as any
+		dcontext.GetLogger(ctx).Warnf("mirror: no driver in sync, reconciling with %s", reference.name)
+		d.saveState(ctx)
+	}
+
+	// files modified past the cutoff may still be written to
+	cutoff := time.Now().Add(-d.reconcileGrace)
+
+	for _, b := range order[1:] {
+		if !b.isHealthy() {
+			dcontext.GetLogger(ctx).Warnf("mirror: not reconciling failing driver %s", b.name)
+			continue
+		}
+
+		// missedWrite reports whether the file of the driver modified at
+		// modTime was written since it was last reconciled, other than by
+		// the reconciler
+		missedWrite := func(path string, modTime time.Time) bool {
+			if copiedAt, ok := b.copied[path]; ok && !modTime.After(copiedAt) {
+				return false
+			}
+			return !b.reconciled.IsZero() && modTime.After(b.reconciled)
+		}
+
+		copied := make(map[string]time.Time)
+		var repaired, failed int
+		repair := func(err error) {
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("mirror: reconciliation error: %v", err)
+				failed++
+			} else {
+				repaired++
+			}
+		}
+
+		err := walkFiles(ctx, reference, func(fi storagedriver.FileInfo) {
+			if fi.ModTime().After(cutoff) {
+				return
+			}
+			path := fi.Path()
+			other, err := b.Stat(ctx, path)
+			switch err.(type) {
+			case nil:
+				if other.ModTime().After(cutoff) {
+					return
+				}
+				same, err := sameFile(ctx, reference, b, fi, other)
+				if err != nil {
+					repair(err)
+					return
+				}
+				if same {
+					return
+				}
+				if other.ModTime().After(fi.ModTime()) && missedWrite(path, other.ModTime()) {
+					repair(copyFile(ctx, b, reference, path))
+					return
+				}
+			case storagedriver.PathNotFoundError:
+			default:
+				repair(fmt.Errorf("checking %s in %s: %v", path, b.name, err))
+				return
+			}
+
+			err = copyFile(ctx, reference, b, path)
+			if err == nil {
+				var copy storagedriver.FileInfo
+				if copy, err = b.Stat(ctx, path); err == nil {
+					copied[path] = copy.ModTime()
+				}
+			}
+			repair(err)
+		})
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("mirror: error walking %s: %v", reference.name, err)
+			continue
+		}
+
+		err = walkFiles(ctx, b, func(fi storagedriver.FileInfo) {
+			if fi.ModTime().After(cutoff) {
+				return
+			}
+			path := fi.Path()
+			_, err := reference.Stat(ctx, path)
+			switch err.(type) {
+			case nil:
+				return
+			case storagedriver.PathNotFoundError:
+			default:
+				repair(fmt.Errorf("checking %s in %s: %v", path, reference.name, err))
+				return
+			}
+
+			if missedWrite(path, fi.ModTime()) {
+				repair(copyFile(ctx, b, reference, path))
+			} else {
+				repair(b.Delete(ctx, path))
+			}
+		})
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("mirror: error walking %s: %v", b.name, err)
+			continue
+		}
+
+		d.stateMu.Lock()
+		if failed == 0 {
+			b.reconciled = cutoff
+			b.copied = copied
+		} else {
+			for path, modTime := range copied {
+				if b.copied == nil {
+					b.copied = make(map[string]time.Time)
+				}
+				b.copied[path] = modTime
+			}
+		}
+		d.stateMu.Unlock()
+		dcontext.GetLogger(ctx).Infof("mirror: reconciled %s with %s: %d files repaired, %d failed", b.name, reference.name, repaired, failed)
+
+		// the writes it missed while recovering may only be repaired by the
+		// next reconciliation
+		if failed == 0 && !b.recoveredAt().After(cutoff) && b.setSynced(true) {
+			dcontext.GetLogger(ctx).Infof("mirror: driver %s in sync, reading from it", b.name)
+		}
+		d.saveState(ctx)
+	}
+
+	return nil
+}
+
+// walkFiles calls f with each file of the driver as it is walked, but the
+// state of the mirror.
+func walkFiles(ctx context.Context, b *backend, f func(storagedriver.FileInfo)) error {
+	err := b.Walk(ctx, "/", func(fileInfo storagedriver.FileInfo) error {
+		if isState(fileInfo.Path()) {
+			return storagedriver.ErrSkipDir
+		}
+		if !fileInfo.IsDir() {
+			f(fileInfo)
+		}
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		err = nil
+	}
+	return err
+}
+
+// sameFile returns whether the file of the reference, fi, and the file of the
+// driver b at the same path, other, hold the same content. The content of
+// small files is only read if either was modified since b was last
+// reconciled, as they were compared then otherwise.
+func sameFile(ctx context.Context, reference, b *backend, fi, other storagedriver.FileInfo) (bool, error) {
+	if fi.Size() != other.Size() {
+		return false, nil
+	}
+	if fi.Size() > maxCompareSize {
+		// a file copied to b is more recent than the reference's
+		return !fi.ModTime().After(other.ModTime().Add(modTimeTolerance)), nil
+	}
+	if !b.reconciled.IsZero() && !fi.ModTime().After(b.reconciled) && !other.ModTime().After(b.reconciled) {
+		return true, nil
+	}
+
+	expected, err := reference.GetContent(ctx, fi.Path())
+	if err != nil {
+		return false, fmt.Errorf("reading %s from %s: %v", fi.Path(), reference.name, err)
+	}
+	actual, err := b.GetContent(ctx, fi.Path())
+	if err != nil {
+		return false, fmt.Errorf("reading %s from %s: %v", fi.Path(), b.name, err)
+	}
+	return bytes.Equal(expected, actual), nil
+}
+
+// copyFile copies the file at path from one driver to another.
+func copyFile(ctx context.Context, from, to *backend, path string) error {
+	rc, err := from.Reader(ctx, path, 0)
+	if err != nil {
+		return fmt.Errorf("reading %s from %s: %v", path, from.name, err)
+	}
+	defer rc.Close()
+
+	fw, err := to.Writer(ctx, path, false)
+	if err != nil {
+		return fmt.Errorf("writing %s to %s: %v", path, to.name, err)
+	}
+	if _, err := io.Copy(fw, rc); err != nil {
+		fw.Cancel()
+		fw.Close()
+		return fmt.Errorf("copying %s from %s to %s: %v", path, from.name, to.name, err)
+	}
+	if err := fw.Commit(); err != nil {
+		fw.Close()
+		return fmt.Errorf("writing %s to %s: %v", path, to.name, err)
+	}
+	return fw.Close()
+}
@@ -0,0 +1,115 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	dcontext "github.com/docker/distribution/context"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// stateRoot holds the state of the mirror in every backing driver, outside
+// of the content it mirrors.
+const stateRoot = "/_mirror"
+
+// statePath is the file holding the state of the mirror.
+const statePath = stateRoot + "/state"
+
+// mirrorState is the state of the drivers which must survive a restart: the
+// drivers out of sync must not be read first, and the files they hold which
+// the reference lacks may only be taken for missed writes since they were
+// last reconciled.
+type mirrorState struct {
+	// Updated orders the copies of the state held by the drivers, some of
+	// which may have missed the last updates.
+	Updated time.Time `json:"updated"`
+	// Drivers is the state of each driver, by name.
+	Drivers map[string]driverState `json:"drivers"`
+}
+
+// driverState is the persisted state of a backend.
+type driverState struct {
+	Synced     bool                 `json:"synced"`
+	Reconciled time.Time            `json:"reconciled,omitempty"`
+	Copied     map[string]time.Time `json:"copied,omitempty"`
+}
+
+// loadState restores the state of the backends from the most recent copy
+// held by the drivers. Without any, the drivers are all taken to be in sync.
+// A driver whose copy cannot be read is failing, and out of sync, until its
+// next successful health check.
+func (d *driver) loadState(ctx context.Context) {
+	var state *mirrorState
+	for _, b := range d.backends {
+		content, err := b.GetContent(ctx, statePath)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				dcontext.GetLogger(ctx).Errorf("mirror: driver %s failing: error reading its state: %v", b.name, err)
+				b.healthy = 0
+				b.synced = 0
+			}
+			continue
+		}
+
+		var s mirrorState
+		if err := json.Unmarshal(content, &s); err != nil {
+			dcontext.GetLogger(ctx).Errorf("mirror: ignoring invalid state of driver %s: %v", b.name, err)
+			continue
+		}
+		if state == nil || s.Updated.After(state.Updated) {
+			state = &s
+		}
+	}
+	if state == nil {
+		return
+	}
+
+	for _, b := range d.backends {
+		// drivers added since are empty until reconciled
+		s := state.Drivers[b.name]
+		if !s.Synced {
+			b.synced = 0
+		}
+		b.reconciled = s.Reconciled
+		b.copied = s.Copied
+	}
+}
+
+// saveState writes the state of the backends to the healthy drivers.
+func (d *driver) saveState(ctx context.Context) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	state := mirrorState{
+		Updated: time.Now(),
+		Drivers: make(map[string]driverState, len(d.backends)),
+	}
+	for _, b := range d.backends {
+		state.Drivers[b.name] = driverState{
+			Synced:     b.isSynced(),
+			Reconciled: b.reconciled,
+			Copied:     b.copied,
+		}
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("mirror: error encoding the state: %v", err)
+		return
+	}
+	for _, b := range d.backends {
+		if !b.isHealthy() {
+			continue
+		}
+		if err := b.PutContent(ctx, statePath, content); err != nil {
+			dcontext.GetLogger(ctx).Errorf("mirror: error writing the state to %s: %v", b.name, err)
+		}
+	}
+}
+
+// isState reports whether path holds the state of the mirror.
+func isState(path string) bool {
+	return path == stateRoot || strings.HasPrefix(path, stateRoot+"/")
+}
@@ -55,6 +55,8 @@ type DriverParameters struct {
 	RootDirectory   string
 	Endpoint        string
 	EncryptionKeyID string
+	// AdaptiveConcurrency regulates the concurrent calls to OSS when set.
+	AdaptiveConcurrency *base.AdaptiveRegulatorParameters
 }
 
 func init() {
@@ -181,6 +183,11 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		endpoint = ""
 	}
 
+	adaptiveConcurrency, err := base.GetAdaptiveRegulatorParameters(parameters["adaptiveconcurrency"])
+	if err != nil {
+		return nil, fmt.Errorf("adaptiveconcurrency config error: %v", err)
+	}
+
 	params := DriverParameters{
 		AccessKeyID:     fmt.Sprint(accessKey),
 		AccessKeySecret: fmt.Sprint(secretKey),
@@ -193,6 +200,8 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		Internal:        internalBool,
 		Endpoint:        fmt.Sprint(endpoint),
 		EncryptionKeyID: fmt.Sprint(encryptionKeyID),
+
+		AdaptiveConcurrency: adaptiveConcurrency,
 	}
 
 	return New(params)
@@ -225,10 +234,15 @@ func New(params DriverParameters) (*Driver, error) {
 		EncryptionKeyID: params.EncryptionKeyID,
 	}
 
+	var sd storagedriver.StorageDriver = d
+	if params.AdaptiveConcurrency != nil {
+		sd = base.NewAdaptiveRegulator(d, *params.AdaptiveConcurrency, isThrottled)
+	}
+
 	return &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
-				StorageDriver: d,
+				StorageDriver: sd,
 			},
 		},
 	}, nil
@@ -498,6 +512,13 @@ func (d *driver) ossPath(path string) string {
 	return strings.TrimLeft(strings.TrimRight(d.RootDirectory, "/")+path, "/")
 }
 
+// isThrottled reports whether OSS rejected a call for exceeding the request
+// rate, with an HTTP 503 or 429 response.
+func isThrottled(err error) bool {
+	ossErr, ok := err.(*oss.Error)
+	return ok && (ossErr.StatusCode == http.StatusServiceUnavailable || ossErr.StatusCode == http.StatusTooManyRequests)
+}
+
 func parseError(path string, err error) error {
 	if ossErr, ok := err.(*oss.Error); ok && ossErr.StatusCode == http.StatusNotFound && (ossErr.Code == "NoSuchKey" || ossErr.Code == "") {
 		return storagedriver.PathNotFoundError{Path: path}
@@ -103,6 +103,7 @@ type DriverParameters struct {
 	UserAgent                   string
 	ObjectACL                   string
 	SessionToken                string
+	AdaptiveConcurrency         *base.AdaptiveRegulatorParameters
 }
 
 func init() {
@@ -159,6 +160,7 @@ type baseEmbed struct {
 // Objects are stored at absolute keys in the provided bucket.
 type Driver struct {
 	baseEmbed
+	driver *driver
 }
 
 // FromParameters constructs a new Driver with a given parameters map
@@ -341,6 +343,11 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 
 	sessionToken := ""
 
+	adaptiveConcurrency, err := base.GetAdaptiveRegulatorParameters(parameters["adaptiveconcurrency"])
+	if err != nil {
+		return nil, fmt.Errorf("adaptiveconcurrency config error: %v", err)
+	}
+
 	params := DriverParameters{
 		fmt.Sprint(accessKey),
 		fmt.Sprint(secretKey),
@@ -361,6 +368,7 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		fmt.Sprint(userAgent),
 		objectACL,
 		fmt.Sprint(sessionToken),
+		adaptiveConcurrency,
 	}
 
 	return New(params)
@@ -489,12 +497,18 @@ func New(params DriverParameters) (*Driver, error) {
 		ObjectACL:                   params.ObjectACL,
 	}
 
+	var sd storagedriver.StorageDriver = d
+	if params.AdaptiveConcurrency != nil {
+		sd = base.NewAdaptiveRegulator(d, *params.AdaptiveConcurrency, isThrottled)
+	}
+
 	return &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
-				StorageDriver: d,
+				StorageDriver: sd,
 			},
 		},
+		driver: d,
 	}, nil
 }
 
@@ -1038,7 +1052,22 @@ func (d *driver) s3Path(path string) string {
 
 // S3BucketKey returns the s3 bucket key for the given storage driver path.
 func (d *Driver) S3BucketKey(path string) string {
-	return d.StorageDriver.(*driver).s3Path(path)
+	return d.driver.s3Path(path)
+}
+
+// isThrottled reports whether S3 rejected a call for exceeding the request
+// rate, with a SlowDown error or an HTTP 503 or 429 response.
+func isThrottled(err error) bool {
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	if s3Err, ok := err.(awserr.RequestFailure); ok {
+		return s3Err.Code() == "SlowDown" || s3Err.StatusCode() == http.StatusServiceUnavailable || s3Err.StatusCode() == http.StatusTooManyRequests
+	}
+	if s3Err, ok := err.(awserr.Error); ok {
+		return s3Err.Code() == "SlowDown"
+	}
+	return false
 }
 
 func parseError(path string, err error) error {
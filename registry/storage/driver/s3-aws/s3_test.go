@@ -96,6 +96,7 @@ func init() {
 			driverName + "-test",
 			objectACL,
 			sessionToken,
+			nil,
 		}
 
 		return New(parameters)
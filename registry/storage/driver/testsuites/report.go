@@ -0,0 +1,122 @@
+package testsuites
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Report is the outcome of a run of the test suite against a driver.
+type Report struct {
+	// Driver is the name of the driver under test.
+	Driver   string        `json:"driver"`
+	Tests    int           `json:"tests"`
+	Failures int           `json:"failures"`
+	Skipped  int           `json:"skipped"`
+	Duration time.Duration `json:"duration"`
+	Results  []TestResult  `json:"results"`
+}
+
+// NewReport summarizes the results of a run against the named driver.
+func NewReport(driver string, results []TestResult) *Report {
+	report := &Report{
+		Driver:  driver,
+		Tests:   len(results),
+		Results: results,
+	}
+	for _, result := range results {
+		switch result.Status {
+		case StatusFailed:
+			report.Failures++
+		case StatusSkipped:
+			report.Skipped++
+		}
+		report.Duration += result.Duration
+	}
+	return report
+}
+
+// Passed reports whether no test failed.
+func (r *Report) Passed() bool {
+	return r.Failures == 0
+}
+
+// WriteJSON writes the report as JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report in the JUnit XML format understood by most
+// CI systems.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suite := junitTestSuite{
+		Name:     "storagedriver." + r.Driver,
+		Tests:    r.Tests,
+		Failures: r.Failures,
+		Skipped:  r.Skipped,
+		Time:     junitTime(r.Duration),
+	}
+	for _, result := range r.Results {
+		testCase := junitTestCase{
+			ClassName: suite.Name,
+			Name:      result.Name,
+			Time:      junitTime(result.Duration),
+		}
+		switch result.Status {
+		case StatusFailed:
+			testCase.Failure = &junitMessage{Message: "failed", Contents: result.Output}
+		case StatusSkipped:
+			testCase.Skipped = &junitMessage{Message: "skipped", Contents: result.Output}
+		default:
+			testCase.SystemOut = result.Output
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,104 @@
+package testsuites
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+// Test statuses reported by Run.
+const (
+	StatusPassed  = "passed"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// RunOptions configures a run of the test suite outside of go test.
+type RunOptions struct {
+	// Filter is a regular expression selecting the tests to run by name,
+	// all of them if empty.
+	Filter string
+	// Short skips or shortens the long running tests, such as the ones
+	// writing files of several gigabytes.
+	Short bool
+}
+
+// TestResult is the outcome of a test of the suite.
+type TestResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	// Output is the log of the test, explaining failures and skips.
+	Output string `json:"output,omitempty"`
+}
+
+// Tests returns the names of the tests of the suite.
+func Tests() []string {
+	var names []string
+	suiteType := reflect.TypeOf(&DriverSuite{})
+	for i := 0; i < suiteType.NumMethod(); i++ {
+		if name := suiteType.Method(i).Name; strings.HasPrefix(name, "Test") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Run runs the test suite against the drivers returned by driverConstructor
+// outside of go test, such as to validate drivers built out of tree. Each
+// test runs against a new driver, which must start empty.
+func Run(driverConstructor DriverConstructor, opts RunOptions) ([]TestResult, error) {
+	var filter *regexp.Regexp
+	if opts.Filter != "" {
+		var err error
+		if filter, err = regexp.Compile(opts.Filter); err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+	}
+
+	var results []TestResult
+	for _, name := range Tests() {
+		if filter != nil && !filter.MatchString(name) {
+			continue
+		}
+
+		suite := &DriverSuite{
+			Constructor: driverConstructor,
+			SkipCheck:   NeverSkip,
+			ctx:         context.Background(),
+			short:       func() bool { return opts.Short },
+		}
+
+		var output bytes.Buffer
+		start := time.Now()
+		result := check.Run(suite, &check.RunConf{
+			Output:  &output,
+			Verbose: true,
+			Filter:  "^DriverSuite\\." + name + "$",
+		})
+		if result.RunError != nil {
+			return results, result.RunError
+		}
+
+		status := StatusPassed
+		switch {
+		case !result.Passed():
+			status = StatusFailed
+		case result.Skipped > 0:
+			status = StatusSkipped
+		}
+		results = append(results, TestResult{
+			Name:     name,
+			Status:   status,
+			Duration: time.Since(start),
+			Output:   output.String(),
+		})
+	}
+	return results, nil
+}
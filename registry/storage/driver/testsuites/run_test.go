@@ -0,0 +1,97 @@
+package testsuites
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+// leakyDriver leaves the files it writes behind, failing the tests.
+type leakyDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d leakyDriver) Delete(ctx context.Context, path string) error {
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	results, err := Run(func() (storagedriver.StorageDriver, error) {
+		return inmemory.New(), nil
+	}, RunOptions{Filter: "^TestWalk|^TestWriteReadLargeStreams$", Short: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := make(map[string]string)
+	for _, result := range results {
+		statuses[result.Name] = result.Status
+	}
+	expected := map[string]string{
+		"TestWalk":                  StatusPassed,
+		"TestWalkError":             StatusPassed,
+		"TestWalkNonexistent":       StatusPassed,
+		"TestWalkSkipDir":           StatusPassed,
+		"TestWriteReadLargeStreams": StatusSkipped,
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("unexpected tests run: %v", statuses)
+	}
+	for name, status := range expected {
+		if statuses[name] != status {
+			t.Errorf("unexpected status of %s: %q != %q", name, statuses[name], status)
+		}
+	}
+
+	if _, err := Run(nil, RunOptions{Filter: "("}); err == nil {
+		t.Fatal("expected an error with an invalid filter")
+	}
+}
+
+func TestReport(t *testing.T) {
+	results, err := Run(func() (storagedriver.StorageDriver, error) {
+		return leakyDriver{inmemory.New()}, nil
+	}, RunOptions{Filter: "^TestRootExists$|^TestWriteRead1$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := NewReport("inmemory", results)
+	if report.Tests != 2 || report.Failures != 1 || report.Passed() {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteJUnit(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("invalid JUnit report: %v", err)
+	}
+	if len(suites.Suites) != 1 || len(suites.Suites[0].Cases) != 2 || suites.Suites[0].Failures != 1 {
+		t.Fatalf("unexpected JUnit report: %s", buf.String())
+	}
+	for _, testCase := range suites.Suites[0].Cases {
+		if failed := testCase.Failure != nil; failed != (testCase.Name == "TestWriteRead1") {
+			t.Errorf("unexpected outcome of %s: %s", testCase.Name, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := report.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON report: %v", err)
+	}
+	if decoded.Driver != "inmemory" || decoded.Failures != 1 || len(decoded.Results) != 2 {
+		t.Fatalf("unexpected JSON report: %s", buf.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -58,6 +59,10 @@ type DriverSuite struct {
 	SkipCheck
 	storagedriver.StorageDriver
 	ctx context.Context
+
+	// short reports whether to skip or shorten the long running tests,
+	// defaulting to the -short flag of go test.
+	short func() bool
 }
 
 // SetUpSuite sets up the gocheck test suite.
@@ -78,6 +83,14 @@ func (suite *DriverSuite) TearDownSuite(c *check.C) {
 	}
 }
 
+// isShort reports whether to skip or shorten the long running tests.
+func (suite *DriverSuite) isShort() bool {
+	if suite.short == nil {
+		return testing.Short()
+	}
+	return suite.short()
+}
+
 // TearDownTest tears down the gocheck test.
 // This causes the suite to abort if any files are left around in the storage
 // driver.
@@ -271,7 +284,7 @@ func (suite *DriverSuite) TestWriteReadStreamsNonUTF8(c *check.C) {
 // TestWriteReadLargeStreams tests that a 5GB file may be written to the storage
 // driver safely.
 func (suite *DriverSuite) TestWriteReadLargeStreams(c *check.C) {
-	if testing.Short() {
+	if suite.isShort() {
 		c.Skip("Skipping test in short mode")
 	}
 
@@ -508,6 +521,114 @@ func (suite *DriverSuite) TestList(c *check.C) {
 	// 3. Ensure that we only respond to directory listings that end with a slash (maybe?).
 }
 
+// TestWalk checks that Walk visits every file and directory of a tree once,
+// with the same information as Stat.
+func (suite *DriverSuite) TestWalk(c *check.C) {
+	rootDirectory := "/" + randomFilename(int64(8+rand.Intn(8)))
+	defer suite.deletePath(c, rootDirectory)
+
+	expected := suite.buildTree(c, rootDirectory)
+
+	visited := make(map[string]storagedriver.FileInfo)
+	err := suite.StorageDriver.Walk(suite.ctx, rootDirectory, func(fileInfo storagedriver.FileInfo) error {
+		_, seen := visited[fileInfo.Path()]
+		c.Assert(seen, check.Equals, false, check.Commentf("%s visited twice", fileInfo.Path()))
+		visited[fileInfo.Path()] = fileInfo
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(visited), check.Equals, len(expected))
+
+	for p, isDir := range expected {
+		fileInfo, ok := visited[p]
+		c.Assert(ok, check.Equals, true, check.Commentf("%s not visited", p))
+		c.Assert(fileInfo.IsDir(), check.Equals, isDir, check.Commentf("%s", p))
+
+		stat, err := suite.StorageDriver.Stat(suite.ctx, p)
+		c.Assert(err, check.IsNil)
+		if !isDir {
+			c.Assert(fileInfo.Size(), check.Equals, stat.Size(), check.Commentf("%s", p))
+		}
+	}
+}
+
+// TestWalkSkipDir checks that Walk does not enter a directory for which the
+// walk function returns ErrSkipDir, and goes on with the rest of the tree.
+func (suite *DriverSuite) TestWalkSkipDir(c *check.C) {
+	rootDirectory := "/" + randomFilename(int64(8+rand.Intn(8)))
+	defer suite.deletePath(c, rootDirectory)
+
+	expected := suite.buildTree(c, rootDirectory)
+	skipped := path.Join(rootDirectory, "a")
+
+	visited := make(map[string]bool)
+	err := suite.StorageDriver.Walk(suite.ctx, rootDirectory, func(fileInfo storagedriver.FileInfo) error {
+		visited[fileInfo.Path()] = true
+		if fileInfo.Path() == skipped {
+			return storagedriver.ErrSkipDir
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+
+	for p := range expected {
+		inSkipped := strings.HasPrefix(p, skipped+"/")
+		c.Assert(visited[p], check.Equals, !inSkipped, check.Commentf("%s", p))
+	}
+}
+
+// TestWalkError checks that Walk stops with the error returned by the walk
+// function.
+func (suite *DriverSuite) TestWalkError(c *check.C) {
+	rootDirectory := "/" + randomFilename(int64(8+rand.Intn(8)))
+	defer suite.deletePath(c, rootDirectory)
+
+	suite.buildTree(c, rootDirectory)
+
+	errStop := errors.New("stop walking")
+	var visits int
+	err := suite.StorageDriver.Walk(suite.ctx, rootDirectory, func(fileInfo storagedriver.FileInfo) error {
+		visits++
+		return errStop
+	})
+	// drivers may wrap the error
+	c.Assert(err, check.ErrorMatches, ".*stop walking")
+	c.Assert(visits, check.Equals, 1)
+}
+
+// TestWalkNonexistent checks that walking a nonexistent path returns a
+// PathNotFoundError.
+func (suite *DriverSuite) TestWalkNonexistent(c *check.C) {
+	filename := randomPath(32)
+	err := suite.StorageDriver.Walk(suite.ctx, filename, func(fileInfo storagedriver.FileInfo) error {
+		c.Errorf("unexpected visit of %s", fileInfo.Path())
+		return nil
+	})
+	c.Assert(err, check.NotNil)
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
+// buildTree populates a small tree of files under root, returning whether
+// each of its paths is a directory.
+func (suite *DriverSuite) buildTree(c *check.C, root string) map[string]bool {
+	tree := map[string]bool{
+		path.Join(root, "a"):           true,
+		path.Join(root, "a", "b"):      true,
+		path.Join(root, "a", "b", "1"): false,
+		path.Join(root, "a", "2"):      false,
+		path.Join(root, "c"):           true,
+		path.Join(root, "c", "3"):      false,
+		path.Join(root, "4"):           false,
+	}
+	for p, isDir := range tree {
+		if !isDir {
+			err := suite.StorageDriver.PutContent(suite.ctx, p, randomContents(int64(1+rand.Intn(64))))
+			c.Assert(err, check.IsNil)
+		}
+	}
+	return tree
+}
+
 // TestMove checks that a moved object no longer exists at the source path and
 // does exist at the destination.
 func (suite *DriverSuite) TestMove(c *check.C) {
@@ -851,7 +972,7 @@ func (suite *DriverSuite) TestPutContentMultipleTimes(c *check.C) {
 func (suite *DriverSuite) TestConcurrentStreamReads(c *check.C) {
 	var filesize int64 = 128 * 1024 * 1024
 
-	if testing.Short() {
+	if suite.isShort() {
 		filesize = 10 * 1024 * 1024
 		c.Log("Reducing file size to 10MB for short mode")
 	}
@@ -889,7 +1010,7 @@ func (suite *DriverSuite) TestConcurrentStreamReads(c *check.C) {
 func (suite *DriverSuite) TestConcurrentFileStreams(c *check.C) {
 	numStreams := 32
 
-	if testing.Short() {
+	if suite.isShort() {
 		numStreams = 8
 		c.Log("Reducing number of streams to 8 for short mode")
 	}
@@ -913,7 +1034,7 @@ func (suite *DriverSuite) TestConcurrentFileStreams(c *check.C) {
 // TestEventualConsistency checks that if stat says that a file is a certain size, then
 // you can freely read from the file (this is the only guarantee that the driver needs to provide)
 // func (suite *DriverSuite) TestEventualConsistency(c *check.C) {
-// 	if testing.Short() {
+// 	if suite.isShort() {
 // 		c.Skip("Skipping test in short mode")
 // 	}
 //
@@ -3,6 +3,8 @@ package storage
 import (
 	"context"
 	"fmt"
+	"path"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
@@ -18,6 +20,46 @@ func emit(format string, a ...interface{}) {
 type GCOpts struct {
 	DryRun         bool
 	RemoveUntagged bool
+
+	// GracePeriod protects blobs whose data or repository link was written
+	// within this duration from being swept. It allows collection to run
+	// while the registry accepts pushes: uploaded layers are not referenced
+	// by a manifest until the manifest itself has been pushed.
+	GracePeriod time.Duration
+
+	// Quiet suppresses the progress output written to stdout.
+	Quiet bool
+
+	// CheckpointFile is a local file to which the progress of the mark
+	// phase is saved periodically and when marking fails. It is removed
+	// once the collection completes.
+	CheckpointFile string
+
+	// Resume continues an interrupted collection from CheckpointFile,
+	// skipping the repositories it has already marked. The registry must
+	// not have been written to since the checkpoint was saved.
+	Resume bool
+
+	// MarkSetCapacity, if non-zero, bounds the memory of the set of marked
+	// blobs with a bloom filter sized for this many referenced blobs. The
+	// filter has a false positive rate of 1%, so a small fraction of
+	// unreferenced blobs may be retained. Only the mark set is bounded: the
+	// repositories marked, the untagged manifests to delete and the blobs to
+	// sweep are still held in memory, and grow with the registry.
+	MarkSetCapacity int
+}
+
+// gcTrackingNamespace is implemented by namespaces which can protect content
+// linked while a collection is running, allowing it to run online.
+type gcTrackingNamespace interface {
+	gcTracker() *gcTracker
+	clearDescriptorCache(ctx context.Context, dgst digest.Digest) error
+}
+
+// quotaAccountingNamespace is implemented by namespaces which account the
+// storage consumed by repositories, which is released as content is swept.
+type quotaAccountingNamespace interface {
+	quotas() *quotaAccountant
 }
 
 // ManifestDel contains manifest structure which will be deleted
@@ -27,19 +69,56 @@ type ManifestDel struct {
 	Tags   []string
 }
 
-// MarkAndSweep performs a mark and sweep of registry data
+// MarkAndSweep performs a mark and sweep of registry data, stopping between
+// repositories, manifests and blobs once the context is done.
 func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
 	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
 	if !ok {
 		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
 	}
 
+	emit := emit // shadowed so that output can be suppressed
+	if opts.Quiet {
+		emit = func(string, ...interface{}) {}
+	}
+
+	tracking, _ := registry.(gcTrackingNamespace)
+	tracker := &gcTracker{}
+	if tracking != nil {
+		tracker = tracking.gcTracker()
+	}
+	if err := tracker.begin(); err != nil {
+		return err
+	}
+	defer tracker.end()
+
+	var cutoff time.Time
+	if opts.GracePeriod > 0 {
+		cutoff = time.Now().Add(-opts.GracePeriod)
+	}
+
+	progress, err := newGCProgress(opts)
+	if err != nil {
+		return err
+	}
+	markSet := progress.marked
+
 	// mark
-	markSet := make(map[digest.Digest]struct{})
-	manifestArr := make([]ManifestDel, 0)
-	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+	err = repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if progress.markComplete || progress.isVisited(repoName) {
+			return nil
+		}
 		emit(repoName)
 
+		if !cutoff.IsZero() {
+			if err := markRecentLayers(ctx, storageDriver, repoName, cutoff, markSet); err != nil {
+				return fmt.Errorf("failed to mark recently linked layers for %s: %v", repoName, err)
+			}
+		}
+
 		var err error
 		named, err := reference.WithName(repoName)
 		if err != nil {
@@ -60,6 +139,10 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
 		}
 
+		// only record the manifests of completely marked repositories, so
+		// that a resumed collection does not record them twice
+		var repoManifests []ManifestDel
+
 		err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
 			if opts.RemoveUntagged {
 				// fetch all tags where this manifest is the latest one
@@ -76,13 +159,13 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 					if err != nil {
 						return fmt.Errorf("failed to retrieve tags %v", err)
 					}
-					manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
+					repoManifests = append(repoManifests, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
 					return nil
 				}
 			}
 			// Mark the manifest's blob
 			emit("%s: marking manifest %s ", repoName, dgst)
-			markSet[dgst] = struct{}{}
+			markSet.add(dgst)
 
 			manifest, err := manifestService.Get(ctx, dgst)
 			if err != nil {
@@ -91,7 +174,7 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 
 			descriptors := manifest.References()
 			for _, descriptor := range descriptors {
-				markSet[descriptor.Digest] = struct{}{}
+				markSet.add(descriptor.Digest)
 				emit("%s: marking blob %s", repoName, descriptor.Digest)
 			}
 
@@ -104,21 +187,49 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 		//
 		// In these cases we can continue marking other manifests safely.
 		if _, ok := err.(driver.PathNotFoundError); ok {
-			return nil
+			err = nil
+		}
+		if err != nil {
+			return err
 		}
 
-		return err
+		progress.manifests = append(progress.manifests, repoManifests...)
+		return progress.repositoryDone(repoName)
 	})
 
 	if err != nil {
+		if progress.path != "" {
+			if saveErr := progress.save(); saveErr != nil {
+				return fmt.Errorf("failed to mark: %v (saving checkpoint failed: %v)", err, saveErr)
+			}
+			return fmt.Errorf("failed to mark: %v (progress saved to %s)", err, progress.path)
+		}
 		return fmt.Errorf("failed to mark: %v", err)
 	}
 
+	if err := progress.markDone(); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	manifestArr := progress.manifests
+
+	var quota *quotaAccountant
+	if accounting, ok := registry.(quotaAccountingNamespace); ok {
+		quota = accounting.quotas()
+	}
+
 	// sweep
 	vacuum := NewVacuum(ctx, storageDriver)
+	vacuum.quota = quota
 	if !opts.DryRun {
 		for _, obj := range manifestArr {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			err = vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
+			if _, ok := err.(driver.PathNotFoundError); ok && opts.Resume {
+				// already removed by the interrupted collection
+				continue
+			}
 			if err != nil {
 				return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
 			}
@@ -128,7 +239,7 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 	deleteSet := make(map[digest.Digest]struct{})
 	err = blobService.Enumerate(ctx, func(dgst digest.Digest) error {
 		// check if digest is in markSet. If not, delete it!
-		if _, ok := markSet[dgst]; !ok {
+		if !markSet.contains(dgst) {
 			deleteSet[dgst] = struct{}{}
 		}
 		return nil
@@ -136,17 +247,173 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 	if err != nil {
 		return fmt.Errorf("error enumerating blobs: %v", err)
 	}
-	emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", len(markSet), len(deleteSet), len(manifestArr))
+	emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", markSet.len(), len(deleteSet), len(manifestArr))
+
+	// the repositories still linking the blobs are charged for them
+	var linkingRepos map[digest.Digest][]string
+	if quota != nil && !opts.DryRun && len(deleteSet) > 0 {
+		linkingRepos, err = layerLinks(ctx, storageDriver, repositoryEnumerator, deleteSet)
+		if err != nil {
+			return fmt.Errorf("failed to find the repositories linking blobs: %v", err)
+		}
+	}
+
 	for dgst := range deleteSet {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !cutoff.IsZero() {
+			recent, err := blobModifiedSince(ctx, storageDriver, dgst, cutoff)
+			if err != nil {
+				return fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+			}
+			if recent {
+				emit("blob within grace period: %s", dgst)
+				continue
+			}
+		}
+
 		emit("blob eligible for deletion: %s", dgst)
 		if opts.DryRun {
 			continue
 		}
-		err = vacuum.RemoveBlob(string(dgst))
+
+		var size int64
+		if len(linkingRepos[dgst]) > 0 {
+			desc, err := registry.BlobStatter().Stat(ctx, dgst)
+			if err != nil {
+				return fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+			}
+			size = desc.Size
+		}
+
+		removed, err := tracker.remove(dgst, func() error {
+			return vacuum.RemoveBlob(string(dgst))
+		})
 		if err != nil {
 			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
 		}
+		if !removed {
+			emit("blob linked during collection: %s", dgst)
+			continue
+		}
+
+		for _, repoName := range linkingRepos[dgst] {
+			if err := quota.release(ctx, repoName, size, 0); err != nil {
+				return fmt.Errorf("failed to release quota of blob %s in %s: %v", dgst, repoName, err)
+			}
+		}
+
+		if tracking != nil {
+			if err := tracking.clearDescriptorCache(ctx, dgst); err != nil && err != distribution.ErrBlobUnknown {
+				return fmt.Errorf("failed to clear cached descriptor for blob %s: %v", dgst, err)
+			}
+		}
+	}
+
+	if err := progress.remove(); err != nil {
+		return fmt.Errorf("failed to remove checkpoint: %v", err)
 	}
 
+	return nil
+}
+
+// markRecentLayers adds blobs linked into the named repository after cutoff
+// to the mark set. Such blobs are usually layers of a push which has not yet
+// uploaded its manifest.
+func markRecentLayers(ctx context.Context, storageDriver driver.StorageDriver, repoName string, cutoff time.Time, markSet markSet) error {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+	layersPath := path.Join(root, repoName, "_layers")
+
+	err = storageDriver.Walk(ctx, layersPath, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+			return nil
+		}
+		if !fileInfo.ModTime().After(cutoff) {
+			return nil
+		}
+
+		content, err := storageDriver.GetContent(ctx, fileInfo.Path())
+		if err != nil {
+			return err
+		}
+		dgst, err := digest.Parse(string(content))
+		if err != nil {
+			return err
+		}
+
+		markSet.add(dgst)
+		return nil
+	})
+
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
 	return err
 }
+
+// layerLinks returns the repositories whose layer links point to the blobs
+// of dgsts. The digest of a link is taken from its path.
+func layerLinks(ctx context.Context, storageDriver driver.StorageDriver, repositoryEnumerator distribution.RepositoryEnumerator, dgsts map[digest.Digest]struct{}) (map[digest.Digest][]string, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	linking := make(map[digest.Digest][]string)
+	err = repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		layersPath := path.Join(root, repoName, "_layers")
+		err := storageDriver.Walk(ctx, layersPath, func(fileInfo driver.FileInfo) error {
+			if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+				return nil
+			}
+
+			// <algorithm>/<hex digest>/link
+			hexPath := path.Dir(fileInfo.Path())
+			dgst := digest.NewDigestFromHex(path.Base(path.Dir(hexPath)), path.Base(hexPath))
+			if _, ok := dgsts[dgst]; ok {
+				linking[dgst] = append(linking[dgst], repoName)
+			}
+			return nil
+		})
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return linking, nil
+}
+
+// blobModifiedSince reports whether the data of the blob, or the index of its
+// compressed content, was written after cutoff.
+func blobModifiedSince(ctx context.Context, storageDriver driver.StorageDriver, dgst digest.Digest, cutoff time.Time) (bool, error) {
+	for _, spec := range []pathSpec{blobDataPathSpec{digest: dgst}, blobCompressionIndexPathSpec{digest: dgst}} {
+		blobPath, err := pathFor(spec)
+		if err != nil {
+			return false, err
+		}
+
+		fi, err := storageDriver.Stat(ctx, blobPath)
+		if err != nil {
+			if _, ok := err.(driver.PathNotFoundError); ok {
+				continue
+			}
+			return false, err
+		}
+
+		return fi.ModTime().After(cutoff), nil
+	}
+
+	return false, nil
+}
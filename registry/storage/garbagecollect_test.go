@@ -1,12 +1,18 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution"
-	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/inmemory"
@@ -500,3 +506,354 @@ func TestOrphanBlobDeleted(t *testing.T) {
 		}
 	}
 }
+
+func TestGCGracePeriodKeepsRecentBlobs(t *testing.T) {
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "nikephoros")
+
+	digests, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+
+	uploadRandomSchema2Image(t, repo)
+
+	// The orphan layer was just written, so it is within the grace period
+	err = MarkAndSweep(context.Background(), inmemoryDriver, registry, GCOpts{
+		GracePeriod: time.Hour,
+		Quiet:       true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	for dgst := range digests {
+		if _, ok := blobs[dgst]; !ok {
+			t.Fatalf("Recent orphan layer was deleted: %v", dgst)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	err = MarkAndSweep(context.Background(), inmemoryDriver, registry, GCOpts{
+		GracePeriod: time.Millisecond,
+		Quiet:       true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs = allBlobs(t, registry)
+	for dgst := range digests {
+		if _, ok := blobs[dgst]; ok {
+			t.Fatalf("Orphan layer is present: %v", dgst)
+		}
+	}
+}
+
+// walkHookDriver runs a hook before the first walk of the given path.
+type walkHookDriver struct {
+	driver.StorageDriver
+	path string
+	hook func()
+	once sync.Once
+}
+
+func (d *walkHookDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	if path == d.path {
+		d.once.Do(d.hook)
+	}
+	return d.StorageDriver.Walk(ctx, path, f)
+}
+
+func TestGCKeepsBlobsReferencedDuringCollection(t *testing.T) {
+	ctx := context.Background()
+	blobsPath, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &walkHookDriver{StorageDriver: inmemory.New(), path: blobsPath}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "basil")
+	uploadRandomSchema2Image(t, repo)
+
+	layers, err := testutil.CreateRandomLayers(2)
+	if err != nil {
+		t.Fatalf("failed to make layers: %v", err)
+	}
+	if err := testutil.UploadBlobs(repo, layers); err != nil {
+		t.Fatalf("failed to upload layers: %v", err)
+	}
+	manifest, err := testutil.MakeSchema2Manifest(repo, getKeys(layers))
+	if err != nil {
+		t.Fatalf("failed to make manifest: %v", err)
+	}
+
+	// Push the manifest after the mark phase has visited the repository, just
+	// before the sweep phase enumerates blobs.
+	var manifestDigest digest.Digest
+	d.hook = func() {
+		manifestDigest, err = makeManifestService(t, repo).Put(ctx, manifest)
+	}
+
+	err = MarkAndSweep(ctx, d, registry, GCOpts{Quiet: true})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[manifestDigest]; !ok {
+		t.Fatalf("manifest pushed during collection is missing")
+	}
+	for dgst := range layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Fatalf("layer referenced during collection is missing: %v", dgst)
+		}
+	}
+
+	// Nothing is tracked once the collection has finished.
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{Quiet: true}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	blobs = allBlobs(t, registry)
+	for dgst := range layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Fatalf("referenced layer is missing: %v", dgst)
+		}
+	}
+}
+
+// blockingReadDriver blocks the first read of the given path until release
+// is closed, closing reached once the read has started.
+type blockingReadDriver struct {
+	driver.StorageDriver
+	path    string
+	reached chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (d *blockingReadDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if path == d.path {
+		d.once.Do(func() {
+			close(d.reached)
+			<-d.release
+		})
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func TestGCKeepsBlobsOfWritesStartedBeforeCollection(t *testing.T) {
+	ctx := context.Background()
+	blobsPath, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walkDriver := &walkHookDriver{StorageDriver: inmemory.New(), path: blobsPath}
+	d := &blockingReadDriver{
+		StorageDriver: walkDriver,
+		reached:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "thyme")
+
+	layers, err := testutil.CreateRandomLayers(2)
+	if err != nil {
+		t.Fatalf("failed to make layers: %v", err)
+	}
+	if err := testutil.UploadBlobs(repo, layers); err != nil {
+		t.Fatalf("failed to upload layers: %v", err)
+	}
+	manifest, err := testutil.MakeSchema2Manifest(repo, getKeys(layers))
+	if err != nil {
+		t.Fatalf("failed to make manifest: %v", err)
+	}
+
+	// Start pushing the manifest before the collection and hold it while
+	// the references are verified, until the mark phase has finished.
+	d.path, err = pathFor(layerLinkPathSpec{name: "thyme", digest: getAnyKey(layers)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := make(chan error)
+	var manifestDigest digest.Digest
+	go func() {
+		var err error
+		manifestDigest, err = makeManifestService(t, repo).Put(ctx, manifest)
+		pushed <- err
+	}()
+	<-d.reached
+
+	walkDriver.hook = func() {
+		close(d.release)
+		if err := <-pushed; err != nil {
+			t.Errorf("failed to push manifest: %v", err)
+		}
+	}
+
+	err = MarkAndSweep(ctx, d, registry, GCOpts{Quiet: true})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[manifestDigest]; !ok {
+		t.Fatalf("manifest pushed during collection is missing")
+	}
+	for dgst := range layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Fatalf("layer referenced during collection is missing: %v", dgst)
+		}
+	}
+}
+
+func TestGCRejectsConcurrentCollection(t *testing.T) {
+	registry := createRegistry(t, inmemory.New())
+
+	tracker := registry.(gcTrackingNamespace).gcTracker()
+	if err := tracker.begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.end()
+
+	err := MarkAndSweep(context.Background(), inmemory.New(), registry, GCOpts{Quiet: true})
+	if err != errGCInProgress {
+		t.Fatalf("expected %v, got %v", errGCInProgress, err)
+	}
+}
+
+// failingWalkDriver fails the first walk of paths with the given suffix and
+// counts the walks of each path.
+type failingWalkDriver struct {
+	driver.StorageDriver
+	suffix string
+	failed bool
+	walks  map[string]int
+}
+
+func (d *failingWalkDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	d.walks[path]++
+	if !d.failed && strings.HasSuffix(path, d.suffix) {
+		d.failed = true
+		return fmt.Errorf("transient error walking %s", path)
+	}
+	return d.StorageDriver.Walk(ctx, path, f)
+}
+
+func TestGCResumeFromCheckpoint(t *testing.T) {
+	for _, capacity := range []int{0, 1000} {
+		ctx := context.Background()
+		d := &failingWalkDriver{
+			StorageDriver: inmemory.New(),
+			suffix:        "zoe/_manifests/revisions",
+			walks:         make(map[string]int),
+		}
+
+		registry := createRegistry(t, d)
+		alexios := makeRepository(t, registry, "alexios")
+		zoe := makeRepository(t, registry, "zoe")
+		image1 := uploadRandomSchema2Image(t, alexios)
+		image2 := uploadRandomSchema2Image(t, zoe)
+		image3 := uploadRandomSchema2Image(t, zoe)
+		manifests, _ := zoe.Manifests(ctx)
+		if err := manifests.Delete(ctx, image3.manifestDigest); err != nil {
+			t.Fatalf("failed to delete manifest: %v", err)
+		}
+
+		dir, err := ioutil.TempDir("", "gc-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		checkpoint := path.Join(dir, "gc.checkpoint")
+		opts := GCOpts{
+			Quiet:           true,
+			CheckpointFile:  checkpoint,
+			MarkSetCapacity: capacity,
+		}
+
+		before := allBlobs(t, registry)
+		err = MarkAndSweep(ctx, d, registry, opts)
+		if err == nil {
+			t.Fatalf("expected mark and sweep to fail")
+		}
+		if _, err := os.Stat(checkpoint); err != nil {
+			t.Fatalf("checkpoint was not saved: %v", err)
+		}
+		if len(allBlobs(t, registry)) != len(before) {
+			t.Fatalf("failed collection removed blobs")
+		}
+
+		opts.Resume = true
+		if err := MarkAndSweep(ctx, d, registry, opts); err != nil {
+			t.Fatalf("Failed mark and sweep: %v", err)
+		}
+
+		alexiosRevisions, err := pathFor(manifestRevisionsPathSpec{name: "alexios"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.walks[alexiosRevisions] != 1 {
+			t.Fatalf("marked repository was walked %d times", d.walks[alexiosRevisions])
+		}
+		if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+			t.Fatalf("checkpoint was not removed: %v", err)
+		}
+
+		blobs := allBlobs(t, registry)
+		for _, im := range []image{image1, image2} {
+			if _, ok := blobs[im.manifestDigest]; !ok {
+				t.Fatalf("manifest %v is missing", im.manifestDigest)
+			}
+			for layer := range im.layers {
+				if _, ok := blobs[layer]; !ok {
+					t.Fatalf("layer %v is missing", layer)
+				}
+			}
+		}
+		for layer := range image3.layers {
+			if _, ok := blobs[layer]; ok {
+				t.Fatalf("unreferenced layer %v is present", layer)
+			}
+		}
+	}
+}
+
+func TestGCResumeRejectsDifferentOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := path.Join(dir, "gc.checkpoint")
+	p, err := newGCProgress(GCOpts{CheckpointFile: checkpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []GCOpts{
+		{CheckpointFile: checkpoint, Resume: true, RemoveUntagged: true},
+		{CheckpointFile: checkpoint, Resume: true, MarkSetCapacity: 10},
+	} {
+		if _, err := newGCProgress(opts); err == nil {
+			t.Fatalf("expected an error resuming with %+v", opts)
+		}
+	}
+
+	if _, err := newGCProgress(GCOpts{CheckpointFile: checkpoint, Resume: true}); err != nil {
+		t.Fatalf("unexpected error resuming: %v", err)
+	}
+}
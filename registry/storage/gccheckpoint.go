@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// gcCheckpointVersion is the version of the checkpoint file format.
+const gcCheckpointVersion = 1
+
+// gcCheckpointInterval is the minimum time between two checkpoints written
+// while marking.
+var gcCheckpointInterval = time.Minute
+
+// gcCheckpointState is the persisted progress of the mark phase.
+type gcCheckpointState struct {
+	Version        int             `json:"version"`
+	RemoveUntagged bool            `json:"removeUntagged"`
+	MarkComplete   bool            `json:"markComplete"`
+	Repositories   []string        `json:"repositories"`
+	Manifests      []ManifestDel   `json:"manifests,omitempty"`
+	Blobs          []digest.Digest `json:"blobs,omitempty"`
+	Bloom          *bloomMarkSet   `json:"bloom,omitempty"`
+}
+
+// gcProgress tracks the mark phase of a collection, periodically saving it
+// to a checkpoint file when one is configured.
+type gcProgress struct {
+	path      string
+	lastSaved time.Time
+
+	removeUntagged bool
+	markComplete   bool
+	visited        map[string]struct{}
+	manifests      []ManifestDel
+	marked         markSet
+}
+
+// newGCProgress returns the starting progress for a collection. When opts
+// requests a resume, the progress is loaded from opts.CheckpointFile.
+func newGCProgress(opts GCOpts) (*gcProgress, error) {
+	p := &gcProgress{
+		path:           opts.CheckpointFile,
+		lastSaved:      time.Now(),
+		removeUntagged: opts.RemoveUntagged,
+		visited:        make(map[string]struct{}),
+		manifests:      make([]ManifestDel, 0),
+	}
+
+	if opts.MarkSetCapacity > 0 {
+		p.marked = newBloomMarkSet(opts.MarkSetCapacity)
+	} else {
+		p.marked = make(mapMarkSet)
+	}
+
+	if !opts.Resume {
+		return p, nil
+	}
+
+	if p.path == "" {
+		return nil, fmt.Errorf("cannot resume garbage collection without a checkpoint file")
+	}
+
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nothing to resume from, start a new collection
+			return p, nil
+		}
+		return nil, err
+	}
+
+	var state gcCheckpointState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %v", p.path, err)
+	}
+
+	if state.Version != gcCheckpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d in %s", state.Version, p.path)
+	}
+	if state.RemoveUntagged != opts.RemoveUntagged {
+		return nil, fmt.Errorf("checkpoint %s was written with delete-untagged=%t", p.path, state.RemoveUntagged)
+	}
+
+	switch marked := p.marked.(type) {
+	case mapMarkSet:
+		if state.Bloom != nil {
+			return nil, fmt.Errorf("checkpoint %s was written with a bounded mark set", p.path)
+		}
+		for _, dgst := range state.Blobs {
+			marked.add(dgst)
+		}
+	case *bloomMarkSet:
+		if state.Bloom == nil {
+			return nil, fmt.Errorf("checkpoint %s was written without a bounded mark set", p.path)
+		}
+		if len(state.Bloom.Bits) != len(marked.Bits) || state.Bloom.Hashes != marked.Hashes {
+			return nil, fmt.Errorf("checkpoint %s was written with a different mark set capacity", p.path)
+		}
+		p.marked = state.Bloom
+	}
+
+	p.markComplete = state.MarkComplete
+	for _, repo := range state.Repositories {
+		p.visited[repo] = struct{}{}
+	}
+	if state.Manifests != nil {
+		p.manifests = state.Manifests
+	}
+
+	return p, nil
+}
+
+// isVisited reports whether the repository was completely marked by this or
+// a previous run.
+func (p *gcProgress) isVisited(repoName string) bool {
+	_, ok := p.visited[repoName]
+	return ok
+}
+
+// repositoryDone records that a repository has been marked and saves a
+// checkpoint if enough time has passed since the last one.
+func (p *gcProgress) repositoryDone(repoName string) error {
+	p.visited[repoName] = struct{}{}
+
+	if time.Since(p.lastSaved) < gcCheckpointInterval {
+		return nil
+	}
+	return p.save()
+}
+
+// markDone records that the mark phase is complete.
+func (p *gcProgress) markDone() error {
+	p.markComplete = true
+	return p.save()
+}
+
+// save writes the progress to the checkpoint file, if one is configured. The
+// file is replaced atomically so that an interrupted save leaves the
+// previous checkpoint intact.
+func (p *gcProgress) save() error {
+	p.lastSaved = time.Now()
+	if p.path == "" {
+		return nil
+	}
+
+	state := gcCheckpointState{
+		Version:        gcCheckpointVersion,
+		RemoveUntagged: p.removeUntagged,
+		MarkComplete:   p.markComplete,
+		Repositories:   make([]string, 0, len(p.visited)),
+		Manifests:      p.manifests,
+	}
+	for repo := range p.visited {
+		state.Repositories = append(state.Repositories, repo)
+	}
+
+	switch marked := p.marked.(type) {
+	case mapMarkSet:
+		state.Blobs = make([]digest.Digest, 0, len(marked))
+		for dgst := range marked {
+			state.Blobs = append(state.Blobs, dgst)
+		}
+	case *bloomMarkSet:
+		state.Bloom = marked
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// remove deletes the checkpoint file once the collection has finished.
+func (p *gcProgress) remove() error {
+	if p.path == "" {
+		return nil
+	}
+
+	if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
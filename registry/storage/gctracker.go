@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// errGCInProgress is returned when a garbage collection is started while
+// another one is still running against the same registry.
+var errGCInProgress = errors.New("garbage collection already in progress")
+
+// gcTracker records content that is linked into the registry while a
+// garbage collection is running. The mark phase only sees links that existed
+// when each repository was visited, so anything pushed, mounted or
+// referenced afterwards must be protected from the sweep phase.
+//
+// Writers track a digest before checking whether the blob exists and before
+// linking it. The sweep only removes a blob if its digest has not been
+// tracked, and writers tracking a digest while its blob is being removed
+// wait for the removal to complete. So a blob is either removed before a
+// writer looks for it, in which case the writer stores it again, or it is
+// retained.
+//
+// Digests are also recorded while no collection is running, for as long as
+// their writes are in progress. A collection starts by tracking the digests
+// of the writes already in flight, which may link content after the mark
+// phase has visited their repository.
+//
+// The tracker only sees the writes of the registry in its own process.
+// Pushes served by other instances sharing the storage are only protected
+// by the grace period of the collection.
+type gcTracker struct {
+	mu       sync.Mutex
+	active   bool
+	inflight map[digest.Digest]int // writes in progress per digest
+	tracked  map[digest.Digest]struct{}
+	deleting map[digest.Digest]chan struct{} // closed once removed
+}
+
+// begin starts tracking for a new collection cycle.
+func (t *gcTracker) begin() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.active {
+		return errGCInProgress
+	}
+
+	t.active = true
+	t.tracked = make(map[digest.Digest]struct{})
+	for dgst := range t.inflight {
+		t.tracked[dgst] = struct{}{}
+	}
+	t.deleting = make(map[digest.Digest]chan struct{})
+	return nil
+}
+
+// end stops tracking and releases the tracked set.
+func (t *gcTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active = false
+	t.tracked = nil
+	t.deleting = nil
+}
+
+// track marks the digests as in use until the returned function is called
+// and, if a collection is running, for the remainder of its cycle. It waits
+// for the removal of their blobs if one is in progress.
+func (t *gcTracker) track(dgsts ...digest.Digest) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.inflight == nil {
+		t.inflight = make(map[digest.Digest]int)
+	}
+	for _, dgst := range dgsts {
+		for t.active {
+			removed, ok := t.deleting[dgst]
+			if !ok {
+				break
+			}
+			t.mu.Unlock()
+			<-removed
+			t.mu.Lock()
+		}
+		if t.active {
+			t.tracked[dgst] = struct{}{}
+		}
+		t.inflight[dgst]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.done(dgsts) })
+	}
+}
+
+// done records the end of the writes of the digests.
+func (t *gcTracker) done(dgsts []digest.Digest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, dgst := range dgsts {
+		if t.inflight[dgst]--; t.inflight[dgst] <= 0 {
+			delete(t.inflight, dgst)
+		}
+	}
+}
+
+// remove calls removeFn for dgst unless the digest was tracked during the
+// current cycle. The lock is not held while removeFn runs, only writers of
+// dgst wait for it. The returned boolean reports whether removeFn was
+// called.
+func (t *gcTracker) remove(dgst digest.Digest, removeFn func() error) (bool, error) {
+	t.mu.Lock()
+	if _, ok := t.tracked[dgst]; ok {
+		t.mu.Unlock()
+		return false, nil
+	}
+	removed := make(chan struct{})
+	t.deleting[dgst] = removed
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.deleting, dgst)
+		close(removed)
+	}()
+
+	return true, removeFn()
+}
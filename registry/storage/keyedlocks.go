@@ -0,0 +1,42 @@
+package storage
+
+import "sync"
+
+// keyedLocks is a set of mutexes identified by string keys, allocated while
+// they are held or waited for.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int // holding or waiting for the lock
+}
+
+// lock locks the key, returning the function unlocking it.
+func (l *keyedLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyedLock)
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyedLock{}
+		l.locks[key] = kl
+	}
+	kl.users++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		kl.users--
+		if kl.users == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
@@ -84,14 +84,23 @@ func (lbs *linkedBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter
 
 func (lbs *linkedBlobStore) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
 	dgst := digest.FromBytes(p)
+	defer lbs.tracker.track(dgst)()
+
+	charge, err := lbs.chargeQuota(ctx, dgst, int64(len(p)))
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
 	// Place the data in the blob store first.
 	desc, err := lbs.blobStore.Put(ctx, mediaType, p)
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("error putting into main store: %v", err)
+		charge.refund(ctx)
 		return distribution.Descriptor{}, err
 	}
 
 	if err := lbs.blobAccessController.SetDescriptor(ctx, dgst, desc); err != nil {
+		charge.refund(ctx)
 		return distribution.Descriptor{}, err
 	}
 
@@ -99,7 +108,12 @@ func (lbs *linkedBlobStore) Put(ctx context.Context, mediaType string, p []byte)
 	// returned by Put above. Note that we should allow updates for a given
 	// repository.
 
-	return desc, lbs.linkBlob(ctx, desc)
+	if err := lbs.linkBlob(ctx, desc); err != nil {
+		charge.refund(ctx)
+		return distribution.Descriptor{}, err
+	}
+	charge.keep()
+	return desc, nil
 }
 
 type optionFunc func(interface{}) error
@@ -218,8 +232,12 @@ func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) erro
 		return distribution.ErrUnsupported
 	}
 
+	if lbs.quota != nil {
+		defer lbs.quota.lockBlob(lbs.repository.Named().Name(), dgst)()
+	}
+
 	// Ensure the blob is available for deletion
-	_, err := lbs.blobAccessController.Stat(ctx, dgst)
+	desc, err := lbs.blobAccessController.Stat(ctx, dgst)
 	if err != nil {
 		return err
 	}
@@ -229,7 +247,7 @@ func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) erro
 		return err
 	}
 
-	return nil
+	return lbs.quota.release(ctx, lbs.repository.Named().Name(), desc.Size, 0)
 }
 
 func (lbs *linkedBlobStore) Enumerate(ctx context.Context, ingestor func(digest.Digest) error) error {
@@ -276,6 +294,8 @@ func (lbs *linkedBlobStore) Enumerate(ctx context.Context, ingestor func(digest.
 }
 
 func (lbs *linkedBlobStore) mount(ctx context.Context, sourceRepo reference.Named, dgst digest.Digest, sourceStat *distribution.Descriptor) (distribution.Descriptor, error) {
+	defer lbs.tracker.track(dgst)()
+
 	var stat distribution.Descriptor
 	if sourceStat == nil {
 		// look up the blob info from the sourceRepo if not already provided
@@ -301,7 +321,17 @@ func (lbs *linkedBlobStore) mount(ctx context.Context, sourceRepo reference.Name
 		MediaType: "application/octet-stream",
 		Digest:    dgst,
 	}
-	return desc, lbs.linkBlob(ctx, desc)
+
+	charge, err := lbs.chargeQuota(ctx, dgst, desc.Size)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if err := lbs.linkBlob(ctx, desc); err != nil {
+		charge.refund(ctx)
+		return distribution.Descriptor{}, err
+	}
+	charge.keep()
+	return desc, nil
 }
 
 // newBlobUpload allocates a new upload controller with the given state.
@@ -360,6 +390,66 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical distribution
 	return nil
 }
 
+// chargeQuota charges size bytes to the quota of the repository for linking
+// the blob into it, unless it is already linked. The blob stays locked until
+// the returned charge is kept, once the blob is linked, or refunded.
+func (lbs *linkedBlobStore) chargeQuota(ctx context.Context, dgst digest.Digest, size int64) (*quotaCharge, error) {
+	if lbs.quota == nil {
+		return nil, nil
+	}
+
+	unlock := lbs.quota.lockBlob(lbs.repository.Named().Name(), dgst)
+	charge := &quotaCharge{lbs: lbs, unlock: unlock}
+
+	switch _, err := lbs.blobAccessController.Stat(ctx, dgst); err {
+	case nil:
+		return charge, nil
+	case distribution.ErrBlobUnknown:
+	default:
+		unlock()
+		return nil, err
+	}
+
+	if err := lbs.quota.charge(ctx, lbs.repository.Named().Name(), size, 0); err != nil {
+		unlock()
+		return nil, err
+	}
+	charge.size = size
+	return charge, nil
+}
+
+// quotaCharge is the charge made by chargeQuota for linking a blob. Its
+// methods do nothing when quotas are disabled.
+type quotaCharge struct {
+	lbs    *linkedBlobStore
+	size   int64 // zero if the blob was already linked
+	unlock func()
+}
+
+// keep unlocks the blob once it is linked.
+func (c *quotaCharge) keep() {
+	if c == nil {
+		return
+	}
+	c.unlock()
+}
+
+// refund releases the bytes charged for a blob which could not be linked and
+// unlocks it.
+func (c *quotaCharge) refund(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	defer c.unlock()
+
+	if c.size == 0 {
+		return
+	}
+	if err := c.lbs.quota.release(ctx, c.lbs.repository.Named().Name(), c.size, 0); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error releasing quota: %v", err)
+	}
+}
+
 type linkedBlobStatter struct {
 	*blobStore
 	repository distribution.Repository
@@ -129,6 +129,14 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Put")
 
+	// The referenced blobs are verified below, after which they must survive
+	// a garbage collection that may already have visited this repository.
+	var refs []digest.Digest
+	for _, ref := range manifest.References() {
+		refs = append(refs, ref.Digest)
+	}
+	defer ms.repository.blobStore.tracker.track(refs...)()
+
 	switch manifest.(type) {
 	case *schema1.SignedManifest:
 		return ms.schema1Handler.Put(ctx, manifest, ms.skipDependencyVerification)
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// markSet holds the digests of blobs found to be referenced during the mark
+// phase of a garbage collection.
+type markSet interface {
+	add(dgst digest.Digest)
+	contains(dgst digest.Digest) bool
+	len() int
+}
+
+// mapMarkSet is an exact mark set. Its memory use grows with the number of
+// referenced blobs.
+type mapMarkSet map[digest.Digest]struct{}
+
+func (s mapMarkSet) add(dgst digest.Digest) {
+	s[dgst] = struct{}{}
+}
+
+func (s mapMarkSet) contains(dgst digest.Digest) bool {
+	_, ok := s[dgst]
+	return ok
+}
+
+func (s mapMarkSet) len() int {
+	return len(s)
+}
+
+// bloomMarkSet is a mark set of fixed size backed by a bloom filter. It may
+// report an unmarked digest as marked, which only causes the collector to
+// retain a blob it could have deleted. It never reports a marked digest as
+// unmarked.
+type bloomMarkSet struct {
+	Bits   []byte `json:"bits"`
+	Hashes uint   `json:"hashes"`
+	Count  int    `json:"count"`
+}
+
+// bloomFalsePositiveRate is the rate newBloomMarkSet sizes filters for.
+const bloomFalsePositiveRate = 0.01
+
+// newBloomMarkSet returns a bloom filter sized to hold capacity digests at
+// bloomFalsePositiveRate.
+func newBloomMarkSet(capacity int) *bloomMarkSet {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	bits := math.Ceil(-float64(capacity) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := uint(math.Ceil(bits / float64(capacity) * math.Ln2))
+
+	return &bloomMarkSet{
+		Bits:   make([]byte, (int(bits)+7)/8),
+		Hashes: hashes,
+	}
+}
+
+// locations returns the bit positions for dgst using double hashing over a
+// single 128 bit FNV-1a hash.
+func (s *bloomMarkSet) locations(dgst digest.Digest) []uint64 {
+	h := fnv.New128a()
+	h.Write([]byte(dgst))
+	sum := h.Sum(nil)
+
+	var h1, h2 uint64
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[i+8])
+	}
+
+	m := uint64(len(s.Bits)) * 8
+	locations := make([]uint64, s.Hashes)
+	for i := range locations {
+		locations[i] = (h1 + uint64(i)*h2) % m
+	}
+	return locations
+}
+
+func (s *bloomMarkSet) add(dgst digest.Digest) {
+	if s.contains(dgst) {
+		return
+	}
+
+	for _, l := range s.locations(dgst) {
+		s.Bits[l/8] |= 1 << (l % 8)
+	}
+	s.Count++
+}
+
+func (s *bloomMarkSet) contains(dgst digest.Digest) bool {
+	for _, l := range s.locations(dgst) {
+		if s.Bits[l/8]&(1<<(l%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// len returns the approximate number of digests added to the set.
+func (s *bloomMarkSet) len() int {
+	return s.Count
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestBloomMarkSet(t *testing.T) {
+	const capacity = 10000
+	s := newBloomMarkSet(capacity)
+
+	for i := 0; i < capacity; i++ {
+		s.add(digest.FromString(fmt.Sprintf("marked-%d", i)))
+	}
+
+	// digests reported as already present are not counted
+	if s.len() > capacity || s.len() < capacity*99/100 {
+		t.Fatalf("unexpected count: %d", s.len())
+	}
+
+	for i := 0; i < capacity; i++ {
+		dgst := digest.FromString(fmt.Sprintf("marked-%d", i))
+		if !s.contains(dgst) {
+			t.Fatalf("marked digest not found: %v", dgst)
+		}
+	}
+
+	var falsePositives int
+	for i := 0; i < capacity; i++ {
+		if s.contains(digest.FromString(fmt.Sprintf("unmarked-%d", i))) {
+			falsePositives++
+		}
+	}
+
+	if rate := float64(falsePositives) / capacity; rate > 2*bloomFalsePositiveRate {
+		t.Fatalf("false positive rate too high: %f", rate)
+	}
+}
@@ -40,6 +40,9 @@ const (
 // 						data
 // 						startedat
 // 						hashstates/<algorithm>/<offset>
+// 					-> _usage/
+// 						repository
+// 						namespace
 //			-> blob/<algorithm>
 //				<split directory content addressable storage>
 //
@@ -94,12 +97,19 @@ const (
 // 	uploadStartedAtPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/startedat
 // 	uploadHashStatePathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/hashstates/<algorithm>/<offset>
 //
+//	Quota usage:
+//
+// 	repositoryUsagePathSpec:        <root>/v2/repositories/<name>/_usage/repository
+// 	namespaceUsagePathSpec:         <root>/v2/repositories/<namespace>/_usage/namespace
+//
 //	Blob Store:
 //
 //	blobsPathSpec:                  <root>/v2/blobs/
 // 	blobPathSpec:                   <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>
 // 	blobDataPathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
 // 	blobMediaTypePathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
+// 	blobCompressedDataPathSpec:     <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data.zst
+// 	blobCompressionIndexPathSpec:   <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data.zst.index
 //
 // For more information on the semantic meaning of each path and their
 // contents, please see the path spec documentation.
@@ -226,6 +236,24 @@ func pathFor(spec pathSpec) (string, error) {
 		components = append(components, "data")
 		blobPathPrefix := append(rootPrefix, "blobs")
 		return path.Join(append(blobPathPrefix, components...)...), nil
+	case blobCompressedDataPathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "data.zst")
+		blobPathPrefix := append(rootPrefix, "blobs")
+		return path.Join(append(blobPathPrefix, components...)...), nil
+	case blobCompressionIndexPathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "data.zst.index")
+		blobPathPrefix := append(rootPrefix, "blobs")
+		return path.Join(append(blobPathPrefix, components...)...), nil
 
 	case uploadDataPathSpec:
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "data")...), nil
@@ -237,6 +265,10 @@ func pathFor(spec pathSpec) (string, error) {
 			offset = "" // Limit to the prefix for listing offsets.
 		}
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "hashstates", string(v.alg), offset)...), nil
+	case repositoryUsagePathSpec:
+		return path.Join(append(repoPrefix, v.name, "_usage", "repository")...), nil
+	case namespaceUsagePathSpec:
+		return path.Join(append(repoPrefix, v.namespace, "_usage", "namespace")...), nil
 	case repositoriesRootPathSpec:
 		return path.Join(repoPrefix...), nil
 	default:
@@ -383,6 +415,23 @@ type blobDataPathSpec struct {
 
 func (blobDataPathSpec) pathSpec() {}
 
+// blobCompressedDataPathSpec contains the path for the compressed content of
+// a blob, stored in place of its data.
+type blobCompressedDataPathSpec struct {
+	digest digest.Digest
+}
+
+func (blobCompressedDataPathSpec) pathSpec() {}
+
+// blobCompressionIndexPathSpec contains the path for the index of the
+// compressed content of a blob. It is written last, marking the compressed
+// content as complete.
+type blobCompressionIndexPathSpec struct {
+	digest digest.Digest
+}
+
+func (blobCompressionIndexPathSpec) pathSpec() {}
+
 // uploadDataPathSpec defines the path parameters of the data file for
 // uploads.
 type uploadDataPathSpec struct {
@@ -420,6 +469,23 @@ type uploadHashStatePathSpec struct {
 
 func (uploadHashStatePathSpec) pathSpec() {}
 
+// repositoryUsagePathSpec defines the path of the file recording the storage
+// consumed by a repository, used to enforce quotas.
+type repositoryUsagePathSpec struct {
+	name string
+}
+
+func (repositoryUsagePathSpec) pathSpec() {}
+
+// namespaceUsagePathSpec defines the path of the file recording the storage
+// consumed by all the repositories of a namespace. It is kept in the
+// directory named after the namespace whether or not it is a repository.
+type namespaceUsagePathSpec struct {
+	namespace string
+}
+
+func (namespaceUsagePathSpec) pathSpec() {}
+
 // repositoriesRootPathSpec returns the root of repositories
 type repositoriesRootPathSpec struct {
 }
@@ -28,12 +28,16 @@ func newUploadData() uploadData {
 
 // PurgeUploads deletes files from the upload directory
 // created before olderThan.  The list of files deleted and errors
-// encountered are returned
+// encountered are returned.  It stops deleting once the context is done.
 func PurgeUploads(ctx context.Context, driver storageDriver.StorageDriver, olderThan time.Time, actuallyDelete bool) ([]string, []error) {
 	logrus.Infof("PurgeUploads starting: olderThan=%s, actuallyDelete=%t", olderThan, actuallyDelete)
 	uploadData, errors := getOutstandingUploads(ctx, driver)
 	var deleted []string
 	for _, uploadData := range uploadData {
+		if ctx.Err() != nil {
+			errors = append(errors, ctx.Err())
+			break
+		}
 		if uploadData.startedAt.Before(olderThan) {
 			var err error
 			logrus.Infof("Upload files in %s have older date (%s) than purge date (%s).  Removing upload directory.",
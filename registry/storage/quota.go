@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// QuotaLimits caps the storage consumed by a repository or a namespace. A
+// zero field is unlimited.
+type QuotaLimits struct {
+	// Size is the number of bytes of the blobs and manifests linked into
+	// the repositories.
+	Size int64
+	// Tags is the number of tags of the repositories.
+	Tags int64
+}
+
+// QuotaFunc returns the limits of the named repository and the limits of its
+// namespace, which is the first component of the repository name. The
+// namespace limits apply to all of its repositories together.
+type QuotaFunc func(repository, namespace string) (repositoryLimits, namespaceLimits QuotaLimits)
+
+// Quotas returns a functional option for NewRegistry. It enables the
+// accounting of the storage consumed by each repository and namespace, and
+// rejects blob uploads, blob mounts, manifest puts and new tags that would
+// exceed the limits returned by limits with distribution.ErrQuotaExceeded.
+func Quotas(limits QuotaFunc) RegistryOption {
+	return func(registry *registry) error {
+		registry.blobStore.quota = &quotaAccountant{
+			driver: registry.driver,
+			limits: limits,
+		}
+		return nil
+	}
+}
+
+// QuotaUsage is the storage consumed by a repository or a namespace, as
+// recorded alongside the repository data.
+type QuotaUsage struct {
+	Size int64 `json:"size"`
+	Tags int64 `json:"tags"`
+}
+
+// quotaAccountant keeps the usage of repositories and namespaces up to date
+// as content is linked and unlinked. Each usage record is updated with a
+// read, modify, write cycle under its own lock, so that pushes to different
+// repositories only contend on their namespace. The updates are serialized
+// within the process only: registries sharing a storage backend may drift
+// and rely on RecomputeQuotaUsage to correct the records.
+type quotaAccountant struct {
+	locks  keyedLocks // usage records and blobs being linked
+	driver storagedriver.StorageDriver
+	limits QuotaFunc
+}
+
+// lockBlob serializes the linking of the blob into the named repository,
+// returning the function unlocking it. Holding it from the check of an
+// existing link to the link itself charges a blob pushed concurrently once.
+func (q *quotaAccountant) lockBlob(repository string, dgst digest.Digest) func() {
+	return q.locks.lock(repository + "@" + dgst.String())
+}
+
+// charge adds size bytes and tags tags to the usage of the repository and of
+// its namespace, unless doing so exceeds one of their limits.
+func (q *quotaAccountant) charge(ctx context.Context, repository string, size, tags int64) error {
+	if q == nil {
+		return nil
+	}
+
+	namespace := quotaNamespace(repository)
+	repoLimits, nsLimits := q.limits(repository, namespace)
+
+	repoPath, nsPath, err := quotaUsagePaths(repository, namespace)
+	if err != nil {
+		return err
+	}
+
+	// the repository record is always locked before the namespace record,
+	// which is only held while it is read and written
+	defer q.locks.lock(repoPath)()
+	repoUsage, err := readQuotaUsage(ctx, q.driver, repoPath)
+	if err != nil {
+		return err
+	}
+	if err := checkQuota("repository", repository, repoUsage, repoLimits, size, tags); err != nil {
+		return err
+	}
+
+	if err := q.chargeNamespace(ctx, namespace, nsPath, nsLimits, size, tags); err != nil {
+		return err
+	}
+
+	repoUsage.add(size, tags)
+	return writeQuotaUsage(ctx, q.driver, repoPath, repoUsage)
+}
+
+func (q *quotaAccountant) chargeNamespace(ctx context.Context, namespace, nsPath string, limits QuotaLimits, size, tags int64) error {
+	defer q.locks.lock(nsPath)()
+
+	nsUsage, err := readQuotaUsage(ctx, q.driver, nsPath)
+	if err != nil {
+		return err
+	}
+	if err := checkQuota("namespace", namespace, nsUsage, limits, size, tags); err != nil {
+		return err
+	}
+
+	nsUsage.add(size, tags)
+	return writeQuotaUsage(ctx, q.driver, nsPath, nsUsage)
+}
+
+// release removes size bytes and tags tags from the usage of the repository
+// and of its namespace.
+func (q *quotaAccountant) release(ctx context.Context, repository string, size, tags int64) error {
+	if q == nil {
+		return nil
+	}
+
+	repoPath, nsPath, err := quotaUsagePaths(repository, quotaNamespace(repository))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{repoPath, nsPath} {
+		if err := q.update(ctx, p, -size, -tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// update applies a change to the usage record at p under its lock.
+func (q *quotaAccountant) update(ctx context.Context, p string, size, tags int64) error {
+	defer q.locks.lock(p)()
+
+	usage, err := readQuotaUsage(ctx, q.driver, p)
+	if err != nil {
+		return err
+	}
+	usage.add(size, tags)
+	return writeQuotaUsage(ctx, q.driver, p, usage)
+}
+
+// checkQuota returns distribution.ErrQuotaExceeded if adding size bytes and
+// tags tags to usage exceeds limits. Releasing storage is always allowed.
+func checkQuota(scope, name string, usage QuotaUsage, limits QuotaLimits, size, tags int64) error {
+	if limits.Size > 0 && size > 0 && usage.Size+size > limits.Size {
+		return distribution.ErrQuotaExceeded{Scope: scope, Name: name, Resource: "size", Limit: limits.Size}
+	}
+	if limits.Tags > 0 && tags > 0 && usage.Tags+tags > limits.Tags {
+		return distribution.ErrQuotaExceeded{Scope: scope, Name: name, Resource: "tags", Limit: limits.Tags}
+	}
+	return nil
+}
+
+// add applies a change to the usage, never letting it become negative.
+func (u *QuotaUsage) add(size, tags int64) {
+	u.Size += size
+	if u.Size < 0 {
+		u.Size = 0
+	}
+	u.Tags += tags
+	if u.Tags < 0 {
+		u.Tags = 0
+	}
+}
+
+// quotaNamespace returns the namespace of the named repository.
+func quotaNamespace(repository string) string {
+	if i := strings.IndexByte(repository, '/'); i >= 0 {
+		return repository[:i]
+	}
+	return repository
+}
+
+func quotaUsagePaths(repository, namespace string) (repoPath, nsPath string, err error) {
+	repoPath, err = pathFor(repositoryUsagePathSpec{name: repository})
+	if err != nil {
+		return "", "", err
+	}
+	nsPath, err = pathFor(namespaceUsagePathSpec{namespace: namespace})
+	if err != nil {
+		return "", "", err
+	}
+	return repoPath, nsPath, nil
+}
+
+// readQuotaUsage reads a usage record, which is empty if it does not exist.
+func readQuotaUsage(ctx context.Context, driver storagedriver.StorageDriver, p string) (QuotaUsage, error) {
+	var usage QuotaUsage
+
+	content, err := driver.GetContent(ctx, p)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return usage, nil
+		}
+		return usage, err
+	}
+
+	if err := json.Unmarshal(content, &usage); err != nil {
+		return QuotaUsage{}, err
+	}
+	return usage, nil
+}
+
+func writeQuotaUsage(ctx context.Context, driver storagedriver.StorageDriver, p string, usage QuotaUsage) error {
+	content, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return driver.PutContent(ctx, p, content)
+}
+
+// RepositoryQuotaUsage returns the storage consumed by the named repository
+// and by its namespace, as recorded since quotas were enabled.
+func RepositoryQuotaUsage(ctx context.Context, storageDriver storagedriver.StorageDriver, repository string) (repositoryUsage, namespaceUsage QuotaUsage, err error) {
+	repoPath, nsPath, err := quotaUsagePaths(repository, quotaNamespace(repository))
+	if err != nil {
+		return QuotaUsage{}, QuotaUsage{}, err
+	}
+
+	repositoryUsage, err = readQuotaUsage(ctx, storageDriver, repoPath)
+	if err != nil {
+		return QuotaUsage{}, QuotaUsage{}, err
+	}
+	namespaceUsage, err = readQuotaUsage(ctx, storageDriver, nsPath)
+	if err != nil {
+		return QuotaUsage{}, QuotaUsage{}, err
+	}
+	return repositoryUsage, namespaceUsage, nil
+}
+
+// RecomputeQuotaUsage rewrites the usage records of every repository and
+// namespace from the content found in storage. It should be run when quotas
+// are first enabled on an existing registry and whenever the records drift,
+// for instance after repositories were removed from storage directly. Writes
+// happening while it runs may be lost, so the registry should be read-only.
+func RecomputeQuotaUsage(ctx context.Context, storageDriver storagedriver.StorageDriver, registry distribution.Namespace) error {
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	namespaces := make(map[string]QuotaUsage)
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		usage, err := computeRepositoryUsage(ctx, storageDriver, registry, repoName)
+		if err != nil {
+			return err
+		}
+
+		p, err := pathFor(repositoryUsagePathSpec{name: repoName})
+		if err != nil {
+			return err
+		}
+		if err := writeQuotaUsage(ctx, storageDriver, p, usage); err != nil {
+			return err
+		}
+
+		namespace := quotaNamespace(repoName)
+		nsUsage := namespaces[namespace]
+		nsUsage.add(usage.Size, usage.Tags)
+		namespaces[namespace] = nsUsage
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for namespace, usage := range namespaces {
+		p, err := pathFor(namespaceUsagePathSpec{namespace: namespace})
+		if err != nil {
+			return err
+		}
+		if err := writeQuotaUsage(ctx, storageDriver, p, usage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// computeRepositoryUsage sums the sizes of the layers and manifest revisions
+// linked into the named repository and counts its tags.
+func computeRepositoryUsage(ctx context.Context, storageDriver storagedriver.StorageDriver, registry distribution.Namespace, repoName string) (QuotaUsage, error) {
+	var usage QuotaUsage
+
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return usage, err
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return usage, err
+	}
+
+	tags, err := repository.Tags(ctx).All(ctx)
+	if _, ok := err.(distribution.ErrRepositoryUnknown); err != nil && !ok {
+		return usage, err
+	}
+	usage.Tags = int64(len(tags))
+
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return usage, err
+	}
+	layersPath := path.Join(root, repoName, "_layers")
+	revisionsPath, err := pathFor(manifestRevisionsPathSpec{name: repoName})
+	if err != nil {
+		return usage, err
+	}
+
+	statter := registry.BlobStatter()
+	for _, root := range []string{layersPath, revisionsPath} {
+		err := storageDriver.Walk(ctx, root, func(fileInfo storagedriver.FileInfo) error {
+			if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+				return nil
+			}
+
+			content, err := storageDriver.GetContent(ctx, fileInfo.Path())
+			if err != nil {
+				return err
+			}
+			dgst, err := digest.Parse(string(content))
+			if err != nil {
+				return err
+			}
+
+			desc, err := statter.Stat(ctx, dgst)
+			if err != nil {
+				if err == distribution.ErrBlobUnknown {
+					// dangling link, left for the garbage collector
+					return nil
+				}
+				return err
+			}
+
+			usage.Size += desc.Size
+			return nil
+		})
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return usage, err
+		}
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/docker/distribution/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func noQuotaLimits(repository, namespace string) (QuotaLimits, QuotaLimits) {
+	return QuotaLimits{}, QuotaLimits{}
+}
+
+func TestQuotaUsageAccounting(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	registry := createRegistry(t, d, Quotas(noQuotaLimits))
+	repoA := makeRepository(t, registry, "acme/a")
+	repoB := makeRepository(t, registry, "acme/b")
+
+	imageA := uploadRandomSchema2Image(t, repoA)
+	if err := repoA.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: imageA.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	// moving a tag does not create a new one
+	if err := repoA.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: imageA.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	imageB := uploadRandomSchema2Image(t, repoB)
+	if err := repoB.Tags(ctx).Tag(ctx, "v1", distribution.Descriptor{Digest: imageB.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	usageA, namespaceUsage, err := RepositoryQuotaUsage(ctx, d, "acme/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usageB, _, err := RepositoryQuotaUsage(ctx, d, "acme/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usageA.Tags != 1 || usageB.Tags != 1 {
+		t.Fatalf("unexpected tag usage: %d, %d", usageA.Tags, usageB.Tags)
+	}
+	if usageA.Size == 0 || usageB.Size == 0 {
+		t.Fatalf("unexpected size usage: %d, %d", usageA.Size, usageB.Size)
+	}
+	if namespaceUsage.Size != usageA.Size+usageB.Size || namespaceUsage.Tags != 2 {
+		t.Fatalf("unexpected namespace usage: %+v", namespaceUsage)
+	}
+
+	// the recomputed usage matches the accounted one
+	if err := RecomputeQuotaUsage(ctx, d, registry); err != nil {
+		t.Fatal(err)
+	}
+	recomputedA, recomputedNamespace, err := RepositoryQuotaUsage(ctx, d, "acme/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recomputedA != usageA || recomputedNamespace != namespaceUsage {
+		t.Fatalf("recomputed usage %+v, %+v differs from %+v, %+v", recomputedA, recomputedNamespace, usageA, namespaceUsage)
+	}
+
+	// deleting releases the usage
+	if err := repoA.Tags(ctx).Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	manifests := makeManifestService(t, repoA)
+	if err := manifests.Delete(ctx, imageA.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	for dgst := range imageA.layers {
+		if err := repoA.Blobs(ctx).Delete(ctx, dgst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usageA, namespaceUsage, err = RepositoryQuotaUsage(ctx, d, "acme/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usageA.Tags != 0 || namespaceUsage.Tags != 1 {
+		t.Fatalf("unexpected tag usage after deletion: %d, %d", usageA.Tags, namespaceUsage.Tags)
+	}
+	if namespaceUsage.Size != usageA.Size+usageB.Size {
+		t.Fatalf("unexpected namespace size after deletion: %d", namespaceUsage.Size)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	layers, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layerDigest digest.Digest
+	var layerSize int64
+	for dgst, rs := range layers {
+		layerDigest = dgst
+		if layerSize, err = rs.Seek(0, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registry := createRegistry(t, d, Quotas(func(repository, namespace string) (QuotaLimits, QuotaLimits) {
+		return QuotaLimits{Size: layerSize, Tags: 1}, QuotaLimits{}
+	}))
+	repo := makeRepository(t, registry, "acme/app")
+
+	if err := testutil.UploadBlobs(repo, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	// pushing a blob already linked into the repository is free
+	if _, err := layers[layerDigest].Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(layers[layerDigest])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Blobs(ctx).Put(ctx, "application/octet-stream", p); err != nil {
+		t.Fatalf("unexpected error pushing the same blob again: %v", err)
+	}
+
+	_, err = repo.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("over quota"))
+	if qe, ok := err.(distribution.ErrQuotaExceeded); !ok || qe.Scope != "repository" || qe.Resource != "size" {
+		t.Fatalf("expected size quota error, got %v", err)
+	}
+
+	tags := repo.Tags(ctx)
+	dgst := digest.FromString("manifest")
+	if err := tags.Tag(ctx, "first", distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatal(err)
+	}
+	err = tags.Tag(ctx, "second", distribution.Descriptor{Digest: dgst})
+	if qe, ok := err.(distribution.ErrQuotaExceeded); !ok || qe.Resource != "tags" {
+		t.Fatalf("expected tag quota error, got %v", err)
+	}
+	if _, err := tags.Get(ctx, "second"); err == nil {
+		t.Fatal("tag over quota was created")
+	}
+
+	if err := tags.Untag(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tags.Tag(ctx, "second", distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("unexpected error after releasing a tag: %v", err)
+	}
+}
+
+func TestNamespaceQuotaExceeded(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	registry := createRegistry(t, d, Quotas(func(repository, namespace string) (QuotaLimits, QuotaLimits) {
+		if namespace == "acme" {
+			return QuotaLimits{}, QuotaLimits{Tags: 1}
+		}
+		return QuotaLimits{}, QuotaLimits{}
+	}))
+
+	dgst := digest.FromString("manifest")
+	a := makeRepository(t, registry, "acme/a")
+	if err := a.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := makeRepository(t, registry, "acme/b")
+	err := b.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: dgst})
+	if qe, ok := err.(distribution.ErrQuotaExceeded); !ok || qe.Scope != "namespace" || qe.Name != "acme" {
+		t.Fatalf("expected namespace quota error, got %v", err)
+	}
+
+	other := makeRepository(t, registry, "other/b")
+	if err := other.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("unexpected error in another namespace: %v", err)
+	}
+}
+
+func TestQuotaConcurrentPushesChargeOnce(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	registry := createRegistry(t, &slowReadDriver{d}, Quotas(noQuotaLimits))
+	repo := makeRepository(t, registry, "acme/app")
+
+	p := []byte("pushed concurrently")
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.Blobs(ctx).Put(ctx, "application/octet-stream", p)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, namespaceUsage, err := RepositoryQuotaUsage(ctx, d, "acme/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Size != int64(len(p)) || namespaceUsage.Size != int64(len(p)) {
+		t.Fatalf("unexpected usage: %+v, %+v", usage, namespaceUsage)
+	}
+}
+
+func TestQuotaRemoveTagWithoutCurrentLink(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	registry := createRegistry(t, d, Quotas(noQuotaLimits))
+	repo := makeRepository(t, registry, "acme/app")
+	tags := repo.Tags(ctx)
+
+	dgst := digest.FromString("manifest")
+	if err := tags.Tag(ctx, "latest", distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatal(err)
+	}
+
+	// left behind by a tag which failed once its index entry was written
+	indexPath, err := pathFor(manifestTagIndexEntryLinkPathSpec{name: "acme/app", tag: "broken", revision: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, indexPath, []byte(dgst)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tags.Untag(ctx, "broken"); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, _, err := RepositoryQuotaUsage(ctx, d, "acme/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Tags != 1 {
+		t.Fatalf("unexpected tag usage: %d", usage.Tags)
+	}
+}
+
+func TestQuotaReleasedByGarbageCollection(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	registry := createRegistry(t, d, Quotas(noQuotaLimits))
+	repo := makeRepository(t, registry, "acme/app")
+
+	// the first image is left untagged once the tag moves
+	for i := 0; i < 2; i++ {
+		image := uploadRandomSchema2Image(t, repo)
+		if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, _, err := RepositoryQuotaUsage(ctx, d, "acme/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MarkAndSweep(ctx, d, registry, GCOpts{
+		RemoveUntagged: true,
+		Quiet:          true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	usage, namespaceUsage, err := RepositoryQuotaUsage(ctx, d, "acme/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Size >= before.Size || namespaceUsage != usage {
+		t.Fatalf("usage not released: %+v, %+v, was %+v", usage, namespaceUsage, before)
+	}
+
+	// the released usage matches the recomputed one
+	if err := RecomputeQuotaUsage(ctx, d, registry); err != nil {
+		t.Fatal(err)
+	}
+	recomputed, _, err := RepositoryQuotaUsage(ctx, d, "acme/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recomputed != usage {
+		t.Fatalf("recomputed usage %+v differs from %+v", recomputed, usage)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/docker/distribution/registry/storage/cache"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/libtrust"
+	"github.com/opencontainers/go-digest"
 )
 
 // registry is the top-level implementation of Registry for use in the storage
@@ -24,6 +25,8 @@ type registry struct {
 	schema1SigningKey            libtrust.PrivateKey
 	blobDescriptorServiceFactory distribution.BlobDescriptorServiceFactory
 	manifestURLs                 manifestURLs
+	tagImmutable                 TagImmutabilityFunc
+	tagLocks                     tagLocks
 	driver                       storagedriver.StorageDriver
 }
 
@@ -89,6 +92,22 @@ func Schema1SigningKey(key libtrust.PrivateKey) RegistryOption {
 	}
 }
 
+// TagImmutabilityFunc reports whether a tag of the named repository is
+// immutable for the request carried by ctx.
+type TagImmutabilityFunc func(ctx context.Context, repository, tag string) bool
+
+// ImmutableTags returns a functional option for NewRegistry. Once they exist,
+// the tags for which immutable returns true can neither be moved to another
+// manifest nor removed. The changes of a tag are serialized within the
+// process only: registries sharing a storage backend may still both create
+// an immutable tag at the same time, the last one winning.
+func ImmutableTags(immutable TagImmutabilityFunc) RegistryOption {
+	return func(registry *registry) error {
+		registry.tagImmutable = immutable
+		return nil
+	}
+}
+
 // BlobDescriptorServiceFactory returns a functional option for NewRegistry. It sets the
 // factory to create BlobDescriptorServiceFactory middleware.
 func BlobDescriptorServiceFactory(factory distribution.BlobDescriptorServiceFactory) RegistryOption {
@@ -131,6 +150,7 @@ func NewRegistry(ctx context.Context, driver storagedriver.StorageDriver, option
 	bs := &blobStore{
 		driver:  driver,
 		statter: statter,
+		tracker: &gcTracker{},
 	}
 
 	registry := &registry{
@@ -189,6 +209,28 @@ func (reg *registry) BlobStatter() distribution.BlobStatter {
 	return reg.statter
 }
 
+// gcTracker returns the tracker guarding content linked while a garbage
+// collection is running against this registry.
+func (reg *registry) gcTracker() *gcTracker {
+	return reg.blobStore.tracker
+}
+
+// quotas returns the accountant of the storage consumed by repositories, or
+// nil if quotas are disabled.
+func (reg *registry) quotas() *quotaAccountant {
+	return reg.blobStore.quota
+}
+
+// clearDescriptorCache removes dgst from the global blob descriptor cache,
+// if one is configured, after the blob has been removed from storage.
+func (reg *registry) clearDescriptorCache(ctx context.Context, dgst digest.Digest) error {
+	if reg.blobDescriptorCacheProvider == nil {
+		return nil
+	}
+
+	return reg.blobDescriptorCacheProvider.Clear(ctx, dgst)
+}
+
 // repository provides name-scoped access to various services.
 type repository struct {
 	*registry
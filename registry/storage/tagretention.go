@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+// TagRetentionRule describes which tags of a repository are retained. A tag
+// is retained if it is one of the KeepLast most recently updated tags, if it
+// matches one of KeepTags, or if it was updated within OlderThan. A rule with
+// neither KeepLast nor OlderThan set retains every tag.
+type TagRetentionRule struct {
+	// KeepLast is the number of most recently updated tags to retain.
+	KeepLast int
+
+	// KeepTags lists expressions matching tags which are always retained.
+	KeepTags []*regexp.Regexp
+
+	// OlderThan is the age after which tags become eligible for pruning.
+	OlderThan time.Duration
+}
+
+// retainsAll reports whether the rule retains every tag.
+func (rule TagRetentionRule) retainsAll() bool {
+	return rule.KeepLast <= 0 && rule.OlderThan <= 0
+}
+
+// ExpiredTags returns the tags of the repository which rule does not retain,
+// ordered from the least to the most recently updated. A tag is considered
+// updated when it was last pointed at a manifest. The repository must be
+// provided by a registry created with NewRegistry.
+func ExpiredTags(ctx context.Context, repo distribution.Repository, rule TagRetentionRule, now time.Time) ([]string, error) {
+	r, ok := repo.(*repository)
+	if !ok {
+		return nil, fmt.Errorf("unable to determine tag ages of repository %T", repo)
+	}
+
+	if rule.retainsAll() {
+		return nil, nil
+	}
+
+	ts := r.Tags(ctx).(*tagStore)
+	tags, err := ts.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	type taggedAt struct {
+		tag       string
+		updatedAt time.Time
+	}
+
+	var candidates []taggedAt
+	for _, tag := range tags {
+		updatedAt, err := ts.updatedAt(ctx, tag)
+		if err != nil {
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				continue
+			}
+			return nil, err
+		}
+		candidates = append(candidates, taggedAt{tag: tag, updatedAt: updatedAt})
+	}
+
+	// newest first, so that the tags to keep come first
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].updatedAt.Equal(candidates[j].updatedAt) {
+			return candidates[i].tag > candidates[j].tag
+		}
+		return candidates[i].updatedAt.After(candidates[j].updatedAt)
+	})
+
+	var expired []string
+	for i := len(candidates) - 1; i >= 0; i-- {
+		candidate := candidates[i]
+		if i < rule.KeepLast {
+			continue
+		}
+		if rule.OlderThan > 0 && now.Sub(candidate.updatedAt) < rule.OlderThan {
+			continue
+		}
+		if matchesAny(rule.KeepTags, candidate.tag) {
+			continue
+		}
+		expired = append(expired, candidate.tag)
+	}
+
+	return expired, nil
+}
+
+func matchesAny(expressions []*regexp.Regexp, s string) bool {
+	for _, re := range expressions {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// updatedAt returns the time at which tag was last pointed at a manifest.
+func (ts *tagStore) updatedAt(ctx context.Context, tag string) (time.Time, error) {
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	fi, err := ts.blobStore.driver.Stat(ctx, currentPath)
+	if err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return time.Time{}, distribution.ErrTagUnknown{Tag: tag}
+		}
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
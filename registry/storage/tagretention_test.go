@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+)
+
+func TestExpiredTags(t *testing.T) {
+	env := testTagStore(t)
+	ctx := env.ctx
+
+	desc := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	for _, tag := range []string{"t1", "t2", "t3", "t4", "t5"} {
+		if err := env.ts.Tag(ctx, tag, desc); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	repo := env.ts.(*tagStore).repository
+	now := time.Now()
+	for _, testcase := range []struct {
+		rule     TagRetentionRule
+		now      time.Time
+		expected []string
+	}{
+		{
+			rule: TagRetentionRule{},
+			now:  now,
+		},
+		{
+			rule:     TagRetentionRule{KeepLast: 2},
+			now:      now,
+			expected: []string{"t1", "t2", "t3"},
+		},
+		{
+			rule:     TagRetentionRule{KeepLast: 2, KeepTags: []*regexp.Regexp{regexp.MustCompile("^t1$")}},
+			now:      now,
+			expected: []string{"t2", "t3"},
+		},
+		{
+			rule: TagRetentionRule{OlderThan: time.Hour},
+			now:  now,
+		},
+		{
+			rule:     TagRetentionRule{OlderThan: time.Hour},
+			now:      now.Add(2 * time.Hour),
+			expected: []string{"t1", "t2", "t3", "t4", "t5"},
+		},
+		{
+			rule:     TagRetentionRule{KeepLast: 1, OlderThan: time.Hour},
+			now:      now.Add(2 * time.Hour),
+			expected: []string{"t1", "t2", "t3", "t4"},
+		},
+		{
+			rule:     TagRetentionRule{KeepLast: 10},
+			now:      now,
+			expected: nil,
+		},
+	} {
+		expired, err := ExpiredTags(ctx, repo, testcase.rule, testcase.now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(expired, testcase.expected) {
+			t.Errorf("unexpected expired tags for %+v: %v != %v", testcase.rule, expired, testcase.expected)
+		}
+	}
+}
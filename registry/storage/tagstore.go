@@ -2,14 +2,19 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
 	"path"
+	"sort"
 
 	"github.com/docker/distribution"
+	dcontext "github.com/docker/distribution/context"
 	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 )
 
 var _ distribution.TagService = &tagStore{}
+var _ distribution.TagReplacer = &tagStore{}
 
 // tagStore provides methods to manage manifest tags in a backend storage driver.
 // This implementation uses the same on-disk layout as the (now deleted) tag
@@ -50,27 +55,108 @@ func (ts *tagStore) All(ctx context.Context) ([]string, error) {
 	return tags, nil
 }
 
+// List fills tags with the tags following last in lexical order, returning
+// io.EOF when no tags remain. The tag directory is listed once, without
+// reading the tags, and sorted to find the page.
+func (ts *tagStore) List(ctx context.Context, tags []string, last string) (n int, err error) {
+	if len(tags) == 0 {
+		return 0, errors.New("no space in slice")
+	}
+
+	pathSpec, err := pathFor(manifestTagPathSpec{
+		name: ts.repository.Named().Name(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := ts.blobStore.driver.List(ctx, pathSpec)
+	if err != nil {
+		switch err := err.(type) {
+		case storagedriver.PathNotFoundError:
+			return 0, distribution.ErrRepositoryUnknown{Name: ts.repository.Named().Name()}
+		default:
+			return 0, err
+		}
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		_, names[i] = path.Split(entry)
+	}
+	sort.Strings(names)
+
+	start := sort.Search(len(names), func(i int) bool { return names[i] > last })
+	n = copy(tags, names[start:])
+	if start+n == len(names) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 // Tag tags the digest with the given tag, updating the the store to point at
 // the current tag. The digest must point to a manifest.
 func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	_, err := ts.Replace(ctx, tag, desc)
+	return err
+}
+
+// Replace tags the digest with the given tag like Tag, returning the digest
+// the tag pointed to, which is read once while the tag is locked.
+func (ts *tagStore) Replace(ctx context.Context, tag string, desc distribution.Descriptor) (digest.Digest, error) {
 	currentPath, err := pathFor(manifestTagCurrentPathSpec{
 		name: ts.repository.Named().Name(),
 		tag:  tag,
 	})
 
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	defer ts.repository.tagLocks.lock(ts.repository.Named().Name(), tag)()
+
+	previous, err := ts.current(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+
+	if previous != "" && previous != desc.Digest && ts.immutable(ctx, tag) {
+		return "", distribution.ErrTagImmutable{Tag: tag}
+	}
+
+	// only new tags count against the quota
+	var charged bool
+	if ts.blobStore.quota != nil && previous == "" {
+		if err := ts.blobStore.quota.charge(ctx, ts.repository.Named().Name(), 0, 1); err != nil {
+			return "", err
+		}
+		charged = true
 	}
 
 	lbs := ts.linkedBlobStore(ctx, tag)
 
 	// Link into the index
 	if err := lbs.linkBlob(ctx, desc); err != nil {
-		return err
+		ts.refundQuota(ctx, charged)
+		return "", err
 	}
 
 	// Overwrite the current link
-	return ts.blobStore.link(ctx, currentPath, desc.Digest)
+	if err := ts.blobStore.link(ctx, currentPath, desc.Digest); err != nil {
+		ts.refundQuota(ctx, charged)
+		return "", err
+	}
+	return previous, nil
+}
+
+func (ts *tagStore) refundQuota(ctx context.Context, charged bool) {
+	if !charged {
+		return
+	}
+
+	if err := ts.blobStore.quota.release(ctx, ts.repository.Named().Name(), 0, 1); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error releasing quota: %v", err)
+	}
 }
 
 // resolve the current revision for name and tag.
@@ -99,24 +185,86 @@ func (ts *tagStore) Get(ctx context.Context, tag string) (distribution.Descripto
 
 // Untag removes the tag association
 func (ts *tagStore) Untag(ctx context.Context, tag string) error {
+	_, err := ts.Remove(ctx, tag)
+	return err
+}
+
+// Remove removes the tag association like Untag, returning the digest the tag
+// pointed to, which is read once while the tag is locked.
+func (ts *tagStore) Remove(ctx context.Context, tag string) (digest.Digest, error) {
 	tagPath, err := pathFor(manifestTagPathSpec{
 		name: ts.repository.Named().Name(),
 		tag:  tag,
 	})
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	defer ts.repository.tagLocks.lock(ts.repository.Named().Name(), tag)()
+
+	previous, err := ts.current(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+
+	if ts.immutable(ctx, tag) {
+		if previous != "" {
+			return "", distribution.ErrTagImmutable{Tag: tag}
+		}
+		return "", nil
 	}
 
 	if err := ts.blobStore.driver.Delete(ctx, tagPath); err != nil {
 		switch err.(type) {
 		case storagedriver.PathNotFoundError:
-			return nil // Untag is idempotent, we don't care if it didn't exist
+			return previous, nil // Untag is idempotent, we don't care if it didn't exist
 		default:
-			return err
+			return "", err
 		}
 	}
 
-	return nil
+	// a tag directory without a current link was never charged, or was
+	// refunded when tagging failed
+	if previous == "" {
+		return previous, nil
+	}
+	return previous, ts.blobStore.quota.release(ctx, ts.repository.Named().Name(), 0, 1)
+}
+
+// current returns the digest the tag points to, or the empty digest if the
+// tag does not exist.
+func (ts *tagStore) current(ctx context.Context, tag string) (digest.Digest, error) {
+	desc, err := ts.Get(ctx, tag)
+	switch err.(type) {
+	case nil:
+		return desc.Digest, nil
+	case distribution.ErrTagUnknown:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// tagLocks serializes the changes of each tag within the process, so that
+// the checks made on the current revision of a tag, such as its immutability,
+// hold until the tag is changed. Registries sharing a storage backend are not
+// serialized with each other.
+type tagLocks struct {
+	keyedLocks
+}
+
+// lock locks the tag of the named repository, returning the function
+// unlocking it.
+func (l *tagLocks) lock(name, tag string) func() {
+	return l.keyedLocks.lock(name + ":" + tag)
+}
+
+// immutable reports whether the tag may no longer change once it exists.
+func (ts *tagStore) immutable(ctx context.Context, tag string) bool {
+	if ts.repository.tagImmutable == nil {
+		return false
+	}
+	return ts.repository.tagImmutable(ctx, ts.repository.Named().Name(), tag)
 }
 
 // linkedBlobStore returns the linkedBlobStore for the named tag, allowing one
@@ -2,11 +2,19 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
 	"github.com/docker/distribution/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
 )
 
 type tagsTestEnv struct {
@@ -105,6 +113,39 @@ func TestTagStoreUnTag(t *testing.T) {
 	}
 }
 
+func TestTagStoreReplace(t *testing.T) {
+	env := testTagStore(t)
+	tags := env.ts.(distribution.TagReplacer)
+	ctx := env.ctx
+	first := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	second := distribution.Descriptor{Digest: "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}
+
+	for _, step := range []struct {
+		desc     *distribution.Descriptor
+		previous digest.Digest
+	}{
+		{&first, ""},
+		{&first, first.Digest},
+		{&second, first.Digest},
+		{nil, second.Digest},
+		{nil, ""},
+	} {
+		var previous digest.Digest
+		var err error
+		if step.desc != nil {
+			previous, err = tags.Replace(ctx, "latest", *step.desc)
+		} else {
+			previous, err = tags.Remove(ctx, "latest")
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if previous != step.previous {
+			t.Fatalf("unexpected previous digest: %q != %q", previous, step.previous)
+		}
+	}
+}
+
 func TestTagStoreAll(t *testing.T) {
 	env := testTagStore(t)
 	tagStore := env.ts
@@ -152,6 +193,108 @@ func TestTagStoreAll(t *testing.T) {
 
 }
 
+func TestTagStoreList(t *testing.T) {
+	env := testTagStore(t)
+	tagStore := env.ts.(*tagStore)
+	ctx := env.ctx
+
+	page := make([]string, 3)
+	if _, err := tagStore.List(ctx, page, ""); err == nil {
+		t.Errorf("expected error listing tags of unknown repository")
+	}
+
+	desc := distribution.Descriptor{Digest: "sha256:eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"}
+	for _, tag := range []string{"v2", "1.0", "latest", "v2.1", "1.0-rc1", "v1", "1.1"} {
+		if err := tagStore.Tag(ctx, tag, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var listed []string
+	last := ""
+	for {
+		n, err := tagStore.List(ctx, page, last)
+		listed = append(listed, page[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error listing tags: %v", err)
+		}
+		last = page[n-1]
+	}
+
+	expected := []string{"1.0", "1.0-rc1", "1.1", "latest", "v1", "v2", "v2.1"}
+	if !reflect.DeepEqual(listed, expected) {
+		t.Errorf("unexpected tags listed: %v != %v", listed, expected)
+	}
+
+	// a page which exactly holds the remaining tags reports their end
+	n, err := tagStore.List(ctx, page[:2], "v1")
+	if n != 2 || err != io.EOF {
+		t.Errorf("unexpected result listing the last page: %d, %v", n, err)
+	}
+}
+
+// statCountingDriver counts the Stat calls below prefix, walking with them.
+type statCountingDriver struct {
+	storagedriver.StorageDriver
+	prefix string
+	stats  int
+}
+
+func (d *statCountingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if strings.HasPrefix(path, d.prefix) {
+		d.stats++
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *statCountingDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+func TestTagStoreListWithoutStat(t *testing.T) {
+	ctx := context.Background()
+	tagsPath, err := pathFor(manifestTagPathSpec{name: "a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &statCountingDriver{StorageDriver: inmemory.New(), prefix: tagsPath}
+	reg, err := NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagStore := repo.Tags(ctx).(*tagStore)
+
+	desc := distribution.Descriptor{Digest: "sha256:eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"}
+	for i := 0; i < 20; i++ {
+		if err := tagStore.Tag(ctx, fmt.Sprintf("t%02d", i), desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.stats = 0
+	page := make([]string, 3)
+	n, err := tagStore.List(ctx, page, "t04")
+	if err != nil {
+		t.Fatalf("unexpected error listing tags: %v", err)
+	}
+	if !reflect.DeepEqual(page[:n], []string{"t05", "t06", "t07"}) {
+		t.Errorf("unexpected tags listed: %v", page[:n])
+	}
+
+	// the tags are listed, not statted one by one
+	if d.stats != 0 {
+		t.Errorf("listing a page of 3 tags statted %d paths", d.stats)
+	}
+}
+
 func TestTagLookup(t *testing.T) {
 	env := testTagStore(t)
 	tagStore := env.ts
@@ -207,3 +350,122 @@ func TestTagLookup(t *testing.T) {
 	}
 
 }
+
+func TestTagStoreImmutable(t *testing.T) {
+	ctx := context.Background()
+	reg, err := NewRegistry(ctx, inmemory.New(), ImmutableTags(func(ctx context.Context, repository, tag string) bool {
+		return repository == "a/b" && tag == "v1"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := repo.Tags(ctx)
+
+	a := distribution.Descriptor{Digest: "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	b := distribution.Descriptor{Digest: "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"}
+
+	// removing an immutable tag which does not exist is a no-op
+	if err := tags.Untag(ctx, "v1"); err != nil {
+		t.Fatalf("unexpected error removing unknown tag: %v", err)
+	}
+
+	for _, tag := range []string{"v1", "latest"} {
+		if err := tags.Tag(ctx, tag, a); err != nil {
+			t.Fatalf("unexpected error tagging %s: %v", tag, err)
+		}
+	}
+
+	if err := tags.Tag(ctx, "v1", a); err != nil {
+		t.Errorf("unexpected error tagging the same manifest: %v", err)
+	}
+	if err := tags.Tag(ctx, "v1", b); err != (distribution.ErrTagImmutable{Tag: "v1"}) {
+		t.Errorf("expected immutable tag error moving tag: %v", err)
+	}
+	if err := tags.Untag(ctx, "v1"); err != (distribution.ErrTagImmutable{Tag: "v1"}) {
+		t.Errorf("expected immutable tag error removing tag: %v", err)
+	}
+
+	d, err := tags.Get(ctx, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Digest != a.Digest {
+		t.Errorf("immutable tag moved to %s", d.Digest)
+	}
+
+	if err := tags.Tag(ctx, "latest", b); err != nil {
+		t.Errorf("unexpected error moving mutable tag: %v", err)
+	}
+	if err := tags.Untag(ctx, "latest"); err != nil {
+		t.Errorf("unexpected error removing mutable tag: %v", err)
+	}
+}
+
+func TestTagStoreImmutableConcurrentPushes(t *testing.T) {
+	ctx := context.Background()
+	reg, err := NewRegistry(ctx, &slowReadDriver{inmemory.New()}, ImmutableTags(func(ctx context.Context, repository, tag string) bool {
+		return true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only one of the pushes creating the tag succeeds
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			desc := distribution.Descriptor{Digest: digest.Digest(fmt.Sprintf("sha256:%064x", i))}
+			errs <- repo.Tags(ctx).Tag(ctx, "v1", desc)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	var succeeded int
+	for err := range errs {
+		switch err.(type) {
+		case nil:
+			succeeded++
+		case distribution.ErrTagImmutable:
+		default:
+			t.Fatalf("unexpected error tagging: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("unexpected number of pushes creating the tag: %d", succeeded)
+	}
+
+	ts := repo.Tags(ctx).(*tagStore)
+	ts.repository.tagLocks.mu.Lock()
+	defer ts.repository.tagLocks.mu.Unlock()
+	if len(ts.repository.tagLocks.locks) != 0 {
+		t.Fatalf("unexpected tag locks left: %d", len(ts.repository.tagLocks.locks))
+	}
+}
+
+// slowReadDriver delays the results of reads, so that concurrent requests
+// interleave.
+type slowReadDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d *slowReadDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	time.Sleep(10 * time.Millisecond)
+	return content, err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"path"
 
+	"github.com/docker/distribution"
 	dcontext "github.com/docker/distribution/context"
 	"github.com/docker/distribution/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
@@ -26,6 +27,7 @@ func NewVacuum(ctx context.Context, driver driver.StorageDriver) Vacuum {
 type Vacuum struct {
 	driver driver.StorageDriver
 	ctx    context.Context
+	quota  *quotaAccountant // releases removed manifests, if set
 }
 
 // RemoveBlob removes a blob from the filesystem
@@ -80,8 +82,25 @@ func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) e
 	if err != nil {
 		return err
 	}
+
+	var size int64
+	if v.quota != nil {
+		desc, err := (&blobStatter{driver: v.driver}).Stat(v.ctx, dgst)
+		switch err {
+		case nil:
+			size = desc.Size
+		case distribution.ErrBlobUnknown:
+			// not counted in the usage of the repository
+		default:
+			return err
+		}
+	}
+
 	dcontext.GetLogger(v.ctx).Infof("deleting manifest: %s", manifestPath)
-	return v.driver.Delete(v.ctx, manifestPath)
+	if err := v.driver.Delete(v.ctx, manifestPath); err != nil {
+		return err
+	}
+	return v.quota.release(v.ctx, name, size, 0)
 }
 
 // RemoveRepository removes a repository directory from the
@@ -2,6 +2,10 @@ package distribution
 
 import (
 	"context"
+	"io"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // TagService provides access to information about tagged objects.
@@ -25,3 +29,98 @@ type TagService interface {
 	// Lookup returns the set of tags referencing the given digest.
 	Lookup(ctx context.Context, digest Descriptor) ([]string, error)
 }
+
+// TagLister is implemented by the tag services which can list the tags a
+// page at a time.
+type TagLister interface {
+	// List fills tags with the tags which sort lexically after last, in
+	// lexical order, and returns the number of tags filled. io.EOF is
+	// returned along with the tags if no more tags remain.
+	List(ctx context.Context, tags []string, last string) (n int, err error)
+}
+
+// TagReplacer is implemented by the tag services which can report the digest
+// a tag pointed to along with changing it, without another request.
+type TagReplacer interface {
+	// Replace associates the tag with the provided descriptor, as Tag does,
+	// and returns the digest the tag previously pointed to, or the empty
+	// digest if the tag did not exist.
+	Replace(ctx context.Context, tag string, desc Descriptor) (previous digest.Digest, err error)
+
+	// Remove removes the given tag association, as Untag does, and returns
+	// the digest the tag pointed to, or the empty digest if the tag did not
+	// exist.
+	Remove(ctx context.Context, tag string) (previous digest.Digest, err error)
+}
+
+// ReplaceTag associates the tag with the provided descriptor in ts, as
+// TagReplacer.Replace does. The tag is replaced with the Replace method of ts
+// if it implements TagReplacer, and read with Get before calling Tag
+// otherwise.
+func ReplaceTag(ctx context.Context, ts TagService, tag string, desc Descriptor) (digest.Digest, error) {
+	if replacer, ok := ts.(TagReplacer); ok {
+		return replacer.Replace(ctx, tag, desc)
+	}
+
+	previous, err := currentTag(ctx, ts, tag)
+	if err != nil {
+		return "", err
+	}
+	if err := ts.Tag(ctx, tag, desc); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+// RemoveTag removes the tag from ts, as TagReplacer.Remove does. The tag is
+// removed with the Remove method of ts if it implements TagReplacer, and read
+// with Get before calling Untag otherwise.
+func RemoveTag(ctx context.Context, ts TagService, tag string) (digest.Digest, error) {
+	if replacer, ok := ts.(TagReplacer); ok {
+		return replacer.Remove(ctx, tag)
+	}
+
+	previous, err := currentTag(ctx, ts, tag)
+	if err != nil {
+		return "", err
+	}
+	if err := ts.Untag(ctx, tag); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+// currentTag returns the digest the tag points to in ts, or the empty digest
+// if the tag does not exist.
+func currentTag(ctx context.Context, ts TagService, tag string) (digest.Digest, error) {
+	desc, err := ts.Get(ctx, tag)
+	switch err.(type) {
+	case nil:
+		return desc.Digest, nil
+	case ErrTagUnknown:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// ListTags fills tags with the tags of ts which sort lexically after last,
+// as TagLister.List does. The tags are listed with the List method of ts if
+// it implements TagLister, and with All otherwise.
+func ListTags(ctx context.Context, ts TagService, tags []string, last string) (int, error) {
+	if lister, ok := ts.(TagLister); ok {
+		return lister.List(ctx, tags, last)
+	}
+
+	all, err := ts.All(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(all)
+	all = all[sort.Search(len(all), func(i int) bool { return all[i] > last }):]
+	n := copy(tags, all)
+	if n == len(all) {
+		return n, io.EOF
+	}
+	return n, nil
+}